@@ -0,0 +1,114 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"strconv"
+)
+
+// TLS alert message descriptions, by name (RFC 8446).
+var Alerts = map[string]int{
+	"close_notify":                    0,
+	"unexpected_message":              10,
+	"bad_record_mac":                  20,
+	"record_overflow":                 22,
+	"handshake_failure":               40,
+	"bad_certificate":                 42,
+	"unsupported_certificate":         43,
+	"certificate_revoked":             44,
+	"certificate_expired":             45,
+	"certificate_unknown":             46,
+	"illegal_parameter":               47,
+	"unknown_ca":                      48,
+	"access_denied":                   49,
+	"decode_error":                    50,
+	"decrypt_error":                   51,
+	"protocol_version":                70,
+	"insufficient_security":           71,
+	"internal_error":                  80,
+	"inappropriate_fallback":          86,
+	"user_canceled":                   90,
+	"missing_extension":               109,
+	"unsupported_extension":           110,
+	"unrecognized_name":               112,
+	"bad_certificate_status_response": 113,
+	"unknown_psk_identity":            115,
+	"certificate_required":            116,
+	"no_application_protocol":         120,
+}
+
+// Returns the name of a TLS alert description, or its value if unknown.
+func AlertName(desc int) string {
+	for name, val := range Alerts {
+		if val == desc {
+			return name
+		}
+	}
+	return strconv.Itoa(desc)
+}
+
+// Action values used to close a connection without sending an alert, and to
+// reset it (TCP RST), giving no hint a proxy is in place. The route actions left
+// to ActionDefault (e.g. on routes built from Go) take the action of the
+// configuration for the cause of the rejection.
+const (
+	ActionDefault = 0
+	ActionClose   = -1
+	ActionReset   = -2
+)
+
+// Causes of rejection of a connection, with the action taken by default: a TLS
+// alert description, ActionClose or ActionReset.
+var RejectCauses = map[string]int{
+	"handshakes-full":   ActionReset,
+	"no-data":           ActionClose,
+	"proxy-header":      ActionClose,
+	"not-tls":           Alerts["internal_error"],
+	"handshake-timeout": Alerts["internal_error"],
+	"bad-handshake":     Alerts["internal_error"],
+	"suspicious-hello":  ActionClose,
+	"no-sni":            Alerts["unrecognized_name"],
+	"no-route":          Alerts["unrecognized_name"],
+	"no-backend":        Alerts["internal_error"],
+	"maintenance":       Alerts["internal_error"],
+	"denied":            Alerts["access_denied"],
+	"rate-limited":      Alerts["internal_error"],
+	"tls-version":       Alerts["internal_error"],
+	"weak-ciphers":      Alerts["insufficient_security"],
+	"backend-full":      Alerts["internal_error"],
+	"setup-timeout":     Alerts["internal_error"],
+	"backend-dial":      Alerts["internal_error"],
+	"replay":            Alerts["internal_error"],
+	"internal":          Alerts["internal_error"],
+}
+
+// Parses an action taken when rejecting a connection: either the name of a
+// TLS alert to send, "close" to close the connection silently or "reset" to
+// reset it. The close_notify alert, not reporting an error, has the value of
+// ActionDefault and is not accepted.
+func parseAction(val string) (int, bool) {
+	switch val {
+	case "close":
+		return ActionClose, true
+	case "reset":
+		return ActionReset, true
+	case "close_notify":
+		return 0, false
+	}
+
+	desc, ok := Alerts[val]
+	return desc, ok
+}
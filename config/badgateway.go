@@ -0,0 +1,69 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package config
+
+import (
+	"crypto/tls"
+	"os"
+)
+
+// Page served when no custom one is configured.
+const defaultBadGatewayPage = `<!DOCTYPE html>
+<html>
+<head><title>502 Bad Gateway</title></head>
+<body><h1>502 Bad Gateway</h1><p>The server is unreachable, please try again later.</p></body>
+</html>
+`
+
+// Page served while the route is in maintenance.
+const maintenancePage = `<!DOCTYPE html>
+<html>
+<head><title>503 Service Unavailable</title></head>
+<body><h1>503 Service Unavailable</h1><p>The server is under maintenance, please try again later.</p></body>
+</html>
+`
+
+// Fallback used when a route backend is unreachable: the TLS handshake is
+// completed using Certificate and Page is served as an HTTP 502 response.
+// While the route is in maintenance, MaintenancePage is served as an HTTP 503
+// response instead.
+type BadGateway struct {
+	Certificate     tls.Certificate
+	Page            []byte
+	MaintenancePage []byte
+}
+
+// Loads the certificate, key and optional page of a bad gateway fallback.
+func newBadGateway(cert, key, page string) (*BadGateway, error) {
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	bg := &BadGateway{
+		Certificate: pair,
+		Page: []byte(defaultBadGatewayPage),
+		MaintenancePage: []byte(maintenancePage),
+	}
+	if page != "" {
+		if bg.Page, err = os.ReadFile(page); err != nil {
+			return nil, err
+		}
+	}
+
+	return bg, nil
+}
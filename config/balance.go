@@ -0,0 +1,308 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// Backends selection strategies.
+const (
+	// Backends are used in turn.
+	BalanceRoundRobin = iota
+	// The SNI is hashed to select a backend, so that a given domain always
+	// hits the same backend (cache locality). Rendezvous hashing is used
+	// so that only the share of an unavailable backend is redistributed.
+	BalanceSNIHash    = iota
+	// Backends are selected randomly, following their weight.
+	BalanceRandom     = iota
+	// Backends are used in turn following their weight, interleaved so
+	// that a heavy backend does not receive bursts (smooth weighted round
+	// robin, as in nginx).
+	BalanceWeightedRoundRobin = iota
+)
+
+// Backend represents a single backend of a route.
+type Backend struct {
+	Address string
+	// Relative weight of the backend, used by some balancing strategies.
+	Weight  int
+	// When set, the client SNI is dialed on this port instead of Address
+	// (sni:<port> backends, turning the route into a forward proxy).
+	SNIPort int
+	// PROXY header sent to the backend, in place of the route one when
+	// OverrideProxy is set.
+	SendProxy     uint
+	OverrideProxy bool
+}
+
+// Returns the PROXY header version sent to a backend: its own if set, the
+// route one otherwise.
+func (r *Route) ProxyVersion(b *Backend) uint {
+	if b != nil && b.OverrideProxy {
+		return b.SendProxy
+	}
+	return r.SendProxy
+}
+
+// Reports whether the route forwards the connections to their SNI.
+func (r *Route) Forwards() bool {
+	return len(r.Backends) == 1 && r.Backends[0].SNIPort != 0
+}
+
+// Reports whether a route forwarding connections to their SNI accepts a given
+// server name.
+func (r *Route) ForwardAllowed(sni string) bool {
+	for _, deny := range r.ForwardDeny {
+		if deny.MatchString(sni) {
+			return false
+		}
+	}
+	if len(r.ForwardAllow) == 0 {
+		return true
+	}
+	for _, allow := range r.ForwardAllow {
+		if allow.MatchString(sni) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a label identifying the route: its name if set, its backends
+// addresses otherwise.
+func (r *Route) Label() string {
+	if r.Name != "" {
+		return r.Name
+	}
+
+	if r.SRV != "" {
+		return r.SRV
+	}
+	if r.Discovery != "" {
+		return r.Discovery
+	}
+	if r.Lookup != "" && len(r.Backends) == 0 {
+		return r.Lookup
+	}
+
+	addrs := make([]string, len(r.Backends))
+	for i, b := range r.Backends {
+		addrs[i] = b.Address
+	}
+	return strings.Join(addrs, ",")
+}
+
+// Selects a backend for a connection, following the route balancing strategy.
+// Backends in slow start only get a share of their connections, the others
+// being sent to the remaining backends. When the route has health checks, the
+// backends down are skipped unless all of them are. Returns nil if the route
+// has no backend.
+func (r *Route) PickBackend(sni string) *Backend {
+	backends := r.CurrentBackends()
+	if r.HealthCheck > 0 {
+		backends = r.healthyBackends(backends)
+	}
+	switch len(backends) {
+	case 0:
+		return nil
+	case 1:
+		return backends[0]
+	}
+
+	b := r.pick(backends, sni)
+	if !r.admit(b) {
+		others := make([]*Backend, 0, len(backends) - 1)
+		for _, o := range backends {
+			if o != b {
+				others = append(others, o)
+			}
+		}
+		if len(others) == 1 {
+			return others[0]
+		}
+		b = r.pick(others, sni)
+	}
+	return b
+}
+
+// Returns the backends up, or all of them if none is.
+func (r *Route) healthyBackends(backends []*Backend) []*Backend {
+	var up []*Backend
+	for i, b := range backends {
+		if r.BackendUp(b) {
+			if up != nil {
+				up = append(up, b)
+			}
+			continue
+		}
+		if up == nil {
+			up = append(make([]*Backend, 0, len(backends)), backends[:i]...)
+		}
+	}
+	// No backend down (up is nil), or all of them.
+	if len(up) == 0 {
+		return backends
+	}
+	return up
+}
+
+func (r *Route) pick(backends []*Backend, sni string) *Backend {
+	switch r.Balance {
+	case BalanceSNIHash:
+		return pickSNIHash(backends, sni)
+	case BalanceRandom:
+		return pickRandom(backends)
+	case BalanceWeightedRoundRobin:
+		return r.pickWeightedRoundRobin(backends)
+	default:
+		return r.pickRoundRobin(backends)
+	}
+}
+
+// Returns the backends currently used by the route: the ones of its provider
+// if set (resolved from the SRV record, or discovered), the configured ones
+// otherwise.
+func (r *Route) CurrentBackends() []*Backend {
+	return r.provider().Backends()
+}
+
+// Returns backends updated from a provider source, those already known (same
+// address and weight) being replaced by their current instance so that their
+// state is preserved. The backends are sorted by address.
+func reuseBackends(known, backends []*Backend) []*Backend {
+	for i, b := range backends {
+		for _, k := range known {
+			if k.Address == b.Address && k.Weight == b.Weight {
+				backends[i] = k
+				break
+			}
+		}
+	}
+	slices.SortFunc(backends, func(a, b *Backend) int { return strings.Compare(a.Address, b.Address) })
+	return backends
+}
+
+// Returns the provider of the route backends.
+func (r *Route) provider() BackendProvider {
+	if r.Provider != nil {
+		return r.Provider
+	}
+	return StaticBackends(r.Backends)
+}
+
+func (r *Route) pickRoundRobin(backends []*Backend) *Backend {
+	n := atomic.AddUint64(&r.rrCounter, 1)
+	return backends[(n-1) % uint64(len(backends))]
+}
+
+// Smooth weighted round robin: each backend current weight is increased by its
+// weight, and the backend with the highest current weight is selected, its
+// current weight then being decreased by the total weight.
+func (r *Route) pickWeightedRoundRobin(backends []*Backend) *Backend {
+	r.swrrMu.Lock()
+	defer r.swrrMu.Unlock()
+
+	if r.swrrWeights == nil {
+		r.swrrWeights = make(map[string]int)
+	}
+
+	var best *Backend
+	var total int
+	for _, b := range backends {
+		if b.Weight <= 0 {
+			continue
+		}
+		r.swrrWeights[b.Address] += b.Weight
+		total += b.Weight
+		if best == nil || r.swrrWeights[b.Address] > r.swrrWeights[best.Address] {
+			best = b
+		}
+	}
+	if best == nil {
+		return r.pickRoundRobin(backends)
+	}
+	r.swrrWeights[best.Address] -= total
+
+	// Forget the backends no longer used (e.g. after an SRV resolution).
+	if len(r.swrrWeights) > len(backends) {
+		used := make(map[string]bool, len(backends))
+		for _, b := range backends {
+			used[b.Address] = true
+		}
+		for addr := range r.swrrWeights {
+			if !used[addr] {
+				delete(r.swrrWeights, addr)
+			}
+		}
+	}
+
+	return best
+}
+
+// Weighted random selection.
+func pickRandom(backends []*Backend) *Backend {
+	var total int
+	for _, b := range backends {
+		total += b.Weight
+	}
+	if total <= 0 {
+		return backends[rand.Intn(len(backends))]
+	}
+
+	n := rand.Intn(total)
+	for _, b := range backends {
+		if n < b.Weight {
+			return b
+		}
+		n -= b.Weight
+	}
+	return backends[len(backends)-1]
+}
+
+// Rendezvous (highest random weight) hashing: the backend with the highest
+// hash of (SNI, backend) wins.
+func pickSNIHash(backends []*Backend, sni string) *Backend {
+	var best *Backend
+	var bestScore uint64
+	for _, b := range backends {
+		if score := rendezvousScore(sni, b.Address); best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+func rendezvousScore(key, node string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(node))
+
+	// FNV alone does not mix the bits enough for this use; apply the
+	// SplitMix64 finalizer.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
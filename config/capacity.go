@@ -0,0 +1,88 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package config
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors returned when no connection slot can be acquired on a backend.
+var (
+	ErrBackendFull = errors.New("Backend at capacity")
+	ErrQueueFull   = errors.New("Backend queue is full")
+)
+
+// Connection slots of a backend, and number of connections waiting for one.
+type backendSlots struct {
+	slots  chan struct{}
+	queued atomic.Int64
+}
+
+// Returns the connection slots of a route backend, creating them if needed.
+func (r *Route) backendSlots(address string) *backendSlots {
+	if s, ok := r.slots.Load(address); ok {
+		return s.(*backendSlots)
+	}
+
+	s, _ := r.slots.LoadOrStore(address, &backendSlots{ slots: make(chan struct{}, r.MaxConns) })
+	return s.(*backendSlots)
+}
+
+// Acquires a connection slot on a route backend, and returns the function
+// releasing it. When the backend is at capacity, the connection waits for a
+// slot to be released if the route has a queue: up to the queue maximum wait,
+// or until the context is done.
+func (r *Route) AcquireSlot(ctx context.Context, backend *Backend) (func(), error) {
+	if r.MaxConns == 0 {
+		return func() {}, nil
+	}
+
+	s := r.backendSlots(backend.Address)
+	var once sync.Once
+	release := func() { once.Do(func() { <-s.slots }) }
+
+	select {
+	case s.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if r.QueueDepth == 0 {
+		return nil, ErrBackendFull
+	}
+	if s.queued.Add(1) > int64(r.QueueDepth) {
+		s.queued.Add(-1)
+		return nil, ErrQueueFull
+	}
+	defer s.queued.Add(-1)
+
+	timer := time.NewTimer(r.QueueWait)
+	defer timer.Stop()
+
+	select {
+	case s.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, ErrBackendFull
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/atenart/sniproxy/handshake"
+)
+
+// Cipher suites the clients must offer at least one of, the others being
+// rejected: AEAD ones or listed ones.
+type CipherPolicy struct {
+	AEAD   bool
+	Suites map[uint16]bool
+}
+
+// Parses a cipher suites policy: a comma separated list of cipher suites, by
+// IANA name (as known by crypto/tls) or identifier (e.g. 0x1301), and/or "aead"
+// for any AEAD suite.
+func parseCipherPolicy(val string) (*CipherPolicy, error) {
+	names := make(map[string]uint16)
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		names[s.Name] = s.ID
+	}
+
+	p := &CipherPolicy{ Suites: make(map[uint16]bool) }
+	for _, suite := range(strings.Split(val, ",")) {
+		if suite == "aead" {
+			p.AEAD = true
+			continue
+		}
+		if id, ok := names[suite]; ok {
+			p.Suites[id] = true
+			continue
+		}
+		id, err := strconv.ParseUint(suite, 0, 16)
+		if err != nil || !strings.HasPrefix(suite, "0x") {
+			return nil, fmt.Errorf("Unknown cipher suite: %s", suite)
+		}
+		p.Suites[uint16(id)] = true
+	}
+	return p, nil
+}
+
+// Reports whether offered cipher suites meet the policy.
+func (p *CipherPolicy) Allows(suites []uint16) bool {
+	for _, id := range suites {
+		if p.Suites[id] || (p.AEAD && handshake.IsAEADCipherSuite(id)) {
+			return true
+		}
+	}
+	return false
+}
@@ -16,33 +16,476 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Config holds the entire current configuration.
 type Config struct {
 	Routes  []*Route
+	// Addresses to listen on, and their parameters. When empty, the
+	// address given on the command line is used.
+	Listeners []*Listener
+	// Transparent proxying support (None, REDIRECT, TPROXY). Linux only.
+	Transparent uint
+	// Maximum length of the queue of pending connections. The system
+	// default (somaxconn) is used when set to 0.
+	ListenBacklog int
+	// Enable TCP Fast Open on the listeners (OnClient), the backend
+	// connections (OnUpstream) or both. Linux only.
+	TCPFastOpen   bool
+	TCPFastOpenOn uint
+	// Default ACL tie break for routes not setting one.
+	ACLTieBreak uint
+	// Rewrite rules applied, in order, to the SNI before matching routes.
+	Rewrites []*Rewrite
+	// Whether a trailing :port, sent by some clients in their SNI, is
+	// removed before the rewrite rules.
+	StripSNIPort bool
+	// Maximum time to read the TLS handshake (3s when set to 0), and to
+	// receive its first byte (no specific limit when set to 0).
+	HandshakeTimeout time.Duration
+	FirstByteTimeout time.Duration
+	// Actions taken when rejecting a connection, by cause (see
+	// RejectCauses), when not the default one: a TLS alert description,
+	// ActionClose or ActionReset.
+	RejectActions map[string]int
+	// Destinations of the access logs (routed and closed connections) and
+	// of the error logs: a file path, "stderr", "stdout" or "off" (access
+	// logs only). Access logs go to the error logs destination when empty,
+	// which defaults to stderr.
+	AccessLog string
+	ErrorLog  string
+	// Optional format of the connections records, written to the access
+	// logs in place of the default messages once connections are done.
+	// Records are written as JSON objects when LogJSON is set.
+	LogFormat LogFormat
+	LogJSON   bool
+	// Default logging level of the routes not setting one.
+	LogLevel  uint
+	// Whether the routes matching JA3 fingerprints are matched before the
+	// SNI (JA3BeforeSNI) or only when no route matches it (JA3AfterSNI).
+	JA3Match  uint
+	// Whether domains listed by more than one route, the later ones never
+	// matching, are reported as a warning or as an error.
+	DuplicateDomains uint
+	// Whether the domains of the routes are matched case-sensitively,
+	// the case being ignored by default.
+	DomainCaseSensitive bool
+	// Address the Prometheus metrics are served on (/metrics), if any.
+	Metrics string
+	// OTLP/HTTP endpoint the connections traces are exported to, if any.
+	Tracing string
+	// Whether the time spent in each phase of the connections dispatch is
+	// not recorded in the metrics.
+	NoPhaseTimings bool
+	// Address the admin HTTP API is served on, if any.
+	Admin string
+	// Optional credentials (HTTP basic auth) and client networks the
+	// metrics and admin requests are restricted to. The requests received
+	// on Unix sockets are not restricted by network.
+	AdminUser     string
+	AdminPassword string
+	AdminAllow    []*net.IPNet
+	// On shutdown, time spent draining (reported as not ready) before
+	// closing the listeners, and maximum time then waited for the
+	// connections being routed to finish, before closing them.
+	ShutdownGrace   time.Duration
+	ShutdownTimeout time.Duration
+	// Interval at which the routed connections are scanned for the ones
+	// exceeding the idle timeout of their listener (10s when not set).
+	ReapInterval time.Duration
+	// Maximum number of backend health checks run concurrently (16 when
+	// not set), and random share of the interval (0 to 1) by which each
+	// check is moved forward or backward.
+	HealthCheckWorkers int
+	HealthCheckJitter  float64
+	// Jitter randomizing the backoff delays (replay retries and health
+	// checks of the failing backends), full jitter by default.
+	BackoffJitter uint
+	// Maximum number of connections reading their handshake at once, up
+	// to the backend dial (no limit when set to 0).
+	MaxHandshakes      int
+	// Abuse filter heuristics: minimum size of the handshake (no minimum
+	// when set to 0), and whether the clients offering TLS 1.3 cipher
+	// suites must send the supported_versions extension TLS 1.3 requires.
+	HelloMinSize       int
+	HelloCheckVersions bool
+	// Lowest TLS record version of the client handshakes not logged as
+	// unusual, the versions above TLS 1.2 always being. Not checked when
+	// set to 0.
+	RecordVersionWarn uint16
+	// Default minimum TLS version clients must offer for the routes not
+	// setting one. No minimum when set to 0.
+	RequireTLS uint16
+	// Default cipher suites policy of the routes not setting one. Not
+	// enforced when nil.
+	RequireCiphers *CipherPolicy
+}
+
+// Listener represents an address to listen on, and its parameters.
+type Listener struct {
+	Bind        string
+	// Sources allowed to send an HAProxy PROXY protocol header (v1 or v2).
+	// Data sent by other sources is always considered as being part of
+	// the TLS stream, so that a PROXY header can't be forged.
+	AcceptProxy []*net.IPNet
+	// Number of goroutines accepting connections concurrently, 1 when not
+	// set.
+	AcceptLoops int
+	// Trusted listeners read the handshakes using a buffer and without a
+	// first byte timeout, trading the protections against misbehaving
+	// clients for throughput. For internal clients only.
+	Trusted     bool
+	// Handling of the clients whose first byte is not the one of a TLS
+	// handshake record: closed, reset or forwarded to NonTLSBackend right
+	// away. They go through the handshake parsing otherwise.
+	NonTLS        uint
+	NonTLSBackend string
+	// Framing header preceding the TLS stream (after the PROXY header, if
+	// any), skipped before reading the handshake: a fixed number of bytes,
+	// or up to a delimiter. It is dropped unless SkipForward is set, in
+	// which case it is sent to the backend before the handshake.
+	SkipBytes   int
+	SkipUntil   []byte
+	SkipForward bool
+	// Connections routed without any data read from either side for this
+	// time are closed by the reaper. Not closed when set to 0.
+	IdleTimeout time.Duration
+}
+
+// Handling of non-TLS clients on a listener.
+const (
+	NonTLSParse   = iota
+	NonTLSClose   = iota
+	NonTLSReset   = iota
+	NonTLSForward = iota
+)
+
+// Rewrite represents a regexp replacement applied to an SNI.
+type Rewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// PortRange represents an inclusive range of ports, cycled through.
+type PortRange struct {
+	Low, High uint16
+
+	next atomic.Uint32
+}
+
+// Returns the number of ports in the range.
+func (r *PortRange) Size() int {
+	return int(r.High) - int(r.Low) + 1
+}
+
+// Returns the next port of the range, starting over once the highest one was
+// returned.
+func (r *PortRange) Next() int {
+	return int(r.Low) + int((r.next.Add(1) - 1) % uint32(r.Size()))
+}
+
+func (r *PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Low, r.High)
 }
 
 // Route represents a route between matched domains and a backend.
 type Route struct {
+	// Optional bounds of the highest TLS version offered by the client
+	// (e.g. 0x304 for TLS 1.3), 0 when unset.
+	TLSMinVersion uint16
+	TLSMaxVersion uint16
+	// Minimum TLS version clients must offer, connections offering only
+	// older versions being rejected rather than skipping the route. No
+	// minimum when set to 0.
+	RequireTLS uint16
+	// Cipher suites clients must offer at least one of, the others being
+	// rejected. Not enforced when nil.
+	RequireCiphers *CipherPolicy
+	// Logging level of the connections matching the route.
+	LogLevel uint
+	// Optional name and tags, used in logs and metrics in place of the
+	// backend addresses to group related routes.
+	Name      string
+	Tags      map[string]string
 	Domains   []*regexp.Regexp
-	Backend   string
+	// Domain lists loaded from files, matched in addition to Domains.
+	DomainLists []*DomainList
+	// Destinations (IP range and/or port) matched by the connections not
+	// sending an SNI, before the domains are.
+	Destinations []*Destination
+	// Client networks the route is restricted to, as a match condition: the
+	// routes matching both the SNI and the client address take precedence
+	// over the others, the most specific network first.
+	Clients []*net.IPNet
+	// JA3 fingerprints (MD5 hashes) of the clients matching the route,
+	// whatever their SNI (see Config.JA3Match).
+	JA3 map[string]bool
+	Backends  []*Backend
+	// Domains the client SNI must match (ForwardAllow, when set) and must
+	// not match (ForwardDeny) to be forwarded to, when using an sni
+	// backend.
+	ForwardAllow []*regexp.Regexp
+	ForwardDeny  []*regexp.Regexp
+	// Optional DNS SRV record the backends are resolved from, and the
+	// interval between two resolutions.
+	SRV        string
+	SRVRefresh time.Duration
+	// Optional provider the backends are taken from in place of Backends
+	// (set for SRV backends), and the discovery service URL it watches
+	// when set from the configuration (its token redacted).
+	Provider  BackendProvider
+	Discovery string
+	// Optional HTTP endpoint the backend is looked up from per server
+	// name, and the time its answers are cached for. The backends, if
+	// any, are used when the lookup fails.
+	Lookup    string
+	LookupTTL time.Duration
+	// Backends selection strategy, when more than one is used.
+	Balance   uint
+	// Optional backend receiving a copy of the client traffic, its
+	// responses being discarded.
+	Mirror    string
 	// Deny and Allow contain lists of IP ranges and/or addresses to
 	// whitelist or blacklist for a given route. If Allow is used, all
 	// addresses are then blocked by default.
 	// The more specific subnet takes precedence, and Deny wins over Allow
-	// in case none is more specific.
+	// in case none is more specific (unless ACLTieBreak says otherwise).
 	Deny      []*net.IPNet
 	Allow     []*net.IPNet
+	// External lists of subnets, merged into Deny and Allow.
+	DenyLists  []*SubnetList
+	AllowLists []*SubnetList
+	ACLTieBreak uint
+	// Action taken when denying a connection: a TLS alert description,
+	// ActionClose or ActionReset, or ActionDefault for the one of the
+	// configuration (as for the other route actions).
+	DenyAction  int
+	// Optional per client connection rate limit, and the action taken
+	// when the limit is reached: a TLS alert description, ActionClose or
+	// ActionReset.
+	RateLimit *RateLimiter
+	RateLimitAction int
+	// Routes in maintenance reject their connections without dialing the
+	// backends, taking the given action: a TLS alert description,
+	// ActionClose or ActionReset.
+	Maintenance       bool
+	MaintenanceAction int
 	// HAProxy PROXY protocol support (None, v1, v2).
 	SendProxy uint
+	// Handling of the PROXY header received from the client, if any, when
+	// sending one to the backend.
+	ProxyInbound uint
+	// Dial the backend using the client address as the source address
+	// (transparent egress). Linux only, requires CAP_NET_ADMIN.
+	TransparentEgress bool
+	// Optional range of local ports the backend connections are bound to.
+	SourcePorts *PortRange
+	// Network used to dial the backends (tcp, tcp4 or tcp6), both
+	// families being used when empty.
+	Network string
+	// Send an internal_error TLS alert to the client if the backend resets
+	// the connection before sending any data.
+	ResetAlert bool
+	// Maximum time spent writing the PROXY header and the handshake to the
+	// backend (no limit but the setup budget when set to 0).
+	ReplayTimeout time.Duration
+	// Maximum number of times the handshake is replayed again, possibly to
+	// another backend, when the backend closes the connection before
+	// answering it, and period after the first dial during which retries
+	// are made (no limit but the setup budget when set to 0). The backend
+	// answer is only awaited when retries are enabled.
+	ReplayRetries     int
+	ReplayRetryPeriod time.Duration
+	// Delay before the first replay retry, growing exponentially up to
+	// the maximum on the following ones. Retries are immediate when set
+	// to 0.
+	RetryBackoff    time.Duration
+	RetryBackoffMax time.Duration
+	// Delay for receiving the handshake of the clients whose SNI matches one
+	// of the route domains, overriding Config.HandshakeTimeout once the SNI
+	// is received (0 to keep it).
+	HandshakeTimeout time.Duration
+	// Number of backends dialed in parallel for each connection, the first
+	// one connected being used (no race when lower than 2), and optional
+	// timeout of each of these dials.
+	DialRace        int
+	DialRaceTimeout time.Duration
+	// Whether Nagle's algorithm is kept on the backend connection while
+	// the handshake is replayed, so that it is batched, and only disabled
+	// (TCP_NODELAY) afterwards. It is always disabled otherwise.
+	NoDelayAfterReplay bool
+	// Period between TCP keep alive probes sent to both the client and
+	// the backend. Keep alive is disabled when set to 0. The idle time
+	// before the first probe is the period, and the interval between the
+	// unanswered probes and their count before the peer is considered
+	// dead can also be set (the system count is used when 0).
+	KeepAlive         time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+	// Maximum time data sent to the client or the backend, including the
+	// keep alive probes, can remain unacknowledged before the connection
+	// is closed (TCP_USER_TIMEOUT, Linux only). System default when 0.
+	UserTimeout time.Duration
+	// Maximum time between accepting a connection and having replayed its
+	// handshake to the backend. No limit when set to 0.
+	SetupTimeout time.Duration
+	// Maximum lifetime of a connection, regardless of its activity. No
+	// limit when set to 0.
+	MaxLifetime time.Duration
+	// Time left to the other direction of a connection to finish once one
+	// side closed, the close being propagated as a half-close. Both sides
+	// are closed right away when set to 0.
+	CloseGrace time.Duration
+	// TCP congestion control algorithm used on the client and/or backend
+	// connections (Linux only). The system default is used when empty.
+	CongestionControl string
+	CongestionControlOn uint
+	// DSCP codepoint (0 to 63) marking the client and/or backend
+	// connections packets, for QoS (Linux only). Not set when 0.
+	DSCP   int
+	DSCPOn uint
+	// Optional fallback serving an HTTP 502 page over TLS when the
+	// backend is unreachable, instead of sending a TLS alert.
+	BadGateway *BadGateway
+	// Optional TLS termination of the connections, all of them or those
+	// to some of the server names only. Passed through when nil.
+	Terminate *Termination
+	// Optional server name used to periodically retrieve the certificates
+	// of the backends, exposing their expiry date in the metrics.
+	CertProbe         string
+	CertProbeInterval time.Duration
+
+	// Optional maximum number of concurrent connections per backend, and
+	// queue of connections waiting for one to be released: maximum number
+	// of connections waiting, and maximum wait.
+	MaxConns   int
+	QueueDepth int
+	QueueWait  time.Duration
+	// Period over which a backend recovering from dial failures is given
+	// a growing share of the connections. Disabled when set to 0.
+	SlowStart time.Duration
+	// Interval at which the backends are dialed to check they are up, the
+	// failing ones being skipped. Disabled when set to 0. The failing
+	// backends are checked less and less often, up to the maximum
+	// interval, if greater.
+	HealthCheck    time.Duration
+	HealthCheckMax time.Duration
+
+	rrCounter uint64
+	lookups   lookupCache
+	slots     sync.Map
+	disabled  atomic.Bool
+	health    sync.Map
+	// Current weights of the backends, for smooth weighted round robin.
+	swrrMu      sync.Mutex
+	swrrWeights map[string]int
+}
+
+// Reports whether the route is enabled, routes being skipped when matching
+// connections otherwise.
+func (r *Route) Enabled() bool {
+	return !r.disabled.Load()
+}
+
+// Enables or disables the route at runtime.
+func (r *Route) SetEnabled(enabled bool) {
+	r.disabled.Store(!enabled)
+}
+
+// Returns the first enabled route whose domains or domain lists match a server
+// name, without considering the other criteria (TLS versions, JA3...). Returns
+// nil if none does.
+func (c *Config) MatchDomain(name string) *Route {
+	for _, route := range c.Routes {
+		if !route.Enabled() {
+			continue
+		}
+		for _, domain := range route.Domains {
+			if domain.MatchString(name) {
+				return route
+			}
+		}
+		for _, list := range route.DomainLists {
+			if list.Match(name) {
+				return route
+			}
+		}
+	}
+	return nil
 }
 
+// Returns the network used to dial the route backends.
+func (r *Route) DialNetwork() string {
+	if r.Network == "" {
+		return "tcp"
+	}
+	return r.Network
+}
+
+// Destination of a connection, as the address the client connected to: an
+// optional IP range and an optional port (0 matching all).
+type Destination struct {
+	Subnet *net.IPNet
+	Port   int
+}
+
+// Reports whether an address matches the destination.
+func (d *Destination) Matches(addr *net.TCPAddr) bool {
+	if addr == nil {
+		return false
+	}
+	if d.Port != 0 && addr.Port != d.Port {
+		return false
+	}
+	return d.Subnet == nil || d.Subnet.Contains(addr.IP)
+}
+
+// JA3 fingerprints matching precedence.
+const (
+	JA3BeforeSNI = iota
+	JA3AfterSNI  = iota
+)
+
+// BackoffJitter possible values.
+const (
+	// Uniformly between 0 and the exponential delay.
+	JitterFull         = iota
+	// Uniformly between the base delay and three times the previous one.
+	JitterDecorrelated = iota
+	// The exponential delay, unchanged.
+	JitterNone         = iota
+)
+
+// DuplicateDomains possible values.
+const (
+	DuplicateDomainsWarn  = iota
+	DuplicateDomainsError = iota
+)
+
+// A JA3 fingerprint, as an MD5 hash.
+var ja3Regex = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+
+// Logging levels.
+const (
+	// Errors and access logs (routed and closed connections).
+	LogInfo  = iota
+	// Errors only.
+	LogError = iota
+	// Errors, access logs and the details of each connection setup.
+	LogDebug = iota
+)
+
 // SendProxy possible values.
 const (
 	ProxyNone = iota
@@ -50,6 +493,42 @@ const (
 	ProxyV2   = iota
 )
 
+// ProxyInbound possible values.
+const (
+	// The header sent reports the addresses of the received one.
+	ProxyInboundRewrite = iota
+	// The received header is forwarded verbatim, in place of the one
+	// sent otherwise.
+	ProxyInboundPass    = iota
+	// The received header is ignored, the header sent reporting the
+	// addresses of the connection to the proxy.
+	ProxyInboundStrip   = iota
+)
+
+// CongestionControlOn, TCPFastOpenOn and DSCPOn possible values.
+const (
+	OnUpstream = iota
+	OnClient   = iota
+	OnBoth     = iota
+)
+
+// ACLTieBreak possible values.
+const (
+	ACLTieBreakDeny  = iota
+	ACLTieBreakAllow = iota
+)
+
+// Transparent possible values.
+const (
+	TransparentNone     = iota
+	// Connections were redirected using iptables REDIRECT, the original
+	// destination is retrieved using SO_ORIGINAL_DST.
+	TransparentRedirect = iota
+	// Connections are intercepted using TPROXY, the original destination
+	// is the local address of the connection.
+	TransparentTProxy   = iota
+)
+
 // Reads a configuration file and transforms it into a Config struct.
 func (c *Config) ReadFile(file string) error {
 	f, err := os.Open(file)
@@ -58,23 +537,414 @@ func (c *Config) ReadFile(file string) error {
 	}
 	defer f.Close()
 
-	l := newLexer(f)
-	c.parse(newBlock(&l))
+	return c.read(f)
+}
 
-	return nil
+// Returns the action taken when rejecting a connection for a given cause.
+func (c *Config) RejectAction(cause string) int {
+	if action, ok := c.RejectActions[cause]; ok {
+		return action
+	}
+	return RejectCauses[cause]
+}
+
+// Sets the action taken when rejecting a connection for the given causes.
+func (c *Config) setRejectAction(val string, causes ...string) {
+	action, ok := parseAction(val)
+	if !ok {
+		fail("Invalid action: " + val)
+	}
+
+	if c.RejectActions == nil {
+		c.RejectActions = make(map[string]int)
+	}
+	for _, cause := range causes {
+		c.RejectActions[cause] = action
+	}
+}
+
+// Applies the rewrite rules to an SNI, returning the name to match routes
+// against.
+func (c *Config) RewriteSNI(sni string) string {
+	if c.StripSNIPort {
+		sni = stripPort(sni)
+	}
+	for _, rw := range c.Rewrites {
+		sni = rw.Pattern.ReplaceAllString(sni, rw.Replacement)
+	}
+	return sni
+}
+
+// Removes a trailing :port from a server name. IPv6 literals must be bracketed
+// for their port to be removed, the brackets being kept.
+func stripPort(name string) string {
+	i := strings.LastIndexByte(name, ':')
+	if i < 0 || i == len(name) - 1 {
+		return name
+	}
+	for _, c := range name[i+1:] {
+		if c < '0' || c > '9' {
+			return name
+		}
+	}
+
+	host := name[:i]
+	if strings.IndexByte(host, ':') >= 0 && !(strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]")) {
+		return name
+	}
+	return host
 }
 
 // Parses the blocks generated by the parser and generate the configuration.
 func (c *Config) parse(root *Block) {
+
+	// Global directives.
+	for _, dir := range(root.directives) {
+		switch dir.directive {
+		case "listen":
+			c.Listeners = append(c.Listeners, parseListener(dir.args))
+			break
+		case "alert":
+			if len(dir.args) != 2 {
+				fail("Invalid alert directive")
+			}
+			if _, ok := RejectCauses[dir.args[0]]; !ok {
+				fail("Invalid rejection cause: " + dir.args[0])
+			}
+			c.setRejectAction(dir.args[1], dir.args[0])
+			break
+		case "no-match-action":
+			if len(dir.args) != 1 {
+				fail("Invalid no-match-action directive")
+			}
+			c.setRejectAction(dir.args[0], "no-route", "no-sni")
+			break
+		case "non-tls-action":
+			if len(dir.args) != 1 {
+				fail("Invalid non-tls-action directive")
+			}
+			c.setRejectAction(dir.args[0], "not-tls")
+			break
+		case "transparent":
+			if len(dir.args) != 1 {
+				fail("Invalid transparent directive")
+			}
+			switch dir.args[0] {
+			case "redirect":
+				c.Transparent = TransparentRedirect
+				break
+			case "tproxy":
+				c.Transparent = TransparentTProxy
+				break
+			default:
+				fail("Invalid transparent mode: " + dir.args[0])
+			}
+			break
+		case "listen-backlog":
+			if len(dir.args) != 1 {
+				fail("Invalid listen-backlog directive")
+			}
+			backlog, err := strconv.Atoi(dir.args[0])
+			if err != nil || backlog <= 0 {
+				fail("Invalid listen backlog: " + dir.args[0])
+			}
+			c.ListenBacklog = backlog
+			break
+		case "tcp-fast-open":
+			if len(dir.args) > 1 {
+				fail("Invalid tcp-fast-open directive")
+			}
+			c.TCPFastOpen, c.TCPFastOpenOn = true, OnBoth
+			if len(dir.args) == 1 {
+				c.TCPFastOpenOn = parseSide(dir.directive, dir.args[0])
+			}
+			break
+		case "acl-tie-break":
+			if len(dir.args) != 1 {
+				fail("Invalid acl-tie-break directive")
+			}
+			c.ACLTieBreak = parseACLTieBreak(dir.args[0])
+			break
+		case "handshake-timeout", "first-byte-timeout":
+			if len(dir.args) != 1 {
+				failf("Invalid %s directive", dir.directive)
+			}
+			timeout, err := time.ParseDuration(dir.args[0])
+			if err != nil || timeout <= 0 {
+				fail("Invalid timeout: " + dir.args[0])
+			}
+			if dir.directive == "handshake-timeout" {
+				c.HandshakeTimeout = timeout
+			} else {
+				c.FirstByteTimeout = timeout
+			}
+			break
+		case "rewrite":
+			if len(dir.args) != 2 {
+				fail("Invalid rewrite directive")
+			}
+			rgp, err := regexp.Compile(dir.args[0])
+			if err != nil {
+				failf("Invalid rewrite pattern %q (%s)", dir.args[0], err)
+			}
+			c.Rewrites = append(c.Rewrites, &Rewrite{ Pattern: rgp, Replacement: dir.args[1] })
+			break
+		case "strip-sni-port":
+			if len(dir.args) > 0 {
+				fail("Invalid strip-sni-port directive")
+			}
+			c.StripSNIPort = true
+			break
+		case "max-handshakes":
+			if len(dir.args) != 1 {
+				fail("Invalid max-handshakes directive")
+			}
+			max, err := strconv.Atoi(dir.args[0])
+			if err != nil || max <= 0 {
+				fail("Invalid max-handshakes value: " + dir.args[0])
+			}
+			c.MaxHandshakes = max
+			break
+		case "hello-min-size":
+			if len(dir.args) != 1 {
+				fail("Invalid hello-min-size directive")
+			}
+			size, err := strconv.Atoi(dir.args[0])
+			if err != nil || size <= 0 {
+				fail("Invalid hello-min-size value: " + dir.args[0])
+			}
+			c.HelloMinSize = size
+			break
+		case "hello-check-versions":
+			if len(dir.args) > 0 {
+				fail("Invalid hello-check-versions directive")
+			}
+			c.HelloCheckVersions = true
+			break
+		case "warn-record-version":
+			if len(dir.args) != 1 {
+				fail("Invalid warn-record-version directive")
+			}
+			c.RecordVersionWarn = parseTLSVersion(dir.args[0])
+			break
+		case "require-tls":
+			if len(dir.args) != 1 {
+				fail("Invalid require-tls directive")
+			}
+			c.RequireTLS = parseTLSVersion(dir.args[0])
+			break
+		case "require-ciphers":
+			if len(dir.args) != 1 {
+				fail("Invalid require-ciphers directive")
+			}
+			policy, err := parseCipherPolicy(dir.args[0])
+			if err != nil {
+				failf("Invalid require-ciphers directive (%s)", err)
+			}
+			c.RequireCiphers = policy
+			break
+		case "metrics":
+			if len(dir.args) != 1 {
+				fail("Invalid metrics directive")
+			}
+			c.Metrics = dir.args[0]
+			break
+		case "tracing":
+			if len(dir.args) != 1 || !IsURL(dir.args[0]) {
+				fail("Invalid tracing directive")
+			}
+			c.Tracing = dir.args[0]
+			break
+		case "phase-timings":
+			if len(dir.args) != 1 || (dir.args[0] != "on" && dir.args[0] != "off") {
+				fail("Invalid phase-timings directive")
+			}
+			c.NoPhaseTimings = dir.args[0] == "off"
+			break
+		case "admin":
+			if len(dir.args) != 1 {
+				fail("Invalid admin directive")
+			}
+			c.Admin = dir.args[0]
+			break
+		case "admin-auth":
+			if len(dir.args) != 2 || dir.args[0] == "" || dir.args[1] == "" {
+				fail("Invalid admin-auth directive")
+			}
+			c.AdminUser, c.AdminPassword = dir.args[0], dir.args[1]
+			break
+		case "admin-allow":
+			if len(dir.args) != 1 {
+				fail("Invalid admin-allow directive")
+			}
+			for _, subnet := range(strings.Split(dir.args[0], ",")) {
+				c.AdminAllow = append(c.AdminAllow, parseRange(subnet))
+			}
+			break
+		case "shutdown-grace", "shutdown-timeout":
+			if len(dir.args) != 1 {
+				failf("Invalid %s directive", dir.directive)
+			}
+			d, err := time.ParseDuration(dir.args[0])
+			if err != nil || d < 0 {
+				failf("Invalid %s duration: %s", dir.directive, dir.args[0])
+			}
+			if dir.directive == "shutdown-grace" {
+				c.ShutdownGrace = d
+			} else {
+				c.ShutdownTimeout = d
+			}
+			break
+		case "reap-interval":
+			if len(dir.args) != 1 {
+				fail("Invalid reap-interval directive")
+			}
+			d, err := time.ParseDuration(dir.args[0])
+			if err != nil || d <= 0 {
+				fail("Invalid reap-interval duration: " + dir.args[0])
+			}
+			c.ReapInterval = d
+			break
+		case "health-check-workers":
+			if len(dir.args) != 1 {
+				fail("Invalid health-check-workers directive")
+			}
+			workers, err := strconv.Atoi(dir.args[0])
+			if err != nil || workers <= 0 {
+				fail("Invalid health-check-workers value: " + dir.args[0])
+			}
+			c.HealthCheckWorkers = workers
+			break
+		case "health-check-jitter":
+			if len(dir.args) != 1 {
+				fail("Invalid health-check-jitter directive")
+			}
+			jitter, err := strconv.ParseFloat(dir.args[0], 64)
+			if err != nil || jitter < 0 || jitter > 1 {
+				fail("Invalid health-check-jitter value: " + dir.args[0])
+			}
+			c.HealthCheckJitter = jitter
+			break
+		case "backoff-jitter":
+			if len(dir.args) != 1 {
+				fail("Invalid backoff-jitter directive")
+			}
+			switch dir.args[0] {
+			case "full":
+				c.BackoffJitter = JitterFull
+				break
+			case "decorrelated":
+				c.BackoffJitter = JitterDecorrelated
+				break
+			case "none":
+				c.BackoffJitter = JitterNone
+				break
+			default:
+				fail("Invalid backoff-jitter value: " + dir.args[0])
+			}
+			break
+		case "log-level":
+			if len(dir.args) != 1 {
+				fail("Invalid log-level directive")
+			}
+			c.LogLevel = parseLogLevel(dir.args[0])
+			break
+		case "ja3-match":
+			if len(dir.args) != 1 {
+				fail("Invalid ja3-match directive")
+			}
+			switch dir.args[0] {
+			case "before-sni":
+				c.JA3Match = JA3BeforeSNI
+				break
+			case "after-sni":
+				c.JA3Match = JA3AfterSNI
+				break
+			default:
+				fail("Invalid ja3-match value: " + dir.args[0])
+			}
+			break
+		case "domain-case":
+			if len(dir.args) != 1 || (dir.args[0] != "sensitive" && dir.args[0] != "insensitive") {
+				fail("Invalid domain-case directive")
+			}
+			c.DomainCaseSensitive = dir.args[0] == "sensitive"
+			break
+		case "duplicate-domains":
+			if len(dir.args) != 1 {
+				fail("Invalid duplicate-domains directive")
+			}
+			switch dir.args[0] {
+			case "warn":
+				c.DuplicateDomains = DuplicateDomainsWarn
+				break
+			case "error":
+				c.DuplicateDomains = DuplicateDomainsError
+				break
+			default:
+				fail("Invalid duplicate-domains value: " + dir.args[0])
+			}
+			break
+		case "log-format":
+			if len(dir.args) == 0 {
+				fail("Invalid log-format directive")
+			}
+			if len(dir.args) == 1 && dir.args[0] == "json" {
+				c.LogFormat, c.LogJSON = nil, true
+				break
+			}
+			format, err := ParseLogFormat(strings.Join(dir.args, " "))
+			if err != nil {
+				fail("Invalid log-format: " + err.Error())
+			}
+			c.LogFormat, c.LogJSON = format, false
+			break
+		case "log":
+			if len(dir.args) != 2 {
+				fail("Invalid log directive")
+			}
+			switch dir.args[0] {
+			case "access":
+				c.AccessLog = dir.args[1]
+				break
+			case "error":
+				if dir.args[1] == "off" {
+					fail("Error logs can't be turned off")
+				}
+				c.ErrorLog = dir.args[1]
+				break
+			default:
+				fail("Invalid log category: " + dir.args[0])
+			}
+			break
+		default:
+			continue
+		}
+	}
+
 	for _, block := range(root.blocks) {
-		route := &Route{ SendProxy: ProxyNone }
+		route := &Route{
+			SendProxy: ProxyNone,
+			KeepAlive: time.Minute,
+			ACLTieBreak: c.ACLTieBreak,
+			RateLimitAction: c.RejectAction("rate-limited"),
+			MaintenanceAction: c.RejectAction("maintenance"),
+			DenyAction: c.RejectAction("denied"),
+			RequireTLS: c.RequireTLS,
+			RequireCiphers: c.RequireCiphers,
+			LogLevel: c.LogLevel,
+		}
 		c.Routes = append(c.Routes, route)
 
+		// Discovery service URL the backends are watched from, if any.
+		var discovery string
+
 		domains := strings.Split(block.label, ",")
 		for _, domain := range(domains) {
-			rgp, err := domain2Regex(domain)
+			warnWildcard(domain)
+			rgp, err := domain2Regex(domain, c.DomainCaseSensitive)
 			if err != nil {
-				log.Fatal("Invalid domain: " + domain)
+				fail("Invalid domain: " + domain)
 			}
 
 			route.Domains = append(route.Domains, rgp)
@@ -83,47 +953,666 @@ func (c *Config) parse(root *Block) {
 		for _, dir := range(block.directives) {
 			switch dir.directive {
 			case "backend":
+				if len(dir.args) < 1 {
+					fail("Invalid backend directive")
+				}
+				params := parseBackendParams(dir.args[1:])
+				for _, addr := range(strings.Split(dir.args[0], ",")) {
+					if isDiscovery(addr) {
+						if params.OverrideProxy {
+							fail("PROXY header parameters can't be used with discovered backends: " + addr)
+						}
+						if discovery != "" {
+							fail("Only one discovery service can be used per route: " + addr)
+						}
+						discovery = addr
+						continue
+					}
+					if isSRV(addr) {
+						if params.OverrideProxy {
+							fail("PROXY header parameters can't be used with SRV backends: " + addr)
+						}
+						route.SRV = addr
+						continue
+					}
+					b := params
+					b.Address = addr
+					if port, ok := strings.CutPrefix(addr, "sni:"); ok {
+						n, err := strconv.Atoi(port)
+						if err != nil || n <= 0 || n > 65535 {
+							fail("Invalid sni backend port: " + port)
+						}
+						b.SNIPort = n
+					}
+					route.Backends = append(route.Backends, &b)
+				}
+				break
+			case "forward-allow", "forward-deny":
 				if len(dir.args) != 1 {
-					log.Fatal("Invalid backend directive")
+					failf("Invalid %s directive", dir.directive)
+				}
+				for _, domain := range(strings.Split(dir.args[0], ",")) {
+					warnWildcard(domain)
+					rgp, err := domain2Regex(domain, c.DomainCaseSensitive)
+					if err != nil {
+						fail("Invalid domain: " + domain)
+					}
+					if dir.directive == "forward-allow" {
+						route.ForwardAllow = append(route.ForwardAllow, rgp)
+					} else {
+						route.ForwardDeny = append(route.ForwardDeny, rgp)
+					}
+				}
+				break
+			case "backend-lookup":
+				if len(dir.args) < 1 || len(dir.args) > 2 {
+					fail("Invalid backend-lookup directive")
+				}
+				u, err := url.Parse(dir.args[0])
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					fail("Invalid backend-lookup URL: " + dir.args[0])
+				}
+				route.Lookup = dir.args[0]
+				route.LookupTTL = lookupTTL
+				if len(dir.args) == 2 {
+					ttl, err := time.ParseDuration(dir.args[1])
+					if err != nil || ttl <= 0 {
+						fail("Invalid backend-lookup TTL: " + dir.args[1])
+					}
+					route.LookupTTL = ttl
+				}
+				break
+			case "srv-refresh":
+				if len(dir.args) != 1 {
+					fail("Invalid srv-refresh directive")
+				}
+				refresh, err := time.ParseDuration(dir.args[0])
+				if err != nil || refresh <= 0 {
+					fail("Invalid SRV refresh interval: " + dir.args[0])
+				}
+				route.SRVRefresh = refresh
+				break
+			case "mirror":
+				if len(dir.args) != 1 {
+					fail("Invalid mirror directive")
+				}
+				route.Mirror = dir.args[0]
+				break
+			case "balance":
+				if len(dir.args) != 1 {
+					fail("Invalid balance directive")
+				}
+				switch dir.args[0] {
+				case "round-robin":
+					route.Balance = BalanceRoundRobin
+					break
+				case "sni-hash":
+					route.Balance = BalanceSNIHash
+					break
+				case "random":
+					route.Balance = BalanceRandom
+					break
+				case "weighted-round-robin":
+					route.Balance = BalanceWeightedRoundRobin
+					break
+				default:
+					fail("Invalid balance strategy: " + dir.args[0])
 				}
-				route.Backend = dir.args[0]
+				break
+			case "setup-timeout":
+				if len(dir.args) != 1 {
+					fail("Invalid setup-timeout directive")
+				}
+				timeout, err := time.ParseDuration(dir.args[0])
+				if err != nil || timeout <= 0 {
+					fail("Invalid setup timeout: " + dir.args[0])
+				}
+				route.SetupTimeout = timeout
+				break
+			case "max-lifetime":
+				if len(dir.args) != 1 {
+					fail("Invalid max-lifetime directive")
+				}
+				lifetime, err := time.ParseDuration(dir.args[0])
+				if err != nil || lifetime <= 0 {
+					fail("Invalid max lifetime: " + dir.args[0])
+				}
+				route.MaxLifetime = lifetime
+				break
+			case "close-grace":
+				if len(dir.args) != 1 {
+					fail("Invalid close-grace directive")
+				}
+				grace, err := time.ParseDuration(dir.args[0])
+				if err != nil || grace <= 0 {
+					fail("Invalid close grace period: " + dir.args[0])
+				}
+				route.CloseGrace = grace
+				break
+			case "congestion-control":
+				if len(dir.args) < 1 || len(dir.args) > 2 {
+					fail("Invalid congestion-control directive")
+				}
+				route.CongestionControl = dir.args[0]
+				if len(dir.args) == 2 {
+					route.CongestionControlOn = parseSide(dir.directive, dir.args[1])
+				}
+				break
+			case "dscp":
+				if len(dir.args) < 1 || len(dir.args) > 2 {
+					fail("Invalid dscp directive")
+				}
+				route.DSCP = parseDSCP(dir.args[0])
+				if len(dir.args) == 2 {
+					route.DSCPOn = parseSide(dir.directive, dir.args[1])
+				}
+				break
+			case "tls-min-version", "tls-max-version":
+				if len(dir.args) != 1 {
+					failf("Invalid %s directive", dir.directive)
+				}
+				version := parseTLSVersion(dir.args[0])
+				if dir.directive == "tls-min-version" {
+					route.TLSMinVersion = version
+				} else {
+					route.TLSMaxVersion = version
+				}
+				break
+			case "require-tls":
+				if len(dir.args) != 1 {
+					fail("Invalid require-tls directive")
+				}
+				route.RequireTLS = parseTLSVersion(dir.args[0])
+				break
+			case "require-ciphers":
+				if len(dir.args) != 1 {
+					fail("Invalid require-ciphers directive")
+				}
+				policy, err := parseCipherPolicy(dir.args[0])
+				if err != nil {
+					failf("Invalid require-ciphers directive (%s)", err)
+				}
+				route.RequireCiphers = policy
+				break
+			case "name":
+				if len(dir.args) != 1 {
+					fail("Invalid name directive")
+				}
+				route.Name = dir.args[0]
+				break
+			case "tags":
+				if len(dir.args) != 1 {
+					fail("Invalid tags directive")
+				}
+				if route.Tags == nil {
+					route.Tags = make(map[string]string)
+				}
+				for _, tag := range(strings.Split(dir.args[0], ",")) {
+					kv := strings.SplitN(tag, "=", 2)
+					if len(kv) != 2 || kv[0] == "" {
+						fail("Invalid tag: " + tag)
+					}
+					route.Tags[kv[0]] = kv[1]
+				}
+				break
+			case "domains-file":
+				if len(dir.args) != 1 {
+					fail("Invalid domains-file directive")
+				}
+				list, err := newDomainList(dir.args[0], c.DomainCaseSensitive)
+				if err != nil {
+					failf("Could not load domain list %q (%s)", dir.args[0], err)
+				}
+				route.DomainLists = append(route.DomainLists, list)
 				break
 			case "deny":
 				if len(dir.args) != 1 {
-					log.Fatal("Invalid deny directive")
+					fail("Invalid deny directive")
 				}
 				for _, subnet := range(strings.Split(dir.args[0], ",")) {
 					route.Deny = append(route.Deny, parseRange(subnet))
 				}
 				break
+			case "ja3":
+				if len(dir.args) != 1 {
+					fail("Invalid ja3 directive")
+				}
+				if route.JA3 == nil {
+					route.JA3 = make(map[string]bool)
+				}
+				for _, hash := range(strings.Split(dir.args[0], ",")) {
+					if !ja3Regex.MatchString(hash) {
+						fail("Invalid JA3 fingerprint: " + hash)
+					}
+					route.JA3[strings.ToLower(hash)] = true
+				}
+				break
+			case "destination":
+				if len(dir.args) != 1 {
+					fail("Invalid destination directive")
+				}
+				for _, dst := range(strings.Split(dir.args[0], ",")) {
+					route.Destinations = append(route.Destinations, parseDestination(dst))
+				}
+				break
 			case "allow":
 				if len(dir.args) != 1 {
-					log.Fatal("Invalid allow directive")
+					fail("Invalid allow directive")
 				}
 				for _, subnet := range(strings.Split(dir.args[0], ",")) {
 					route.Allow = append(route.Allow, parseRange(subnet))
 				}
 				break
+			case "clients":
+				if len(dir.args) != 1 {
+					fail("Invalid clients directive")
+				}
+				for _, subnet := range(strings.Split(dir.args[0], ",")) {
+					route.Clients = append(route.Clients, parseRange(subnet))
+				}
+				break
+			case "deny-from", "allow-from":
+				if len(dir.args) < 1 || len(dir.args) > 2 {
+					failf("Invalid %s directive", dir.directive)
+				}
+				interval := subnetListRefresh
+				if len(dir.args) == 2 {
+					var err error
+					interval, err = time.ParseDuration(dir.args[1])
+					if err != nil || interval <= 0 {
+						fail("Invalid refresh interval: " + dir.args[1])
+					}
+				}
+				list, err := newSubnetList(dir.args[0], interval)
+				if err != nil {
+					failf("Could not load subnet list %q (%s)", dir.args[0], err)
+				}
+				if dir.directive == "deny-from" {
+					route.DenyLists = append(route.DenyLists, list)
+				} else {
+					route.AllowLists = append(route.AllowLists, list)
+				}
+				break
+			case "acl-tie-break":
+				if len(dir.args) != 1 {
+					fail("Invalid acl-tie-break directive")
+				}
+				route.ACLTieBreak = parseACLTieBreak(dir.args[0])
+				break
+			case "rate-limit":
+				if len(dir.args) != 1 {
+					fail("Invalid rate-limit directive")
+				}
+				route.RateLimit = parseRateLimit(dir.args[0])
+				break
+			case "deny-action":
+				if len(dir.args) != 1 {
+					fail("Invalid deny-action directive")
+				}
+				action, ok := parseAction(dir.args[0])
+				if !ok {
+					fail("Invalid deny action: " + dir.args[0])
+				}
+				route.DenyAction = action
+				break
+			case "rate-limit-action":
+				if len(dir.args) != 1 {
+					fail("Invalid rate-limit-action directive")
+				}
+				action, ok := parseAction(dir.args[0])
+				if !ok {
+					fail("Invalid rate limit action: " + dir.args[0])
+				}
+				route.RateLimitAction = action
+				break
+			case "maintenance":
+				if len(dir.args) > 1 {
+					fail("Invalid maintenance directive")
+				}
+				if len(dir.args) == 1 {
+					action, ok := parseAction(dir.args[0])
+					if !ok {
+						fail("Invalid maintenance action: " + dir.args[0])
+					}
+					route.MaintenanceAction = action
+				}
+				route.Maintenance = true
+				break
 			// HAProxy PROXY protocol (v1)
 			case "send-proxy":
 				if len(dir.args) > 0 {
-					log.Fatal("Invalid send-proxy directive")
+					fail("Invalid send-proxy directive")
 				}
 				route.SendProxy = ProxyV1
 				break
 			// HAProxy PROXY protocol (v2)
 			case "send-proxy-v2":
 				if len(dir.args) > 0 {
-					log.Fatal("Invalid send-proxy directive")
+					fail("Invalid send-proxy directive")
 				}
 				route.SendProxy = ProxyV2
 				break
+			case "proxy-inbound":
+				if len(dir.args) != 1 {
+					fail("Invalid proxy-inbound directive")
+				}
+				switch dir.args[0] {
+				case "rewrite":
+					route.ProxyInbound = ProxyInboundRewrite
+					break
+				case "pass":
+					route.ProxyInbound = ProxyInboundPass
+					break
+				case "strip":
+					route.ProxyInbound = ProxyInboundStrip
+					break
+				default:
+					fail("Invalid proxy-inbound value: " + dir.args[0])
+				}
+				break
+			case "transparent-egress":
+				if len(dir.args) > 0 {
+					fail("Invalid transparent-egress directive")
+				}
+				route.TransparentEgress = true
+				break
+			case "keepalive":
+				if len(dir.args) < 1 || len(dir.args) > 3 {
+					fail("Invalid keepalive directive")
+				}
+				if dir.args[0] == "off" {
+					if len(dir.args) > 1 {
+						fail("Invalid keepalive directive")
+					}
+					route.KeepAlive = 0
+					break
+				}
+				period, err := time.ParseDuration(dir.args[0])
+				if err != nil || period <= 0 {
+					fail("Invalid keepalive period: " + dir.args[0])
+				}
+				route.KeepAlive = period
+				if len(dir.args) > 1 {
+					interval, err := time.ParseDuration(dir.args[1])
+					if err != nil || interval <= 0 {
+						fail("Invalid keepalive interval: " + dir.args[1])
+					}
+					route.KeepAliveInterval = interval
+				}
+				if len(dir.args) > 2 {
+					count, err := strconv.Atoi(dir.args[2])
+					if err != nil || count <= 0 {
+						fail("Invalid keepalive count: " + dir.args[2])
+					}
+					route.KeepAliveCount = count
+				}
+				break
+			case "user-timeout":
+				if len(dir.args) != 1 {
+					fail("Invalid user-timeout directive")
+				}
+				timeout, err := time.ParseDuration(dir.args[0])
+				if err != nil || timeout < time.Millisecond {
+					fail("Invalid user-timeout value: " + dir.args[0])
+				}
+				route.UserTimeout = timeout
+				break
+			case "log-level":
+				if len(dir.args) != 1 {
+					fail("Invalid log-level directive")
+				}
+				route.LogLevel = parseLogLevel(dir.args[0])
+				break
+			case "handshake-timeout":
+				if len(dir.args) != 1 {
+					fail("Invalid handshake-timeout directive")
+				}
+				timeout, err := time.ParseDuration(dir.args[0])
+				if err != nil || timeout <= 0 {
+					fail("Invalid timeout: " + dir.args[0])
+				}
+				route.HandshakeTimeout = timeout
+				break
+			case "replay-timeout":
+				if len(dir.args) != 1 {
+					fail("Invalid replay-timeout directive")
+				}
+				timeout, err := time.ParseDuration(dir.args[0])
+				if err != nil || timeout <= 0 {
+					fail("Invalid timeout: " + dir.args[0])
+				}
+				route.ReplayTimeout = timeout
+				break
+			case "replay-retries":
+				if len(dir.args) != 1 && len(dir.args) != 2 {
+					fail("Invalid replay-retries directive")
+				}
+				retries, err := strconv.Atoi(dir.args[0])
+				if err != nil || retries <= 0 {
+					fail("Invalid replay-retries count: " + dir.args[0])
+				}
+				route.ReplayRetries = retries
+				if len(dir.args) == 2 {
+					period, err := time.ParseDuration(dir.args[1])
+					if err != nil || period <= 0 {
+						fail("Invalid replay-retries period: " + dir.args[1])
+					}
+					route.ReplayRetryPeriod = period
+				}
+				break
+			case "retry-backoff":
+				if len(dir.args) != 1 && len(dir.args) != 2 {
+					fail("Invalid retry-backoff directive")
+				}
+				base, err := time.ParseDuration(dir.args[0])
+				if err != nil || base <= 0 {
+					fail("Invalid retry-backoff delay: " + dir.args[0])
+				}
+				route.RetryBackoff, route.RetryBackoffMax = base, 10*base
+				if len(dir.args) == 2 {
+					max, err := time.ParseDuration(dir.args[1])
+					if err != nil || max < base {
+						fail("Invalid retry-backoff maximum delay: " + dir.args[1])
+					}
+					route.RetryBackoffMax = max
+				}
+				break
+			case "nodelay-after-replay":
+				if len(dir.args) > 0 {
+					fail("Invalid nodelay-after-replay directive")
+				}
+				route.NoDelayAfterReplay = true
+				break
+			case "reset-alert":
+				if len(dir.args) > 0 {
+					fail("Invalid reset-alert directive")
+				}
+				route.ResetAlert = true
+				break
+			case "network":
+				if len(dir.args) != 1 {
+					fail("Invalid network directive")
+				}
+				switch dir.args[0] {
+				case "tcp", "tcp4", "tcp6":
+					route.Network = dir.args[0]
+					break
+				default:
+					fail("Invalid network: " + dir.args[0])
+				}
+				break
+			case "source-ports":
+				if len(dir.args) != 1 {
+					fail("Invalid source-ports directive")
+				}
+				route.SourcePorts = parsePortRange(dir.args[0])
+				break
+			case "max-conns":
+				if len(dir.args) != 1 {
+					fail("Invalid max-conns directive")
+				}
+				max, err := strconv.Atoi(dir.args[0])
+				if err != nil || max <= 0 {
+					fail("Invalid max-conns value: " + dir.args[0])
+				}
+				route.MaxConns = max
+				break
+			case "slow-start":
+				if len(dir.args) != 1 {
+					fail("Invalid slow-start directive")
+				}
+				ramp, err := time.ParseDuration(dir.args[0])
+				if err != nil || ramp <= 0 {
+					fail("Invalid slow-start period: " + dir.args[0])
+				}
+				route.SlowStart = ramp
+				break
+			case "dial-race":
+				if len(dir.args) != 1 && len(dir.args) != 2 {
+					fail("Invalid dial-race directive")
+				}
+				count, err := strconv.Atoi(dir.args[0])
+				if err != nil || count < 2 {
+					fail("Invalid dial-race count: " + dir.args[0])
+				}
+				route.DialRace = count
+				if len(dir.args) == 2 {
+					timeout, err := time.ParseDuration(dir.args[1])
+					if err != nil || timeout <= 0 {
+						fail("Invalid dial-race timeout: " + dir.args[1])
+					}
+					route.DialRaceTimeout = timeout
+				}
+				break
+			case "health-check":
+				if len(dir.args) != 1 && len(dir.args) != 2 {
+					fail("Invalid health-check directive")
+				}
+				interval, err := time.ParseDuration(dir.args[0])
+				if err != nil || interval <= 0 {
+					fail("Invalid health-check interval: " + dir.args[0])
+				}
+				route.HealthCheck = interval
+				if len(dir.args) == 2 {
+					max, err := time.ParseDuration(dir.args[1])
+					if err != nil || max < interval {
+						fail("Invalid health-check maximum interval: " + dir.args[1])
+					}
+					route.HealthCheckMax = max
+				}
+				break
+			case "queue":
+				if len(dir.args) != 2 {
+					fail("Invalid queue directive")
+				}
+				depth, err := strconv.Atoi(dir.args[0])
+				if err != nil || depth <= 0 {
+					fail("Invalid queue depth: " + dir.args[0])
+				}
+				wait, err := time.ParseDuration(dir.args[1])
+				if err != nil || wait <= 0 {
+					fail("Invalid queue wait: " + dir.args[1])
+				}
+				route.QueueDepth, route.QueueWait = depth, wait
+				break
+			case "cert-probe":
+				if len(dir.args) != 1 && len(dir.args) != 2 {
+					fail("Invalid cert-probe directive")
+				}
+				route.CertProbe = dir.args[0]
+				route.CertProbeInterval = time.Hour
+				if len(dir.args) == 2 {
+					interval, err := time.ParseDuration(dir.args[1])
+					if err != nil || interval <= 0 {
+						fail("Invalid cert-probe interval: " + dir.args[1])
+					}
+					route.CertProbeInterval = interval
+				}
+				break
+			case "bad-gateway":
+				if len(dir.args) != 2 && len(dir.args) != 3 {
+					fail("Invalid bad-gateway directive")
+				}
+				page := ""
+				if len(dir.args) == 3 {
+					page = dir.args[2]
+				}
+				bg, err := newBadGateway(dir.args[0], dir.args[1], page)
+				if err != nil {
+					failf("Could not load the bad-gateway fallback (%s)", err)
+				}
+				route.BadGateway = bg
+				break
+			case "terminate":
+				if len(dir.args) != 2 && len(dir.args) != 3 {
+					fail("Invalid terminate directive")
+				}
+				domains := ""
+				if len(dir.args) == 3 {
+					domains = dir.args[2]
+				}
+				t, err := newTermination(dir.args[0], dir.args[1], domains, c.DomainCaseSensitive)
+				if err != nil {
+					failf("Could not load the terminate certificate (%s)", err)
+				}
+				route.Terminate = t
+				break
 			default:
 				continue
 			}
 		}
 
-		if len(route.Allow) > 0 {
+		for _, b := range route.Backends {
+			if b.SNIPort != 0 && (len(route.Backends) > 1 || route.SRV != "") {
+				fail("sni backends can't be mixed with other backends: " + b.Address)
+			}
+		}
+		if (len(route.ForwardAllow) > 0 || len(route.ForwardDeny) > 0) && !route.Forwards() {
+			fail("forward-allow and forward-deny require an sni backend")
+		}
+		if route.Forwards() && route.CertProbe != "" {
+			fail("cert-probe can't be used with an sni backend")
+		}
+		if route.Forwards() && route.DialRace > 0 {
+			fail("dial-race can't be used with an sni backend")
+		}
+		if route.Forwards() && route.HealthCheck > 0 {
+			fail("health-check can't be used with an sni backend")
+		}
+		if route.Lookup != "" && (route.Forwards() || route.SRV != "") {
+			fail("backend-lookup can't be used with sni or SRV backends")
+		}
+
+		if route.RetryBackoff > 0 && route.ReplayRetries == 0 {
+			fail("retry-backoff requires replay-retries to be set")
+		}
+
+		if route.QueueDepth > 0 && route.MaxConns == 0 {
+			fail("A queue requires max-conns to be set")
+		}
+
+		if route.SRV != "" {
+			if len(route.Backends) > 0 {
+				fail("SRV backends can't be mixed with other backends: " + route.SRV)
+			}
+			if route.SRVRefresh == 0 {
+				route.SRVRefresh = srvRefresh
+			}
+			route.Provider = newSRVBackends(route.SRV, route.SRVRefresh)
+		}
+
+		if discovery != "" {
+			if len(route.Backends) > 0 || route.SRV != "" || route.Lookup != "" {
+				fail("Discovered backends can't be mixed with other backends: " + discovery)
+			}
+			d, err := newDiscovery(discovery)
+			if err != nil {
+				failf("Invalid discovery service %s (%s)", discovery, err)
+			}
+			route.Provider, route.Discovery = d, d.source
+		}
+
+		if len(route.Allow) > 0 || len(route.AllowLists) > 0 {
 			// When using the allow directive, we should block all
 			// other IPs. Set Deny to match all IPs.
 			_, all4, _ := net.ParseCIDR("0.0.0.0/0")
@@ -134,43 +1623,366 @@ func (c *Config) parse(root *Block) {
 	}
 }
 
-// Converts a domain to a regexp.Regexp.
-func domain2Regex(domain string) (*regexp.Regexp, error) {
+// Converts a domain to a regexp.Regexp, matching the whole SNI. A '*' matches
+// any part of a single label, while '**' matches one or more labels. The case
+// is ignored unless caseSensitive is set.
+func domain2Regex(domain string, caseSensitive bool) (*regexp.Regexp, error) {
 	// Translate the domains into a regexp valid string.
 	regex := ""
-	for _, r := range domain {
-		switch r {
+	runes := []rune(domain)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
 		case '*':
-			regex += `.*`
+			if i + 1 < len(runes) && runes[i + 1] == '*' {
+				regex += `[^.]+(?:\.[^.]+)*`
+				i++
+				break
+			}
+			regex += `[^.]*`
 			break
 		case '.':
 			regex += `\.`
 			break
 		default:
-			regex += string(r)
+			regex += string(runes[i])
+		}
+	}
+
+	if !caseSensitive {
+		return regexp.Compile(`(?i)^(?:` + regex + `)$`)
+	}
+	return regexp.Compile(`^(?:` + regex + `)$`)
+}
+
+// Reports whether a domain has a '*' not part of a '**', which used to match
+// several labels as well.
+func singleWildcard(domain string) bool {
+	for i := 0; i < len(domain); i++ {
+		if domain[i] != '*' {
+			continue
+		}
+		if i + 1 < len(domain) && domain[i + 1] == '*' {
+			i++
+			continue
 		}
+		return true
 	}
+	return false
+}
 
-	return regexp.Compile(regex)
+// Warns about the domains whose '*' matched several labels before it was
+// limited to a single one, so that upgraded configurations can be fixed.
+func warnWildcard(domain string) {
+	if singleWildcard(domain) {
+		log.Printf("Warning: '*' only matches a single label in %s, use '**' to match several labels", domain)
+	}
+}
+
+// Parses the optional parameters of a backend directive: its weight and the
+// PROXY header sent to it, overriding the route one.
+func parseBackendParams(args []string) Backend {
+	b := Backend{ Weight: 1 }
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "weight":
+			if i + 1 >= len(args) {
+				fail("Missing argument to backend parameter weight")
+			}
+			i++
+			weight, err := strconv.Atoi(args[i])
+			if err != nil || weight <= 0 {
+				fail("Invalid backend weight: " + args[i])
+			}
+			b.Weight = weight
+			break
+		case "send-proxy":
+			b.SendProxy, b.OverrideProxy = ProxyV1, true
+			break
+		case "send-proxy-v2":
+			b.SendProxy, b.OverrideProxy = ProxyV2, true
+			break
+		case "no-send-proxy":
+			b.SendProxy, b.OverrideProxy = ProxyNone, true
+			break
+		default:
+			fail("Invalid backend parameter: " + args[i])
+		}
+	}
+	return b
+}
+
+// Parse a listen directive: an address, followed by optional parameters.
+func parseListener(args []string) *Listener {
+	if len(args) < 1 {
+		fail("Invalid listen directive")
+	}
+
+	l := &Listener{ Bind: args[0] }
+	if fd, ok := strings.CutPrefix(l.Bind, "fd://"); ok {
+		if n, err := strconv.Atoi(fd); err != nil || n < 0 {
+			fail("Invalid file descriptor: " + fd)
+		}
+	}
+	for i := 1; i < len(args); i++ {
+		// Returns the argument of the current parameter.
+		arg := func() string {
+			if i + 1 >= len(args) {
+				failf("Missing argument to listen parameter %s", args[i])
+			}
+			i++
+			return args[i]
+		}
+
+		switch args[i] {
+		case "accept-proxy":
+			for _, subnet := range(strings.Split(arg(), ",")) {
+				l.AcceptProxy = append(l.AcceptProxy, parseRange(subnet))
+			}
+			break
+		case "accept-loops":
+			val := arg()
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				fail("Invalid accept-loops value: " + val)
+			}
+			l.AcceptLoops = n
+			break
+		case "trusted":
+			l.Trusted = true
+			break
+		case "non-tls":
+			switch val := arg(); val {
+			case "close":
+				l.NonTLS = NonTLSClose
+				break
+			case "reset":
+				l.NonTLS = NonTLSReset
+				break
+			default:
+				if _, _, err := net.SplitHostPort(val); err != nil {
+					fail("Invalid non-tls value: " + val)
+				}
+				l.NonTLS, l.NonTLSBackend = NonTLSForward, val
+			}
+			break
+		case "skip-bytes":
+			val := arg()
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 || n > MaxSkip {
+				fail("Invalid skip-bytes value: " + val)
+			}
+			l.SkipBytes = n
+			break
+		case "skip-until":
+			delim, err := parseDelimiter(arg())
+			if err != nil {
+				fail("Invalid skip-until value: " + err.Error())
+			}
+			l.SkipUntil = delim
+			break
+		case "skip-forward":
+			l.SkipForward = true
+			break
+		case "idle-timeout":
+			val := arg()
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				fail("Invalid idle-timeout value: " + val)
+			}
+			l.IdleTimeout = d
+			break
+		default:
+			fail("Invalid listen parameter: " + args[i])
+		}
+	}
+	if err := l.checkSkip(); err != nil {
+		fail(err.Error())
+	}
+
+	return l
+}
+
+// Parse the side of the connections an option applies to.
+func parseSide(directive, val string) uint {
+	switch val {
+	case "upstream":
+		return OnUpstream
+	case "client":
+		return OnClient
+	case "both":
+		return OnBoth
+	}
+
+	failf("Invalid %s side: %s", directive, val)
+	return 0
+}
+
+// Parse a DSCP codepoint, given as a number (0 to 63) or a class name (ef,
+// csN, afXY).
+func parseDSCP(val string) int {
+	name := strings.ToLower(val)
+	switch {
+	case name == "ef":
+		return 46
+	case len(name) == 3 && name[:2] == "cs" && name[2] >= '0' && name[2] <= '7':
+		return int(name[2] - '0') * 8
+	case len(name) == 4 && name[:2] == "af" && name[2] >= '1' && name[2] <= '4' &&
+	     name[3] >= '1' && name[3] <= '3':
+		return int(name[2] - '0') * 8 + int(name[3] - '0') * 2
+	}
+
+	dscp, err := strconv.Atoi(val)
+	if err != nil || dscp < 0 || dscp > 63 {
+		fail("Invalid DSCP value: " + val)
+	}
+	return dscp
+}
+
+// Parse a TLS version (1.0 to 1.3).
+func parseTLSVersion(val string) uint16 {
+	switch val {
+	case "1.0":
+		return 0x301
+	case "1.1":
+		return 0x302
+	case "1.2":
+		return 0x303
+	case "1.3":
+		return 0x304
+	}
+
+	fail("Invalid TLS version: " + val)
+	return 0
+}
+
+// Parse a logging level.
+func parseLogLevel(val string) uint {
+	switch val {
+	case "info":
+		return LogInfo
+	case "error":
+		return LogError
+	case "debug":
+		return LogDebug
+	}
+
+	fail("Invalid log level: " + val)
+	return LogInfo
+}
+
+// Parse an ACL tie break value.
+func parseACLTieBreak(val string) uint {
+	switch val {
+	case "deny":
+		return ACLTieBreakDeny
+	case "allow":
+		return ACLTieBreakAllow
+	}
+
+	fail("Invalid ACL tie break: " + val)
+	return ACLTieBreakDeny
+}
+
+// Parse a rate limit, expressed as a number of connections per unit of time
+// (e.g. 10/s, 100/m). The number of connections is also the burst size.
+func parseRateLimit(val string) *RateLimiter {
+	parts := strings.SplitN(val, "/", 2)
+	if len(parts) != 2 {
+		fail("Invalid rate limit: " + val)
+	}
+
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n <= 0 {
+		fail("Invalid rate limit: " + val)
+	}
+
+	var unit time.Duration
+	switch parts[1] {
+	case "s":
+		unit = time.Second
+		break
+	case "m":
+		unit = time.Minute
+		break
+	case "h":
+		unit = time.Hour
+		break
+	default:
+		fail("Invalid rate limit unit: " + val)
+	}
+
+	return newRateLimiter(float64(n) / unit.Seconds(), n)
+}
+
+// Parse a port range (low-high).
+func parsePortRange(val string) *PortRange {
+	low, high, found := strings.Cut(val, "-")
+	if !found {
+		fail("Invalid port range: " + val)
+	}
+
+	l, errL := strconv.ParseUint(low, 10, 16)
+	h, errH := strconv.ParseUint(high, 10, 16)
+	if errL != nil || errH != nil || l == 0 || l > h {
+		fail("Invalid port range: " + val)
+	}
+
+	return &PortRange{ Low: uint16(l), High: uint16(h) }
+}
+
+// Parse a destination: an IP range, a port (e.g. :443) or both (e.g.
+// 10.0.0.1:443, [2001:db8::/32]:443).
+func parseDestination(val string) *Destination {
+	host, port, err := net.SplitHostPort(val)
+	if err != nil {
+		host, port = val, ""
+	}
+
+	d := &Destination{}
+	if port != "" {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || p == 0 {
+			fail("Invalid destination port: " + val)
+		}
+		d.Port = int(p)
+	}
+	if host != "" {
+		if d.Subnet, err = parseSubnet(host); err != nil {
+			fail("Invalid destination: " + val)
+		}
+	}
+	if d.Subnet == nil && d.Port == 0 {
+		fail("Invalid destination: " + val)
+	}
+	return d
 }
 
 // Parse a subnet string.
 func parseRange(subnet string) *net.IPNet {
+	ipnet, err := parseSubnet(subnet)
+	if err != nil {
+		fail(err)
+	}
+	return ipnet
+}
+
+// Parse a subnet string, being either a CIDR range or a single IP.
+func parseSubnet(subnet string) (*net.IPNet, error) {
 	_, ipnet, err := net.ParseCIDR(subnet)
 	if err == nil {
-		return ipnet
+		return ipnet, nil
 	}
 
 	ip := net.ParseIP(subnet)
 	if ip == nil {
-		log.Fatal("Could not parse subnet " + subnet)
+		return nil, fmt.Errorf("Could not parse subnet %s", subnet)
 	}
 
 	// IP is an IPv4 address, its CIDR should be /32.
 	if v4 := ip.To4(); v4 != nil {
-		return &net.IPNet{ IP: ip, Mask: net.CIDRMask(32, 32) }
+		return &net.IPNet{ IP: ip, Mask: net.CIDRMask(32, 32) }, nil
 	}
 
 	// IP is an IPv6 address, its CIDR should be /128.
-	return &net.IPNet{ IP: ip, Mask: net.CIDRMask(128, 128) }
+	return &net.IPNet{ IP: ip, Mask: net.CIDRMask(128, 128) }, nil
 }
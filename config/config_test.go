@@ -0,0 +1,1338 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDomain2Regex(t *testing.T) {
+	tests := []struct {
+		domain string
+		sni    string
+		match  bool
+	}{
+		{ "example.com", "example.com", true },
+		{ "example.com", "www.example.com", false },
+		{ "example.com", "example.com.evil.net", false },
+		{ "example.com", "examplexcom", false },
+		// Single label wildcard.
+		{ "*.example.com", "www.example.com", true },
+		{ "*.example.com", "a.b.example.com", false },
+		{ "*.example.com", "example.com", false },
+		{ "*.example.com", "www.example.com.evil.net", false },
+		{ "api-*.example.com", "api-eu.example.com", true },
+		{ "api-*.example.com", "api-eu.west.example.com", false },
+		{ "*.*.example.com", "a.b.example.com", true },
+		{ "*.*.example.com", "www.example.com", false },
+		// Multiple labels wildcard.
+		{ "**.example.com", "example.com", false },
+		{ "**.example.com", "www.example.com", true },
+		{ "**.example.com", "a.b.example.com", true },
+		{ "**.example.com", "a.b.c.d.example.com", true },
+		{ "**.example.com", "wwwexample.com", false },
+		{ "**.example.com", "www.example.net", false },
+		{ "www.**.example.com", "www.a.b.example.com", true },
+		{ "www.**.example.com", "www.example.com", false },
+		// Regexps.
+		{ "api[0-9]+.example.com", "api42.example.com", true },
+		{ "api[0-9]+.example.com", "api.example.com", false },
+		{ "(www|blog).example.com", "blog.example.com", true },
+		{ "(www|blog).example.com", "mail.example.com", false },
+	}
+
+	for _, test := range(tests) {
+		rgp, err := domain2Regex(test.domain, false)
+		if err != nil {
+			t.Errorf("%s: %s", test.domain, err)
+			continue
+		}
+		if rgp.MatchString(test.sni) != test.match {
+			t.Errorf("%s: wrong result for %s (wanted %t)", test.domain, test.sni, test.match)
+		}
+	}
+}
+
+func TestWarnWildcard(t *testing.T) {
+	tests := []struct {
+		domains string
+		warn    bool
+	}{
+		{ "example.net", false },
+		{ "**.example.net", false },
+		{ "www.**.example.net", false },
+		{ "*.example.net", true },
+		{ "www*.example.net", true },
+		{ "example.org, *.example.net", true },
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	for _, test := range(tests) {
+		logs.Reset()
+		var c Config
+		if err := c.Parse([]byte(test.domains + " {\n\tbackend 1.2.3.4:443\n}\n")); err != nil {
+			t.Fatalf("%s: %s", test.domains, err)
+		}
+		if warn := strings.Contains(logs.String(), "only matches a single label"); warn != test.warn {
+			t.Errorf("%s: got warning %t, wanted %t (%q)", test.domains, warn, test.warn, logs.String())
+		}
+	}
+}
+
+func TestParseDomainCase(t *testing.T) {
+	route := "Example.net, *.example.ORG {\n\tbackend 1.2.3.4:443\n}\n"
+	tests := []struct {
+		policy string
+		sni    string
+		match  bool
+	}{
+		{ "", "example.net", true },
+		{ "", "EXAMPLE.NET", true },
+		{ "", "www.Example.Org", true },
+		{ "domain-case insensitive\n", "eXaMpLe.NeT", true },
+		{ "domain-case sensitive\n", "Example.net", true },
+		{ "domain-case sensitive\n", "example.net", false },
+		{ "domain-case sensitive\n", "www.example.org", false },
+	}
+
+	for _, test := range(tests) {
+		var c Config
+		if err := c.Parse([]byte(test.policy + route)); err != nil {
+			t.Fatalf("%q: %s", test.policy, err)
+		}
+		r := c.Routes[0]
+		if match := r.Domains[0].MatchString(test.sni) || r.Domains[1].MatchString(test.sni); match != test.match {
+			t.Errorf("%q: wrong result for %s (wanted %t)", test.policy, test.sni, test.match)
+		}
+		// The domains are still reported as written.
+		if name := DomainName(r.Domains[1]); name != "*.example.ORG" {
+			t.Errorf("%q: got domain %q", test.policy, name)
+		}
+	}
+
+	var c Config
+	if err := c.Parse([]byte("domain-case lower\n" + route)); err == nil {
+		t.Error("invalid domain-case value parsed")
+	}
+}
+
+func TestRejectAction(t *testing.T) {
+	var c Config
+	l := newLexer(strings.NewReader(`
+no-match-action close
+alert denied handshake_failure
+alert rate-limited certificate_unknown
+alert maintenance access_denied
+
+example.net {
+	backend 127.0.0.1:443
+}
+
+maintenance.example.net {
+	backend 127.0.0.1:443
+	maintenance
+}
+
+close.example.net {
+	backend 127.0.0.1:443
+	maintenance close
+	deny-action reset
+}
+`))
+	c.parse(newBlock(&l))
+
+	tests := []struct {
+		cause  string
+		action int
+	}{
+		{ "no-route", ActionClose },
+		{ "no-sni", ActionClose },
+		{ "denied", Alerts["handshake_failure"] },
+		{ "not-tls", Alerts["internal_error"] },
+		{ "no-data", ActionClose },
+	}
+	for _, test := range(tests) {
+		if action := c.RejectAction(test.cause); action != test.action {
+			t.Errorf("%s: got action %d, wanted %d", test.cause, action, test.action)
+		}
+	}
+
+	// Routes use the global rate limit action, unless they set one.
+	if action := c.Routes[0].RateLimitAction; action != Alerts["certificate_unknown"] {
+		t.Errorf("wrong route rate limit action %d", action)
+	}
+
+	// Same for the maintenance action.
+	if c.Routes[0].Maintenance {
+		t.Error("route in maintenance by default")
+	}
+	if r := c.Routes[1]; !r.Maintenance || r.MaintenanceAction != Alerts["access_denied"] {
+		t.Errorf("wrong maintenance %t, action %d", r.Maintenance, r.MaintenanceAction)
+	}
+	if r := c.Routes[2]; !r.Maintenance || r.MaintenanceAction != ActionClose {
+		t.Errorf("wrong maintenance %t, action %d", r.Maintenance, r.MaintenanceAction)
+	}
+
+	// And for the deny action.
+	if action := c.Routes[0].DenyAction; action != Alerts["handshake_failure"] {
+		t.Errorf("wrong route deny action %d", action)
+	}
+	if action := c.Routes[2].DenyAction; action != ActionReset {
+		t.Errorf("wrong route deny action %d", action)
+	}
+
+	// close_notify is no rejection, and would mean the default action.
+	for _, conf := range []string{
+		"alert denied close_notify\n",
+		"example.net {\n\tbackend 127.0.0.1:443\n\tdeny-action close_notify\n}\n",
+	} {
+		var c Config
+		if err := c.Parse([]byte(conf)); err == nil {
+			t.Errorf("%q: parsed", conf)
+		}
+	}
+}
+
+func TestAcquireSlot(t *testing.T) {
+	backend := &Backend{ Address: "127.0.0.1:443" }
+
+	// No limit.
+	r := &Route{}
+	if _, err := r.AcquireSlot(context.Background(), backend); err != nil {
+		t.Fatalf("unlimited route: %s", err)
+	}
+
+	// At capacity, without a queue.
+	r = &Route{ MaxConns: 1 }
+	release, err := r.AcquireSlot(context.Background(), backend)
+	if err != nil {
+		t.Fatalf("first slot: %s", err)
+	}
+	if _, err := r.AcquireSlot(context.Background(), backend); err != ErrBackendFull {
+		t.Errorf("full backend: got %v, wanted %v", err, ErrBackendFull)
+	}
+	// Slots are per backend.
+	if _, err := r.AcquireSlot(context.Background(), &Backend{ Address: "127.0.0.2:443" }); err != nil {
+		t.Errorf("other backend: %s", err)
+	}
+	// Releasing twice frees a single slot.
+	release()
+	release()
+	if _, err := r.AcquireSlot(context.Background(), backend); err != nil {
+		t.Errorf("released slot: %s", err)
+	}
+
+	// Queued connections get a slot once released, or time out.
+	r = &Route{ MaxConns: 1, QueueDepth: 1, QueueWait: 50*time.Millisecond }
+	release, _ = r.AcquireSlot(context.Background(), backend)
+	time.AfterFunc(10*time.Millisecond, release)
+	if _, err := r.AcquireSlot(context.Background(), backend); err != nil {
+		t.Errorf("queued connection: %s", err)
+	}
+	if _, err := r.AcquireSlot(context.Background(), backend); err != ErrBackendFull {
+		t.Errorf("queue wait: got %v, wanted %v", err, ErrBackendFull)
+	}
+
+	// The queue depth is bounded.
+	done := make(chan struct{})
+	go func() {
+		r.AcquireSlot(context.Background(), backend)
+		close(done)
+	}()
+	time.Sleep(10*time.Millisecond)
+	if _, err := r.AcquireSlot(context.Background(), backend); err != ErrQueueFull {
+		t.Errorf("full queue: got %v, wanted %v", err, ErrQueueFull)
+	}
+	<-done
+
+	// The context bounds the wait.
+	r = &Route{ MaxConns: 1, QueueDepth: 1, QueueWait: time.Second }
+	r.AcquireSlot(context.Background(), backend)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := r.AcquireSlot(ctx, backend); err != context.DeadlineExceeded {
+		t.Errorf("context deadline: got %v, wanted %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestParseDSCP(t *testing.T) {
+	tests := []struct {
+		val  string
+		dscp int
+		ok   bool
+	}{
+		{ "0", 0, true },
+		{ "63", 63, true },
+		{ "EF", 46, true },
+		{ "cs1", 8, true },
+		{ "af41", 34, true },
+		{ "64", 0, false },
+		{ "-1", 0, false },
+		{ "af44", 0, false },
+		{ "cs8", 0, false },
+	}
+
+	for _, test := range(tests) {
+		var dscp int
+		ok := func() (ok bool) {
+			defer func() {
+				ok = recover() == nil
+			}()
+			dscp = parseDSCP(test.val)
+			return
+		}()
+		if ok != test.ok || dscp != test.dscp {
+			t.Errorf("%s: got %d (valid %v)", test.val, dscp, ok)
+		}
+	}
+}
+
+func TestParseDestination(t *testing.T) {
+	tests := []struct {
+		val    string
+		subnet string
+		port   int
+	}{
+		{ "192.0.2.1", "192.0.2.1/32", 0 },
+		{ "192.0.2.0/24", "192.0.2.0/24", 0 },
+		{ "192.0.2.1:443", "192.0.2.1/32", 443 },
+		{ "192.0.2.0/24:443", "192.0.2.0/24", 443 },
+		{ ":8443", "", 8443 },
+		{ "2001:db8::1", "2001:db8::1/128", 0 },
+		{ "[2001:db8::/32]:443", "2001:db8::/32", 443 },
+	}
+
+	for _, test := range(tests) {
+		d := parseDestination(test.val)
+		subnet := ""
+		if d.Subnet != nil {
+			subnet = d.Subnet.String()
+		}
+		if subnet != test.subnet || d.Port != test.port {
+			t.Errorf("%s: got %s port %d, wanted %s port %d", test.val, subnet, d.Port, test.subnet, test.port)
+		}
+	}
+}
+
+func TestPickWeightedRoundRobin(t *testing.T) {
+	r := &Route{
+		Balance: BalanceWeightedRoundRobin,
+		Backends: []*Backend{
+			{ Address: "a", Weight: 5 },
+			{ Address: "b", Weight: 1 },
+			{ Address: "c", Weight: 1 },
+		},
+	}
+
+	// Sequence produced by nginx for these weights, repeated.
+	want := "aabacaa" + "aabacaa"
+	got := ""
+	for i := 0; i < len(want); i++ {
+		got += r.PickBackend("").Address
+	}
+	if got != want {
+		t.Errorf("got sequence %s, wanted %s", got, want)
+	}
+
+	// Backends with no weight are skipped.
+	r.Backends = []*Backend{ { Address: "a", Weight: 0 }, { Address: "b", Weight: 2 } }
+	for i := 0; i < 4; i++ {
+		if b := r.PickBackend(""); b.Address != "b" {
+			t.Errorf("pick %d: got backend %s", i, b.Address)
+		}
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	a, b := &Backend{ Address: "a" }, &Backend{ Address: "b" }
+	r := &Route{ Backends: []*Backend{ a, b }, SlowStart: time.Minute }
+
+	share := func() float64 {
+		var n int
+		for i := 0; i < 2000; i++ {
+			if r.PickBackend("") == a {
+				n++
+			}
+		}
+		return float64(n) / 2000
+	}
+
+	// Backends never marked down get their full share.
+	r.MarkUp(a)
+	if got := share(); got != 0.5 {
+		t.Errorf("healthy backend: got share %.2f", got)
+	}
+
+	// Half way through the ramp, the backend gets half its share.
+	r.MarkDown(a)
+	r.MarkUp(a)
+	r.backendHealth("a").recovered = time.Now().Add(-30*time.Second)
+	if got := share(); got < 0.15 || got > 0.35 {
+		t.Errorf("half way: got share %.2f", got)
+	}
+
+	// The ramp completes after the slow start period.
+	r.backendHealth("a").recovered = time.Now().Add(-time.Minute)
+	if got := share(); got != 0.5 {
+		t.Errorf("ramp completed: got share %.2f", got)
+	}
+}
+
+func TestPickBackendHealthCheck(t *testing.T) {
+	a, b, c := &Backend{ Address: "a" }, &Backend{ Address: "b" }, &Backend{ Address: "c" }
+	r := &Route{ Backends: []*Backend{ a, b, c }, HealthCheck: time.Second }
+
+	picked := func() map[string]bool {
+		seen := make(map[string]bool)
+		for i := 0; i < 30; i++ {
+			seen[r.PickBackend("").Address] = true
+		}
+		return seen
+	}
+
+	// Backends down are skipped.
+	r.MarkDown(b)
+	if seen := picked(); len(seen) != 2 || seen["b"] {
+		t.Errorf("b down: picked %v", seen)
+	}
+
+	// All backends are used when none is up.
+	r.MarkDown(a)
+	r.MarkDown(c)
+	if seen := picked(); len(seen) != 3 {
+		t.Errorf("all down: picked %v", seen)
+	}
+
+	r.MarkUp(a)
+	if seen := picked(); len(seen) != 1 || !seen["a"] {
+		t.Errorf("a up: picked %v", seen)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	valid := "example.net {\n\tbackend 127.0.0.1:443\n}\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/valid":
+			w.Write([]byte(valid))
+			break
+		case "/invalid":
+			w.Write([]byte("example.net {\n\tbalance unknown\n}\n"))
+			break
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "sniproxy.conf")
+	if err := os.WriteFile(file, []byte(valid), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source string
+		ok     bool
+	}{
+		{ file, true },
+		{ file + ".missing", false },
+		{ srv.URL + "/valid", true },
+		{ srv.URL + "/missing", false },
+		// Invalid configurations are reported, not fatal.
+		{ srv.URL + "/invalid", false },
+	}
+
+	for _, test := range(tests) {
+		var c Config
+		err := c.Load(test.source)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error '%v'", test.source, err)
+		}
+		if err == nil && len(c.Routes) != 1 {
+			t.Errorf("%s: got %d routes", test.source, len(c.Routes))
+		}
+	}
+}
+
+func TestValidateDuplicateDomains(t *testing.T) {
+	routes := "web.example.com {\n\tbackend 1.2.3.4:443\n}\n" +
+		  "example.net, *.example.net {\n\tname a\n\tbackend 1.2.3.4:443\n}\n" +
+		  "*.example.net, example.org {\n\tname b\n\tbackend 1.2.3.5:443\n}\n"
+
+	tests := []struct {
+		policy string
+		ok     bool
+	}{
+		{ "", true },
+		{ "duplicate-domains warn\n", true },
+		{ "duplicate-domains error\n", false },
+	}
+
+	for _, test := range(tests) {
+		var c Config
+		err := c.Parse([]byte(test.policy + routes))
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error '%v'", test.policy, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "*.example.net is listed by routes #2 (a) and #3 (b)") {
+			t.Errorf("%q: unclear error '%v'", test.policy, err)
+		}
+	}
+
+	// The same domain listed twice by a route is not reported.
+	var c Config
+	if err := c.Parse([]byte("duplicate-domains error\nexample.net, example.net {\n\tbackend 1.2.3.4:443\n}\n")); err != nil {
+		t.Error(err)
+	}
+
+	// Nor the domains of routes restricted to client networks.
+	c = Config{}
+	if err := c.Parse([]byte("duplicate-domains error\n" + routes +
+				 "example.net {\n\tbackend 1.2.3.6:443\n\tclients 10.0.0.0/8\n}\n")); err == nil {
+		t.Error("duplicate domains of unrestricted routes not reported")
+	}
+	c = Config{}
+	if err := c.Parse([]byte("duplicate-domains error\nexample.net {\n\tbackend 1.2.3.4:443\n}\n" +
+				 "example.net {\n\tbackend 1.2.3.6:443\n\tclients 10.0.0.0/8, 2001:db8::/32\n}\n")); err != nil {
+		t.Error(err)
+	}
+	if n := len(c.Routes[1].Clients); n != 2 {
+		t.Errorf("got %d client networks, wanted 2", n)
+	}
+}
+
+func TestRewriteSNIStripPort(t *testing.T) {
+	c := &Config{ StripSNIPort: true }
+	tests := []struct {
+		sni  string
+		name string
+	}{
+		{ "example.net", "example.net" },
+		{ "example.net:8443", "example.net" },
+		{ "example.net:", "example.net:" },
+		{ "example.net:https", "example.net:https" },
+		{ "[2001:db8::1]:8443", "[2001:db8::1]" },
+		{ "[2001:db8::1]", "[2001:db8::1]" },
+		{ "2001:db8::1", "2001:db8::1" },
+		{ "", "" },
+	}
+
+	for _, test := range(tests) {
+		if name := c.RewriteSNI(test.sni); name != test.name {
+			t.Errorf("%q: got %q, wanted %q", test.sni, name, test.name)
+		}
+	}
+
+	// Not stripped by default.
+	if name := (&Config{}).RewriteSNI("example.net:8443"); name != "example.net:8443" {
+		t.Errorf("port stripped by default: got %q", name)
+	}
+}
+
+func TestParseKeepAlive(t *testing.T) {
+	tests := []struct {
+		args     string
+		period   time.Duration
+		interval time.Duration
+		count    int
+		ok       bool
+	}{
+		{ "30s", 30*time.Second, 0, 0, true },
+		{ "30s 5s", 30*time.Second, 5*time.Second, 0, true },
+		{ "30s 5s 3", 30*time.Second, 5*time.Second, 3, true },
+		{ "off", 0, 0, 0, true },
+		{ "off 5s", 0, 0, 0, false },
+		{ "30s 5s 0", 0, 0, 0, false },
+		{ "30s 5s 3 1", 0, 0, 0, false },
+	}
+
+	for _, test := range(tests) {
+		var c Config
+		err := c.Parse([]byte("example.net {\n\tbackend 1.2.3.4:443\n\tkeepalive " + test.args + "\n}\n"))
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error '%v'", test.args, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		route := c.Routes[0]
+		if route.KeepAlive != test.period || route.KeepAliveInterval != test.interval ||
+		   route.KeepAliveCount != test.count {
+			t.Errorf("%q: got %s %s %d", test.args, route.KeepAlive, route.KeepAliveInterval,
+				 route.KeepAliveCount)
+		}
+	}
+}
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		conf string
+		ok   bool
+	}{
+		{ "**.example.net {\n\tbackend sni:443\n\tforward-allow **.example.net\n\tforward-deny internal.example.net\n}\n", true },
+		{ "** {\n\tbackend sni:0\n}\n", false },
+		{ "** {\n\tbackend sni:443, 1.2.3.4:443\n}\n", false },
+		{ "** {\n\tbackend 1.2.3.4:443\n\tforward-allow example.net\n}\n", false },
+	}
+
+	for _, test := range(tests) {
+		var c Config
+		err := c.Parse([]byte(test.conf))
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error '%v'", test.conf, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		route := c.Routes[0]
+		if !route.Forwards() || route.Backends[0].SNIPort != 443 {
+			t.Errorf("%q: route does not forward on port 443", test.conf)
+		}
+		for sni, want := range map[string]bool{
+			"www.example.net": true,
+			"internal.example.net": false,
+			"example.org": false,
+		} {
+			if got := route.ForwardAllowed(sni); got != want {
+				t.Errorf("%s: got allowed %v, wanted %v", sni, got, want)
+			}
+		}
+	}
+}
+
+func TestParseLogFormat(t *testing.T) {
+	tests := []struct {
+		conf string
+		out  string
+		ok   bool
+	}{
+		{ `log-format %{client_ip} - - [%{clf_time}] \"%{sni}\" %{bytes_received}`,
+		  `<client_ip> - - [<clf_time>] "<sni>" <bytes_received>`, true },
+		{ `log-format %{date}\t%{time}\t%{outcome}`, "<date>\t<time>\t<outcome>", true },
+		{ `log-format 100%% %{sni}`, `100% <sni>`, true },
+		{ `log-format %{unknown}`, "", false },
+		{ `log-format %{sni`, "", false },
+		{ `log-format 100%`, "", false },
+		{ `log-format \n`, "", false },
+		{ `log-format`, "", false },
+		{ `log-format json`, "json", true },
+		{ `log-format json %{sni}`, "json <sni>", true },
+	}
+
+	for _, test := range(tests) {
+		c := &Config{}
+		err := c.Parse([]byte(test.conf + "\nexample.net {\n\tbackend 1.2.3.4:443\n}\n"))
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error '%v'", test.conf, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		// Fields are shown as <field>, and JSON records as json.
+		var out string
+		if c.LogJSON {
+			out = "json"
+		}
+		for _, part := range c.LogFormat {
+			if part.Field != "" {
+				out += "<" + part.Field + ">"
+			} else {
+				out += part.Literal
+			}
+		}
+		if out != test.out {
+			t.Errorf("%q: got %q, wanted %q", test.conf, out, test.out)
+		}
+	}
+}
+
+func TestLookupBackend(t *testing.T) {
+	var lookups atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		switch r.URL.Query().Get("sni") {
+		case "a.example.net":
+			w.Write([]byte("10.0.0.1:443\n"))
+			break
+		case "invalid.example.net":
+			w.Write([]byte("10.0.0.1"))
+			break
+		case "broken.example.net":
+			http.Error(w, "broken", http.StatusInternalServerError)
+			break
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	var c Config
+	if err := c.Parse([]byte("*.example.net {\n\tbackend-lookup " + srv.URL + "/lookup?tenant=x 1h\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+	route := c.Routes[0]
+	if route.LookupTTL != time.Hour {
+		t.Errorf("got TTL %s", route.LookupTTL)
+	}
+
+	tests := []struct {
+		sni     string
+		backend string
+		ok      bool
+		lookups int64
+	}{
+		{ "a.example.net", "10.0.0.1:443", true, 1 },
+		// Answers are cached, including the lack of backend.
+		{ "a.example.net", "10.0.0.1:443", true, 1 },
+		{ "b.example.net", "", true, 2 },
+		{ "b.example.net", "", true, 2 },
+		// Errors are not.
+		{ "invalid.example.net", "", false, 3 },
+		{ "broken.example.net", "", false, 4 },
+		{ "broken.example.net", "", false, 5 },
+	}
+	for _, test := range(tests) {
+		backend, err := route.LookupBackend(context.Background(), test.sni)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error '%v'", test.sni, err)
+		}
+		var addr string
+		if backend != nil {
+			addr = backend.Address
+		}
+		if addr != test.backend {
+			t.Errorf("%s: got backend %q, wanted %q", test.sni, addr, test.backend)
+		}
+		if n := lookups.Load(); n != test.lookups {
+			t.Errorf("%s: got %d lookups, wanted %d", test.sni, n, test.lookups)
+		}
+	}
+
+	for _, conf := range []string{
+		"example.net {\n\tbackend-lookup ftp://lookup.example.net\n}\n",
+		"example.net {\n\tbackend-lookup http://lookup.example.net 0s\n}\n",
+		"example.net {\n\tbackend sni:443\n\tbackend-lookup http://lookup.example.net\n}\n",
+	} {
+		var c Config
+		if err := c.Parse([]byte(conf)); err == nil {
+			t.Errorf("%q: parsed", conf)
+		}
+	}
+}
+
+func TestParseSkip(t *testing.T) {
+	tests := []struct {
+		listen  string
+		bytes   int
+		until   string
+		forward bool
+		ok      bool
+	}{
+		{ "listen :443 skip-bytes 4", 4, "", false, true },
+		{ `listen :443 skip-until \r\n skip-forward`, 0, "\r\n", true, true },
+		{ `listen :443 skip-until \x00end`, 0, "\x00end", false, true },
+		{ "listen :443 skip-bytes 0", 0, "", false, false },
+		{ "listen :443 skip-bytes 5000", 0, "", false, false },
+		{ `listen :443 skip-until \q`, 0, "", false, false },
+		{ `listen :443 skip-until \x0`, 0, "", false, false },
+		{ `listen :443 skip-bytes 4 skip-until \n`, 0, "", false, false },
+		{ "listen :443 skip-forward", 0, "", false, false },
+	}
+
+	for _, test := range(tests) {
+		var c Config
+		err := c.Parse([]byte(test.listen + "\nexample.net {\n\tbackend 1.2.3.4:443\n}\n"))
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error '%v'", test.listen, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		l := c.Listeners[0]
+		if l.SkipBytes != test.bytes || string(l.SkipUntil) != test.until || l.SkipForward != test.forward {
+			t.Errorf("%q: got %d, %q, %v", test.listen, l.SkipBytes, l.SkipUntil, l.SkipForward)
+		}
+	}
+}
+
+func TestParseTracing(t *testing.T) {
+	tests := []struct {
+		conf    string
+		tracing string
+		ok      bool
+	}{
+		{ "", "", true },
+		{ "tracing http://collector:4318/v1/traces", "http://collector:4318/v1/traces", true },
+		{ "tracing collector:4318", "", false },
+		{ "tracing", "", false },
+	}
+
+	for _, test := range(tests) {
+		var c Config
+		err := c.Parse([]byte(test.conf + "\nexample.net {\n\tbackend 1.2.3.4:443\n}\n"))
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error '%v'", test.conf, err)
+			continue
+		}
+		if err == nil && c.Tracing != test.tracing {
+			t.Errorf("%q: got endpoint %q", test.conf, c.Tracing)
+		}
+	}
+}
+
+func TestParseReaper(t *testing.T) {
+	tests := []struct {
+		conf     string
+		idle     time.Duration
+		interval time.Duration
+		ok       bool
+	}{
+		{ "listen :443", 0, 0, true },
+		{ "listen :443 idle-timeout 5m", 5*time.Minute, 0, true },
+		{ "listen :443 idle-timeout 5m\nreap-interval 30s", 5*time.Minute, 30*time.Second, true },
+		{ "listen :443 idle-timeout 0", 0, 0, false },
+		{ "listen :443 idle-timeout", 0, 0, false },
+		{ "listen :443\nreap-interval 0s", 0, 0, false },
+		{ "listen :443\nreap-interval forever", 0, 0, false },
+	}
+
+	for _, test := range(tests) {
+		var c Config
+		err := c.Parse([]byte(test.conf + "\nexample.net {\n\tbackend 1.2.3.4:443\n}\n"))
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error '%v'", test.conf, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if c.Listeners[0].IdleTimeout != test.idle || c.ReapInterval != test.interval {
+			t.Errorf("%q: got %s, %s", test.conf, c.Listeners[0].IdleTimeout, c.ReapInterval)
+		}
+	}
+}
+
+func TestParseBackoff(t *testing.T) {
+	route := "example.net {\n\tbackend 1.2.3.4:443\n\treplay-retries 2\n\t%s\n}\n"
+	tests := []struct {
+		conf   string
+		base   time.Duration
+		max    time.Duration
+		jitter uint
+		ok     bool
+	}{
+		{ fmt.Sprintf(route, "retry-backoff 50ms"), 50*time.Millisecond, 500*time.Millisecond, JitterFull, true },
+		{ fmt.Sprintf(route, "retry-backoff 50ms 2s"), 50*time.Millisecond, 2*time.Second, JitterFull, true },
+		{ "backoff-jitter decorrelated\n" + fmt.Sprintf(route, ""), 0, 0, JitterDecorrelated, true },
+		{ "backoff-jitter none\n" + fmt.Sprintf(route, ""), 0, 0, JitterNone, true },
+		{ "backoff-jitter equal\n" + fmt.Sprintf(route, ""), 0, 0, 0, false },
+		{ fmt.Sprintf(route, "retry-backoff 50ms 10ms"), 0, 0, 0, false },
+		{ fmt.Sprintf(route, "retry-backoff 0s"), 0, 0, 0, false },
+		{ "example.net {\n\tbackend 1.2.3.4:443\n\tretry-backoff 50ms\n}\n", 0, 0, 0, false },
+	}
+
+	for _, test := range(tests) {
+		var c Config
+		err := c.Parse([]byte(test.conf))
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error '%v'", test.conf, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		route := c.Routes[0]
+		if route.RetryBackoff != test.base || route.RetryBackoffMax != test.max || c.BackoffJitter != test.jitter {
+			t.Errorf("%q: got %s %s %d", test.conf, route.RetryBackoff, route.RetryBackoffMax, c.BackoffJitter)
+		}
+	}
+}
+
+func TestParseCipherPolicy(t *testing.T) {
+	tests := []struct {
+		val     string
+		allowed []uint16
+		denied  []uint16
+		ok      bool
+	}{
+		{ "aead", []uint16{ 0x1301, 0xc02f, 0xcca9 }, []uint16{ 0xc013, 0x002f, 0x000a }, true },
+		{ "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,0x002f", []uint16{ 0xc013, 0x002f }, []uint16{ 0x1301 }, true },
+		{ "aead,0x000a", []uint16{ 0x1302, 0x000a }, []uint16{ 0xc013 }, true },
+		{ "rc4", nil, nil, false },
+		{ "47", nil, nil, false },
+		{ "0x10000", nil, nil, false },
+	}
+
+	for _, test := range(tests) {
+		p, err := parseCipherPolicy(test.val)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error '%v'", test.val, err)
+			continue
+		}
+		for _, id := range test.allowed {
+			if !p.Allows([]uint16{ 0x0a0a, id }) {
+				t.Errorf("%q: %#04x not allowed", test.val, id)
+			}
+		}
+		for _, id := range test.denied {
+			if p.Allows([]uint16{ 0x0a0a, id }) {
+				t.Errorf("%q: %#04x allowed", test.val, id)
+			}
+		}
+	}
+}
+
+// Waits for a condition to be met, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(10*time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+// Returns the addresses and weights of the backends of a route.
+func backendsString(r *Route) string {
+	var backends []string
+	for _, b := range r.CurrentBackends() {
+		backends = append(backends, fmt.Sprintf("%s/%d", b.Address, b.Weight))
+	}
+	return strings.Join(backends, ",")
+}
+
+// Fake discovery service state: its revision, the backends it returns and
+// a channel closed on each change.
+type fakeDiscovery struct {
+	mu       sync.Mutex
+	version  int
+	backends []string
+	changed  chan struct{}
+}
+
+func newFakeDiscovery(backends ...string) *fakeDiscovery {
+	return &fakeDiscovery{ version: 1, backends: backends, changed: make(chan struct{}) }
+}
+
+func (f *fakeDiscovery) get() (int, []string, chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.version, f.backends, f.changed
+}
+
+func (f *fakeDiscovery) set(backends ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.version++
+	f.backends = backends
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func TestConsulDiscovery(t *testing.T) {
+	// Backends are given as "node address/service address:port/weight".
+	fake := newFakeDiscovery("10.0.0.1/:443/1")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/v1/health/service/web" || q.Get("passing") != "true" || q.Get("tag") != "v2" ||
+		   r.Header.Get("X-Consul-Token") != "secret" {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Blocking query, until the index changes.
+		version, backends, changed := fake.get()
+		if q.Get("index") == strconv.Itoa(version) {
+			select {
+			case <-changed:
+				version, backends, _ = fake.get()
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		var entries []string
+		for _, b := range backends {
+			f := strings.Split(b, "/")
+			host, port, _ := net.SplitHostPort(f[1])
+			entries = append(entries, fmt.Sprintf(`{"Node":{"Address":"%s"},"Service":{"Address":"%s","Port":%s,"Weights":{"Passing":%s}}}`,
+							      f[0], host, port, f[2]))
+		}
+		w.Header().Set("X-Consul-Index", strconv.Itoa(version))
+		fmt.Fprintf(w, "[%s]", strings.Join(entries, ","))
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	var c Config
+	if err := c.Parse([]byte("example.net {\n\tbackend consul://:secret@" + host + "/web?tag=v2\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := c.Routes[0]
+	if label := r.Label(); strings.Contains(label, "secret") {
+		t.Errorf("token not redacted from the route label: %s", label)
+	}
+
+	waitFor(t, "the first backend", func() bool { return backendsString(r) == "10.0.0.1:443/1" })
+	first := r.CurrentBackends()[0]
+
+	// The service address is used when set, and the known backends kept.
+	fake.set("10.0.0.1/:443/1", "10.0.0.2/10.0.0.9:443/3")
+	waitFor(t, "the second backend", func() bool { return backendsString(r) == "10.0.0.1:443/1,10.0.0.9:443/3" })
+	if r.CurrentBackends()[0] != first {
+		t.Error("backend replaced when updating the backends")
+	}
+
+	// The last known backends are kept when Consul can't be reached.
+	srv.CloseClientConnections()
+	srv.Close()
+	time.Sleep(50*time.Millisecond)
+	if got := backendsString(r); got != "10.0.0.1:443/1,10.0.0.9:443/3" {
+		t.Errorf("got backends %s once disconnected", got)
+	}
+}
+
+func TestEtcdDiscovery(t *testing.T) {
+	fake := newFakeDiscovery("10.0.0.1:443")
+	prefix := base64.StdEncoding.EncodeToString([]byte("/services/web/"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Key      string
+			RangeEnd string `json:"range_end"`
+			Create   struct {
+				Key string
+			} `json:"create_request"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		version, backends, changed := fake.get()
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			if req.Key != prefix || req.RangeEnd != base64.StdEncoding.EncodeToString([]byte("/services/web0")) {
+				http.NotFound(w, r)
+				return
+			}
+			var kvs []string
+			for i, b := range backends {
+				key := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("/services/web/%d", i)))
+				kvs = append(kvs, fmt.Sprintf(`{"key":"%s","value":"%s"}`, key, base64.StdEncoding.EncodeToString([]byte(b))))
+			}
+			fmt.Fprintf(w, `{"header":{"revision":"%d"},"kvs":[%s]}`, version, strings.Join(kvs, ","))
+			break
+		case "/v3/watch":
+			if req.Create.Key != prefix {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintln(w, `{"result":{"header":{},"created":true}}`)
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case <-changed:
+					_, _, changed = fake.get()
+					fmt.Fprintln(w, `{"result":{"header":{},"events":[{"type":"PUT"}]}}`)
+					w.(http.Flusher).Flush()
+				case <-r.Context().Done():
+					return
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	var c Config
+	if err := c.Parse([]byte("example.net {\n\tbackend etcd://" + host + "/services/web/\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := c.Routes[0]
+
+	waitFor(t, "the first backend", func() bool { return backendsString(r) == "10.0.0.1:443/1" })
+
+	// Invalid values are ignored.
+	fake.set("10.0.0.1:443", "10.0.0.2:443 5", "invalid")
+	waitFor(t, "the second backend", func() bool { return backendsString(r) == "10.0.0.1:443/1,10.0.0.2:443/5" })
+
+	srv.CloseClientConnections()
+	srv.Close()
+	time.Sleep(50*time.Millisecond)
+	if got := backendsString(r); got != "10.0.0.1:443/1,10.0.0.2:443/5" {
+		t.Errorf("got backends %s once disconnected", got)
+	}
+}
+
+func TestParseDiscovery(t *testing.T) {
+	for _, backends := range []string{
+		"backend consul://127.0.0.1:1/web,10.0.0.1:443",
+		"backend etcd://127.0.0.1:1/web\n\tbackend 10.0.0.1:443",
+		"backend consul://127.0.0.1:1/web,etcd://127.0.0.1:1/web",
+		"backend consul://127.0.0.1:1/web\n\tbackend-lookup http://127.0.0.1:1/",
+		"backend consul://127.0.0.1:1/web send-proxy-v2",
+		"backend consul://127.0.0.1:1/",
+		"backend etcd:///web",
+	} {
+		var c Config
+		if err := c.Parse([]byte("example.net {\n\t" + backends + "\n}\n")); err == nil {
+			c.Close()
+			t.Errorf("%q: parsed", backends)
+		}
+	}
+}
+
+func TestDomainList(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "domains")
+	if err := os.WriteFile(file, []byte("# blocked\nexample.net\n*.Example.ORG  # wildcard\n\n.trailing.com.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := newDomainList(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	tests := []struct {
+		domain string
+		match  bool
+	}{
+		{ "example.net", true },
+		{ "www.example.net", true },
+		{ "a.b.example.net", true },
+		{ "WWW.Example.Net.", true },
+		{ "example.org", true },
+		{ "www.example.org", true },
+		{ "trailing.com", true },
+		{ "notexample.net", false },
+		{ "example.net.evil.com", false },
+		{ "net", false },
+		{ "blocked", false },
+	}
+	for _, test := range(tests) {
+		if match := l.Match(test.domain); match != test.match {
+			t.Errorf("%s: got %t, wanted %t", test.domain, match, test.match)
+		}
+	}
+
+	// Case-sensitive lists, from domain-case.
+	var c Config
+	if err := c.Parse([]byte("domain-case sensitive\n\nexample.net {\n\tdomains-file " + file +
+				 "\n\tbackend 1.2.3.4:443\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sensitive := c.Routes[0].DomainLists[0]
+	for _, test := range []struct {
+		domain string
+		match  bool
+	}{
+		{ "www.example.net", true },
+		{ "WWW.Example.Net.", false },
+		{ "www.Example.ORG", true },
+		{ "www.example.org", false },
+	} {
+		if match := sensitive.Match(test.domain); match != test.match {
+			t.Errorf("case sensitive, %s: got %t, wanted %t", test.domain, match, test.match)
+		}
+	}
+
+	if _, err := newDomainList(filepath.Join(t.TempDir(), "missing"), false); err == nil {
+		t.Error("missing domain list loaded")
+	}
+}
+
+func TestDomainListRefresh(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "domains")
+	write := func(content string, mod time.Time) {
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write("example.net\n", now)
+
+	l, err := newDomainList(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// Not reloaded while the file is not modified.
+	write("example.org\n", now)
+	l.refresh()
+	if !l.Match("example.net") || l.Match("example.org") {
+		t.Error("domain list reloaded while not modified")
+	}
+
+	write("example.org\n", now.Add(time.Second))
+	l.refresh()
+	if l.Match("example.net") || !l.Match("example.org") {
+		t.Error("domain list not reloaded once modified")
+	}
+
+	// The list is kept when the file can't be read.
+	os.Remove(file)
+	l.refresh()
+	if !l.Match("example.org") {
+		t.Error("domain list dropped once removed")
+	}
+
+	// Closing a list not watched, e.g. twice, does not block.
+	l.Close()
+	(&DomainList{}).Close()
+}
+
+func TestSubnetList(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "subnets")
+	content := "# drop list\n10.0.0.0/8 ; SBL1\n192.168.1.1\n2001:db8::/32\n\ninvalid\n300.0.0.0/8\n"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := newSubnetList(file, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if n := len(l.Subnets()); n != 3 {
+		t.Errorf("got %d subnets, wanted 3", n)
+	}
+	tests := []struct {
+		ip    string
+		match bool
+	}{
+		{ "10.1.2.3", true },
+		{ "192.168.1.1", true },
+		{ "192.168.1.2", false },
+		{ "2001:db8::1", true },
+		{ "2001:db9::1", false },
+		{ "11.0.0.1", false },
+	}
+	for _, test := range(tests) {
+		match := false
+		for _, subnet := range l.Subnets() {
+			match = match || subnet.Contains(net.ParseIP(test.ip))
+		}
+		if match != test.match {
+			t.Errorf("%s: got %t, wanted %t", test.ip, match, test.match)
+		}
+	}
+
+	if _, err := newSubnetList(filepath.Join(t.TempDir(), "missing"), time.Hour); err == nil {
+		t.Error("missing subnet list loaded")
+	}
+}
+
+func TestSubnetListRefresh(t *testing.T) {
+	var status atomic.Int64
+	var body atomic.Value
+	status.Store(http.StatusOK)
+	body.Store("10.0.0.0/8\n")
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(int(status.Load()))
+		fmt.Fprint(w, body.Load())
+	}))
+	defer srv.Close()
+
+	// The configuration is parsed without waiting for the first fetch.
+	var c Config
+	parsed := make(chan error, 1)
+	go func() {
+		parsed <- c.Parse([]byte("example.net {\n\tbackend 1.2.3.4:443\n\tdeny-from " + srv.URL + " 1h\n}\n"))
+	}()
+	select {
+	case err := <-parsed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5*time.Second):
+		close(release)
+		t.Fatal("parsing waited for the subnet list")
+	}
+	l := c.Routes[0].DenyLists[0]
+	if n := len(l.Subnets()); n != 0 {
+		t.Errorf("got %d subnets before the first fetch", n)
+	}
+	close(release)
+	waitFor(t, "the first fetch", func() bool { return len(l.Subnets()) == 1 })
+	c.Close()
+
+	body.Store("10.0.0.0/8\n172.16.0.0/12\n")
+	l.refresh()
+	if n := len(l.Subnets()); n != 2 {
+		t.Errorf("got %d subnets once refreshed, wanted 2", n)
+	}
+
+	// A failed refresh keeps the current list.
+	status.Store(http.StatusInternalServerError)
+	body.Store("")
+	l.refresh()
+	if n := len(l.Subnets()); n != 2 {
+		t.Errorf("got %d subnets after a failed refresh, wanted 2", n)
+	}
+}
+
+func TestReuseBackends(t *testing.T) {
+	a, b := &Backend{ Address: "10.0.0.1:443", Weight: 1 }, &Backend{ Address: "10.0.0.2:443", Weight: 1 }
+	backends := reuseBackends([]*Backend{ a, b }, []*Backend{
+		{ Address: "10.0.0.3:443", Weight: 1 },
+		{ Address: "10.0.0.2:443", Weight: 5 },
+		{ Address: "10.0.0.1:443", Weight: 1 },
+	})
+
+	// Sorted by address, the backend whose weight changed being replaced.
+	if len(backends) != 3 {
+		t.Fatalf("got %d backends, wanted 3", len(backends))
+	}
+	if backends[0] != a || backends[1] == b || backends[1].Weight != 5 || backends[2].Address != "10.0.0.3:443" {
+		t.Errorf("got backends %+v %+v %+v", backends[0], backends[1], backends[2])
+	}
+}
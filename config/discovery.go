@@ -0,0 +1,343 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Time waited before reconnecting to a discovery service, and maximum time a
+// Consul blocking query waits for a change.
+const (
+	discoveryRetry = 5 * time.Second
+	consulWait     = 5 * time.Minute
+)
+
+// Source of the backends of a route. The backends it returns can change over
+// time, e.g. following a service discovery.
+type BackendProvider interface {
+	// Returns the backends currently provided. The slice is not modified
+	// once returned.
+	Backends() []*Backend
+	// Stops updating the backends, the last ones being kept.
+	Close()
+}
+
+// Backends set in the configuration.
+type StaticBackends []*Backend
+
+func (s StaticBackends) Backends() []*Backend { return s }
+func (s StaticBackends) Close() {}
+
+// Reports whether a backend address is a discovery service URL (consul:// or
+// etcd://).
+func isDiscovery(addr string) bool {
+	return strings.HasPrefix(addr, "consul://") || strings.HasPrefix(addr, "etcd://")
+}
+
+// Backends kept up to date from a discovery service, watched in the
+// background. The last known backends are kept while the service can't be
+// reached.
+type discovery struct {
+	source  string
+	current atomic.Pointer[[]*Backend]
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// Starts watching the backends of a discovery service URL:
+// consul://[:token@]host:port/service[?tag=...&dc=...] for the passing
+// instances of a Consul service, or etcd://host:port/prefix for the addresses
+// stored under an etcd key prefix.
+func newDiscovery(source string) (*discovery, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || name == "" {
+		return nil, fmt.Errorf("missing host or name")
+	}
+
+	var watch func(ctx context.Context, update func([]*Backend)) error
+	switch u.Scheme {
+	case "consul":
+		watch = consulWatch(u, name)
+		break
+	case "etcd":
+		watch = etcdWatch(u, u.Path)
+		break
+	default:
+		return nil, fmt.Errorf("unknown discovery service %s", u.Scheme)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &discovery{ source: u.Redacted(), cancel: cancel, done: make(chan struct{}) }
+	go d.run(ctx, watch)
+	return d, nil
+}
+
+func (d *discovery) Backends() []*Backend {
+	if backends := d.current.Load(); backends != nil {
+		return *backends
+	}
+	return nil
+}
+
+func (d *discovery) Close() {
+	d.cancel()
+	<-d.done
+}
+
+// Watches the backends until the context is canceled, reconnecting when the
+// watch fails.
+func (d *discovery) run(ctx context.Context, watch func(context.Context, func([]*Backend)) error) {
+	defer close(d.done)
+	for {
+		err := watch(ctx, d.update)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Lost %s, keeping the last known backends (%s)", d.source, err)
+
+		timer := time.NewTimer(discoveryRetry)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Replaces the backends, keeping the ones already known so that their state is
+// preserved.
+func (d *discovery) update(backends []*Backend) {
+	old := d.Backends()
+	backends = reuseBackends(old, backends)
+	if !slices.Equal(old, backends) {
+		log.Printf("Discovered %d backends from %s", len(backends), d.source)
+	}
+	d.current.Store(&backends)
+}
+
+// Returns the watch of the passing instances of a Consul service, using
+// blocking queries on the health endpoint of the agent.
+func consulWatch(u *url.URL, service string) func(context.Context, func([]*Backend)) error {
+	token, _ := u.User.Password()
+	query := url.Values{ "passing": { "true" }, "wait": { consulWait.String() } }
+	for _, param := range []string{ "tag", "dc" } {
+		if val := u.Query().Get(param); val != "" {
+			query.Set(param, val)
+		}
+	}
+	endpoint := "http://" + u.Host + "/v1/health/service/" + url.PathEscape(service)
+	client := &http.Client{ Timeout: consulWait + 30*time.Second }
+
+	return func(ctx context.Context, update func([]*Backend)) error {
+		index := "0"
+		for {
+			query.Set("index", index)
+			req, err := http.NewRequestWithContext(ctx, "GET", endpoint + "?" + query.Encode(), nil)
+			if err != nil {
+				return err
+			}
+			if token != "" {
+				req.Header.Set("X-Consul-Token", token)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+
+			var entries []struct {
+				Node    struct{ Address string }
+				Service struct {
+					Address string
+					Port    int
+					Weights struct{ Passing int }
+				}
+			}
+			err = json.NewDecoder(resp.Body).Decode(&entries)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("unexpected status %s", resp.Status)
+			}
+			if err != nil {
+				return err
+			}
+
+			var backends []*Backend
+			for _, e := range entries {
+				host := e.Service.Address
+				if host == "" {
+					host = e.Node.Address
+				}
+				weight := e.Service.Weights.Passing
+				if weight <= 0 {
+					weight = 1
+				}
+				backends = append(backends, &Backend{
+					Address: net.JoinHostPort(host, strconv.Itoa(e.Service.Port)),
+					Weight: weight,
+				})
+			}
+			update(backends)
+
+			// The index is reset when it goes backward.
+			next := resp.Header.Get("X-Consul-Index")
+			if n, err := strconv.ParseUint(next, 10, 64); err != nil {
+				return fmt.Errorf("invalid index %q", next)
+			} else if cur, _ := strconv.ParseUint(index, 10, 64); n < cur {
+				next = "0"
+			}
+			index = next
+		}
+	}
+}
+
+// Returns the watch of the backends stored under an etcd key prefix, one per
+// key, its value being the backend address optionally followed by its weight.
+// The JSON gateway of the v3 API is used: the keys are read, then watched
+// from the revision read, being read again on each change.
+func etcdWatch(u *url.URL, prefix string) func(context.Context, func([]*Backend)) error {
+	base := "http://" + u.Host + "/v3"
+	key := base64.StdEncoding.EncodeToString([]byte(prefix))
+	end := []byte(prefix)
+	end[len(end) - 1]++
+	rangeEnd := base64.StdEncoding.EncodeToString(end)
+
+	post := func(ctx context.Context, path string, body any) (*http.Response, error) {
+		data, _ := json.Marshal(body)
+		req, err := http.NewRequestWithContext(ctx, "POST", base + path, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return resp, err
+	}
+
+	// Reads the backends, returning the revision read.
+	read := func(ctx context.Context, update func([]*Backend)) (int64, error) {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		resp, err := post(ctx, "/kv/range", map[string]string{ "key": key, "range_end": rangeEnd })
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+
+		var answer struct {
+			Header struct{ Revision int64 `json:",string"` }
+			Kvs    []struct{ Key, Value []byte }
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+			return 0, err
+		}
+
+		var backends []*Backend
+		for _, kv := range answer.Kvs {
+			b, err := parseDiscoveredBackend(string(kv.Value))
+			if err != nil {
+				log.Printf("Ignoring etcd key %s (%s)", kv.Key, err)
+				continue
+			}
+			backends = append(backends, b)
+		}
+		update(backends)
+		return answer.Header.Revision, nil
+	}
+
+	return func(ctx context.Context, update func([]*Backend)) error {
+		rev, err := read(ctx, update)
+		if err != nil {
+			return err
+		}
+
+		resp, err := post(ctx, "/watch", map[string]any{
+			"create_request": map[string]string{
+				"key": key,
+				"range_end": rangeEnd,
+				"start_revision": strconv.FormatInt(rev + 1, 10),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var msg struct {
+				Result struct {
+					Canceled     bool
+					CancelReason string `json:"cancel_reason"`
+					Events       []json.RawMessage
+				}
+			}
+			if err := dec.Decode(&msg); err != nil {
+				return err
+			}
+			if msg.Result.Canceled {
+				return fmt.Errorf("watch canceled (%s)", msg.Result.CancelReason)
+			}
+			if len(msg.Result.Events) > 0 {
+				if _, err := read(ctx, update); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// Parses a backend stored in a discovery service: its address, optionally
+// followed by its weight.
+func parseDiscoveredBackend(val string) (*Backend, error) {
+	fields := strings.Fields(val)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid backend %q", val)
+	}
+	if _, _, err := net.SplitHostPort(fields[0]); err != nil {
+		return nil, err
+	}
+
+	b := &Backend{ Address: fields[0], Weight: 1 }
+	if len(fields) == 2 {
+		w, err := strconv.Atoi(fields[1])
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight %q", fields[1])
+		}
+		b.Weight = w
+	}
+	return b, nil
+}
@@ -0,0 +1,179 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interval between two checks of a domain list file for changes.
+const domainListPollInterval = 10 * time.Second
+
+// DomainList is a set of domains loaded from a file, matching the listed
+// domains and all their subdomains. It is meant for large lists (tens of
+// thousands of entries) where using regexps would be impractical.
+type DomainList struct {
+	File          string
+	// Domains are matched ignoring the case unless set (domain-case).
+	CaseSensitive bool
+
+	mu      sync.RWMutex
+	domains map[string]struct{}
+	modTime time.Time
+	// Stops watching the file, the watch being done once done is closed.
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// Loads a newline-delimited domain list from a file, and watch it for changes
+// until closed. Empty lines and comments (#) are ignored; a leading wildcard
+// (*.) is allowed and has the same meaning as the domain itself.
+func newDomainList(file string, caseSensitive bool) (*DomainList, error) {
+	l := &DomainList{ File: file, CaseSensitive: caseSensitive }
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel, l.done = cancel, make(chan struct{})
+	go l.watch(ctx)
+	return l, nil
+}
+
+// Stops watching the file, the list being kept as is.
+func (l *DomainList) Close() {
+	if l.cancel == nil {
+		return
+	}
+	l.cancel()
+	<-l.done
+}
+
+// Matches a domain against the list. A domain matches if it or one of its
+// parent domains is part of the list.
+func (l *DomainList) Match(domain string) bool {
+	domain = strings.TrimSuffix(l.fold(domain), ".")
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for {
+		if _, ok := l.domains[domain]; ok {
+			return true
+		}
+
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return false
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// Returns a domain as stored in the list, lowercased unless the list is case
+// sensitive.
+func (l *DomainList) fold(domain string) string {
+	if l.CaseSensitive {
+		return domain
+	}
+	return strings.ToLower(domain)
+}
+
+// Loads (or reloads) the domain list file. On error the current list is kept.
+func (l *DomainList) load() error {
+	f, err := os.Open(l.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	domains := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		domain := l.fold(strings.TrimSpace(line))
+		domain = strings.TrimPrefix(domain, "*.")
+		domain = strings.Trim(domain, ".")
+		if domain == "" {
+			continue
+		}
+
+		domains[domain] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.domains = domains
+	l.modTime = info.ModTime()
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Polls the domain list file until the context is canceled.
+func (l *DomainList) watch(ctx context.Context) {
+	defer close(l.done)
+	ticker := time.NewTicker(domainListPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.refresh()
+		}
+	}
+}
+
+// Reloads the domain list file if modified.
+func (l *DomainList) refresh() {
+	info, err := os.Stat(l.File)
+	if err != nil {
+		log.Printf("Could not check domain list %q (%s)", l.File, err)
+		return
+	}
+
+	l.mu.RLock()
+	modified := !info.ModTime().Equal(l.modTime)
+	l.mu.RUnlock()
+	if !modified {
+		return
+	}
+
+	if err := l.load(); err != nil {
+		log.Printf("Could not reload domain list %q, keeping the previous one (%s)", l.File, err)
+		return
+	}
+	log.Printf("Reloaded domain list %q", l.File)
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Maximum length of a framing header skipped before the TLS stream.
+const MaxSkip = 4096
+
+// Parses the delimiter ending a framing header: \r, \n, \t, \\ and \xHH
+// insert a carriage return, a line feed, a tab, a backslash and a byte.
+func parseDelimiter(val string) ([]byte, error) {
+	var delim []byte
+	for i := 0; i < len(val); i++ {
+		if val[i] != '\\' {
+			delim = append(delim, val[i])
+			continue
+		}
+		if i + 1 >= len(val) {
+			return nil, fmt.Errorf("Trailing backslash in %q", val)
+		}
+		i++
+		switch val[i] {
+		case 'r':
+			delim = append(delim, '\r')
+			break
+		case 'n':
+			delim = append(delim, '\n')
+			break
+		case 't':
+			delim = append(delim, '\t')
+			break
+		case '\\':
+			delim = append(delim, '\\')
+			break
+		case 'x':
+			if i + 2 >= len(val) {
+				return nil, fmt.Errorf("Invalid \\x sequence in %q", val)
+			}
+			b, err := strconv.ParseUint(val[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid \\x sequence in %q", val)
+			}
+			delim = append(delim, byte(b))
+			i += 2
+			break
+		default:
+			return nil, fmt.Errorf("Invalid escape sequence \\%c in %q", val[i], val)
+		}
+	}
+	if len(delim) == 0 || len(delim) > MaxSkip {
+		return nil, fmt.Errorf("Invalid delimiter length in %q", val)
+	}
+	return delim, nil
+}
+
+// Checks the framing options of a listener are consistent.
+func (l *Listener) checkSkip() error {
+	if l.SkipBytes > 0 && l.SkipUntil != nil {
+		return fmt.Errorf("skip-bytes and skip-until can't be used together")
+	}
+	if l.SkipForward && !l.Skips() {
+		return fmt.Errorf("skip-forward requires skip-bytes or skip-until")
+	}
+	return nil
+}
+
+// Reports whether connections start with a framing header to skip.
+func (l *Listener) Skips() bool {
+	return l != nil && (l.SkipBytes > 0 || l.SkipUntil != nil)
+}
+
@@ -0,0 +1,127 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Error found while parsing a configuration.
+type parseError struct {
+	msg string
+}
+
+func (e *parseError) Error() string {
+	return e.msg
+}
+
+// Reports an invalid configuration, aborting its parsing.
+func fail(v ...interface{}) {
+	panic(&parseError{ msg: fmt.Sprint(v...) })
+}
+
+func failf(format string, v ...interface{}) {
+	panic(&parseError{ msg: fmt.Sprintf(format, v...) })
+}
+
+// Reports whether a configuration source is an http(s) URL.
+func IsURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// Returns the content of a configuration source: a file path, "-" for the
+// standard input, or an http(s) URL.
+func Fetch(source string) ([]byte, error) {
+	if source == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	if !IsURL(source) {
+		return os.ReadFile(source)
+	}
+
+	client := http.Client{ Timeout: 30 * time.Second }
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Reads a configuration from a source (see Fetch) and transforms it into a
+// Config struct.
+func (c *Config) Load(source string) error {
+	data, err := Fetch(source)
+	if err != nil {
+		return err
+	}
+	return c.Parse(data)
+}
+
+// Transforms a configuration into a Config struct. Returns an error if the
+// configuration is invalid.
+func (c *Config) Parse(data []byte) error {
+	return c.read(bytes.NewReader(data))
+}
+
+// Parses a configuration read from r, turning the errors reported by fail
+// into a returned error.
+func (c *Config) read(r io.Reader) (err error) {
+	defer func() {
+		r := recover()
+		if e, ok := r.(*parseError); ok {
+			err = e
+		} else if r != nil {
+			panic(r)
+		}
+		if err != nil {
+			c.Close()
+		}
+	}()
+
+	l := newLexer(r)
+	c.parse(newBlock(&l))
+	return c.Validate()
+}
+
+// Stops the background updates of a configuration no longer used: the
+// domain and subnet lists of its routes are no longer refreshed, and their
+// backends no longer discovered.
+func (c *Config) Close() {
+	for _, route := range c.Routes {
+		for _, list := range route.DomainLists {
+			list.Close()
+		}
+		for _, list := range route.AllowLists {
+			list.Close()
+		}
+		for _, list := range route.DenyLists {
+			list.Close()
+		}
+		route.provider().Close()
+	}
+}
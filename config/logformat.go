@@ -0,0 +1,133 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Fields which can be used in a log format.
+var LogFields = map[string]bool{
+	"timestamp":      true,
+	"date":           true,
+	"time":           true,
+	"clf_time":       true,
+	"client_ip":      true,
+	"client_port":    true,
+	"local_addr":     true,
+	"sni":            true,
+	"route":          true,
+	"backend":        true,
+	"backend_addr":   true,
+	"bytes_sent":     true,
+	"bytes_received": true,
+	"duration_ms":    true,
+	"outcome":        true,
+	"tls_version":    true,
+	"alpn":           true,
+	"ja3":            true,
+}
+
+// LogFormat is a compiled log format template.
+type LogFormat []LogFormatPart
+
+// Part of a log format: either a literal or a field.
+type LogFormatPart struct {
+	Literal string
+	Field   string
+}
+
+// Fields of the JSON records, in order. Unknown values are written as null.
+var LogJSONFields = []string{
+	"timestamp", "client_ip", "client_port", "local_addr", "sni", "route",
+	"backend", "backend_addr", "outcome", "bytes_sent", "bytes_received",
+	"duration_ms", "tls_version", "alpn", "ja3",
+}
+
+// Fields of the JSON records holding numbers.
+var logJSONNumbers = map[string]bool{
+	"client_port":    true,
+	"bytes_sent":     true,
+	"bytes_received": true,
+	"duration_ms":    true,
+}
+
+// Reports whether a field of the JSON records holds a number.
+func LogJSONNumber(field string) bool {
+	return logJSONNumbers[field]
+}
+
+// Reports whether the connections are logged as a single record once done,
+// rather than by the default messages.
+func (c *Config) LogRecords() bool {
+	return c.LogFormat != nil || c.LogJSON
+}
+
+// Compiles a log format template: %{field} is replaced by the value of a field,
+// %% by a percent sign, and \t, \" and \\ by a tab, a quote and a backslash.
+func ParseLogFormat(template string) (LogFormat, error) {
+	var format LogFormat
+	var literal strings.Builder
+	flush := func() {
+		if literal.Len() > 0 {
+			format = append(format, LogFormatPart{ Literal: literal.String() })
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(template); i++ {
+		switch ch := template[i]; {
+		case ch == '\\' && i + 1 < len(template):
+			i++
+			switch template[i] {
+			case 't':
+				literal.WriteByte('\t')
+				break
+			case '"', '\\':
+				literal.WriteByte(template[i])
+				break
+			default:
+				return nil, fmt.Errorf("Invalid escape sequence \\%c", template[i])
+			}
+			break
+		case ch == '%' && strings.HasPrefix(template[i:], "%%"):
+			literal.WriteByte('%')
+			i++
+			break
+		case ch == '%' && strings.HasPrefix(template[i:], "%{"):
+			end := strings.IndexByte(template[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated field in %q", template[i:])
+			}
+			field := template[i+2:i+end]
+			if !LogFields[field] {
+				return nil, fmt.Errorf("Unknown log field %q", field)
+			}
+			flush()
+			format = append(format, LogFormatPart{ Field: field })
+			i += end
+			break
+		case ch == '%':
+			return nil, fmt.Errorf("Invalid %% sequence in %q", template[i:])
+		default:
+			literal.WriteByte(ch)
+		}
+	}
+	flush()
+	return format, nil
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default time the results of a backend lookup are cached for, and maximum
+// time spent looking a backend up.
+const (
+	lookupTTL     = time.Minute
+	lookupTimeout = 5 * time.Second
+)
+
+// Backend looked up for a server name, nil if the endpoint has none.
+type lookupEntry struct {
+	backend *Backend
+	expires time.Time
+}
+
+// Backends looked up, by server name.
+type lookupCache struct {
+	mu      sync.Mutex
+	entries map[string]lookupEntry
+	// Size of the cache from which expired entries are removed.
+	sweep   int
+}
+
+// Looks up the backend of a server name using the route lookup endpoint, the
+// name being given as the sni query parameter. The endpoint answers with the
+// backend address, or with a 404 status when it has none. Both answers are
+// cached for LookupTTL, errors are not. Returns nil when there is no backend.
+func (r *Route) LookupBackend(ctx context.Context, sni string) (*Backend, error) {
+	c := &r.lookups
+	c.mu.Lock()
+	if e, ok := c.entries[sni]; ok && time.Now().Before(e.expires) {
+		c.mu.Unlock()
+		return e.backend, nil
+	}
+	c.mu.Unlock()
+
+	backend, err := r.lookup(ctx, sni)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.entries == nil {
+		c.entries = make(map[string]lookupEntry)
+	}
+	if len(c.entries) >= c.sweep {
+		for name, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, name)
+			}
+		}
+		c.sweep = max(2 * len(c.entries), 64)
+	}
+	c.entries[sni] = lookupEntry{ backend: backend, expires: now.Add(r.LookupTTL) }
+	return backend, nil
+}
+
+// Queries the route lookup endpoint for a server name.
+func (r *Route) lookup(ctx context.Context, sni string) (*Backend, error) {
+	u, err := url.Parse(r.Lookup)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("sni", sni)
+	u.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		break
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return nil, err
+	}
+	addr := strings.TrimSpace(string(body))
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("Invalid backend address %q", addr)
+	}
+	return &Backend{ Address: addr, Weight: 1 }, nil
+}
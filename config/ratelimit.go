@@ -0,0 +1,93 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"sync"
+	"time"
+)
+
+// Number of calls to Allow between two sweeps of the idle clients.
+const rateLimitSweep = 1024
+
+// RateLimiter limits the connection rate of each client, using a token bucket
+// per client address.
+type RateLimiter struct {
+	// Sustained number of connections per second, and burst size.
+	Rate  float64
+	Burst int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		Rate: rate,
+		Burst: burst,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Reports whether a new connection from the given client is allowed.
+func (rl *RateLimiter) Allow(client string) bool {
+	now := time.Now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.buckets == nil {
+		rl.buckets = make(map[string]*bucket)
+	}
+
+	rl.calls++
+	if rl.calls % rateLimitSweep == 0 {
+		rl.sweep(now)
+	}
+
+	b, ok := rl.buckets[client]
+	if !ok {
+		b = &bucket{ tokens: float64(rl.Burst), last: now }
+		rl.buckets[client] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rl.Rate
+	if b.tokens > float64(rl.Burst) {
+		b.tokens = float64(rl.Burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Removes the clients whose bucket is full again, they do not hold any state.
+func (rl *RateLimiter) sweep(now time.Time) {
+	for client, b := range rl.buckets {
+		if b.tokens + now.Sub(b.last).Seconds() * rl.Rate >= float64(rl.Burst) {
+			delete(rl.buckets, client)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package config
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Availability of a backend, as reported by its dials and health checks. A
+// backend recovering from failures is given a share of the connections ramping
+// up over the route slow start period.
+type backendHealth struct {
+	mu        sync.Mutex
+	down      bool
+	recovered time.Time
+	// Last ramp progress logged, in quarters.
+	logged    int
+}
+
+func (r *Route) backendHealth(address string) *backendHealth {
+	if h, ok := r.health.Load(address); ok {
+		return h.(*backendHealth)
+	}
+
+	h, _ := r.health.LoadOrStore(address, &backendHealth{})
+	return h.(*backendHealth)
+}
+
+// Reports a backend as failing. It is considered as recovering, and slowly
+// started, once reported as up again. Routes with health checks no longer
+// select it in the meantime.
+func (r *Route) MarkDown(backend *Backend) {
+	if r.SlowStart == 0 && r.HealthCheck == 0 {
+		return
+	}
+
+	h := r.backendHealth(backend.Address)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.down && r.HealthCheck > 0 {
+		log.Printf("Backend %s of route %s is down", backend.Address, r.Label())
+	}
+	h.down = true
+	h.recovered = time.Time{}
+}
+
+// Reports a backend as up, starting its ramp if it was down.
+func (r *Route) MarkUp(backend *Backend) {
+	if r.SlowStart == 0 && r.HealthCheck == 0 {
+		return
+	}
+
+	h := r.backendHealth(backend.Address)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.down {
+		return
+	}
+	h.down = false
+	if r.SlowStart == 0 {
+		log.Printf("Backend %s of route %s recovered", backend.Address, r.Label())
+		return
+	}
+	h.recovered = time.Now()
+	h.logged = 0
+	log.Printf("Backend %s of route %s recovered, slow start over %s",
+		   backend.Address, r.Label(), r.SlowStart)
+}
+
+// Reports whether a backend is up, i.e. it was not reported as failing since
+// its last success.
+func (r *Route) BackendUp(backend *Backend) bool {
+	v, ok := r.health.Load(backend.Address)
+	if !ok {
+		return true
+	}
+	h := v.(*backendHealth)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.down
+}
+
+// Returns the share (0 to 1) of its connections a backend currently gets,
+// following its slow start ramp.
+func (r *Route) rampFactor(backend *Backend) float64 {
+	v, ok := r.health.Load(backend.Address)
+	if !ok {
+		return 1
+	}
+	h := v.(*backendHealth)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.recovered.IsZero() {
+		return 1
+	}
+
+	elapsed := time.Since(h.recovered)
+	if elapsed >= r.SlowStart {
+		h.recovered = time.Time{}
+		log.Printf("Backend %s of route %s completed its slow start",
+			   backend.Address, r.Label())
+		return 1
+	}
+
+	factor := float64(elapsed) / float64(r.SlowStart)
+	if quarter := int(factor * 4); quarter > h.logged {
+		h.logged = quarter
+		log.Printf("Backend %s of route %s slow start at %d%%",
+			   backend.Address, r.Label(), quarter * 25)
+	}
+	return factor
+}
+
+// Reports whether a connection is admitted on a backend, given its slow start
+// ramp.
+func (r *Route) admit(backend *Backend) bool {
+	if r.SlowStart == 0 {
+		return true
+	}
+	factor := r.rampFactor(backend)
+	return factor >= 1 || rand.Float64() < factor
+}
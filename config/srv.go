@@ -0,0 +1,118 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Default interval between two resolutions of an SRV record. The resolver
+// does not expose the records TTL.
+const srvRefresh = 30 * time.Second
+
+// Reports whether a backend address is an SRV name (_service._proto.name).
+func isSRV(addr string) bool {
+	return strings.HasPrefix(addr, "_") && !strings.Contains(addr, ":")
+}
+
+// Backends resolved from a DNS SRV record, periodically until closed.
+type srvBackends struct {
+	name     string
+	current  atomic.Pointer[[]*Backend]
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// Resolves an SRV record, and starts resolving it again every interval.
+func newSRVBackends(name string, interval time.Duration) *srvBackends {
+	s := &srvBackends{ name: name }
+	if err := s.resolve(); err != nil {
+		log.Printf("Could not resolve %s (%s)", name, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel, s.done = cancel, make(chan struct{})
+	go s.watch(ctx, interval)
+	return s
+}
+
+func (s *srvBackends) Backends() []*Backend {
+	if backends := s.current.Load(); backends != nil {
+		return *backends
+	}
+	return nil
+}
+
+func (s *srvBackends) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// Resolves the SRV record and updates the backends. Only the targets with the
+// lowest priority are used, their weight is kept (it is only honored by the
+// random and weighted round robin balancing strategies). The backends already
+// known are kept, so that their state is preserved. When the record has no
+// target there is no backend available; on other errors the previous backends
+// are kept.
+func (s *srvBackends) resolve() error {
+	_, addrs, err := net.LookupSRV("", "", s.name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			return err
+		}
+	}
+
+	var backends []*Backend
+	for _, srv := range addrs {
+		// Records are sorted by priority.
+		if srv.Priority != addrs[0].Priority {
+			break
+		}
+
+		host := strings.TrimSuffix(srv.Target, ".")
+		backends = append(backends, &Backend{
+			Address: net.JoinHostPort(host, strconv.Itoa(int(srv.Port))),
+			Weight: int(srv.Weight),
+		})
+	}
+
+	backends = reuseBackends(s.Backends(), backends)
+	s.current.Store(&backends)
+	return err
+}
+
+// Resolves the SRV record every interval, until the context is canceled.
+func (s *srvBackends) watch(ctx context.Context, interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.resolve(); err != nil {
+			log.Printf("Could not resolve %s, keeping the previous backends (%s)", s.name, err)
+		}
+	}
+}
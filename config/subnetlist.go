@@ -0,0 +1,166 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Default interval between two refreshes of a subnet list.
+const subnetListRefresh = 5 * time.Minute
+
+// SubnetList is a list of subnets loaded from a file or an URL (e.g. a
+// threat-intel feed), refreshed periodically. A failed refresh keeps the last
+// successfully loaded list.
+type SubnetList struct {
+	Source   string
+	Interval time.Duration
+
+	subnets  atomic.Pointer[[]*net.IPNet]
+	// Stops refreshing the list, the refreshes being done once done is
+	// closed.
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// Loads a subnet list from a file or an http(s) URL, and refreshes it
+// periodically until closed. Files are loaded right away, so that a missing
+// one is reported. URLs are fetched in the background, so that parsing the
+// configuration does not wait for the network; the list is empty until then.
+func newSubnetList(source string, interval time.Duration) (*SubnetList, error) {
+	l := &SubnetList{ Source: source, Interval: interval }
+	if !IsURL(source) {
+		if err := l.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel, l.done = cancel, make(chan struct{})
+	go l.watch(ctx)
+	return l, nil
+}
+
+// Returns the current list of subnets. The returned slice must not be
+// modified.
+func (l *SubnetList) Subnets() []*net.IPNet {
+	if subnets := l.subnets.Load(); subnets != nil {
+		return *subnets
+	}
+	return nil
+}
+
+// Stops refreshing the list, the current one being kept.
+func (l *SubnetList) Close() {
+	if l.cancel == nil {
+		return
+	}
+	l.cancel()
+	<-l.done
+}
+
+// Loads the list; on error the current one is kept. One IP or subnet is
+// expected per line, everything after a hash (#) or a semicolon (;) is a
+// comment. Invalid lines are skipped.
+func (l *SubnetList) load() error {
+	var r io.ReadCloser
+	if IsURL(l.Source) {
+		client := http.Client{ Timeout: 30 * time.Second }
+		resp, err := client.Get(l.Source)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("Unexpected HTTP status (%s)", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(l.Source)
+		if err != nil {
+			return err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	var subnets []*net.IPNet
+	var invalid int
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		subnet, err := parseSubnet(line)
+		if err != nil {
+			invalid++
+			continue
+		}
+		subnets = append(subnets, subnet)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if invalid > 0 {
+		log.Printf("Skipped %d invalid entries in subnet list %q", invalid, l.Source)
+	}
+
+	l.subnets.Store(&subnets)
+	return nil
+}
+
+// Refreshes the list at its interval until the context is canceled, loading
+// it first if not loaded yet.
+func (l *SubnetList) watch(ctx context.Context) {
+	defer close(l.done)
+	if l.subnets.Load() == nil {
+		l.refresh()
+	}
+
+	ticker := time.NewTicker(l.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.refresh()
+		}
+	}
+}
+
+func (l *SubnetList) refresh() {
+	if err := l.load(); err != nil {
+		log.Printf("Could not refresh subnet list %q, keeping the previous one (%s)", l.Source, err)
+	}
+}
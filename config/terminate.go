@@ -0,0 +1,70 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"crypto/tls"
+	"regexp"
+	"strings"
+)
+
+// TLS termination of a route connections: the handshake is served using the
+// route certificate and the plaintext is forwarded to the backends.
+type Termination struct {
+	Certificate tls.Certificate
+	// Server names terminated, in the domain syntax of the routes. All the
+	// connections of the route are terminated when empty, the others being
+	// passed through.
+	Domains []*regexp.Regexp
+}
+
+func newTermination(cert, key, domains string, caseSensitive bool) (*Termination, error) {
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Termination{ Certificate: pair }
+	if domains != "" {
+		for _, domain := range(strings.Split(domains, ",")) {
+			warnWildcard(domain)
+			rgp, err := domain2Regex(domain, caseSensitive)
+			if err != nil {
+				return nil, err
+			}
+			t.Domains = append(t.Domains, rgp)
+		}
+	}
+
+	return t, nil
+}
+
+// Reports whether the connections of the route to a server name are
+// terminated, rather than passed through.
+func (r *Route) Terminates(name string) bool {
+	if r.Terminate == nil {
+		return false
+	}
+	if len(r.Terminate.Domains) == 0 {
+		return true
+	}
+	for _, domain := range r.Terminate.Domains {
+		if domain.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
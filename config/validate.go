@@ -0,0 +1,68 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package config
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Checks the consistency of a configuration as a whole, once parsed. Domains
+// listed by more than one route are reported following DuplicateDomains.
+func (c *Config) Validate() error {
+	seen := make(map[string]int)
+	for i, route := range c.Routes {
+		// Routes restricted to client networks can share their domains
+		// with other routes.
+		if len(route.Clients) > 0 {
+			continue
+		}
+		for _, domain := range route.Domains {
+			key := domain.String()
+			first, ok := seen[key]
+			if !ok {
+				seen[key] = i
+				continue
+			}
+			if first == i {
+				continue
+			}
+
+			err := fmt.Errorf("Domain %s is listed by routes #%d (%s) and #%d (%s), the first one taking precedence",
+					  domainName(key), first + 1, c.Routes[first].Label(), i + 1, route.Label())
+			if c.DuplicateDomains == DuplicateDomainsError {
+				return err
+			}
+			log.Printf("Warning: %s", err)
+		}
+	}
+	return nil
+}
+
+// Returns the domain (as written in the configuration) a route domain regexp
+// was built from.
+func DomainName(domain *regexp.Regexp) string {
+	return domainName(domain.String())
+}
+
+// Returns the domain a regexp was built from by domain2Regex.
+func domainName(regex string) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(regex, `(?i)`), `^(?:`), `)$`)
+	return strings.NewReplacer(`[^.]+(?:\.[^.]+)*`, "**", `[^.]*`, "*", `\.`, ".").Replace(name)
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package handshake
+
+import (
+	"fmt"
+)
+
+// Deprecated cipher suites, and the reason they are: NULL (no encryption),
+// export grade, DES, 3DES or RC4 ciphers.
+var deprecatedCipherSuites = map[uint16]string{
+	0x0000: "NULL", 0x0001: "NULL", 0x0002: "NULL", 0x003b: "NULL",
+	0xc001: "NULL", 0xc006: "NULL", 0xc00b: "NULL", 0xc010: "NULL",
+	0xc015: "NULL",
+
+	0x0003: "export", 0x0006: "export", 0x0008: "export", 0x000b: "export",
+	0x000e: "export", 0x0011: "export", 0x0014: "export", 0x0017: "export",
+	0x0019: "export",
+
+	0x0009: "DES", 0x000c: "DES", 0x000f: "DES", 0x0012: "DES",
+	0x0015: "DES", 0x001a: "DES",
+
+	0x000a: "3DES", 0x000d: "3DES", 0x0010: "3DES", 0x0013: "3DES",
+	0x0016: "3DES", 0x001b: "3DES", 0xc003: "3DES", 0xc008: "3DES",
+	0xc00d: "3DES", 0xc012: "3DES", 0xc017: "3DES",
+
+	0x0004: "RC4", 0x0005: "RC4", 0x0018: "RC4", 0xc002: "RC4",
+	0xc007: "RC4", 0xc00c: "RC4", 0xc011: "RC4", 0xc016: "RC4",
+}
+
+// DeprecatedCipherSuite describes a deprecated cipher suite offered by a
+// client.
+type DeprecatedCipherSuite struct {
+	ID     uint16
+	// Reason the suite is deprecated: NULL, export, DES, 3DES or RC4.
+	Reason string
+}
+
+func (s DeprecatedCipherSuite) String() string {
+	return fmt.Sprintf("%#04x (%s)", s.ID, s.Reason)
+}
+
+// Returns the deprecated cipher suites offered by the client, in the order
+// they were offered.
+func (h *ClientHello) DeprecatedCipherSuites() []DeprecatedCipherSuite {
+	var suites []DeprecatedCipherSuite
+	for _, id := range h.CipherSuites {
+		if reason, ok := deprecatedCipherSuites[id]; ok {
+			suites = append(suites, DeprecatedCipherSuite{ ID: id, Reason: reason })
+		}
+	}
+	return suites
+}
+
+// Ranges of AEAD cipher suites: TLS 1.3, AES-GCM, AES-CCM and ChaCha20-Poly1305.
+var aeadCipherSuites = [][2]uint16{
+	{ 0x1301, 0x1305 },
+	{ 0x009c, 0x00ad },
+	{ 0xc02b, 0xc032 },
+	{ 0xc09c, 0xc0af },
+	{ 0xcca8, 0xccae },
+}
+
+// IsAEADCipherSuite reports whether a cipher suite uses an AEAD cipher.
+func IsAEADCipherSuite(id uint16) bool {
+	for _, r := range aeadCipherSuites {
+		if id >= r[0] && id <= r[1] {
+			return true
+		}
+	}
+	return false
+}
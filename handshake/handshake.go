@@ -0,0 +1,534 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package handshake parses TLS ClientHello messages, as sent by clients at the
+// beginning of a TLS handshake, without terminating the TLS connection.
+package handshake
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// TLS extension types.
+const (
+	ExtServerName        = 0
+	ExtSupportedGroups   = 10
+	ExtECPointFormats    = 11
+	ExtALPN              = 16
+	ExtSupportedVersions = 43
+)
+
+// TLS versions.
+const (
+	VersionTLS10 = 0x301
+	VersionTLS11 = 0x302
+	VersionTLS12 = 0x303
+	VersionTLS13 = 0x304
+)
+
+// Errors returned when a stream does not start with a ClientHello message.
+// They are reported as soon as the offending byte is read, without waiting for
+// the rest of the record or message.
+var (
+	ErrNotHandshake   = errors.New("Record is not a TLS handshake")
+	ErrNotClientHello = errors.New("TLS handshake is not a ClientHello message")
+)
+
+// ClientHello holds the fields of a parsed TLS ClientHello message.
+type ClientHello struct {
+	// Version of the TLS record holding the message (legacy_record_version).
+	RecordVersion      uint16
+	// Version advertised in the message (legacy_version).
+	Version            uint16
+	Random             [32]byte
+	SessionID          []byte
+	CipherSuites       []uint16
+	CompressionMethods []byte
+	// Extensions, in the order they were sent.
+	Extensions         []Extension
+
+	// Server name from the SNI extension, empty if none was sent.
+	ServerName         string
+}
+
+// Extension represents a raw TLS extension.
+type Extension struct {
+	Type uint16
+	Data []byte
+}
+
+// ParseClientHelloSNI reads a TLS ClientHello message from r and returns the
+// server name it contains. An empty name is returned, without error, if the
+// message has no SNI extension.
+func ParseClientHelloSNI(r io.Reader) (string, error) {
+	hello, err := ParseClientHello(r)
+	if err != nil {
+		return "", err
+	}
+	return hello.ServerName, nil
+}
+
+// RecordVersion returns the version of the TLS handshake record starting b
+// (legacy_record_version), whether supported or not. It reports false if b
+// does not start with a handshake record header.
+func RecordVersion(b []byte) (uint16, bool) {
+	if len(b) < 3 || b[0] != 22 {
+		return 0, false
+	}
+	return uint16(b[1]) << 8 | uint16(b[2]), true
+}
+
+// ParseClientHello reads and parses a TLS ClientHello message from r. The
+// message is expected to be the first one of a TLS stream, within a single
+// TLS record.
+func ParseClientHello(r io.Reader) (*ClientHello, error) {
+	hello := &ClientHello{}
+
+	if err := parseRecord(r, hello); err != nil {
+		return nil, err
+	}
+
+	if err := parseHandshake(r); err != nil {
+		return nil, err
+	}
+
+	if err := parseClientHello(r, hello); err != nil {
+		return nil, err
+	}
+
+	// Parse the TLS extensions.
+	b, err := parseVector(r, 2)
+	if err != nil {
+		// No extension (not an error).
+		if err == io.EOF {
+			return hello, nil
+		}
+		return nil, err
+	}
+
+	// Loop over the TLS extensions.
+	for len(b) >= 4 {
+		extType := binary.BigEndian.Uint16(b[:2])
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		if length > len(b[4:]) {
+			return nil, fmt.Errorf("TLS extension is too short.")
+		}
+
+		ext := Extension{ Type: extType, Data: b[4 : 4+length] }
+		hello.Extensions = append(hello.Extensions, ext)
+		b = b[4+length:]
+
+		// Look for a server name indication, only the first one is
+		// used.
+		if extType == ExtServerName && hello.ServerName == "" {
+			if hello.ServerName, err = parseSNI(ext.Data); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return hello, nil
+}
+
+// Returns the TLS versions offered by the client: the ones listed in the
+// supported_versions extension if sent (GREASE values excluded), the version
+// advertised in the message otherwise. This is what the client offers, not
+// what will be negotiated.
+func (h *ClientHello) SupportedVersions() []uint16 {
+	for _, ext := range h.Extensions {
+		if ext.Type != ExtSupportedVersions {
+			continue
+		}
+
+		b := ext.Data
+		if len(b) < 1 || int(b[0]) > len(b[1:]) || b[0] % 2 != 0 {
+			break
+		}
+		b = b[1 : 1+b[0]]
+
+		var versions []uint16
+		for i := 0; i < len(b); i += 2 {
+			if v := binary.BigEndian.Uint16(b[i:i+2]); !IsGREASE(v) {
+				versions = append(versions, v)
+			}
+		}
+		return versions
+	}
+
+	return []uint16{ h.Version }
+}
+
+// Returns the application protocols offered by the client in the ALPN
+// extension, if any.
+func (h *ClientHello) ALPN() []string {
+	for _, ext := range h.Extensions {
+		if ext.Type != ExtALPN {
+			continue
+		}
+
+		b := ext.Data
+		if len(b) < 2 || int(binary.BigEndian.Uint16(b)) > len(b[2:]) {
+			return nil
+		}
+		b = b[2 : 2+binary.BigEndian.Uint16(b)]
+
+		var protos []string
+		for len(b) > 0 {
+			n := int(b[0])
+			if n == 0 || n > len(b[1:]) {
+				return nil
+			}
+			protos = append(protos, string(b[1:1+n]))
+			b = b[1+n:]
+		}
+		return protos
+	}
+	return nil
+}
+
+// Reports whether the client offers TLS 1.3 cipher suites without sending the
+// supported_versions extension, which TLS 1.3 clients must send.
+func (h *ClientHello) MissingSupportedVersions() bool {
+	var tls13 bool
+	for _, suite := range h.CipherSuites {
+		if suite >= 0x1301 && suite <= 0x1305 {
+			tls13 = true
+			break
+		}
+	}
+	if !tls13 {
+		return false
+	}
+
+	for _, ext := range h.Extensions {
+		if ext.Type == ExtSupportedVersions {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the highest TLS version offered by the client.
+func (h *ClientHello) MaxVersion() uint16 {
+	var max uint16
+	for _, v := range h.SupportedVersions() {
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// Returns the JA3 fingerprint of the ClientHello: the MD5 hash of its JA3
+// string (see JA3String).
+func (h *ClientHello) JA3() string {
+	sum := md5.Sum([]byte(h.JA3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the JA3 string of the ClientHello: its version, cipher suites,
+// extensions, supported groups and EC point formats, GREASE values excluded.
+// See https://github.com/salesforce/ja3
+func (h *ClientHello) JA3String() string {
+	var exts, groups []uint16
+	var formats []byte
+	for _, ext := range h.Extensions {
+		exts = append(exts, ext.Type)
+
+		switch ext.Type {
+		case ExtSupportedGroups:
+			b := ext.Data
+			if len(b) < 2 || int(binary.BigEndian.Uint16(b)) > len(b[2:]) {
+				break
+			}
+			b = b[2 : 2+binary.BigEndian.Uint16(b)]
+			for i := 0; i + 1 < len(b); i += 2 {
+				groups = append(groups, binary.BigEndian.Uint16(b[i:i+2]))
+			}
+			break
+		case ExtECPointFormats:
+			if len(ext.Data) < 1 || int(ext.Data[0]) > len(ext.Data[1:]) {
+				break
+			}
+			formats = ext.Data[1 : 1+ext.Data[0]]
+			break
+		}
+	}
+
+	// Values are joined using dashes.
+	join := func(values []uint16) string {
+		var s []string
+		for _, v := range values {
+			if !IsGREASE(v) {
+				s = append(s, strconv.Itoa(int(v)))
+			}
+		}
+		return strings.Join(s, "-")
+	}
+	var f []string
+	for _, v := range formats {
+		f = append(f, strconv.Itoa(int(v)))
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)), join(h.CipherSuites), join(exts), join(groups),
+		strings.Join(f, "-"),
+	}, ",")
+}
+
+// Reports whether a value is a GREASE one (RFC 8701), used by clients in
+// various places of the ClientHello and which should be ignored.
+func IsGREASE(v uint16) bool {
+	return v & 0x0f0f == 0x0a0a && v >> 8 == v & 0xff
+}
+
+// Parse a TLS Plaintext record.
+func parseRecord(r io.Reader, hello *ClientHello) error {
+	// Check if record type is 22, aka handshake, before reading the rest
+	// of the header: non-TLS streams are rejected right away.
+	contentType := make([]byte, 1)
+	if _, err := io.ReadFull(r, contentType); err != nil {
+		return fmt.Errorf("Could not read TLS handshake (%w)", err)
+	}
+	if contentType[0] != 22 {
+		return ErrNotHandshake
+	}
+
+	var record struct {
+		Major, Minor  uint8
+		Length        uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &record); err != nil {
+		return fmt.Errorf("Could not read TLS handshake (%w)", err)
+	}
+
+	// Checks the TLS version is supported:
+	// 3.1: TLS 1.0, 3.2: TLS 1.1, 3.3: TLS 1.2 & TLS 1.3
+	if record.Major != 3 {
+		return fmt.Errorf("TLS version not supported (%d.%d)", record.Major, record.Minor)
+	}
+	switch (record.Minor) {
+	default:
+		return fmt.Errorf("TLS version not supported (%d.%d)", record.Major, record.Minor)
+	case 1,2,3:
+	}
+
+	// Check the handshake does not exceed the max authorized.
+	if record.Length > (16 * 1024) {
+		return fmt.Errorf("TLS record length exceed maximum (%d > 2^14)", record.Length)
+	}
+
+	hello.RecordVersion = uint16(record.Major) << 8 | uint16(record.Minor)
+	return nil
+}
+
+// Parse a TLS handshake message.
+func parseHandshake(r io.Reader) error {
+	// Check if the message type is ClientHello, before reading its length.
+	messageType := make([]byte, 1)
+	if _, err := io.ReadFull(r, messageType); err != nil {
+		return fmt.Errorf("Could not read TLS message header (%w)", err)
+	}
+	if messageType[0] != 1 {
+		return fmt.Errorf("%w (%d)", ErrNotClientHello, messageType[0])
+	}
+
+	messageLength := make([]byte, 3)
+	if _, err := io.ReadFull(r, messageLength); err != nil {
+		return fmt.Errorf("Could not read TLS message header (%w)", err)
+	}
+
+	// We do not check the handshake length as we'll try to read it fully anyway.
+
+	return nil
+}
+
+// Parse a TLS ClientHello message.
+func parseClientHello(r io.Reader, h *ClientHello) error {
+	var hello struct {
+		Version uint16
+		Random  [32]byte
+	}
+	if err := binary.Read(r, binary.BigEndian, &hello); err != nil {
+		return fmt.Errorf("Could not read TLS ClientHello message (%w)", err)
+	}
+
+	// Checks the version:
+	// 0x301: TLS 1.0, 0x302: TLS 1.1, 0x303 after TLS 1.2.
+	switch (hello.Version) {
+	default:
+		return fmt.Errorf("ClientHello version is not 0x303 (%#x)", hello.Version)
+	case 0x301, 0x302, 0x303:
+	}
+	h.Version = hello.Version
+	h.Random = hello.Random
+
+	// We do not check other fields strictly, but reading them ensure they
+	// are present (ie. the message seems to be a valid ClientHello).
+
+	// SessionID.
+	b, err := parseVector(r, 1)
+	if err != nil {
+		return fmt.Errorf("Could not read ClientHello session ID (%w)", err)
+	}
+	if len(b) > 32 {
+		return fmt.Errorf("ClientHello SessionID has an invalid length (%d)", len(b))
+	}
+	h.SessionID = b
+
+	// Cipher Suites.
+	b, err = parseVector(r, 2)
+	if err != nil {
+		return fmt.Errorf("Could not read ClientHello cipher suites (%w)", err)
+	}
+	if len(b) < 2 || len(b) % 2 != 0 {
+		return fmt.Errorf("ClientHello cipher suites has an invalid length (%d)", len(b))
+	}
+	for i := 0; i < len(b); i += 2 {
+		h.CipherSuites = append(h.CipherSuites, binary.BigEndian.Uint16(b[i:i+2]))
+	}
+
+	// Compression methods.
+	b, err = parseVector(r, 1)
+	if err != nil {
+		return fmt.Errorf("Could not read ClientHello compression methods (%w)", err)
+	}
+	if len(b) < 1 {
+		return fmt.Errorf("ClientHello compression methods has an invalid length (%d)", len(b))
+	}
+	h.CompressionMethods = b
+
+	// We reached the extensions (or none, which is valid).
+	return nil
+}
+
+// PeekServerName looks for the server name in the beginning of a TLS stream,
+// before the whole ClientHello message is received. It reports whether it could
+// be found: false is returned while more data is needed, or if the data isn't a
+// valid ClientHello. An empty name is returned if the message has no SNI
+// extension.
+func PeekServerName(b []byte) (string, bool) {
+	// Record and handshake headers, version and random.
+	if len(b) < 5 + 4 + 34 || b[0] != 22 || b[5] != 1 {
+		return "", false
+	}
+	b = b[5 + 4 + 34:]
+
+	// Session ID, cipher suites and compression methods.
+	for _, l := range []int{ 1, 2, 1 } {
+		if len(b) < l {
+			return "", false
+		}
+		n := int(b[0])
+		if l == 2 {
+			n = int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < l + n {
+			return "", false
+		}
+		b = b[l+n:]
+	}
+
+	if len(b) < 2 {
+		return "", false
+	}
+	exts := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	for exts >= 4 {
+		if len(b) < 4 {
+			return "", false
+		}
+		extType := binary.BigEndian.Uint16(b[:2])
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4 + length {
+			return "", false
+		}
+		if extType == ExtServerName {
+			name, err := parseSNI(b[4:4+length])
+			return name, err == nil
+		}
+		b = b[4+length:]
+		exts -= 4 + length
+	}
+	return "", true
+}
+
+// Parse the SNI from an SNI extension.
+func parseSNI(b []byte) (string, error) {
+	if len(b) < 2 {
+		return "", fmt.Errorf("SNI extension is empty.")
+	}
+
+	length := binary.BigEndian.Uint16(b[:2])
+	if int(length) > len(b[2:]) {
+		return "", fmt.Errorf("SNI extension is too short.")
+	}
+
+	b = b[2:2+length]
+
+	for len(b) >= 3 {
+		nameType := b[0]
+		vectLength := binary.BigEndian.Uint16(b[1:3])
+		if int(vectLength) > len(b[3:]) {
+			return "", fmt.Errorf("SNI vector is too short.")
+		}
+
+		if nameType != 0 {
+			b = b[3+vectLength:]
+			continue
+		}
+
+		return string(b[3 : 3+vectLength]), nil
+	}
+
+	// No DNS-based SNI.
+	return "", nil
+}
+
+// Parse a vector and returns a byte array. Takes the length of the len field as
+// an argument.
+func parseVector(r io.Reader, l uint) ([]byte, error) {
+	rawLen := make([]byte, l)
+	if err := binary.Read(r, binary.BigEndian, &rawLen); err != nil {
+		// No data to read. This can be valid.
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Could not read the vector lenght (%w)", err)
+	}
+
+	var length uint = 0
+	for _, b := range rawLen {
+		length = (length << 8) + uint(b)
+	}
+
+	if length == 0 {
+		return nil, nil
+	}
+
+	data := make([]byte, length)
+	if err := binary.Read(r, binary.BigEndian, &data); err != nil {
+		return nil, fmt.Errorf("Could not read the vector data (%w)", err)
+	}
+
+	return data, nil
+}
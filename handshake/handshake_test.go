@@ -0,0 +1,722 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package handshake
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func craft(bs ...[]byte) []byte {
+	var packet []byte
+	for _, b := range(bs) {
+		packet = append(packet, b...)
+	}
+	return packet
+}
+
+// Returns the first TLS record sent by a crypto/tls client, holding its
+// ClientHello message.
+func captureClientHello(t testing.TB, config *tls.Config) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go tls.Client(client, config).Handshake()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(server, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	return craft(header, payload)
+}
+
+func TestParseRecord(t *testing.T) {
+	tests := []struct {
+		desc    string
+		in      []byte
+		success bool
+	}{
+		{
+			"Empty message",
+			[]byte{},
+			false,
+		},
+		{
+			"Truncated message #0",
+			[]byte{22},
+			false,
+		},
+		{
+			"Truncated message #2",
+			[]byte{22, 3},
+			false,
+		},
+		{
+			"Truncated message #3",
+			[]byte{22, 3, 2},
+			false,
+		},
+		{
+			"Truncated message #4",
+			[]byte{22, 3, 2, 0},
+			false,
+		},
+		{
+			"SSL 3.0",
+			[]byte{22, 3, 0, 0, 0},
+			false,
+		},
+		{
+			"TLS 1.0, empty payload",
+			[]byte{22, 3, 1, 0, 0},
+			true,
+		},
+		{
+			"TLS 1.1, empty payload",
+			[]byte{22, 3, 2, 0, 0},
+			true,
+		},
+		{
+			"TLS 1.2 or later, empty payload",
+			[]byte{22, 3, 3, 0, 0},
+			true,
+		},
+		{
+			"TLS 1.2 or later, 1b payload",
+			[]byte{22, 3, 3, 0, 1, 0},
+			true,
+		},
+		{
+			"TLS 1.2 or later, max message length payload",
+			[]byte{22, 3, 3, 64, 0},
+			true,
+		},
+		{
+			"TLS 1.2 or later, (max message length + 1) payload",
+			[]byte{22, 3, 3, 64, 1},
+			false,
+		},
+		{
+			"Wrong TLS content type",
+			[]byte{99, 3, 2, 0, 0},
+			false,
+		},
+		{
+			"Wrong TLS major version",
+			[]byte{22, 4, 2, 0, 0},
+			false,
+		},
+		{
+			"Wrong TLS minor version",
+			[]byte{22, 3, 99, 0, 0},
+			false,
+		},
+	}
+
+	for _, test := range(tests) {
+		err := parseRecord(bytes.NewBuffer(test.in), &ClientHello{})
+		if (test.success && (err != nil)) || (!test.success && (err == nil)) {
+			t.Error(test.desc)
+		}
+	}
+}
+
+func TestParseHandshake(t *testing.T) {
+	tests := []struct {
+		desc    string
+		in      []byte
+		success bool
+	}{
+		{
+			"Empty handshake",
+			[]byte{},
+			false,
+		},
+		{
+			"Truncated handshake #0",
+			[]byte{1, 0},
+			false,
+		},
+		{
+			"Truncated handshake #1",
+			[]byte{1, 0, 0},
+			false,
+		},
+		{
+			"Wrong message type",
+			[]byte{99, 0, 0, 0},
+			false,
+		},
+		{
+			"ClientHello handshake, no payload",
+			[]byte{1, 0, 0, 0},
+			true,
+		},
+		{
+			"ClientHello handshake, 34b payload",
+			[]byte{1, 0, 0, 34},
+			true,
+		},
+	}
+
+	for _, test := range(tests) {
+		err := parseHandshake(bytes.NewBuffer(test.in))
+		if (test.success && (err != nil)) || (!test.success && (err == nil)) {
+			t.Error(test.desc)
+		}
+	}
+}
+
+func TestParseClientHello(t *testing.T) {
+	tests := []struct {
+		desc    string
+		in      []byte
+		success bool
+	}{
+		{
+			"Empty message",
+			[]byte{},
+			false,
+		},
+		{
+			"ClientHello TLS 1.2 or later, no payload",
+			craft([]byte{3, 3}, make([]byte, 32)),
+			false,
+		},
+		{
+			"ClientHello TLS 1.2 or later, 0'ed payload",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{0, 0, 0, 0}),
+			false,
+		},
+		{
+			"ClientHello TLS1.0, valid payload",
+			craft([]byte{3, 1}, make([]byte, 32), []byte{0, 0, 2, 0, 0, 1, 0}),
+			true,
+		},
+		{
+			"ClientHello TLS1.1, valid payload",
+			craft([]byte{3, 2}, make([]byte, 32), []byte{0, 0, 2, 0, 0, 1, 0}),
+			true,
+		},
+		{
+			"ClientHello TLS 1.2 or later, valid payload",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{0, 0, 2, 0, 0, 1, 0}),
+			true,
+		},
+		{
+			"ClientHello wrong TLS major version",
+			craft([]byte{4, 2}, make([]byte, 32), []byte{0, 0, 2, 0, 0, 1, 0}),
+			false,
+		},
+		{
+			"ClientHello wrong TLS minor version",
+			craft([]byte{3, 99}, make([]byte, 32), []byte{0, 0, 2, 0, 0, 1, 0}),
+			false,
+		},
+		{
+			"ClientHello TLS 1.2 or later, max session ID length",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{32}, make([]byte, 32),
+			      []byte{0, 2, 0, 0, 1, 0}),
+			true,
+		},
+		{
+			"ClientHello TLS 1.2 or later, (max + 1) session ID length",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{33}, make([]byte, 33),
+			      []byte{0, 2, 0, 0, 1, 0}),
+			false,
+		},
+		{
+			"ClientHello TLS 1.2 or later, invalid cipher suites length #0",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{0, 0, 1, 0, 1, 0}),
+			false,
+		},
+		{
+			"ClientHello TLS 1.2 or later, invalid cipher suites length #1",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{0, 0, 33}, make([]byte, 33),
+			      []byte{0, 1, 0}),
+			false,
+		},
+		{
+			"ClientHello TLS 1.2 or later, invalid compression methods length",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{0, 0, 1, 0, 0}),
+			false,
+		},
+		{
+			"ClientHello TLS 1.2 or later, valid payload, max size",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{32}, make([]byte, 32),
+			      []byte{0xff, 0xfe}, make([]byte, 0xfffe),
+			      []byte{0xff}, make([]byte, 0xff)),
+			true,
+		},
+	}
+
+	for _, test := range(tests) {
+		err := parseClientHello(bytes.NewBuffer(test.in), &ClientHello{})
+		if (test.success && (err != nil)) || (!test.success && (err == nil)) {
+			t.Error(test.desc)
+		}
+	}
+}
+
+func TestParseSNI(t *testing.T) {
+	tests := []struct{
+		desc    string
+		in      []byte
+		out     string
+		success bool
+	}{
+		{
+			"Empty SNI extension",
+			[]byte{},
+			"",
+			false,
+		},
+		{
+			"Invalid SNI extension vector",
+			[]byte{0},
+			"",
+			false,
+		},
+		{
+			"Empty SNI extension",
+			[]byte{0, 0},
+			"",
+			true,
+		},
+		{
+			"Invalid SNI vector",
+			[]byte{0, 2, 0, 0},
+			"",
+			true,
+		},
+		{
+			"Empty SNI vector",
+			[]byte{0, 3, 0, 0, 0},
+			"",
+			true,
+		},
+		{
+			"Invalid name type",
+			[]byte{0, 6, 1, 0, 3, 1, 2, 3},
+			"",
+			true,
+		},
+		{
+			"Valid SNI",
+			craft([]byte{0, 14, 0, 0, 11}, []byte("example.net")),
+			"example.net",
+			true,
+		},
+		{
+			"Multiple SNI vectors",
+			craft([]byte{0, 28, 0, 0, 11}, []byte("example.net"),
+			      []byte{0, 0, 11}, []byte("example.org")),
+			"example.net",
+			true,
+		},
+		{
+			"SNI in second vector",
+			craft([]byte{0, 22, 1, 0, 5, 1, 2, 3, 4, 5},
+			      []byte{0, 0, 11}, []byte("example.net")),
+			"example.net",
+			true,
+		},
+	}
+
+	for _, test := range(tests) {
+		sni, err := parseSNI(test.in)
+		if (test.success && (err != nil)) || (!test.success && (err == nil)) {
+			t.Error(test.desc)
+		}
+		if sni != test.out {
+			t.Errorf("%s: wrong SNI: got '%s', wanted '%s'", test.desc, sni, test.out)
+		}
+	}
+}
+
+func TestParseClientHelloMessage(t *testing.T) {
+	tests := []struct{
+		desc   string
+		config *tls.Config
+		sni    string
+	}{
+		{
+			"ClientHello with an SNI",
+			&tls.Config{ ServerName: "example.net" },
+			"example.net",
+		},
+		{
+			"ClientHello without an SNI",
+			&tls.Config{ InsecureSkipVerify: true },
+			"",
+		},
+		{
+			"TLS 1.2 only ClientHello",
+			&tls.Config{ ServerName: "example.net", MaxVersion: tls.VersionTLS12 },
+			"example.net",
+		},
+	}
+
+	for _, test := range(tests) {
+		msg := captureClientHello(t, test.config)
+
+		hello, err := ParseClientHello(bytes.NewReader(msg))
+		if err != nil {
+			t.Errorf("%s: %s", test.desc, err)
+			continue
+		}
+		if hello.ServerName != test.sni {
+			t.Errorf("%s: wrong SNI: got '%s', wanted '%s'", test.desc, hello.ServerName, test.sni)
+		}
+		if hello.Version != 0x303 {
+			t.Errorf("%s: wrong version: %#x", test.desc, hello.Version)
+		}
+		if len(hello.CipherSuites) == 0 || len(hello.Extensions) == 0 {
+			t.Errorf("%s: missing cipher suites or extensions", test.desc)
+		}
+
+		sni, err := ParseClientHelloSNI(bytes.NewReader(msg))
+		if err != nil || sni != test.sni {
+			t.Errorf("%s: ParseClientHelloSNI returned '%s' (%v)", test.desc, sni, err)
+		}
+
+		// Truncated messages must be rejected.
+		if _, err := ParseClientHello(bytes.NewReader(msg[:len(msg)-1])); err == nil {
+			t.Errorf("%s: truncated message was accepted", test.desc)
+		}
+	}
+}
+
+func TestPeekServerName(t *testing.T) {
+	for _, sni := range []string{ "example.net", "" } {
+		hello := captureClientHello(t, &tls.Config{ ServerName: sni, InsecureSkipVerify: true })
+
+		// Once found, the name must be reported for all the longer
+		// prefixes of the message.
+		found := -1
+		for i := 0; i <= len(hello); i++ {
+			name, ok := PeekServerName(hello[:i])
+			if !ok {
+				if found >= 0 {
+					t.Errorf("%q: found at %d bytes, not at %d", sni, found, i)
+				}
+				continue
+			}
+			if name != sni {
+				t.Errorf("%q: got name %q at %d bytes", sni, name, i)
+			}
+			if found < 0 {
+				found = i
+			}
+		}
+		if found < 0 {
+			t.Errorf("%q: name not found", sni)
+		}
+	}
+
+	if _, ok := PeekServerName([]byte("GET / HTTP/1.1\r\nHost: example.net\r\n\r\n")); ok {
+		t.Error("found a name in a non-TLS stream")
+	}
+}
+
+func TestALPN(t *testing.T) {
+	tests := []struct{
+		protos []string
+	}{
+		{ nil },
+		{ []string{ "h2", "http/1.1" } },
+	}
+
+	for _, test := range(tests) {
+		config := &tls.Config{ ServerName: "example.net", NextProtos: test.protos }
+		hello, err := ParseClientHello(bytes.NewReader(captureClientHello(t, config)))
+		if err != nil {
+			t.Errorf("%v: %s", test.protos, err)
+			continue
+		}
+		if protos := hello.ALPN(); fmt.Sprint(protos) != fmt.Sprint(test.protos) {
+			t.Errorf("got protocols %v, wanted %v", protos, test.protos)
+		}
+	}
+}
+
+func TestSupportedVersions(t *testing.T) {
+	tests := []struct{
+		desc   string
+		config *tls.Config
+		max    uint16
+	}{
+		{
+			"TLS 1.2 and TLS 1.3 client",
+			&tls.Config{ ServerName: "example.net", MinVersion: tls.VersionTLS12 },
+			VersionTLS13,
+		},
+		{
+			"TLS 1.3 only client",
+			&tls.Config{ ServerName: "example.net", MinVersion: tls.VersionTLS13 },
+			VersionTLS13,
+		},
+		{
+			"TLS 1.2 only client",
+			&tls.Config{ ServerName: "example.net", MinVersion: tls.VersionTLS12,
+				     MaxVersion: tls.VersionTLS12 },
+			VersionTLS12,
+		},
+	}
+
+	for _, test := range(tests) {
+		hello, err := ParseClientHello(bytes.NewReader(captureClientHello(t, test.config)))
+		if err != nil {
+			t.Errorf("%s: %s", test.desc, err)
+			continue
+		}
+		if max := hello.MaxVersion(); max != test.max {
+			t.Errorf("%s: wrong max version: got %#x, wanted %#x", test.desc, max, test.max)
+		}
+	}
+
+	// Crafted supported_versions extensions.
+	crafted := []struct{
+		desc     string
+		hello    ClientHello
+		versions []uint16
+	}{
+		{
+			"No extension",
+			ClientHello{ Version: VersionTLS11 },
+			[]uint16{ VersionTLS11 },
+		},
+		{
+			"GREASE values are ignored",
+			ClientHello{ Version: VersionTLS12, Extensions: []Extension{
+				{ ExtSupportedVersions, []byte{6, 0xaa, 0xaa, 3, 4, 3, 3} },
+			}},
+			[]uint16{ VersionTLS13, VersionTLS12 },
+		},
+		{
+			"Invalid extension",
+			ClientHello{ Version: VersionTLS12, Extensions: []Extension{
+				{ ExtSupportedVersions, []byte{4, 3, 4} },
+			}},
+			[]uint16{ VersionTLS12 },
+		},
+	}
+
+	for _, test := range(crafted) {
+		versions := test.hello.SupportedVersions()
+		if len(versions) != len(test.versions) {
+			t.Errorf("%s: got %v, wanted %v", test.desc, versions, test.versions)
+			continue
+		}
+		for i := range(versions) {
+			if versions[i] != test.versions[i] {
+				t.Errorf("%s: got %v, wanted %v", test.desc, versions, test.versions)
+			}
+		}
+	}
+}
+
+// ClientHello messages captured from real clients, with the SNI they hold.
+var fixtures = []struct{
+	file string
+	sni  string
+	ja3  string
+}{
+	{ "testdata/curl-7.88.1.bin", "www.example.com", "0149f47eabf9a20d0893e2a44e5a6323" },
+	{ "testdata/openssl-3.0.17.bin", "www.example.org", "a3afc2c46ba4a7d7fbe1cfb7a3031c2f" },
+}
+
+func TestParseFixtures(t *testing.T) {
+	for _, fixture := range(fixtures) {
+		msg, err := os.ReadFile(fixture.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sni, err := ParseClientHelloSNI(bytes.NewReader(msg))
+		if err != nil {
+			t.Errorf("%s: %s", fixture.file, err)
+		}
+		if sni != fixture.sni {
+			t.Errorf("%s: wrong SNI: got '%s', wanted '%s'", fixture.file, sni, fixture.sni)
+		}
+
+		hello, err := ParseClientHello(bytes.NewReader(msg))
+		if err != nil {
+			t.Fatalf("%s: %s", fixture.file, err)
+		}
+		if ja3 := hello.JA3(); ja3 != fixture.ja3 {
+			t.Errorf("%s: wrong JA3: got '%s', wanted '%s'", fixture.file, ja3, fixture.ja3)
+		}
+	}
+}
+
+func TestJA3String(t *testing.T) {
+	hello := &ClientHello{
+		Version: VersionTLS12,
+		CipherSuites: []uint16{ 0x1a1a, 4865, 49195 },
+		Extensions: []Extension{
+			{ Type: 0x2a2a },
+			{ Type: ExtServerName },
+			{ Type: ExtSupportedGroups, Data: []byte{ 0, 6, 0x3a, 0x3a, 0, 29, 0, 23 } },
+			{ Type: ExtECPointFormats, Data: []byte{ 1, 0 } },
+			{ Type: ExtSupportedVersions, Data: []byte{ 2, 3, 4 } },
+		},
+	}
+
+	want := "771,4865-49195,0-10-11-43,29-23,0"
+	if s := hello.JA3String(); s != want {
+		t.Errorf("got '%s', wanted '%s'", s, want)
+	}
+
+	// Missing fields are left empty.
+	hello = &ClientHello{ Version: VersionTLS10, CipherSuites: []uint16{ 47 } }
+	if s := hello.JA3String(); s != "769,47,,," {
+		t.Errorf("got '%s', wanted '769,47,,,'", s)
+	}
+}
+
+func TestDeprecatedCipherSuites(t *testing.T) {
+	hello := &ClientHello{ CipherSuites: []uint16{ 0x1a1a, 4865, 0x0005, 49195, 0x000a, 0x0003 } }
+	got := fmt.Sprint(hello.DeprecatedCipherSuites())
+	if want := "[0x0005 (RC4) 0x000a (3DES) 0x0003 (export)]"; got != want {
+		t.Errorf("got %s, wanted %s", got, want)
+	}
+
+	hello = &ClientHello{ CipherSuites: []uint16{ 4865, 4866, 49195 } }
+	if suites := hello.DeprecatedCipherSuites(); len(suites) != 0 {
+		t.Errorf("got deprecated suites %v", suites)
+	}
+}
+
+func BenchmarkParseClientHelloSNI(b *testing.B) {
+	type input struct {
+		name string
+		msg  []byte
+	}
+	var inputs []input
+	for _, fixture := range(fixtures) {
+		msg, err := os.ReadFile(fixture.file)
+		if err != nil {
+			b.Fatal(err)
+		}
+		inputs = append(inputs, input{ fixture.file[len("testdata/"):], msg })
+	}
+
+	inputs = append(inputs, input{ "crypto-tls", captureClientHello(b, &tls.Config{ ServerName: "example.net" }) })
+
+	for _, in := range(inputs) {
+		b.Run(in.name, func(b *testing.B) {
+			b.SetBytes(int64(len(in.msg)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := ParseClientHelloSNI(bytes.NewReader(in.msg)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseNonTLS(t *testing.T) {
+	tests := []struct {
+		desc string
+		in   []byte
+		err  error
+	}{
+		{
+			"HTTP request",
+			[]byte("GET / HTTP/1.1\r\nHost: example.net\r\n\r\n"),
+			ErrNotHandshake,
+		},
+		{
+			"SSH banner",
+			[]byte("SSH-2.0-OpenSSH_9.6\r\n"),
+			ErrNotHandshake,
+		},
+		{
+			"TLS alert record",
+			[]byte{21, 3, 3, 0, 2, 2, 40},
+			ErrNotHandshake,
+		},
+		{
+			"ServerHello message",
+			craft([]byte{22, 3, 3, 0, 4}, []byte{2, 0, 0, 0}),
+			ErrNotClientHello,
+		},
+	}
+
+	for _, test := range(tests) {
+		if _, err := ParseClientHello(bytes.NewReader(test.in)); !errors.Is(err, test.err) {
+			t.Errorf("%s: got error '%v', wanted '%s'", test.desc, err, test.err)
+		}
+	}
+
+	// Non-TLS streams are rejected without waiting for more data.
+	for _, in := range([][]byte{ []byte("G"), []byte{22, 3, 3, 0, 4, 2} }) {
+		r, w := io.Pipe()
+		go w.Write(in)
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := ParseClientHello(r)
+			done<- err
+		}()
+
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("%q: non-TLS stream accepted", in)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%q: parser waited for more data", in)
+		}
+		w.Close()
+	}
+}
+
+func TestRecordVersion(t *testing.T) {
+	tests := []struct {
+		in      []byte
+		version uint16
+		ok      bool
+	}{
+		{ []byte{22, 3, 1, 0, 42}, 0x301, true },
+		{ []byte{22, 3, 0}, 0x300, true },
+		{ []byte{22, 3}, 0, false },
+		{ []byte{21, 3, 3, 0, 2}, 0, false },
+		{ nil, 0, false },
+	}
+	for _, test := range(tests) {
+		version, ok := RecordVersion(test.in)
+		if version != test.version || ok != test.ok {
+			t.Errorf("%v: got %#x %t, wanted %#x %t", test.in, version, ok, test.version, test.ok)
+		}
+	}
+}
@@ -16,13 +16,24 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+	"github.com/atenart/sniproxy/proxy"
 )
 
 var (
-	conf = flag.String("conf", "", "Configuration file.")
-	bind = flag.String("bind", ":443", "Address and port to bind to.")
+	conf        = flag.String("conf", "", "Configuration file, http(s) URL or - (standard input).")
+	confRefresh = flag.Duration("conf-refresh", 0, "Interval between two reads of the configuration, to reload it when modified (0 to disable).")
+	bind        = flag.String("bind", ":443", "Address and port to bind to, unless listeners are configured.")
+	probe       = flag.Bool("probe-backends", false, "Check the backends can be reached at startup.")
+	printTable  = flag.Bool("print-routes", false, "Print the routing table at startup and after each reload.")
 )
 
 func main() {
@@ -31,12 +42,129 @@ func main() {
 		log.Fatal("No config provided. Aborting.")
 	}
 
-	p := &Proxy{}
-	if err := p.Config.ReadFile(*conf); err != nil {
+	if *confRefresh > 0 && *conf == "-" {
+		log.Fatal("The configuration can't be reloaded when read from the standard input.")
+	}
+
+	p := &proxy.Proxy{}
+	data, err := config.Fetch(*conf)
+	if err != nil {
 		log.Fatalf("Could not read config %q (%s)", *conf, err)
 	}
+	if err := p.Config.Parse(data); err != nil {
+		log.Fatalf("Invalid config %q (%s)", *conf, err)
+	}
+
+	if err := proxy.SetupLogs(&p.Config); err != nil {
+		log.Fatal(err)
+	}
+	// The log files are closed once the connections records are written.
+	p.Closers = append(p.Closers, proxy.CloserFunc(proxy.CloseLogs))
+
+	// Reopen the log files on SIGUSR1 (or SIGHUP), e.g. after logrotate
+	// rotated them. SIGHUP also reloads the configuration.
+	sig := make(chan os.Signal, 1)
+	reload := make(chan struct{}, 1)
+	signal.Notify(sig, reopenSignals...)
+	go func() {
+		for s := range sig {
+			proxy.ReopenLogs()
+			if s != syscall.SIGHUP {
+				continue
+			}
+			select {
+			case reload <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	if *printTable {
+		proxy.PrintRoutes(os.Stderr, &p.Config)
+	}
+	if *probe {
+		probeBackends(&p.Config)
+	}
+
+	if *conf != "-" {
+		go watchConfig(p, *conf, *confRefresh, reload, data)
+	}
+
+	// Shut down gracefully on SIGTERM (or SIGINT), right away on the
+	// second one.
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-stop
+		p.Shutdown()
+		<-stop
+		log.Fatal("Shutdown forced")
+	}()
+
+	// Use the socket passed by systemd, if any, unless a bind address was
+	// given.
+	if sd, ok := proxy.SystemdBind(); ok && !flagSet("bind") {
+		log.Printf("Using the socket passed by systemd (%s)", sd)
+		*bind = sd
+	}
 
 	if err := p.ListenAndServe(*bind); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// Reads the configuration from its source every interval (if not 0) and when
+// asked to, and reloads it when modified. The current configuration is kept
+// when the source can't be read or holds an invalid configuration.
+func watchConfig(p *proxy.Proxy, source string, interval time.Duration, reload <-chan struct{}, last []byte) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.Tick(interval)
+	}
+
+	for {
+		select {
+		case <-tick:
+		case <-reload:
+		}
+
+		data, err := config.Fetch(source)
+		if err != nil {
+			log.Printf("Could not read config %q, keeping the current one (%s)", source, err)
+			continue
+		}
+		// Only the configurations applied are remembered, so that one
+		// failing to parse or to reload is retried.
+		if bytes.Equal(data, last) {
+			continue
+		}
+
+		c := &config.Config{}
+		if err := c.Parse(data); err != nil {
+			log.Printf("Invalid config %q, keeping the current one (%s)", source, err)
+			continue
+		}
+		if err := p.Reload(*c); err != nil {
+			c.Close()
+			log.Printf("Could not reload config %q, keeping the current one (%s)", source, err)
+			continue
+		}
+
+		last = data
+		log.Printf("Reloaded config %q", source)
+		if *printTable {
+			proxy.PrintRoutes(os.Stderr, c)
+		}
+	}
+}
+
+// Reports whether a command line flag was given.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,143 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+	"github.com/atenart/sniproxy/proxy"
+)
+
+func TestWatchConfigRetry(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind := free.Addr().String()
+	free.Close()
+	p := &proxy.Proxy{ Config: config.Config{
+		Listeners: []*config.Listener{{ Bind: bind }},
+		HandshakeTimeout: 5*time.Second,
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.ListenAndServeContext(ctx, "")
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", bind)
+		if err == nil {
+			c.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+
+	// The new configuration binds an address in use, its reload failing
+	// until the address is freed while the file is left untouched.
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := filepath.Join(t.TempDir(), "sniproxy.conf")
+	data := fmt.Sprintf("listen %s\n\nexample.net {\n\tbackend 127.0.0.1:8443\n}\n", busy.Addr())
+	if err := os.WriteFile(source, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reload := make(chan struct{})
+	go watchConfig(p, source, 0, reload, nil)
+
+	// The second reload is only received once the first one failed.
+	reload<- struct{}{}
+	reload<- struct{}{}
+	reload<- struct{}{}
+	if p.CurrentConfig() != &p.Config {
+		t.Fatal("failed reload replaced the configuration")
+	}
+
+	busy.Close()
+	reload<- struct{}{}
+	for i := 0; p.CurrentConfig() == &p.Config; i++ {
+		if i == 100 {
+			t.Fatal("configuration not reloaded once the address was freed")
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+	if bind := p.CurrentConfig().Listeners[0].Bind; bind != busy.Addr().String() {
+		t.Errorf("got listener %q, wanted %q", bind, busy.Addr())
+	}
+}
+
+func TestProbeBackends(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	reachable, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reachable.Close()
+	unreachable, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := unreachable.Addr().String()
+	unreachable.Close()
+
+	var c config.Config
+	if err := c.Parse([]byte(fmt.Sprintf("example.net {\n\tbackend %s\n}\n\nexample.org {\n\tbackend %s\n}\n",
+					     reachable.Addr(), bad))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unreachable backends are only reported, the probe returning once
+	// all the backends were dialed.
+	done := make(chan struct{})
+	go func() {
+		probeBackends(&c)
+		close(done)
+	}()
+	select {
+	case <-done:
+		break
+	case <-time.After(5*time.Second):
+		t.Fatal("backends probe did not return")
+	}
+
+	if !strings.Contains(logs.String(), "Warning: backend " + bad + " of route") {
+		t.Errorf("no warning about %s in %q", bad, logs.String())
+	}
+	if strings.Contains(logs.String(), reachable.Addr().String()) {
+		t.Errorf("warning about the reachable backend %s in %q", reachable.Addr(), logs.String())
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Dials each backend of the configuration once, concurrently, and logs a
+// warning for those which can't be reached. Only meant to catch configuration
+// mistakes at startup: unreachable backends are still used.
+func probeBackends(c *config.Config) {
+	var wg sync.WaitGroup
+	for _, route := range c.Routes {
+		backends := route.CurrentBackends()
+		if len(backends) == 0 {
+			log.Printf("Warning: route %s has no backend", route.Label())
+			continue
+		}
+
+		for _, backend := range backends {
+			// Forwarding routes have no fixed backend.
+			if backend.SNIPort != 0 {
+				continue
+			}
+			wg.Add(1)
+			go func(route *config.Route, backend *config.Backend) {
+				defer wg.Done()
+				c, err := net.DialTimeout(route.DialNetwork(), backend.Address, 3*time.Second)
+				if err != nil {
+					log.Printf("Warning: backend %s of route %s is unreachable (%s)",
+						   backend.Address, route.Label(), err)
+					return
+				}
+				c.Close()
+			}(route, backend)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,339 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// State of a route, as reported by the admin API.
+type adminRoute struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// Configuration currently used, as reported by the admin API.
+type adminConfig struct {
+	Listeners []adminListener    `json:"listeners"`
+	Routes    []adminRouteConfig `json:"routes"`
+}
+
+type adminListener struct {
+	Bind        string   `json:"bind"`
+	AcceptProxy []string `json:"accept_proxy,omitempty"`
+	Trusted     bool     `json:"trusted,omitempty"`
+}
+
+type adminRouteConfig struct {
+	Name        string            `json:"name,omitempty"`
+	Label       string            `json:"label"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Domains     []string          `json:"domains"`
+	Clients     []string          `json:"clients,omitempty"`
+	DomainLists []string          `json:"domain_lists,omitempty"`
+	SRV         string            `json:"srv,omitempty"`
+	Lookup      string            `json:"lookup,omitempty"`
+	Discovery   string            `json:"discovery,omitempty"`
+	Backends    []adminBackend    `json:"backends"`
+	Allow       []string          `json:"allow,omitempty"`
+	Deny        []string          `json:"deny,omitempty"`
+	AllowLists  []string          `json:"allow_lists,omitempty"`
+	DenyLists   []string          `json:"deny_lists,omitempty"`
+	Enabled     bool              `json:"enabled"`
+	Maintenance bool              `json:"maintenance"`
+	HealthCheck string            `json:"health_check,omitempty"`
+}
+
+type adminBackend struct {
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+	Up      bool   `json:"up"`
+}
+
+// Returns the configuration currently used, as reported by the admin API. The
+// credentials of the URLs are redacted.
+func (p *Proxy) adminConfig() adminConfig {
+	c := p.config()
+	out := adminConfig{ Listeners: []adminListener{}, Routes: []adminRouteConfig{} }
+
+	for _, l := range c.Listeners {
+		out.Listeners = append(out.Listeners, adminListener{
+			Bind: l.Bind,
+			AcceptProxy: subnetStrings(l.AcceptProxy),
+			Trusted: l.Trusted,
+		})
+	}
+
+	for _, route := range c.Routes {
+		r := adminRouteConfig{
+			Name: route.Name,
+			Label: route.Label(),
+			Tags: route.Tags,
+			Domains: []string{},
+			Clients: subnetStrings(route.Clients),
+			SRV: route.SRV,
+			Lookup: route.Lookup,
+			Discovery: route.Discovery,
+			Backends: []adminBackend{},
+			Allow: subnetStrings(route.Allow),
+			Deny: subnetStrings(route.Deny),
+			Enabled: route.Enabled(),
+			Maintenance: route.Maintenance,
+		}
+		for _, domain := range route.Domains {
+			r.Domains = append(r.Domains, config.DomainName(domain))
+		}
+		for _, list := range route.DomainLists {
+			r.DomainLists = append(r.DomainLists, list.File)
+		}
+		for _, backend := range route.CurrentBackends() {
+			r.Backends = append(r.Backends, adminBackend{
+				Address: backend.Address,
+				Weight: backend.Weight,
+				Up: route.BackendUp(backend),
+			})
+		}
+		for _, list := range route.AllowLists {
+			r.AllowLists = append(r.AllowLists, redactURL(list.Source))
+		}
+		for _, list := range route.DenyLists {
+			r.DenyLists = append(r.DenyLists, redactURL(list.Source))
+		}
+		if route.HealthCheck > 0 {
+			r.HealthCheck = route.HealthCheck.String()
+		}
+		out.Routes = append(out.Routes, r)
+	}
+	return out
+}
+
+func subnetStrings(subnets []*net.IPNet) []string {
+	var s []string
+	for _, subnet := range subnets {
+		s = append(s, subnet.String())
+	}
+	return s
+}
+
+// Redacts the password of a URL, if any. Other values are returned as is.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	return u.Redacted()
+}
+
+// Serves the admin API until the context is canceled. Named routes can be
+// listed, and enabled or disabled; changes are kept in memory only. The
+// configuration currently used, the connections being routed and the metrics
+// can be retrieved.
+func (p *Proxy) serveAdmin(ctx context.Context, bind string) error {
+	return serveHTTP(ctx, bind, p.restrictAdmin(p.adminHandler()))
+}
+
+// Returns the handler of the admin API, including the handlers added by
+// embedders.
+func (p *Proxy) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", p.serveMetricsPage)
+	mux.HandleFunc("/ready", p.serveReady)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK\n"))
+	})
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(p.routedConns())
+	})
+	mux.HandleFunc("/routes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		routes := []adminRoute{}
+		for _, route := range p.config().Routes {
+			if route.Name != "" {
+				routes = append(routes, adminRoute{ Name: route.Name, Enabled: route.Enabled() })
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(routes)
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(p.adminConfig())
+	})
+	// POST /routes/<name>/enable and /routes/<name>/disable.
+	mux.HandleFunc("/routes/", func(w http.ResponseWriter, r *http.Request) {
+		name, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/routes/"), "/")
+		if !ok || name == "" || (action != "enable" && action != "disable") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p.setRouteEnabled(w, name, action == "enable")
+	})
+	for path, h := range p.AdminHandlers {
+		mux.Handle(path, h)
+	}
+	return mux
+}
+
+// Restricts the metrics and admin requests to the configured client networks
+// and credentials, if any.
+func (p *Proxy) restrictAdmin(h http.Handler) http.Handler {
+	c := &p.Config
+	if c.AdminUser == "" && len(c.AdminAllow) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(c.AdminAllow) > 0 {
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				if ip := net.ParseIP(host); ip == nil || !containsIP(c.AdminAllow, ip) {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+			}
+		}
+		if c.AdminUser != "" {
+			user, password, ok := r.BasicAuth()
+			if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(c.AdminUser)) != 1 ||
+			   subtle.ConstantTimeCompare([]byte(password), []byte(c.AdminPassword)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="sniproxy"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func containsIP(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Connection being routed, as reported by the admin API.
+type adminConn struct {
+	Client   string `json:"client"`
+	SNI      string `json:"sni"`
+	Route    string `json:"route"`
+	Backend  string `json:"backend"`
+	Accepted string `json:"accepted"`
+	Duration string `json:"duration"`
+}
+
+// Registers a connection as routed to a backend, until the returned function
+// is called. It is considered active from then on.
+func (conn *Conn) trackRouted(backend *config.Backend) func() {
+	conn.lastActive.Store(time.Now().UnixNano())
+	if conn.proxy == nil {
+		return func() {}
+	}
+
+	c := adminConn{
+		Client: conn.RemoteAddr().String(),
+		SNI: conn.Hello.ServerName,
+		Route: conn.route.Label(),
+		Backend: backend.Address,
+		Accepted: conn.accepted.Format(time.RFC3339),
+	}
+	conn.proxy.routed.Store(conn, c)
+	return func() { conn.proxy.routed.Delete(conn) }
+}
+
+// Returns the connections being routed, the oldest first.
+func (p *Proxy) routedConns() []adminConn {
+	type routed struct {
+		accepted time.Time
+		info     adminConn
+	}
+	var conns []routed
+	p.routed.Range(func(k, v any) bool {
+		conn := k.(*Conn)
+		info := v.(adminConn)
+		info.Duration = time.Since(conn.accepted).Round(time.Millisecond).String()
+		conns = append(conns, routed{ conn.accepted, info })
+		return true
+	})
+	sort.Slice(conns, func(i, j int) bool { return conns[i].accepted.Before(conns[j].accepted) })
+
+	out := []adminConn{}
+	for _, c := range conns {
+		out = append(out, c.info)
+	}
+	return out
+}
+
+// Enables or disables the routes having a given name.
+func (p *Proxy) setRouteEnabled(w http.ResponseWriter, name string, enabled bool) {
+	var routes []*config.Route
+	for _, route := range p.config().Routes {
+		if route.Name == name {
+			routes = append(routes, route)
+		}
+	}
+	if len(routes) == 0 {
+		http.Error(w, "No route named " + name, http.StatusNotFound)
+		return
+	}
+
+	for _, route := range routes {
+		route.SetEnabled(enabled)
+	}
+
+	state := "disabled"
+	if enabled {
+		state = "enabled"
+	}
+	log.Printf("Route %s %s using the admin API", name, state)
+	w.WriteHeader(http.StatusNoContent)
+}
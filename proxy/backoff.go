@@ -0,0 +1,75 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Delays of successive attempts, growing exponentially from a base up to a
+// maximum and randomized following a jitter strategy, so that the clients or
+// checks failing at once do not retry in sync.
+type backoff struct {
+	base    time.Duration
+	max     time.Duration
+	jitter  uint
+	attempt uint
+	prev    time.Duration
+}
+
+func newBackoff(base, max time.Duration, jitter uint) *backoff {
+	return &backoff{ base: base, max: max, jitter: jitter }
+}
+
+// Returns the delay before the next attempt, between 0 and the maximum.
+func (b *backoff) next() time.Duration {
+	var d time.Duration
+	if b.jitter == config.JitterDecorrelated {
+		prev := max(b.prev, b.base)
+		d = b.base + time.Duration(rand.Int63n(int64(3*prev - b.base) + 1))
+	} else {
+		d = b.base
+		for i := uint(0); i < b.attempt && d < b.max; i++ {
+			d *= 2
+		}
+		d = min(d, b.max)
+		if b.jitter == config.JitterFull {
+			d = time.Duration(rand.Int63n(int64(d) + 1))
+		}
+	}
+	d = min(d, b.max)
+
+	b.prev = d
+	b.attempt++
+	return d
+}
+
+// Restarts the delays from the base, once an attempt succeeded.
+func (b *backoff) reset() {
+	b.attempt, b.prev = 0, 0
+}
+
+// Returns an interval moved forward or backward by a random share of it, up to
+// half the given share (0 to 1).
+func spread(interval time.Duration, share float64) time.Duration {
+	if share == 0 {
+		return interval
+	}
+	return interval + time.Duration((rand.Float64() - .5) * share * float64(interval))
+}
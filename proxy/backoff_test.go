@@ -0,0 +1,84 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+func TestBackoff(t *testing.T) {
+	base, max := 10*time.Millisecond, 200*time.Millisecond
+
+	// Without jitter, the delays double up to the maximum.
+	b := newBackoff(base, max, config.JitterNone)
+	for _, want := range []time.Duration{ 10, 20, 40, 80, 160, 200, 200 } {
+		if d := b.next(); d != want*time.Millisecond {
+			t.Errorf("none: got %s, wanted %s", d, want*time.Millisecond)
+		}
+	}
+	b.reset()
+	if d := b.next(); d != base {
+		t.Errorf("none: got %s after a reset, wanted %s", d, base)
+	}
+
+	// Full jitter stays between 0 and the exponential delay, and spreads
+	// over it.
+	b = newBackoff(base, max, config.JitterFull)
+	for attempt := 0; attempt < 8; attempt++ {
+		bound := min(base << attempt, max)
+		var low, high bool
+		for i := 0; i < 1000; i++ {
+			c := *b
+			d := c.next()
+			if d < 0 || d > bound {
+				t.Fatalf("full: attempt %d: got %s, not within [0, %s]", attempt, d, bound)
+			}
+			low = low || d < bound/2
+			high = high || d >= bound/2
+		}
+		if !low || !high {
+			t.Errorf("full: attempt %d: delays not spread over [0, %s]", attempt, bound)
+		}
+		b.next()
+	}
+
+	// Decorrelated jitter stays between the base and three times the
+	// previous delay, within the maximum.
+	b = newBackoff(base, max, config.JitterDecorrelated)
+	prev := base
+	for i := 0; i < 1000; i++ {
+		d := b.next()
+		if d < base || d > min(3*prev, max) {
+			t.Fatalf("decorrelated: got %s after %s, not within [%s, %s]", d, prev, base, min(3*prev, max))
+		}
+		prev = d
+	}
+}
+
+func TestSpread(t *testing.T) {
+	interval := time.Second
+	if d := spread(interval, 0); d != interval {
+		t.Errorf("got %s without jitter, wanted %s", d, interval)
+	}
+	for i := 0; i < 1000; i++ {
+		if d := spread(interval, 0.2); d < 900*time.Millisecond || d > 1100*time.Millisecond {
+			t.Fatalf("got %s, not within 10%% of %s", d, interval)
+		}
+	}
+}
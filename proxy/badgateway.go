@@ -0,0 +1,72 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// A client connection whose already consumed handshake is read again first.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Terminates TLS using the route fallback certificate, replaying the handshake
+// already read from the client, and serves a fallback page with the given HTTP
+// status.
+func (conn *Conn) serveBadGateway(bg *config.BadGateway, handshake []byte, status int, page []byte) error {
+	conn.SetDeadline(time.Now().Add(5*time.Second))
+
+	c := tls.Server(&replayConn{ conn.TCPConn, io.MultiReader(bytes.NewReader(handshake), conn.TCPConn) },
+			&tls.Config{
+				Certificates: []tls.Certificate{ bg.Certificate },
+				// Prevent clients from negotiating HTTP/2.
+				NextProtos: []string{ "http/1.1" },
+			})
+	defer c.Close()
+
+	if err := c.Handshake(); err != nil {
+		return fmt.Errorf("Could not complete the bad gateway handshake (%s)", err)
+	}
+
+	// Read the request before replying, so that clients do not see a
+	// reset. Its content does not matter.
+	if req, err := http.ReadRequest(bufio.NewReader(c)); err == nil {
+		req.Body.Close()
+	}
+
+	_, err := fmt.Fprintf(c, "HTTP/1.1 %d %s\r\n" +
+				 "Content-Type: text/html; charset=utf-8\r\n" +
+				 "Content-Length: %d\r\n" +
+				 "Cache-Control: no-store\r\n" +
+				 "Connection: close\r\n\r\n%s", status, http.StatusText(status), len(page), page)
+	return err
+}
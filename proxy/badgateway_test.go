@@ -0,0 +1,105 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+func TestBadGateway(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Borrow the certificate of a test server.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := srv.TLS.Certificates[0]
+	srv.Close()
+
+	// Routes whose backend can't be dialed.
+	route := func(bg *config.BadGateway) *config.Route {
+		return &config.Route{
+			Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			Backends: []*config.Backend{{ Address: "127.0.0.1:1", Weight: 1 }},
+			BadGateway: bg,
+		}
+	}
+
+	// Without a fallback, the client gets an alert.
+	conf := &config.Config{ Routes: []*config.Route{ route(nil) }}
+	if err := dispatchTLSClient(t, conf); !strings.Contains(fmt.Sprint(err), "internal error") {
+		t.Errorf("got client error '%v', wanted an internal error alert", err)
+	}
+
+	// With a fallback, the handshake completes and the page is served.
+	bg := &config.BadGateway{ Certificate: cert, Page: []byte("unreachable") }
+	conf = &config.Config{ Routes: []*config.Route{ route(bg) }}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	type response struct {
+		status int
+		body   string
+		err    error
+	}
+	res := make(chan response, 1)
+	go func() {
+		c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ ServerName: "example.net", InsecureSkipVerify: true })
+		if err != nil {
+			res <- response{ err: err }
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("GET / HTTP/1.1\r\nHost: example.net\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			res <- response{ err: err }
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		res <- response{ resp.StatusCode, string(body), err }
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &Conn{ TCPConn: c.(*net.TCPConn), Config: conf, proxy: &Proxy{}, span: noopSpan{}, accepted: time.Now() }
+	conn.dispatch(context.Background())
+	conn.Close()
+
+	if r := <-res; r.err != nil || r.status != http.StatusBadGateway || r.body != "unreachable" {
+		t.Errorf("got status %d and page %q (%v), wanted the bad gateway page", r.status, r.body, r.err)
+	}
+}
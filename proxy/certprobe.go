@@ -0,0 +1,184 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Result of the latest certificate probe of a route backend.
+type certProbe struct {
+	route    *config.Route
+	backend  string
+	ok       bool
+	notAfter time.Time
+}
+
+// Latest certificate probes results, indexed by route and backend address.
+type certProbes struct {
+	mu     sync.Mutex
+	probes map[*config.Route]map[string]certProbe
+}
+
+// Stores the results of a probing round of a route, replacing the previous
+// ones.
+func (c *certProbes) set(route *config.Route, probes map[string]certProbe) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.probes == nil {
+		c.probes = make(map[*config.Route]map[string]certProbe)
+	}
+	c.probes[route] = probes
+}
+
+// Drops the results of the routes not in a list.
+func (c *certProbes) retain(routes []*config.Route) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for route := range c.probes {
+		if !slices.Contains(routes, route) {
+			delete(c.probes, route)
+		}
+	}
+}
+
+// Returns all the probes results.
+func (c *certProbes) all() []certProbe {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var all []certProbe
+	for _, probes := range c.probes {
+		for _, probe := range probes {
+			all = append(all, probe)
+		}
+	}
+	return all
+}
+
+// Periodically retrieves the certificates presented by the backends of a
+// route, using its probe server name, until the context is canceled.
+func (p *Proxy) probeCerts(ctx context.Context, route *config.Route) {
+	ticker := time.NewTicker(route.CertProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		probes := make(map[string]certProbe)
+		for _, backend := range route.CurrentBackends() {
+			probe := certProbe{ route: route, backend: backend.Address }
+			notAfter, err := fetchCertExpiry(ctx, route, backend)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Could not probe the certificate of backend %s for %s (%s)",
+					   backend.Address, route.CertProbe, err)
+			} else {
+				probe.ok, probe.notAfter = true, notAfter
+			}
+			probes[backend.Address] = probe
+		}
+		// The route may no longer be used.
+		if ctx.Err() != nil {
+			return
+		}
+		p.certs.set(route, probes)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Connects to a backend using the route probe server name and returns the
+// expiry date of the certificate it presents. The certificate is not
+// verified, it is only inspected.
+func fetchCertExpiry(ctx context.Context, route *config.Route, backend *config.Backend) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, route.DialNetwork(), backend.Address)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer raw.Close()
+
+	// The backend expects a PROXY header, send one without addresses.
+	if version := route.ProxyVersion(backend); version != config.ProxyNone {
+		if err := proxyHeader(version, noAddrConn{}, raw); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	c := tls.Client(raw, &tls.Config{
+		ServerName: route.CertProbe,
+		InsecureSkipVerify: true,
+	})
+	if err := c.HandshakeContext(ctx); err != nil {
+		return time.Time{}, err
+	}
+	defer c.Close()
+
+	return c.ConnectionState().PeerCertificates[0].NotAfter, nil
+}
+
+// Writes the certificate probes metrics.
+func (p *Proxy) writeCertMetrics(m *metricsWriter) {
+	probes := p.certs.all()
+	sort.Slice(probes, func(i, j int) bool {
+		if probes[i].route.Label() != probes[j].route.Label() {
+			return probes[i].route.Label() < probes[j].route.Label()
+		}
+		return probes[i].backend < probes[j].backend
+	})
+
+	m.header("sniproxy_backend_cert_probe_success", "gauge",
+		 "Whether the latest backend certificate probe succeeded.")
+	for _, probe := range probes {
+		success := 0.
+		if probe.ok {
+			success = 1
+		}
+		m.sample("sniproxy_backend_cert_probe_success", success, "route", probe.route.Label(),
+			 "backend", probe.backend, "server_name", probe.route.CertProbe)
+	}
+
+	m.header("sniproxy_backend_cert_expiry_seconds", "gauge",
+		 "Time left before the backend certificate expires.")
+	for _, probe := range probes {
+		if !probe.ok {
+			continue
+		}
+		m.sample("sniproxy_backend_cert_expiry_seconds", time.Until(probe.notAfter).Seconds(),
+			 "route", probe.route.Label(), "backend", probe.backend,
+			 "server_name", probe.route.CertProbe)
+	}
+}
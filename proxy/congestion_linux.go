@@ -0,0 +1,57 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Not exported by the syscall package (linux/tcp.h).
+const tcpCongestion = 13
+
+// Checks a TCP congestion control algorithm is available.
+func validateCongestionControl(algo string) error {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/tcp_available_congestion_control")
+	if err != nil {
+		return fmt.Errorf("Could not retrieve the available TCP congestion control algorithms (%s)", err)
+	}
+
+	for _, available := range strings.Fields(string(b)) {
+		if available == algo {
+			return nil
+		}
+	}
+	return fmt.Errorf("TCP congestion control algorithm %q is not available (%s)",
+			  algo, strings.TrimSpace(string(b)))
+}
+
+// Sets the TCP congestion control algorithm of a socket.
+func setCongestionControl(raw syscall.RawConn, algo string) error {
+	var serr error
+	err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, tcpCongestion, algo)
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("Could not set the TCP congestion control algorithm to %s (%s)", algo, serr)
+	}
+	return nil
+}
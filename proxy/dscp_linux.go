@@ -0,0 +1,54 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// DSCP marking is supported.
+func checkDSCP() error {
+	return nil
+}
+
+// Sets the DSCP codepoint of a socket, using its IPv4 ToS or IPv6 traffic class
+// field. IPv6 sockets also get the IPv4 one, as they can carry IPv4 traffic.
+func setDSCP(raw syscall.RawConn, dscp int) error {
+	tos := dscp << 2
+
+	var serr error
+	err := raw.Control(func(fd uintptr) {
+		sa, err := syscall.Getsockname(int(fd))
+		if err != nil {
+			serr = err
+			return
+		}
+		if _, ok := sa.(*syscall.SockaddrInet6); ok {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+			return
+		}
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("Could not set the DSCP codepoint to %d (%s)", dscp, serr)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func checkDSCP() error {
+	return fmt.Errorf("Setting the DSCP codepoint is not supported on this platform")
+}
+
+func setDSCP(raw syscall.RawConn, dscp int) error {
+	return fmt.Errorf("Setting the DSCP codepoint is not supported on this platform")
+}
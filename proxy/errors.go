@@ -0,0 +1,106 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of failures preventing a connection from being routed. A failure is
+// reported as a DispatchError matching one of them (using errors.Is), which
+// decides the alert sent to the client and the outcome of the connection.
+var (
+	ErrHandshakesFull   = errors.New("too many handshakes in flight")
+	ErrNoData           = errors.New("no data received")
+	ErrProxyHeader      = errors.New("invalid PROXY header")
+	ErrNotTLS           = errors.New("not a TLS client")
+	ErrHandshakeTimeout = errors.New("handshake timeout")
+	ErrBadHandshake     = errors.New("invalid handshake")
+	ErrSuspiciousHello  = errors.New("suspicious ClientHello")
+	ErrNoSNI            = errors.New("no SNI")
+	ErrNoRoute          = errors.New("no route")
+	ErrNoBackend        = errors.New("no backend available")
+	ErrMaintenance      = errors.New("route in maintenance")
+	ErrDenied           = errors.New("access denied")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrTLSVersion       = errors.New("TLS version too old")
+	ErrWeakCiphers      = errors.New("weak cipher suites")
+	ErrBackendFull      = errors.New("backend at capacity")
+	ErrSetupTimeout     = errors.New("setup budget exceeded")
+	ErrBackendDial      = errors.New("backend dial failed")
+	ErrReplay           = errors.New("handshake replay failed")
+	ErrInternal         = errors.New("internal error")
+)
+
+// Rejection causes, as named in the configuration, of each kind of failure.
+var rejectCauses = map[error]string{
+	ErrHandshakesFull:   "handshakes-full",
+	ErrNoData:           "no-data",
+	ErrProxyHeader:      "proxy-header",
+	ErrNotTLS:           "not-tls",
+	ErrHandshakeTimeout: "handshake-timeout",
+	ErrBadHandshake:     "bad-handshake",
+	ErrSuspiciousHello:  "suspicious-hello",
+	ErrNoSNI:            "no-sni",
+	ErrNoRoute:          "no-route",
+	ErrNoBackend:        "no-backend",
+	ErrMaintenance:      "maintenance",
+	ErrDenied:           "denied",
+	ErrRateLimited:      "rate-limited",
+	ErrTLSVersion:       "tls-version",
+	ErrWeakCiphers:      "weak-ciphers",
+	ErrBackendFull:      "backend-full",
+	ErrSetupTimeout:     "setup-timeout",
+	ErrBackendDial:      "backend-dial",
+	ErrReplay:           "replay",
+	ErrInternal:         "internal",
+}
+
+// DispatchError represents a failure to route a connection.
+type DispatchError struct {
+	// Kind of failure, one of the Err* values.
+	Kind error
+	// Detailed error, used as the error message.
+	Err  error
+}
+
+func (e *DispatchError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DispatchError) Unwrap() []error {
+	return []error{ e.Kind, e.Err }
+}
+
+// Returns the rejection cause of an error, "internal" if it is not a
+// DispatchError.
+func rejectCause(err error) string {
+	var e *DispatchError
+	if errors.As(err, &e) {
+		if cause, ok := rejectCauses[e.Kind]; ok {
+			return cause
+		}
+	}
+	return "internal"
+}
+
+// Returns a DispatchError of a given kind, its message being formatted as
+// fmt.Errorf does.
+func dispatchErrorf(kind error, format string, v ...interface{}) error {
+	return &DispatchError{ Kind: kind, Err: fmt.Errorf(format, v...) }
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/atenart/sniproxy/config"
+	"github.com/atenart/sniproxy/proxy"
+)
+
+func ExampleProxy() {
+	p := &proxy.Proxy{}
+	if err := p.Config.Load("/etc/sniproxy.conf"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Deny the connections to ignored.example.net, whatever the
+	// configuration says.
+	p.Policy = proxy.PolicyFunc(func(ctx context.Context, input proxy.PolicyInput) (proxy.PolicyDecision, error) {
+		return proxy.PolicyDecision{ Deny: input.SNI == "ignored.example.net" }, nil
+	})
+
+	log.Fatal(p.ListenAndServe(":443"))
+}
+
+func ExampleProxy_hooks() {
+	p := &proxy.Proxy{}
+	if err := p.Config.Load("/etc/sniproxy.conf"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Reject the clients of a blocked network, and account the bytes
+	// transferred per route.
+	_, blocked, _ := net.ParseCIDR("192.0.2.0/24")
+	p.OnAccept = func(conn *proxy.Conn) error {
+		if blocked.Contains(conn.RemoteAddr().(*net.TCPAddr).IP) {
+			return errors.New("blocked network")
+		}
+		return nil
+	}
+	p.OnClose = func(info proxy.ConnInfo) {
+		log.Printf("%s: %d bytes sent, %d received", info.Route, info.Sent, info.Received)
+	}
+
+	log.Fatal(p.ListenAndServe(":443"))
+}
+
+func ExampleProxy_Reload() {
+	p := &proxy.Proxy{}
+	if err := p.Config.Load("/etc/sniproxy.conf"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Reload the configuration when notified by a configuration service.
+	http.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		var c config.Config
+		if err := c.Load("https://config.example.net/sniproxy.conf"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := p.Reload(c); err != nil {
+			c.Close()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	})
+	go http.ListenAndServe("127.0.0.1:8080", nil)
+
+	log.Fatal(p.ListenAndServe(":443"))
+}
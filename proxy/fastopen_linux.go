@@ -0,0 +1,83 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Not exported by the syscall package (linux/tcp.h).
+const (
+	tcpFastOpen        = 23
+	tcpFastOpenConnect = 30
+)
+
+// Length of the queue of pending TFO requests of the listeners.
+const tcpFastOpenQueue = 256
+
+// Checks TCP Fast Open is enabled in the kernel on the given sides, client
+// (bit 0 of net.ipv4.tcp_fastopen) for dialing backends and server (bit 1)
+// for the listeners.
+func checkTCPFastOpen(on uint) error {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		return fmt.Errorf("Could not retrieve the TCP Fast Open settings (%s)", err)
+	}
+	flags, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return fmt.Errorf("Invalid TCP Fast Open settings %q", strings.TrimSpace(string(b)))
+	}
+
+	if on != config.OnClient && flags & 0x1 == 0 {
+		return fmt.Errorf("TCP Fast Open is disabled for outgoing connections (net.ipv4.tcp_fastopen=%d)", flags)
+	}
+	if on != config.OnUpstream && flags & 0x2 == 0 {
+		return fmt.Errorf("TCP Fast Open is disabled for listeners (net.ipv4.tcp_fastopen=%d)", flags)
+	}
+	return nil
+}
+
+// Enables TCP Fast Open on a listening socket.
+func setListenFastOpen(network, address string, c syscall.RawConn) error {
+	return setFastOpen(c, tcpFastOpen, tcpFastOpenQueue)
+}
+
+// Enables TCP Fast Open on a socket being dialed: the connection is
+// established with the first data written, i.e. the replayed handshake.
+func setDialFastOpen(network, address string, c syscall.RawConn) error {
+	return setFastOpen(c, tcpFastOpenConnect, 1)
+}
+
+func setFastOpen(c syscall.RawConn, opt, val int) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt, val)
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("Could not enable TCP Fast Open (%s)", serr)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+//go:build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func checkTCPFastOpen(on uint) error {
+	return fmt.Errorf("TCP Fast Open is not supported on this platform")
+}
+
+// TCP Fast Open is ignored on other platforms, a warning being logged at
+// startup.
+func setListenFastOpen(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+func setDialFastOpen(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Returns the address a backend is dialed on: its own, or the client SNI for
+// sni backends (forward proxy). The SNI is resolved here so that the addresses
+// of the proxy host are never dialed, which would loop connections back to it.
+func (conn *Conn) backendAddress(ctx context.Context, route *config.Route, backend *config.Backend) (string, error) {
+	if backend.SNIPort == 0 {
+		return backend.Address, nil
+	}
+
+	sni := conn.Hello.ServerName
+	if sni == "" {
+		return "", dispatchErrorf(ErrNoBackend, "No SNI to forward the connection to")
+	}
+
+	network := "ip"
+	switch route.DialNetwork() {
+	case "tcp4":
+		network = "ip4"
+		break
+	case "tcp6":
+		network = "ip6"
+		break
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, sni)
+	if err != nil {
+		return "", dispatchErrorf(ErrBackendDial, "Could not resolve %s (%w)", sni, err)
+	}
+
+	local, err := localIPs()
+	if err != nil {
+		return "", dispatchErrorf(ErrInternal, "Could not retrieve the local addresses (%w)", err)
+	}
+	for _, ip := range ips {
+		if !local(ip) {
+			return net.JoinHostPort(ip.String(), strconv.Itoa(backend.SNIPort)), nil
+		}
+	}
+	return "", dispatchErrorf(ErrDenied, "Refused forwarding %s to the proxy itself (%v)", sni, ips)
+}
+
+// Returns a function reporting whether an IP is one of the proxy host: a
+// loopback, unspecified or local interface address.
+func localIPs() (func(net.IP) bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ip net.IP) bool {
+		if ip.IsLoopback() || ip.IsUnspecified() {
+			return true
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Counts the connections reading their handshake, which is buffered until it
+// is replayed, to bound the memory used under connection floods.
+type handshakeLimiter struct {
+	inFlight atomic.Int64
+	shed     atomic.Int64
+}
+
+// Registers a connection starting to read its handshake, if the number of
+// connections doing so is below Config.MaxHandshakes. Returns a function to
+// call once the handshake is no longer buffered (it can be called more than
+// once), or an ErrHandshakesFull DispatchError.
+func (conn *Conn) enterHandshake() (func(), error) {
+	max := conn.Config.MaxHandshakes
+	if max == 0 || conn.proxy == nil {
+		return func() {}, nil
+	}
+
+	l := &conn.proxy.handshakes
+	if l.inFlight.Add(1) > int64(max) {
+		l.inFlight.Add(-1)
+		l.shed.Add(1)
+		return func() {}, dispatchErrorf(ErrHandshakesFull, "%d handshakes already in flight", max)
+	}
+	var once sync.Once
+	return func() { once.Do(func() { l.inFlight.Add(-1) }) }, nil
+}
+
+// Writes the metrics of the connections reading their handshake.
+func (p *Proxy) writeHandshakeMetrics(m *metricsWriter) {
+	m.header("sniproxy_handshakes_in_flight", "gauge", "Connections reading their handshake, up to the backend dial.")
+	m.sample("sniproxy_handshakes_in_flight", float64(p.handshakes.inFlight.Load()))
+	m.header("sniproxy_handshakes_shed_total", "counter", "Connections shed as too many handshakes were in flight.")
+	m.sample("sniproxy_handshakes_shed_total", float64(p.handshakes.shed.Load()))
+}
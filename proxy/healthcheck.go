@@ -0,0 +1,182 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Number of health checks run concurrently when not configured.
+const defaultHealthCheckWorkers = 16
+
+// A backend to check.
+type healthCheck struct {
+	route   *config.Route
+	backend *config.Backend
+}
+
+// Runs the health checks of the routes enabling them, until the context is
+// canceled. Each backend is given a random phase within its route interval so
+// that the checks are spread over it, and the checks are run by a bounded pool
+// of workers.
+func (p *Proxy) runHealthChecks(ctx context.Context, routes []*config.Route) {
+	workers := p.config().HealthCheckWorkers
+	if workers == 0 {
+		workers = defaultHealthCheckWorkers
+	}
+
+	checks := make(chan healthCheck)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case check := <-checks:
+					p.checkBackend(ctx, check.route, check.backend)
+				}
+			}
+		}()
+	}
+
+	for _, route := range routes {
+		if route.HealthCheck > 0 {
+			go p.scheduleHealthChecks(ctx, route, checks)
+		}
+	}
+}
+
+// Sends the checks of the backends of a route to the workers when they are
+// due, until the context is canceled. The backends are looked up again on
+// each round, as they can change (SRV records). The backends down are checked
+// following a backoff, if the route has a maximum interval.
+func (p *Proxy) scheduleHealthChecks(ctx context.Context, route *config.Route, checks chan<- healthCheck) {
+	interval := route.HealthCheck
+	next := make(map[string]time.Time)
+	backoffs := make(map[string]*backoff)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		wake := now.Add(interval)
+		current := make(map[string]bool)
+		for _, backend := range route.CurrentBackends() {
+			current[backend.Address] = true
+
+			due, ok := next[backend.Address]
+			if !ok {
+				due = now.Add(time.Duration(rand.Int63n(int64(interval))))
+			}
+			if !due.After(now) {
+				select {
+				case <-ctx.Done():
+					return
+				case checks <- healthCheck{ route: route, backend: backend }:
+				}
+				due = now.Add(p.nextCheck(route, backend, backoffs))
+			}
+			next[backend.Address] = due
+
+			if due.Before(wake) {
+				wake = due
+			}
+		}
+
+		// Forget the backends no longer used.
+		for addr := range next {
+			if !current[addr] {
+				delete(next, addr)
+				delete(backoffs, addr)
+			}
+		}
+
+		timer.Reset(time.Until(wake))
+	}
+}
+
+// Returns the interval to the next check of a backend: the route one, moved
+// by a random share of it following the configured jitter. Backends down are
+// checked following a backoff from the route interval up to its maximum, never
+// more often than the interval.
+func (p *Proxy) nextCheck(route *config.Route, backend *config.Backend, backoffs map[string]*backoff) time.Duration {
+	interval := spread(route.HealthCheck, p.config().HealthCheckJitter)
+	if route.HealthCheckMax <= route.HealthCheck {
+		return interval
+	}
+
+	b, ok := backoffs[backend.Address]
+	if route.BackendUp(backend) {
+		if ok {
+			delete(backoffs, backend.Address)
+		}
+		return interval
+	}
+	if !ok {
+		b = newBackoff(route.HealthCheck, route.HealthCheckMax, p.config().BackoffJitter)
+		backoffs[backend.Address] = b
+	}
+	return max(b.next(), interval)
+}
+
+// Dials a backend, reporting it as down or up depending on the outcome.
+func (p *Proxy) checkBackend(ctx context.Context, route *config.Route, backend *config.Backend) {
+	timeout := 3*time.Second
+	if route.HealthCheck < timeout {
+		timeout = route.HealthCheck
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var c net.Conn
+	var err error
+	if p.Dialer != nil {
+		c, err = p.Dialer.DialContext(ctx, route.DialNetwork(), backend.Address)
+	} else {
+		var d net.Dialer
+		c, err = d.DialContext(ctx, route.DialNetwork(), backend.Address)
+	}
+	if err == nil {
+		// The backend expects a PROXY header, send one without
+		// addresses.
+		if version := route.ProxyVersion(backend); version != config.ProxyNone {
+			err = proxyHeader(version, noAddrConn{}, c)
+		}
+		c.Close()
+	}
+	// Stopping.
+	if err != nil && ctx.Err() == context.Canceled {
+		return
+	}
+
+	if err != nil {
+		route.MarkDown(backend)
+	} else {
+		route.MarkUp(backend)
+	}
+}
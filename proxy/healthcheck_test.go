@@ -0,0 +1,186 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Dialer recording the number of concurrent dials, the addresses starting with
+// "down" failing.
+type checkDialer struct {
+	mu     sync.Mutex
+	active int
+	max    int
+	dialed map[string]int
+}
+
+func (d *checkDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.active++
+	if d.active > d.max {
+		d.max = d.active
+	}
+	d.dialed[address]++
+	d.mu.Unlock()
+
+	time.Sleep(10*time.Millisecond)
+
+	d.mu.Lock()
+	d.active--
+	d.mu.Unlock()
+
+	if strings.HasPrefix(address, "down") {
+		return nil, errors.New("connection refused")
+	}
+	client, backend := net.Pipe()
+	backend.Close()
+	return client, nil
+}
+
+func TestHealthChecks(t *testing.T) {
+	route := &config.Route{ HealthCheck: 100*time.Millisecond }
+	for i := 0; i < 20; i++ {
+		addr := fmt.Sprintf("up%d:443", i)
+		if i % 4 == 0 {
+			addr = fmt.Sprintf("down%d:443", i)
+		}
+		route.Backends = append(route.Backends, &config.Backend{ Address: addr })
+	}
+
+	d := &checkDialer{ dialed: make(map[string]int) }
+	p := &Proxy{
+		Config: config.Config{
+			Routes: []*config.Route{ route },
+			HealthCheckWorkers: 2,
+			HealthCheckJitter: 0.2,
+		},
+		Dialer: d,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.runHealthChecks(ctx, p.Config.Routes)
+	time.Sleep(400*time.Millisecond)
+	cancel()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.max > 2 {
+		t.Errorf("%d checks ran concurrently, wanted at most 2", d.max)
+	}
+	for _, backend := range route.Backends {
+		if d.dialed[backend.Address] == 0 {
+			t.Errorf("backend %s was not checked", backend.Address)
+		}
+		if up := route.BackendUp(backend); up == strings.HasPrefix(backend.Address, "down") {
+			t.Errorf("backend %s: got up %v", backend.Address, up)
+		}
+	}
+}
+
+func TestHealthCheckBackoff(t *testing.T) {
+	route := &config.Route{ HealthCheck: time.Second, HealthCheckMax: 8*time.Second }
+	backend := &config.Backend{ Address: "down.invalid:443", Weight: 1 }
+	p := &Proxy{ Config: config.Config{ BackoffJitter: config.JitterNone } }
+	backoffs := make(map[string]*backoff)
+
+	// Backends up are checked at the route interval.
+	if d := p.nextCheck(route, backend, backoffs); d != time.Second {
+		t.Errorf("got %s for a backend up, wanted 1s", d)
+	}
+
+	// Backends down back off, up to the maximum interval.
+	route.MarkDown(backend)
+	for _, want := range []time.Duration{ 1, 2, 4, 8, 8 } {
+		if d := p.nextCheck(route, backend, backoffs); d != want*time.Second {
+			t.Errorf("got %s for a backend down, wanted %s", d, want*time.Second)
+		}
+	}
+
+	// The backoff restarts once the backend recovered.
+	route.MarkUp(backend)
+	p.nextCheck(route, backend, backoffs)
+	route.MarkDown(backend)
+	if d := p.nextCheck(route, backend, backoffs); d != time.Second {
+		t.Errorf("got %s once recovered and down again, wanted 1s", d)
+	}
+}
+
+func TestHealthChecksReload(t *testing.T) {
+	route := func(addr string) *config.Route {
+		return &config.Route{
+			HealthCheck: 20*time.Millisecond,
+			Backends: []*config.Backend{{ Address: addr }},
+		}
+	}
+	d := &checkDialer{ dialed: make(map[string]int) }
+	p := &Proxy{ Config: config.Config{ Routes: []*config.Route{ route("old:443") } }, Dialer: d }
+	dialed := func(addr string) int {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.dialed[addr]
+	}
+
+	// Nothing runs until serving.
+	if err := p.Reload(config.Config{ Routes: []*config.Route{ route("old:443") } }); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50*time.Millisecond)
+	if n := dialed("old:443"); n != 0 {
+		t.Errorf("backend checked %d times while not serving", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.runTasks(ctx)
+	time.Sleep(100*time.Millisecond)
+	if n := dialed("old:443"); n == 0 {
+		t.Fatal("backend of the initial configuration not checked")
+	}
+
+	// The checks follow the reloaded configuration.
+	if err := p.Reload(config.Config{ Routes: []*config.Route{ route("new:443") } }); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50*time.Millisecond)
+	old := dialed("old:443")
+	time.Sleep(100*time.Millisecond)
+	if n := dialed("old:443"); n != old {
+		t.Errorf("backend of the replaced configuration still checked (%d checks, %d before)", n, old)
+	}
+	if n := dialed("new:443"); n == 0 {
+		t.Error("backend of the reloaded configuration not checked")
+	}
+
+	// And stop once the context is canceled.
+	cancel()
+	time.Sleep(50*time.Millisecond)
+	checked := dialed("new:443")
+	time.Sleep(100*time.Millisecond)
+	if n := dialed("new:443"); n != checked {
+		t.Errorf("backend still checked once stopped (%d checks, %d before)", n, checked)
+	}
+}
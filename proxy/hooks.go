@@ -0,0 +1,80 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"net"
+	"time"
+)
+
+// Connection summary given to Proxy.OnClose once a connection is closed.
+type ConnInfo struct {
+	Client   net.Addr
+	Local    net.Addr
+	// Server name requested by the client, if read.
+	SNI      string
+	// Label of the route matched, and address of the backend used, if
+	// any.
+	Route    string
+	Backend  string
+	Outcome  string
+	// Bytes sent by the client to the backend, and by the backend to the
+	// client.
+	Sent     int64
+	Received int64
+	Accepted time.Time
+	Duration time.Duration
+}
+
+// Calls the accept hook of the proxy, if any. Returns an ErrDenied
+// DispatchError if the hook vetoes the connection.
+func (conn *Conn) onAccept() error {
+	if conn.proxy == nil || conn.proxy.OnAccept == nil {
+		return nil
+	}
+	if err := conn.proxy.OnAccept(conn); err != nil {
+		return dispatchErrorf(ErrDenied, "Rejected by the accept hook (%w)", err)
+	}
+	return nil
+}
+
+// Calls the close hook of the proxy, if any.
+func (conn *Conn) onClose() {
+	if conn.proxy == nil || conn.proxy.OnClose == nil {
+		return
+	}
+
+	info := ConnInfo{
+		Client: conn.RemoteAddr(),
+		Local: conn.LocalAddr(),
+		Outcome: conn.outcome,
+		Sent: conn.sent,
+		Received: conn.received,
+		Accepted: conn.accepted,
+		Duration: time.Since(conn.accepted),
+	}
+	if conn.Hello != nil {
+		info.SNI = conn.Hello.ServerName
+	}
+	if conn.route != nil {
+		info.Route = conn.route.Label()
+	}
+	if conn.backend != nil {
+		info.Backend = conn.backend.Address
+	}
+	conn.proxy.OnClose(info)
+}
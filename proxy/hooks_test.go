@@ -0,0 +1,113 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Dispatches a connection sending a ClientHello for a server name, returning
+// what the client received.
+func dispatchHello(t *testing.T, p *Proxy, sni string) []byte {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer c.Close()
+		c.Write(rawClientHello(t, sni))
+		b, _ := io.ReadAll(c)
+		received <- b
+	}()
+
+	c, err := l.Accept()
+	l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &Conn{ TCPConn: c.(*net.TCPConn), Config: &p.Config, proxy: p, accepted: time.Now() }
+	conn.dispatch(context.Background())
+	return <-received
+}
+
+func TestHooks(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var infos []ConnInfo
+	p := &Proxy{
+		Config: config.Config{
+			Routes: []*config.Route{
+				{ Name: "web", Domains: domains(`example\.net`),
+				  Backends: []*config.Backend{{ Address: "backend.invalid:443", Weight: 1 }} },
+			},
+		},
+		Dialer: &fakeDialer{ backend: func(c net.Conn) {
+			defer c.Close()
+			c.Read(make([]byte, 4096))
+			c.Write([]byte("reply"))
+		}},
+		OnAccept: func(conn *Conn) error {
+			// The handshake is not read yet.
+			if conn.Hello != nil {
+				t.Error("accept hook called after the handshake was read")
+			}
+			if conn.RemoteAddr().(*net.TCPAddr).Port % 2 == 1 {
+				return errors.New("odd port")
+			}
+			return nil
+		},
+		OnClose: func(info ConnInfo) { infos = append(infos, info) },
+	}
+
+	for len(infos) < 4 {
+		dispatchHello(t, p, "example.net")
+	}
+	for _, info := range infos {
+		if info.Client.(*net.TCPAddr).Port % 2 == 1 {
+			if info.Outcome != "denied" || info.SNI != "" || info.Backend != "" {
+				t.Errorf("vetoed connection: got %+v", info)
+			}
+			continue
+		}
+		if info.Outcome != "routed" || info.SNI != "example.net" || info.Route != "web" ||
+		   info.Backend != "backend.invalid:443" || info.Received != 5 || info.Duration <= 0 {
+			t.Errorf("routed connection: got %+v", info)
+		}
+	}
+
+	// Connections go through without hooks.
+	p.OnAccept, p.OnClose = nil, nil
+	if b := dispatchHello(t, p, "example.net"); string(b) != "reply" {
+		t.Errorf("got %q without hooks", b)
+	}
+}
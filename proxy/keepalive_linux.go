@@ -0,0 +1,62 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Enables keep alive on a connection following the route parameters: its
+// period is the idle time and, unless set, the interval between the probes.
+// The system probes count is kept unless set.
+func setKeepAlive(c *net.TCPConn, route *config.Route) error {
+	if err := c.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if err := c.SetKeepAlivePeriod(route.KeepAlive); err != nil {
+		return err
+	}
+
+	interval := route.KeepAliveInterval
+	if interval == 0 {
+		interval = route.KeepAlive
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		// The interval is set in seconds, rounded up.
+		secs := int((interval + time.Second - 1) / time.Second)
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs)
+		if serr == nil && route.KeepAliveCount > 0 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, route.KeepAliveCount)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("Could not set the keep alive probes interval and count (%s)", serr)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Enables keep alive on a connection, its period being the idle time. The
+// probes interval and count can't be set.
+func setKeepAlive(c *net.TCPConn, route *config.Route) error {
+	if err := c.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if err := c.SetKeepAlivePeriod(route.KeepAlive); err != nil {
+		return err
+	}
+	if route.KeepAliveInterval > 0 || route.KeepAliveCount > 0 {
+		return fmt.Errorf("Setting the keep alive probes interval and count is not supported on this platform")
+	}
+	return nil
+}
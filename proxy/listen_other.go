@@ -0,0 +1,46 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !unix
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+func listenUnixSocket(path string) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func listenBacklog(bind string, backlog int,
+		   control func(network, address string, c syscall.RawConn) error) (net.Listener, error) {
+	return nil, fmt.Errorf("Setting the listen backlog is not supported on this platform")
+}
+
+func listenFD(fd int) (net.Listener, error) {
+	return nil, fmt.Errorf("Inherited sockets are not supported on this platform")
+}
@@ -0,0 +1,136 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build unix
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// Listens on a Unix socket only accessible by its owner and group. The umask
+// is restricted while the socket is created, rather than changing its mode
+// afterwards, so that it is never accessible by others.
+func listenUnixSocket(path string) (net.Listener, error) {
+	mask := syscall.Umask(0117)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	return l, err
+}
+
+// Listens on a TCP address using a custom backlog. The standard library
+// always uses the system maximum (somaxconn) and does not allow to change it,
+// so the socket is created by hand before being converted to a net.Listener.
+// The control function, if any, is called before binding the socket.
+func listenBacklog(bind string, backlog int,
+		   control func(network, address string, c syscall.RawConn) error) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wildcard addresses fall back to IPv4 when IPv6 is not available
+	// (e.g. disabled in the kernel).
+	family, network, sa := sockaddr(addr, true)
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	if err == syscall.EAFNOSUPPORT && addr.IP == nil {
+		family, network, sa = sockaddr(addr, false)
+		fd, err = syscall.Socket(family, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+
+	// The listener is duplicated by net.FileListener, always close this one.
+	f := os.NewFile(uintptr(fd), "tcp:" + bind)
+	defer f.Close()
+
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if family == syscall.AF_INET6 && addr.IP == nil {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0); err != nil {
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+
+	if control != nil {
+		rc, err := f.SyscallConn()
+		if err != nil {
+			return nil, err
+		}
+		if err := control(network, bind, rc); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, fmt.Errorf("Could not bind to %s (%s)", bind, err)
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		return nil, os.NewSyscallError("listen", err)
+	}
+
+	return net.FileListener(f)
+}
+
+// Returns the socket family, network and address to bind to a TCP address.
+// Wildcard addresses use a dual-stack socket, unless IPv6 is not available.
+func sockaddr(addr *net.TCPAddr, ipv6 bool) (int, string, syscall.Sockaddr) {
+	ip := addr.IP
+	if ip == nil && !ipv6 {
+		ip = net.IPv4zero
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{ Port: addr.Port }
+		copy(sa.Addr[:], ip4)
+		return syscall.AF_INET, "tcp4", sa
+	}
+	sa := &syscall.SockaddrInet6{ Port: addr.Port }
+	copy(sa.Addr[:], ip.To16())
+	return syscall.AF_INET6, "tcp6", sa
+}
+
+// Adopts an inherited listening TCP socket (e.g. from systemd socket
+// activation, or a process upgrading in place). Once checked, the descriptor
+// is duplicated by net.FileListener and the original one closed.
+func listenFD(fd int) (net.Listener, error) {
+	listening, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+	if err != nil {
+		return nil, fmt.Errorf("File descriptor %d is not a socket (%s)", fd, err)
+	}
+	if listening == 0 {
+		return nil, fmt.Errorf("File descriptor %d is not a listening socket", fd)
+	}
+
+	f := os.NewFile(uintptr(fd), "fd:" + strconv.Itoa(fd))
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := l.(*net.TCPListener); !ok {
+		l.Close()
+		return nil, fmt.Errorf("File descriptor %d is not a TCP socket", fd)
+	}
+	return l, nil
+}
@@ -0,0 +1,158 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build unix
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+func TestSockaddr(t *testing.T) {
+	tests := []struct {
+		bind    string
+		ipv6    bool
+		family  int
+		network string
+		addr    string
+	}{
+		{ "127.0.0.1:443", true, syscall.AF_INET, "tcp4", "127.0.0.1" },
+		{ "[::1]:443", true, syscall.AF_INET6, "tcp6", "::1" },
+		{ ":443", true, syscall.AF_INET6, "tcp6", "::" },
+		// Wildcard addresses without IPv6.
+		{ ":443", false, syscall.AF_INET, "tcp4", "0.0.0.0" },
+		{ "0.0.0.0:443", true, syscall.AF_INET, "tcp4", "0.0.0.0" },
+	}
+
+	for _, test := range tests {
+		addr, err := net.ResolveTCPAddr("tcp", test.bind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		family, network, sa := sockaddr(addr, test.ipv6)
+
+		var ip net.IP
+		var port int
+		switch sa := sa.(type) {
+		case *syscall.SockaddrInet4:
+			ip, port = net.IP(sa.Addr[:]), sa.Port
+			break
+		case *syscall.SockaddrInet6:
+			ip, port = net.IP(sa.Addr[:]), sa.Port
+			break
+		}
+		if family != test.family || network != test.network || ip.String() != test.addr || port != 443 {
+			t.Errorf("%s (IPv6 %t): got %d/%s %s port %d, wanted %d/%s %s", test.bind, test.ipv6,
+				 family, network, ip, port, test.family, test.network, test.addr)
+		}
+	}
+}
+
+func TestListenBacklog(t *testing.T) {
+	for _, bind := range []string{ "127.0.0.1:0", ":0" } {
+		l, err := listenBacklog(bind, 16, nil)
+		if err != nil {
+			t.Errorf("%s: %s", bind, err)
+			continue
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		c, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			t.Errorf("%s: %s", bind, err)
+		} else {
+			c.Close()
+		}
+		l.Close()
+	}
+}
+
+func TestListenFD(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	f, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pass a descriptor no os.File owns, as the inherited ones: closing
+	// (or finalizing) f once listenFD closed it would close whatever
+	// descriptor reused its number.
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The inherited descriptor is adopted, and closed.
+	rl, err := listen(context.Background(), &config.Config{},
+			  &config.Listener{ Bind: fmt.Sprintf("fd://%d", fd) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.l.Close()
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err == nil {
+		t.Error("inherited descriptor left open")
+	}
+	go func() {
+		if c, err := net.Dial("tcp", tcp.Addr().String()); err == nil {
+			c.Close()
+		}
+	}()
+	if c, err := rl.l.Accept(); err != nil {
+		t.Errorf("could not accept on the inherited socket (%s)", err)
+	} else {
+		c.Close()
+	}
+
+	// Only listening TCP sockets can be used.
+	file, err := os.CreateTemp(t.TempDir(), "fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	uf, err := udp.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uf.Close()
+	for _, bind := range []string{
+		fmt.Sprintf("fd://%d", file.Fd()),
+		fmt.Sprintf("fd://%d", uf.Fd()),
+		"fd://-1",
+		"fd://stdin",
+	} {
+		if rl, err := listen(context.Background(), &config.Config{}, &config.Listener{ Bind: bind }); err == nil {
+			rl.l.Close()
+			t.Errorf("%s: got no error", bind)
+		}
+	}
+}
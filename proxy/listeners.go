@@ -0,0 +1,228 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Listeners being served, by bind address. Reloads start the listeners added
+// and stop the ones removed, the others being kept.
+type listenerSet struct {
+	mu      sync.Mutex
+	// Context the listeners are served with, nil when not serving.
+	ctx     context.Context
+	// Address bound to when the configuration has no listener.
+	bind    string
+	running map[string]*runningListener
+	wg      sync.WaitGroup
+	// First failure of a listener, stopping the proxy.
+	failed  chan error
+}
+
+type runningListener struct {
+	// Configuration of the listener, updated on reloads.
+	config  atomic.Pointer[config.Listener]
+	l       net.Listener
+	removed atomic.Bool
+}
+
+// Returns the listeners of a configuration, or one on the default bind address
+// if it has none.
+func (s *listenerSet) of(c *config.Config) []*config.Listener {
+	if len(c.Listeners) == 0 {
+		return []*config.Listener{{ Bind: s.bind }}
+	}
+	return c.Listeners
+}
+
+// Opens the listeners of a configuration, and starts serving them until the
+// context is canceled. Stops at the first listener failing to be opened, the
+// ones opened before being closed.
+func (p *Proxy) startListeners(ctx context.Context, c *config.Config, bind string) error {
+	s := &p.listeners
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bind = bind
+	s.running = make(map[string]*runningListener)
+	s.failed = make(chan error, 1)
+	for _, listener := range s.of(c) {
+		rl, err := listen(ctx, c, listener)
+		if err != nil {
+			for _, rl := range s.running {
+				rl.l.Close()
+			}
+			s.running = nil
+			return err
+		}
+		s.running[listener.Bind] = rl
+	}
+
+	s.ctx = ctx
+	for _, rl := range s.running {
+		p.runListener(rl)
+	}
+	return nil
+}
+
+// Stops reloads from starting listeners, and waits for the listeners to stop.
+func (p *Proxy) waitListeners() {
+	s := &p.listeners
+	s.mu.Lock()
+	s.ctx = nil
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Opens the listeners added by a new configuration, if serving. Returns the
+// function starting them and stopping the listeners removed, to be called once
+// the configuration is used, or an error if a listener could not be opened.
+func (p *Proxy) reloadListeners(c *config.Config) (func(), error) {
+	s := &p.listeners
+	s.mu.Lock()
+	if s.ctx == nil {
+		s.mu.Unlock()
+		return func() {}, nil
+	}
+
+	wanted := make(map[string]*config.Listener)
+	added := make(map[string]*runningListener)
+	for _, listener := range s.of(c) {
+		wanted[listener.Bind] = listener
+		if _, ok := s.running[listener.Bind]; ok {
+			continue
+		}
+		if _, ok := added[listener.Bind]; ok {
+			continue
+		}
+		rl, err := listen(s.ctx, c, listener)
+		if err != nil {
+			for _, rl := range added {
+				rl.l.Close()
+			}
+			s.mu.Unlock()
+			return nil, fmt.Errorf("Could not listen on %s (%w)", listener.Bind, err)
+		}
+		added[listener.Bind] = rl
+	}
+
+	return func() {
+		defer s.mu.Unlock()
+		for bind, rl := range s.running {
+			listener, ok := wanted[bind]
+			if ok {
+				rl.config.Store(listener)
+				continue
+			}
+			// Stop accepting connections, the ones accepted
+			// before being kept.
+			rl.removed.Store(true)
+			rl.l.Close()
+			delete(s.running, bind)
+			log.Printf("Stopped listening on %s", bind)
+		}
+		for bind, rl := range added {
+			s.running[bind] = rl
+			p.runListener(rl)
+			log.Printf("Listening on %s", bind)
+		}
+	}, nil
+}
+
+// Opens a listener, following the listening options of a configuration.
+func listen(ctx context.Context, c *config.Config, listener *config.Listener) (*runningListener, error) {
+	var controls []func(network, address string, c syscall.RawConn) error
+	if c.Transparent == config.TransparentTProxy {
+		controls = append(controls, setTransparent)
+	}
+	if c.TCPFastOpen && c.TCPFastOpenOn != config.OnUpstream {
+		controls = append(controls, setListenFastOpen)
+	}
+	lc := net.ListenConfig{ Control: chainControls(controls) }
+
+	var l net.Listener
+	var err error
+	if fd, ok := strings.CutPrefix(listener.Bind, "fd://"); ok {
+		// Inherited sockets are used as is, the listening options
+		// not being applied.
+		n, convErr := strconv.Atoi(fd)
+		if convErr != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid file descriptor %q", fd)
+		}
+		l, err = listenFD(n)
+	} else if c.ListenBacklog > 0 {
+		l, err = listenBacklog(listener.Bind, c.ListenBacklog, lc.Control)
+	} else {
+		l, err = lc.Listen(ctx, "tcp", listener.Bind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rl := &runningListener{ l: l }
+	rl.config.Store(listener)
+	return rl, nil
+}
+
+// First file descriptor passed by systemd socket activation.
+const systemdFirstFD = 3
+
+// Returns the bind address of the first socket passed by systemd socket
+// activation, if any was passed to this process. The activation environment
+// is cleared so that it is not inherited.
+func SystemdBind() (string, bool) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != os.Getpid() || fds < 1 {
+		return "", false
+	}
+	return "fd://" + strconv.Itoa(systemdFirstFD), true
+}
+
+// Serves a listener in the background. Its failure, unless removed, stops the
+// proxy.
+func (p *Proxy) runListener(rl *runningListener) {
+	s := &p.listeners
+	ctx := s.ctx
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := p.serve(ctx, rl)
+		if rl.removed.Load() {
+			return
+		}
+		select {
+		case s.failed <- err:
+		default:
+		}
+	}()
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestReloadListeners(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	kept, removed, added := freeAddr(t), freeAddr(t), freeAddr(t)
+	listeners := func(binds ...string) []*config.Listener {
+		var l []*config.Listener
+		for _, bind := range binds {
+			l = append(l, &config.Listener{ Bind: bind })
+		}
+		return l
+	}
+
+	p := &Proxy{ Config: config.Config{
+		Listeners: listeners(kept, removed),
+		HandshakeTimeout: 5*time.Second,
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.ListenAndServeContext(ctx, "")
+	}()
+
+	// Connection accepted on the listener removed, still being handled
+	// after the reload as it sends nothing.
+	var idle net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if idle, err = net.Dial("tcp", removed); err == nil {
+			break
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	// Binding an address in use fails the reload, the listeners being
+	// kept.
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	if err := p.Reload(config.Config{ Listeners: listeners(kept, added, busy.Addr().String()) }); err == nil {
+		t.Error("reload binding an address in use succeeded")
+	}
+	if p.config() != &p.Config {
+		t.Error("failed reload replaced the configuration")
+	}
+
+	if err := p.Reload(config.Config{
+		Listeners: listeners(kept, added),
+		HandshakeTimeout: 5*time.Second,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bind := range []string{ kept, added } {
+		c, err := net.Dial("tcp", bind)
+		if err != nil {
+			t.Errorf("%s: %s", bind, err)
+			continue
+		}
+		c.Close()
+	}
+	if c, err := net.Dial("tcp", removed); err == nil {
+		c.Close()
+		t.Error("connection accepted on a removed listener")
+	}
+
+	idle.SetReadDeadline(time.Now().Add(200*time.Millisecond))
+	if _, err := idle.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("idle connection: got '%v', wanted a timeout", err)
+	}
+
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Errorf("got error '%v'", err)
+		}
+	case <-time.After(3*time.Second):
+		t.Fatal("proxy did not stop")
+	}
+	if c, err := net.Dial("tcp", added); err == nil {
+		c.Close()
+		t.Error("connection accepted after the proxy stopped")
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Logger used for the access logs (routed and closed connections). It is the
+// standard logger, used for errors, unless an access log is configured.
+var accessLog = log.Default()
+
+// Log files in use, reopened on demand.
+var logFiles []*logFile
+
+func (conn *Conn) logf(format string, v ...interface{}) {
+	log.Printf("%s %s", conn.RemoteAddr(), fmt.Sprintf(format, v...))
+}
+
+func (conn *Conn) log(v ...interface{}) {
+	log.Printf("%s %s", conn.RemoteAddr(), fmt.Sprint(v...))
+}
+
+// Logs a connection to the access logs, unless its logging level is limited
+// to errors or a log format is used.
+func (conn *Conn) accessf(format string, v ...interface{}) {
+	if conn.logLevel() == config.LogError || conn.Config.LogRecords() {
+		return
+	}
+	accessLog.Printf("%s %s", conn.RemoteAddr(), fmt.Sprintf(format, v...))
+}
+
+// Writes the record of a done connection to the access logs, following the log
+// format if one is used. Missing values are replaced by a dash, or null in JSON
+// records.
+func (conn *Conn) logRecord() {
+	if !conn.Config.LogRecords() || conn.logLevel() == config.LogError {
+		return
+	}
+
+	var b strings.Builder
+	now := time.Now()
+	if conn.Config.LogJSON {
+		b.WriteByte('{')
+		for i, field := range config.LogJSONFields {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%q:", field)
+			v := conn.logField(field, now)
+			switch {
+			case v == "":
+				b.WriteString("null")
+				break
+			case config.LogJSONNumber(field):
+				b.WriteString(v)
+				break
+			default:
+				s, _ := json.Marshal(v)
+				b.Write(s)
+			}
+		}
+		b.WriteString("}\n")
+		accessLog.Writer().Write([]byte(b.String()))
+		return
+	}
+
+	for _, part := range conn.Config.LogFormat {
+		if part.Field == "" {
+			b.WriteString(part.Literal)
+			continue
+		}
+		if v := conn.logField(part.Field, now); v != "" {
+			b.WriteString(v)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	b.WriteByte('\n')
+	accessLog.Writer().Write([]byte(b.String()))
+}
+
+// Returns the value of a log format field, or an empty string if unknown.
+func (conn *Conn) logField(field string, now time.Time) string {
+	switch field {
+	case "timestamp":
+		return now.Format(time.RFC3339)
+	case "date":
+		return now.UTC().Format("2006-01-02")
+	case "time":
+		return now.UTC().Format("15:04:05")
+	case "clf_time":
+		return now.Format("02/Jan/2006:15:04:05 -0700")
+	case "client_ip", "client_port":
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return ""
+		}
+		if field == "client_ip" {
+			return addr.IP.String()
+		}
+		return strconv.Itoa(addr.Port)
+	case "local_addr":
+		if conn.OriginalDst != nil {
+			return conn.OriginalDst.String()
+		}
+		return conn.LocalAddr().String()
+	case "route":
+		if conn.route != nil {
+			return conn.route.Label()
+		}
+		return ""
+	case "backend":
+		if conn.backend != nil {
+			return conn.backend.Address
+		}
+		return ""
+	case "backend_addr":
+		return conn.backendAddr
+	case "bytes_sent":
+		return strconv.FormatInt(conn.sent, 10)
+	case "bytes_received":
+		return strconv.FormatInt(conn.received, 10)
+	case "duration_ms":
+		return strconv.FormatInt(now.Sub(conn.accepted).Milliseconds(), 10)
+	case "outcome":
+		return conn.outcome
+	}
+
+	// Handshake fields.
+	if conn.Hello == nil {
+		return ""
+	}
+	switch field {
+	case "sni":
+		return conn.Hello.ServerName
+	case "tls_version":
+		if v := conn.Hello.MaxVersion(); v != 0 {
+			return fmt.Sprintf("%#x", v)
+		}
+		return ""
+	case "alpn":
+		return strings.Join(conn.Hello.ALPN(), ",")
+	case "ja3":
+		return conn.Hello.JA3()
+	}
+	return ""
+}
+
+// Logs the details of a connection setup to the error logs, if its logging
+// level is debug.
+func (conn *Conn) debugf(format string, v ...interface{}) {
+	if conn.logLevel() != config.LogDebug {
+		return
+	}
+	log.Printf("%s %s", conn.RemoteAddr(), fmt.Sprintf(format, v...))
+}
+
+// Returns the logging level of a connection: the one of its route once known,
+// the global one before.
+func (conn *Conn) logLevel() uint {
+	if conn.route != nil {
+		return conn.route.LogLevel
+	}
+	return conn.Config.LogLevel
+}
+
+// Sets up the error and access logs destinations.
+func SetupLogs(c *config.Config) error {
+	w, err := logWriter(c.ErrorLog)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(w)
+
+	if c.AccessLog != "" {
+		w, err := logWriter(c.AccessLog)
+		if err != nil {
+			return err
+		}
+		accessLog = log.New(w, "", log.LstdFlags)
+	}
+
+	return nil
+}
+
+// Returns the writer of a logging destination.
+func logWriter(dest string) (io.Writer, error) {
+	switch dest {
+	case "", "stderr":
+		return os.Stderr, nil
+	case "stdout":
+		return os.Stdout, nil
+	case "off":
+		return io.Discard, nil
+	}
+
+	f, err := openLogFile(dest)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open log file %q (%s)", dest, err)
+	}
+	logFiles = append(logFiles, f)
+	return f, nil
+}
+
+// Closes all the log files, syncing them to disk. Logs written afterwards are
+// lost.
+func CloseLogs() error {
+	var errs []error
+	for _, f := range logFiles {
+		errs = append(errs, f.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Reopens all the log files, e.g. after they were rotated.
+func ReopenLogs() {
+	for _, f := range logFiles {
+		if err := f.Reopen(); err != nil {
+			log.Printf("Could not reopen log file %q (%s)", f.path, err)
+		}
+	}
+}
+
+// A log file which can be reopened while in use.
+type logFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	lf := &logFile{ path: path }
+	if err := lf.Reopen(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *logFile) Write(b []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.f.Write(b)
+}
+
+func (lf *logFile) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if err := lf.f.Sync(); err != nil {
+		lf.f.Close()
+		return err
+	}
+	return lf.f.Close()
+}
+
+// Opens the file at the log file path again, writes going to the new file
+// once done. The previous file is kept in use on errors.
+func (lf *logFile) Reopen() error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	lf.mu.Lock()
+	old := lf.f
+	lf.f = f
+	lf.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
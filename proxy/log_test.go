@@ -0,0 +1,238 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/atenart/sniproxy/config"
+	"github.com/atenart/sniproxy/handshake"
+)
+
+func TestLogFileReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	lf, err := openLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(lf, "before")
+
+	// Rotate the file, as logrotate does.
+	if err := os.Rename(path, path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(lf, "rotated")
+
+	if err := lf.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(lf, "after")
+
+	tests := []struct {
+		file    string
+		content string
+	}{
+		{ path + ".1", "before\nrotated\n" },
+		{ path, "after\n" },
+	}
+	for _, test := range(tests) {
+		b, err := os.ReadFile(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.content {
+			t.Errorf("%s: got %q, wanted %q", test.file, b, test.content)
+		}
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	var errorLog, access bytes.Buffer
+	log.SetOutput(&errorLog)
+	accessLog = log.New(&access, "", 0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		accessLog = log.Default()
+	}()
+
+	tests := []struct {
+		desc   string
+		global uint
+		route  *config.Route
+		access bool
+		debug  bool
+	}{
+		{ "Default", config.LogInfo, nil, true, false },
+		{ "Global debug", config.LogDebug, nil, true, true },
+		{ "Global errors", config.LogError, nil, false, false },
+		{ "Route errors", config.LogDebug, &config.Route{ LogLevel: config.LogError }, false, false },
+		{ "Route debug", config.LogError, &config.Route{ LogLevel: config.LogDebug }, true, true },
+	}
+
+	for _, test := range(tests) {
+		errorLog.Reset()
+		access.Reset()
+
+		conn := &Conn{
+			Config: &config.Config{ LogLevel: test.global },
+			route: test.route,
+			proxySrc: &net.TCPAddr{ IP: net.IPv4(192, 0, 2, 1), Port: 1234 },
+		}
+		conn.accessf("access")
+		conn.debugf("debug")
+		conn.logf("error")
+
+		if (access.Len() > 0) != test.access {
+			t.Errorf("%s: got access logs %q", test.desc, access.String())
+		}
+		if strings.Contains(errorLog.String(), "debug") != test.debug {
+			t.Errorf("%s: got error logs %q", test.desc, errorLog.String())
+		}
+		if !strings.Contains(errorLog.String(), "192.0.2.1:1234 error") {
+			t.Errorf("%s: missing error in %q", test.desc, errorLog.String())
+		}
+	}
+}
+
+func TestCheckCipherSuites(t *testing.T) {
+	var errorLog bytes.Buffer
+	log.SetOutput(&errorLog)
+	defer log.SetOutput(os.Stderr)
+
+	legacy := &handshake.ClientHello{ ServerName: "example.net", CipherSuites: []uint16{ 4865, 0x000a } }
+	modern := &handshake.ClientHello{ ServerName: "example.net", CipherSuites: []uint16{ 4865, 49195 } }
+
+	tests := []struct {
+		desc     string
+		level    uint
+		hello    *handshake.ClientHello
+		reported bool
+	}{
+		{ "Deprecated suite, debug", config.LogDebug, legacy, true },
+		{ "Deprecated suite, info", config.LogInfo, legacy, false },
+		{ "No deprecated suite", config.LogDebug, modern, false },
+	}
+
+	for _, test := range(tests) {
+		errorLog.Reset()
+		conn := &Conn{
+			Config: &config.Config{},
+			route: &config.Route{ LogLevel: test.level },
+			Hello: test.hello,
+			stats: &routeCounters{},
+			proxySrc: &net.TCPAddr{ IP: net.IPv4(192, 0, 2, 1), Port: 1234 },
+		}
+		conn.checkCipherSuites()
+
+		if strings.Contains(errorLog.String(), "0x000a (3DES)") != test.reported {
+			t.Errorf("%s: got logs %q", test.desc, errorLog.String())
+		}
+		if n := conn.stats.deprecatedCiphers.Load(); (n == 1) != test.reported {
+			t.Errorf("%s: got %d connections counted", test.desc, n)
+		}
+	}
+}
+
+func TestLogRecord(t *testing.T) {
+	var access bytes.Buffer
+	accessLog = log.New(&access, "", log.LstdFlags)
+	defer func() { accessLog = log.Default() }()
+
+	format, err := config.ParseLogFormat(`%{client_ip}\t%{client_port}\t%{sni}\t%{route}\t%{backend}\t%{bytes_sent}\t%{bytes_received}\t%{outcome}\t%{alpn}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.Config{ LogFormat: format }
+	route := &config.Route{ Name: "web" }
+
+	tests := []struct {
+		desc string
+		conn *Conn
+		want string
+	}{
+		{
+			"Routed",
+			&Conn{ Config: conf, route: route, outcome: "routed",
+			       Hello: &handshake.ClientHello{ ServerName: "example.net" },
+			       backend: &config.Backend{ Address: "10.0.0.1:443" }, sent: 517, received: 4096 },
+			"192.0.2.1\t1234\texample.net\tweb\t10.0.0.1:443\t517\t4096\trouted\t-\n",
+		},
+		{
+			"Rejected before the handshake",
+			&Conn{ Config: conf, outcome: "error" },
+			"192.0.2.1\t1234\t-\t-\t-\t0\t0\terror\t-\n",
+		},
+	}
+
+	for _, test := range(tests) {
+		access.Reset()
+		test.conn.proxySrc = &net.TCPAddr{ IP: net.IPv4(192, 0, 2, 1), Port: 1234 }
+
+		// The default messages are replaced by the record.
+		test.conn.accessf("access")
+		test.conn.logRecord()
+		if access.String() != test.want {
+			t.Errorf("%s: got record %q, wanted %q", test.desc, access.String(), test.want)
+		}
+	}
+}
+
+func TestLogJSONRecord(t *testing.T) {
+	var access bytes.Buffer
+	accessLog = log.New(&access, "", log.LstdFlags)
+	defer func() { accessLog = log.Default() }()
+
+	conf := &config.Config{ LogJSON: true }
+	conn := &Conn{ Config: conf, outcome: "no_route",
+		       Hello: &handshake.ClientHello{ ServerName: "unknown.example.net" },
+		       proxySrc: &net.TCPAddr{ IP: net.IPv4(192, 0, 2, 1), Port: 1234 },
+		       proxyDst: &net.TCPAddr{ IP: net.IPv4(198, 51, 100, 1), Port: 443 } }
+
+	// The default messages are replaced by the record.
+	conn.accessf("access")
+	conn.logRecord()
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(access.Bytes(), &record); err != nil {
+		t.Fatalf("invalid record %q (%s)", access.String(), err)
+	}
+	if len(record) != len(config.LogJSONFields) {
+		t.Errorf("got %d fields, wanted %d", len(record), len(config.LogJSONFields))
+	}
+	for field, want := range map[string]interface{}{
+		"client_ip": "192.0.2.1",
+		"client_port": 1234.,
+		"local_addr": "198.51.100.1:443",
+		"sni": "unknown.example.net",
+		"outcome": "no_route",
+		"route": nil,
+		"backend_addr": nil,
+		"bytes_sent": 0.,
+	} {
+		if record[field] != want {
+			t.Errorf("%s: got %#v, wanted %#v", field, record[field], want)
+		}
+	}
+}
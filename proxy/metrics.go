@@ -0,0 +1,218 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Writes metrics using the Prometheus text exposition format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+// Writes the help and type lines of a metric.
+func (m *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Writes a sample of a metric, its labels being given as name, value pairs.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i + 1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], escapeLabel(labels[i + 1]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(m.w, "%s %s\n", b.String(), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// Escapes a label value.
+func escapeLabel(val string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(val)
+}
+
+// Writes the proxy metrics.
+func (p *Proxy) writeMetrics(w io.Writer) {
+	m := &metricsWriter{ w: w }
+
+	stats := p.RouteStats()
+	routes := make([]string, 0, len(stats))
+	for route := range stats {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	families := []struct {
+		name  string
+		typ   string
+		help  string
+		value func(RouteStat) int64
+	}{
+		{ "sniproxy_route_connections_total", "counter", "Connections matching the route.",
+		  func(s RouteStat) int64 { return s.Connections } },
+		{ "sniproxy_route_active_connections", "gauge", "Connections currently handled.",
+		  func(s RouteStat) int64 { return s.Active } },
+		{ "sniproxy_route_rejected_total", "counter", "Connections rejected (ACLs, rate limits, capacity, maintenance).",
+		  func(s RouteStat) int64 { return s.Rejected } },
+		{ "sniproxy_route_errors_total", "counter", "Connections which failed to be routed.",
+		  func(s RouteStat) int64 { return s.Errors } },
+		{ "sniproxy_replay_errors_total", "counter", "Connections whose handshake could not be replayed to the backend.",
+		  func(s RouteStat) int64 { return s.ReplayErrors } },
+		{ "sniproxy_route_dead_peers_total", "counter", "Connections closed as their client or backend was unreachable (keep alive or user timeout).",
+		  func(s RouteStat) int64 { return s.DeadPeers } },
+		{ "sniproxy_route_sent_bytes_total", "counter", "Bytes sent by the clients to the backends.",
+		  func(s RouteStat) int64 { return s.BytesSent } },
+		{ "sniproxy_route_received_bytes_total", "counter", "Bytes sent by the backends to the clients.",
+		  func(s RouteStat) int64 { return s.BytesReceived } },
+		{ "sniproxy_route_deprecated_ciphers_total", "counter", "Connections offering deprecated cipher suites (debug logging level only).",
+		  func(s RouteStat) int64 { return s.DeprecatedCiphers } },
+	}
+	for _, f := range families {
+		m.header(f.name, f.typ, f.help)
+		for _, route := range routes {
+			m.sample(f.name, float64(f.value(stats[route])), "route", route)
+		}
+	}
+
+	// Backend address family of the routed connections.
+	m.header("sniproxy_route_backend_family_total", "counter", "Connections routed, by backend address family.")
+	for _, route := range routes {
+		m.sample("sniproxy_route_backend_family_total", float64(stats[route].DialedIPv4), "route", route, "family", "ipv4")
+		m.sample("sniproxy_route_backend_family_total", float64(stats[route].DialedIPv6), "route", route, "family", "ipv6")
+	}
+
+	// Named routes can be disabled at runtime.
+	m.header("sniproxy_route_enabled", "gauge", "Whether the route is enabled.")
+	for _, route := range p.config().Routes {
+		if route.Name == "" {
+			continue
+		}
+		enabled := 0.
+		if route.Enabled() {
+			enabled = 1
+		}
+		m.sample("sniproxy_route_enabled", enabled, "route", route.Name)
+	}
+
+	// Backends of the routes with health checks.
+	m.header("sniproxy_backend_up", "gauge", "Whether the backend passed its last health check.")
+	for _, route := range p.config().Routes {
+		if route.HealthCheck == 0 {
+			continue
+		}
+		for _, backend := range route.CurrentBackends() {
+			up := 0.
+			if route.BackendUp(backend) {
+				up = 1
+			}
+			m.sample("sniproxy_backend_up", up, "route", route.Label(), "backend", backend.Address)
+		}
+	}
+
+	// Alerts sent to the clients, by type.
+	m.header("sniproxy_alerts_total", "counter", "TLS alerts sent to the clients, by type.")
+	for desc := range p.alerts {
+		if n := p.alerts[desc].Load(); n > 0 {
+			m.sample("sniproxy_alerts_total", float64(n), "type", config.AlertName(desc))
+		}
+	}
+
+	p.writeHandshakeMetrics(m)
+	p.writeRecordVersionMetrics(m)
+	p.writePhaseMetrics(m)
+	p.writeCertMetrics(m)
+	p.writeReaperMetrics(m)
+}
+
+// Serves the metrics over HTTP, on /metrics, and the readiness endpoint, on
+// /ready, until the context is canceled.
+func (p *Proxy) serveMetrics(ctx context.Context, bind string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", p.serveMetricsPage)
+	mux.HandleFunc("/ready", p.serveReady)
+
+	return serveHTTP(ctx, bind, p.restrictAdmin(mux))
+}
+
+// Serves the metrics, in the Prometheus text format.
+func (p *Proxy) serveMetricsPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.writeMetrics(w)
+}
+
+// Serves HTTP requests on an address until the context is canceled.
+func serveHTTP(ctx context.Context, bind string, h http.Handler) error {
+	l, err := listenHTTP(bind)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{ Handler: h, ReadHeaderTimeout: 5*time.Second }
+	stop := context.AfterFunc(ctx, func() { srv.Close() })
+	defer stop()
+
+	if err := srv.Serve(l); ctx.Err() != nil {
+		return ctx.Err()
+	} else {
+		return err
+	}
+}
+
+// Listens on a TCP address, or on a Unix socket when prefixed by "unix:". The
+// socket is only accessible by its owner and group, and removed on close.
+func listenHTTP(bind string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(bind, "unix:")
+	if !ok {
+		return net.Listen("tcp", bind)
+	}
+
+	// Remove a stale socket left by an unclean shutdown, but not the one of
+	// a running instance.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode() & os.ModeSocket != 0 {
+		c, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			c.Close()
+			return nil, fmt.Errorf("Socket %s is in use", path)
+		}
+		os.Remove(path)
+	}
+
+	l, err := listenUnixSocket(path)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(true)
+	return l, nil
+}
@@ -0,0 +1,370 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+func TestMetricsWriter(t *testing.T) {
+	var buf bytes.Buffer
+	m := &metricsWriter{ w: &buf }
+	m.header("test_total", "counter", "Test metric.")
+	m.sample("test_total", 42, "route", `a "quoted" \\ name`, "backend", "1.2.3.4:443")
+	m.sample("test_total", 0.5)
+
+	want := "# HELP test_total Test metric.\n" +
+		"# TYPE test_total counter\n" +
+		`test_total{route="a \"quoted\" \\\\ name",backend="1.2.3.4:443"} 42` + "\n" +
+		"test_total 0.5\n"
+	if buf.String() != want {
+		t.Errorf("wrong output:\n%s\nwanted:\n%s", buf.String(), want)
+	}
+}
+
+func TestRouteMetrics(t *testing.T) {
+	p := &Proxy{}
+	route := &config.Route{ Name: "test" }
+	stats := p.stats.get(route)
+	stats.connections.Add(3)
+	stats.errors.Add(2)
+	stats.replayErrors.Add(1)
+	stats.deadPeers.Add(1)
+	stats.dialedIPv4.Add(2)
+
+	var buf bytes.Buffer
+	p.writeMetrics(&buf)
+	for _, want := range []string{
+		`sniproxy_route_connections_total{route="test"} 3`,
+		`sniproxy_route_errors_total{route="test"} 2`,
+		`sniproxy_replay_errors_total{route="test"} 1`,
+		`sniproxy_route_dead_peers_total{route="test"} 1`,
+		`sniproxy_route_backend_family_total{route="test",family="ipv4"} 2`,
+		`sniproxy_route_backend_family_total{route="test",family="ipv6"} 0`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing metric %s in:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRouteStatsReload(t *testing.T) {
+	route := func(name string) *config.Route {
+		return &config.Route{ Name: name }
+	}
+	p := &Proxy{ Config: config.Config{ Routes: []*config.Route{ route("kept"), route("active"), route("removed") }}}
+	for _, route := range p.Config.Routes {
+		p.stats.get(route).connections.Add(1)
+	}
+	p.stats.get(p.Config.Routes[1]).active.Add(1)
+
+	// The routes of the new configuration share the counters of the
+	// previous ones with the same label.
+	if err := p.Reload(config.Config{ Routes: []*config.Route{ route("kept"), route("added") }}); err != nil {
+		t.Fatal(err)
+	}
+	p.stats.get(p.config().Routes[0]).connections.Add(1)
+
+	stats := p.RouteStats()
+	if n := stats["kept"].Connections; n != 2 {
+		t.Errorf("kept route: got %d connections, wanted 2", n)
+	}
+	if _, ok := stats["active"]; !ok {
+		t.Error("counters of a removed route with active connections dropped")
+	}
+	if _, ok := stats["removed"]; ok {
+		t.Error("counters of a removed route kept")
+	}
+}
+
+func TestAlertMetrics(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Connections without a route get an unrecognized_name alert.
+	p := &Proxy{}
+	for _, sni := range []string{ "a.example.net", "b.example.net" } {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			c.Write(rawClientHello(t, sni))
+			io.ReadAll(c)
+		}()
+
+		c, err := l.Accept()
+		l.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := &Conn{ TCPConn: c.(*net.TCPConn), Config: &p.Config, proxy: p, accepted: time.Now() }
+		conn.dispatch(context.Background())
+		<-done
+	}
+
+	var buf bytes.Buffer
+	p.writeMetrics(&buf)
+	if want := `sniproxy_alerts_total{type="unrecognized_name"} 2`; !strings.Contains(buf.String(), want) {
+		t.Errorf("missing metric %s in:\n%s", want, buf.String())
+	}
+	if strings.Contains(buf.String(), `type="access_denied"`) {
+		t.Errorf("alert never sent reported in:\n%s", buf.String())
+	}
+}
+
+func TestPhaseMetrics(t *testing.T) {
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			  Backends: []*config.Backend{{ Address: "backend.invalid:443", Weight: 1 }} },
+		},
+		Metrics: "127.0.0.1:0",
+	}
+	d := &fakeDialer{ backend: func(c net.Conn) {
+		defer c.Close()
+		c.Read(make([]byte, 4096))
+		c.Write([]byte("reply"))
+	}}
+	p := &Proxy{ Config: *conf, Dialer: d }
+	send := func(c net.Conn) {
+		c.Write(rawClientHello(t, "example.net"))
+		io.ReadAll(c)
+	}
+	if err := handleProxyConn(t, p, conf, send); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	p.writeMetrics(&buf)
+	for _, want := range []string{
+		`sniproxy_phase_duration_seconds_count{phase="sni_read"} 1`,
+		`sniproxy_phase_duration_seconds_count{phase="route_match"} 1`,
+		`sniproxy_phase_duration_seconds_count{phase="acl"} 1`,
+		`sniproxy_phase_duration_seconds_count{phase="resolve"} 0`,
+		`sniproxy_phase_duration_seconds_count{phase="dial"} 1`,
+		`sniproxy_phase_duration_seconds_count{phase="replay"} 1`,
+		`sniproxy_phase_duration_seconds_count{phase="first_byte"} 1`,
+		`sniproxy_phase_duration_seconds_bucket{phase="dial",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing metric %s in:\n%s", want, buf.String())
+		}
+	}
+
+	// Buckets are cumulative.
+	var h histogram
+	h.observe(2*time.Millisecond)
+	h.observe(time.Minute)
+	buf.Reset()
+	h.write(&metricsWriter{ w: &buf }, "test")
+	for _, want := range []string{
+		`test_bucket{le="0.001"} 0`,
+		`test_bucket{le="0.005"} 1`,
+		`test_bucket{le="5"} 1`,
+		`test_bucket{le="+Inf"} 2`,
+		`test_sum 60.002`,
+		`test_count 2`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing sample %s in:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestCertProbe(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	route := &config.Route{
+		Name: "test",
+		Backends: []*config.Backend{{ Address: srv.Listener.Addr().String(), Weight: 1 }},
+		CertProbe: "example.com",
+	}
+
+	notAfter, err := fetchCertExpiry(context.Background(), route, route.Backends[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !notAfter.Equal(srv.Certificate().NotAfter) {
+		t.Errorf("wrong expiry date: got %s, wanted %s", notAfter, srv.Certificate().NotAfter)
+	}
+
+	p := &Proxy{}
+	p.certs.set(route, map[string]certProbe{
+		route.Backends[0].Address: { route: route, backend: route.Backends[0].Address,
+					     ok: true, notAfter: notAfter },
+		"127.0.0.1:1": { route: route, backend: "127.0.0.1:1" },
+	})
+
+	var buf bytes.Buffer
+	p.writeMetrics(&buf)
+	for _, want := range []string{
+		`sniproxy_backend_cert_probe_success{route="test",backend="127.0.0.1:1",server_name="example.com"} 0`,
+		`sniproxy_backend_cert_probe_success{route="test",backend="` + route.Backends[0].Address + `",server_name="example.com"} 1`,
+		`sniproxy_backend_cert_expiry_seconds{route="test",backend="` + route.Backends[0].Address + `",server_name="example.com"} `,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing metric %s in:\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), `sniproxy_backend_cert_expiry_seconds{route="test",backend="127.0.0.1:1"`) {
+		t.Error("expiry reported for a failed probe")
+	}
+}
+
+func TestCertProbeReload(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	route := func(name string) *config.Route {
+		return &config.Route{
+			Name: name,
+			Backends: []*config.Backend{{ Address: srv.Listener.Addr().String(), Weight: 1 }},
+			CertProbe: "example.com",
+			CertProbeInterval: 20*time.Millisecond,
+		}
+	}
+	probed := func(p *Proxy) []string {
+		var routes []string
+		for _, probe := range p.certs.all() {
+			routes = append(routes, probe.route.Name)
+		}
+		return routes
+	}
+	waitProbed := func(p *Proxy, name string) {
+		for start := time.Now(); ; time.Sleep(10*time.Millisecond) {
+			if routes := probed(p); len(routes) == 1 && routes[0] == name {
+				return
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("got probes of %v, wanted %s only", probed(p), name)
+			}
+		}
+	}
+
+	p := &Proxy{ Config: config.Config{ Routes: []*config.Route{ route("old") } } }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.runTasks(ctx)
+	waitProbed(p, "old")
+
+	// The probes follow the reloaded configuration, the results of the
+	// replaced one being dropped.
+	if err := p.Reload(config.Config{ Routes: []*config.Route{ route("new") } }); err != nil {
+		t.Fatal(err)
+	}
+	waitProbed(p, "new")
+	time.Sleep(50*time.Millisecond)
+	if routes := probed(p); len(routes) != 1 || routes[0] != "new" {
+		t.Errorf("got probes of %v after the reload", routes)
+	}
+}
+
+func TestListenHTTPStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+
+	// The socket of a running instance is left untouched.
+	running, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := listenHTTP("unix:" + path); err == nil {
+		l.Close()
+		t.Fatal("listened on the socket of a running instance")
+	}
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("socket of the running instance removed: %s", err)
+	}
+	c.Close()
+
+	// A stale one is replaced.
+	running.(*net.UnixListener).SetUnlinkOnClose(false)
+	running.Close()
+	l, err := listenHTTP("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
+
+func TestServeHTTPUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+	p := &Proxy{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- p.serveMetrics(ctx, "unix:" + path) }()
+
+	client := &http.Client{ Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+
+	var resp *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get("http://unix/metrics"); err == nil {
+			break
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+
+	if runtime.GOOS != "windows" {
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+			t.Errorf("wrong socket permissions: %v (%v)", fi.Mode(), err)
+		}
+	}
+
+	cancel()
+	<-errs
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed: %v", err)
+	}
+}
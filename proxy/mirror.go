@@ -0,0 +1,114 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// Number of chunks queued for a mirror before giving up on it.
+const mirrorQueueLen = 64
+
+// Mirror receives a copy of the client to backend traffic, on a best effort
+// basis. Its responses are discarded and its failures never impact the
+// connection being mirrored: if the mirror is too slow to keep up, mirroring
+// is stopped.
+type mirror struct {
+	addr   string
+	queue  chan []byte
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Creates a mirror and connects to it asynchronously. The handshake is sent
+// first, once connected.
+func newMirror(ctx context.Context, d *net.Dialer, addr string, handshake []byte) *mirror {
+	m := &mirror{
+		addr: addr,
+		queue: make(chan []byte, mirrorQueueLen),
+	}
+	m.queue <- handshake
+
+	go m.run(ctx, d)
+	return m
+}
+
+// Queues a copy of the data for the mirror. It never fails.
+func (m *mirror) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return len(p), nil
+	}
+
+	b := make([]byte, len(p))
+	copy(b, p)
+
+	select {
+	case m.queue <- b:
+	default:
+		// The mirror can't keep up, as dropping data would corrupt
+		// the mirrored stream stop mirroring altogether.
+		log.Printf("Mirror %s is too slow, stop mirroring", m.addr)
+		m.closed = true
+		close(m.queue)
+	}
+	return len(p), nil
+}
+
+// Stops mirroring, once the queued data is sent.
+func (m *mirror) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	return nil
+}
+
+func (m *mirror) run(ctx context.Context, d *net.Dialer) {
+	// Drain the queue no matter what, so writers never block.
+	defer func() {
+		for range m.queue {
+		}
+	}()
+
+	conn, err := d.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		log.Printf("Could not connect to mirror %s (%s)", m.addr, err)
+		return
+	}
+	defer conn.Close()
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	// Discard the mirror responses.
+	go io.Copy(io.Discard, conn)
+
+	for b := range m.queue {
+		if _, err := conn.Write(b); err != nil {
+			log.Printf("Failed to send data to mirror %s (%s)", m.addr, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Listens as a mirror accepting the connections but never reading them, the
+// connections being closed with the listener.
+func slowMirror(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	return l
+}
+
+func TestMirror(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	m := newMirror(context.Background(), &net.Dialer{}, l.Addr().String(), []byte("hello"))
+	m.Write([]byte(" world"))
+	m.Close()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(3*time.Second))
+	if b, err := io.ReadAll(c); err != nil || string(b) != "hello world" {
+		t.Errorf("mirror received %q (%v), wanted the handshake and the data", b, err)
+	}
+}
+
+func TestMirrorFailures(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	slow := slowMirror(t)
+	defer slow.Close()
+
+	for _, addr := range []string{ slow.Addr().String(), freeAddr(t) } {
+		m := newMirror(context.Background(), &net.Dialer{}, addr, []byte("hello"))
+		chunk := make([]byte, 256*1024)
+		start := time.Now()
+		for i := 0; i < 512; i++ {
+			m.Write(chunk)
+		}
+		m.Close()
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: writes to the mirror took %s", addr, d)
+		}
+	}
+}
+
+// The connection is served by its backend while the mirror does not read.
+func TestMirrorPrimary(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	slow := slowMirror(t)
+	defer slow.Close()
+
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			  Backends: []*config.Backend{{ Address: "backend.invalid:443", Weight: 1 }},
+			  Mirror: slow.Addr().String() },
+		},
+		HandshakeTimeout: 5*time.Second,
+	}
+	hello := rawClientHello(t, "example.net")
+	data := bytes.Repeat([]byte("data"), 4*1024*1024)
+	send := func(c net.Conn) {
+		c.Write(hello)
+		c.Write(data)
+		c.(*net.TCPConn).CloseWrite()
+		io.Copy(io.Discard, c)
+	}
+
+	received := make(chan int64, 1)
+	d := &fakeDialer{ backend: func(c net.Conn) {
+		defer c.Close()
+		n, _ := io.Copy(io.Discard, c)
+		received <- n
+	}}
+	done := make(chan error, 1)
+	go func() {
+		done <- handleProxyConn(t, &Proxy{ Dialer: d }, conf, send)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10*time.Second):
+		t.Fatal("connection stalled by the mirror")
+	}
+	if n := <-received; n != int64(len(hello) + len(data)) {
+		t.Errorf("backend received %d bytes, wanted %d", n, len(hello) + len(data))
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// Forwards a client which did not start with a TLS handshake (e.g. plain HTTP
+// sent to the TLS port) to a backend, replaying the data already read. Returns
+// a DispatchError if the backend can't be reached.
+func (conn *Conn) forwardNonTLS(ctx context.Context, address string) error {
+	var upstream net.Conn
+	var err error
+	if conn.proxy != nil && conn.proxy.Dialer != nil {
+		upstream, err = conn.proxy.Dialer.DialContext(ctx, "tcp", address)
+	} else {
+		d := net.Dialer{ Timeout: 3*time.Second }
+		upstream, err = d.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return dispatchErrorf(ErrBackendDial, "Could not dial the non-TLS backend %s (%w)", address, err)
+	}
+	defer upstream.Close()
+	context.AfterFunc(ctx, func() { upstream.Close() })
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return dispatchErrorf(ErrInternal, "Could not clear the read deadline (%w)", err)
+	}
+	if _, err := upstream.Write(conn.rawHello); err != nil {
+		return dispatchErrorf(ErrBackendDial, "Could not replay the data to the non-TLS backend %s (%w)", address, err)
+	}
+	conn.debugf("Forwarded non-TLS client to %s", address)
+	conn.setOutcome("not_tls")
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn.TCPConn)
+		closeWrite(upstream)
+		done<- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn.TCPConn, upstream)
+		conn.CloseWrite()
+		done<- struct{}{}
+	}()
+	<-done
+	<-done
+	return nil
+}
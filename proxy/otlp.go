@@ -0,0 +1,255 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Spans exported at once, spans kept pending before dropping the new ones, and
+// maximum interval between two exports.
+const (
+	otlpBatchSize     = 512
+	otlpMaxPending    = 8192
+	otlpFlushInterval = 5*time.Second
+)
+
+// OTLPTracer exports the connections spans to an OpenTelemetry collector, using
+// OTLP over HTTP with the JSON encoding (e.g. to http://collector:4318/v1/traces).
+// Spans are exported in batches in the background, and dropped when the
+// collector can't keep up.
+type OTLPTracer struct {
+	endpoint string
+	client   http.Client
+
+	mu       sync.Mutex
+	pending  []*otlpSpan
+	dropped  int
+	closed   bool
+	flush    chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// Creates a tracer exporting its spans to an OTLP/HTTP endpoint, until closed.
+func NewOTLPTracer(endpoint string) *OTLPTracer {
+	t := &OTLPTracer{
+		endpoint: endpoint,
+		client: http.Client{ Timeout: 10*time.Second },
+		flush: make(chan struct{}, 1),
+		done: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *OTLPTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	s := &otlpSpan{ tracer: t, name: name, start: time.Now() }
+	rand.Read(s.traceID[:])
+	rand.Read(s.spanID[:])
+	return ctx, s
+}
+
+// Exports the pending spans and stops the tracer. Spans ended afterwards are
+// dropped.
+func (t *OTLPTracer) Close() error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+	t.mu.Unlock()
+	<-t.stopped
+	return nil
+}
+
+// Queues an ended span for the next export.
+func (t *OTLPTracer) queue(s *otlpSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed || len(t.pending) >= otlpMaxPending {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, s)
+	if len(t.pending) >= otlpBatchSize {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *OTLPTracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.flush:
+		case <-t.done:
+			t.export()
+			return
+		}
+		t.export()
+	}
+}
+
+// Exports the pending spans, in batches.
+func (t *OTLPTracer) export() {
+	t.mu.Lock()
+	spans, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		log.Printf("Dropped %d spans, not exported in time to %s", dropped, t.endpoint)
+	}
+	for len(spans) > 0 {
+		n := min(len(spans), otlpBatchSize)
+		if err := t.post(spans[:n]); err != nil {
+			log.Printf("Could not export %d spans to %s (%s)", n, t.endpoint, err)
+		}
+		spans = spans[n:]
+	}
+}
+
+func (t *OTLPTracer) post(spans []*otlpSpan) error {
+	var encoded []map[string]interface{}
+	for _, s := range spans {
+		encoded = append(encoded, s.encode())
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{ map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{ otlpAttribute("service.name", "sniproxy") },
+			},
+			"scopeSpans": []interface{}{ map[string]interface{}{
+				"scope": map[string]string{ "name": "sniproxy" },
+				"spans": encoded,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode / 100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Span of a connection, exported once ended.
+type otlpSpan struct {
+	tracer  *OTLPTracer
+	name    string
+	traceID [16]byte
+	spanID  [8]byte
+	start   time.Time
+
+	mu      sync.Mutex
+	end     time.Time
+	attrs   []string
+	values  map[string]interface{}
+}
+
+// Sets an attribute, replacing its previous value if any.
+func (s *otlpSpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	if _, ok := s.values[key]; !ok {
+		s.attrs = append(s.attrs, key)
+	}
+	s.values[key] = value
+}
+
+func (s *otlpSpan) End() {
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.queue(s)
+}
+
+// Returns the JSON representation of the span.
+func (s *otlpSpan) encode() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attrs := []interface{}{}
+	for _, key := range s.attrs {
+		attrs = append(attrs, otlpAttribute(key, s.values[key]))
+	}
+	return map[string]interface{}{
+		"traceId": hex.EncodeToString(s.traceID[:]),
+		"spanId": hex.EncodeToString(s.spanID[:]),
+		"name": s.name,
+		// Server span.
+		"kind": 2,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano": strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes": attrs,
+	}
+}
+
+// Returns the JSON representation of an attribute. 64-bit integers are encoded
+// as strings.
+func otlpAttribute(key string, value interface{}) map[string]interface{} {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case string:
+		v = map[string]interface{}{ "stringValue": value }
+		break
+	case int:
+		v = map[string]interface{}{ "intValue": strconv.Itoa(value) }
+		break
+	case int64:
+		v = map[string]interface{}{ "intValue": strconv.FormatInt(value, 10) }
+		break
+	case bool:
+		v = map[string]interface{}{ "boolValue": value }
+		break
+	case float64:
+		v = map[string]interface{}{ "doubleValue": value }
+		break
+	default:
+		v = map[string]interface{}{ "stringValue": fmt.Sprint(value) }
+	}
+	return map[string]interface{}{ "key": key, "value": v }
+}
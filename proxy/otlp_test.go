@@ -0,0 +1,93 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestOTLPTracer(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		b, _ := io.ReadAll(r.Body)
+		bodies <- b
+	}))
+	defer srv.Close()
+
+	tracer := NewOTLPTracer(srv.URL + "/v1/traces")
+	_, span := tracer.Start(context.Background(), "sniproxy.conn")
+	span.SetAttribute("sni", "example.net")
+	span.SetAttribute("bytes.sent", int64(42))
+	span.SetAttribute("bytes.sent", int64(43))
+	span.End()
+	// Pending spans are exported when closing.
+	tracer.Close()
+
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID    string `json:"traceId"`
+					SpanID     string `json:"spanId"`
+					Name       string
+					Attributes []struct {
+						Key   string
+						Value map[string]interface{}
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(<-bodies, &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 ||
+	   len(req.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("got %+v, wanted a single span", req)
+	}
+	s := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if s.Name != "sniproxy.conn" || len(s.TraceID) != 32 || len(s.SpanID) != 16 {
+		t.Errorf("got span %q (trace %q, span %q)", s.Name, s.TraceID, s.SpanID)
+	}
+	if len(s.Attributes) != 2 ||
+	   s.Attributes[0].Key != "sni" || s.Attributes[0].Value["stringValue"] != "example.net" ||
+	   s.Attributes[1].Key != "bytes.sent" || s.Attributes[1].Value["intValue"] != "43" {
+		t.Errorf("got attributes %+v", s.Attributes)
+	}
+
+	// Spans ended once closed are dropped.
+	_, span = tracer.Start(context.Background(), "sniproxy.conn")
+	span.End()
+	tracer.export()
+	select {
+	case <-bodies:
+		t.Error("span exported after the tracer was closed")
+	default:
+	}
+}
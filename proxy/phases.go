@@ -0,0 +1,128 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Phases of the dispatch of a connection, timed to find where the latency
+// comes from.
+const (
+	// From the connection being accepted to its handshake being read.
+	phaseSNIRead    = iota
+	phaseRouteMatch = iota
+	phaseACL        = iota
+	// Resolution of the backend address (sni backends only), and dial.
+	phaseResolve    = iota
+	phaseDial       = iota
+	// Sending of the PROXY header, if any, and of the handshake.
+	phaseReplay     = iota
+	// From the handshake being replayed to the first backend byte.
+	phaseFirstByte  = iota
+	phaseCount      = iota
+)
+
+var phaseNames = [phaseCount]string{ "sni_read", "route_match", "acl", "resolve", "dial", "replay", "first_byte" }
+
+// Upper bounds of the phase durations histograms buckets, in seconds.
+var phaseBuckets = [...]float64{ .0001, .0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5 }
+
+// Histogram of durations, safe for concurrent use.
+type histogram struct {
+	// Observations per bucket (not cumulative), the last one for those
+	// above all bounds.
+	buckets [len(phaseBuckets) + 1]atomic.Int64
+	count   atomic.Int64
+	// Sum of the observations, in nanoseconds.
+	sum     atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	i := 0
+	for i < len(phaseBuckets) && s > phaseBuckets[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Writes the histogram samples, under the given labels and an le one.
+func (h *histogram) write(m *metricsWriter, name string, labels ...string) {
+	var cumulative int64
+	for i := range(h.buckets) {
+		cumulative += h.buckets[i].Load()
+		le := "+Inf"
+		if i < len(phaseBuckets) {
+			le = strconv.FormatFloat(phaseBuckets[i], 'g', -1, 64)
+		}
+		m.sample(name + "_bucket", float64(cumulative), append(labels, "le", le)...)
+	}
+	m.sample(name + "_sum", time.Duration(h.sum.Load()).Seconds(), labels...)
+	m.sample(name + "_count", float64(h.count.Load()), labels...)
+}
+
+// Records the duration of a dispatch phase started at the given time, and
+// returns the time it ended, i.e. the start of the next one. Nothing is done,
+// start being returned, when the phase timings are disabled or not exported.
+func (conn *Conn) phaseDone(phase int, start time.Time) time.Time {
+	if !conn.phaseTimings() {
+		return start
+	}
+
+	now := time.Now()
+	conn.proxy.phases[phase].observe(now.Sub(start))
+	return now
+}
+
+// Reports whether the dispatch phases of the connection are timed: only when
+// the metrics are served, unless disabled.
+func (conn *Conn) phaseTimings() bool {
+	return conn.proxy != nil && conn.Config != nil && conn.Config.Metrics != "" && !conn.Config.NoPhaseTimings
+}
+
+// Copies the data of a single read from src to dst, returning the number of
+// bytes copied.
+func copyFirstRead(dst io.Writer, src io.Reader) (int64, error) {
+	b := make([]byte, 16*1024)
+	n, err := src.Read(b)
+	if n > 0 {
+		if _, err := dst.Write(b[:n]); err != nil {
+			return 0, err
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return int64(n), err
+}
+
+// Writes the phase durations histograms.
+func (p *Proxy) writePhaseMetrics(m *metricsWriter) {
+	if p.Config.NoPhaseTimings {
+		return
+	}
+
+	m.header("sniproxy_phase_duration_seconds", "histogram", "Time spent in each phase of the connections dispatch.")
+	for phase := range(p.phases) {
+		p.phases[phase].write(m, "sniproxy_phase_duration_seconds", "phase", phaseNames[phase])
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// PolicyEngine takes routing and access decisions the configuration can't
+// express, e.g. evaluating a CEL expression or a Lua script. It is evaluated
+// for each connection once its handshake is read, before the routes are
+// matched. An evaluation error rejects the connection (fail closed).
+type PolicyEngine interface {
+	Evaluate(ctx context.Context, input PolicyInput) (PolicyDecision, error)
+}
+
+// PolicyFunc allows using a function as a PolicyEngine.
+type PolicyFunc func(ctx context.Context, input PolicyInput) (PolicyDecision, error)
+
+func (f PolicyFunc) Evaluate(ctx context.Context, input PolicyInput) (PolicyDecision, error) {
+	return f(ctx, input)
+}
+
+// Connection metadata given to the policy engine.
+type PolicyInput struct {
+	// Server name requested by the client, once rewritten.
+	SNI       string
+	ClientIP  net.IP
+	// Application protocols offered by the client.
+	ALPN      []string
+	JA3       string
+	// Port the client connected to.
+	LocalPort int
+}
+
+// Decision of the policy engine. The zero value lets the connection go
+// through the usual route matching.
+type PolicyDecision struct {
+	Deny  bool
+	// Name of the route the connection is sent to, instead of the one
+	// matching its SNI.
+	Route string
+}
+
+// Evaluates the proxy policy engine, if any, for a connection. Returns the
+// route it selected, nil if the connection should be matched as usual, or a
+// DispatchError if it is denied.
+func (conn *Conn) evaluatePolicy(ctx context.Context, sni string) (*config.Route, error) {
+	if conn.proxy == nil || conn.proxy.Policy == nil {
+		return nil, nil
+	}
+
+	input := PolicyInput{
+		SNI: sni,
+		ALPN: conn.Hello.ALPN(),
+		JA3: conn.Hello.JA3(),
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		input.ClientIP = addr.IP
+	}
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		input.LocalPort = addr.Port
+	}
+
+	decision, err := conn.proxy.Policy.Evaluate(ctx, input)
+	if err != nil {
+		return nil, dispatchErrorf(ErrDenied, "Policy evaluation failed, denied %s (%w)", sni, err)
+	}
+	if decision.Deny {
+		return nil, dispatchErrorf(ErrDenied, "Policy denied %s", sni)
+	}
+	if decision.Route == "" {
+		return nil, nil
+	}
+
+	for _, route := range conn.Config.Routes {
+		if route.Name == decision.Route {
+			conn.debugf("Policy selected route %s for %q", route.Name, sni)
+			return route, nil
+		}
+	}
+	return nil, dispatchErrorf(ErrNoRoute, "Policy selected an unknown route %s for %s", decision.Route, sni)
+}
@@ -0,0 +1,1648 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package proxy routes TLS connections to backends based on the SNI of their
+// handshake, following a configuration. It is used by the sniproxy command,
+// and can be embedded in other programs.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+	"github.com/atenart/sniproxy/handshake"
+)
+
+// Connects to the backends.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Represents the proxy itself.
+type Proxy struct {
+	Config config.Config
+	// Optional tracer, creating a span per connection.
+	Tracer Tracer
+	// Optional engine taking routing and access decisions per connection.
+	Policy PolicyEngine
+	// Optional dialer used to connect to the backends (e.g. a fake one in
+	// tests). A net.Dialer following the route options (transparent
+	// egress, source ports, congestion control) is used when nil.
+	Dialer Dialer
+	// Optional subsystems closed in order once the proxy stopped, after
+	// the connections are done (e.g. buffered log or metrics exporters,
+	// flushing their last records).
+	Closers []io.Closer
+	// Optional hooks called when a connection is accepted, before its
+	// handshake is read, and once it is closed. A connection is rejected
+	// as denied when OnAccept returns an error.
+	OnAccept func(conn *Conn) error
+	OnClose  func(info ConnInfo)
+	// Optional handlers added to the admin API, by path (e.g. to expose
+	// the state of an embedder). They are subject to its restrictions.
+	AdminHandlers map[string]http.Handler
+
+	stats  routeStats
+	certs  certProbes
+	phases [phaseCount]histogram
+	// Connections reading their handshake.
+	handshakes handshakeLimiter
+	// Alerts sent, by description, and client handshakes by record
+	// version.
+	alerts         [256]atomic.Int64
+	recordVersions [6]atomic.Int64
+	// Listeners being served, by bind address.
+	listeners listenerSet
+	// Configuration replacing Config once reloaded, and background tasks
+	// of the configuration in use.
+	current atomic.Pointer[config.Config]
+	tasks   configTasks
+	// Shutdown state (see Shutdown), and connections being handled.
+	draining atomic.Bool
+	stopOnce sync.Once
+	stop     chan struct{}
+	conns    sync.WaitGroup
+	// Connections being routed to a backend, reported by the admin API
+	// and scanned by the idle connections reaper, and connections reaped
+	// by listener bind address.
+	routed sync.Map
+	reaped sync.Map
+}
+
+// Represents a connection being routed.
+type Conn struct {
+	*net.TCPConn
+	Config *config.Config
+	// Original destination of the connection, when transparent proxying
+	// is used.
+	OriginalDst *net.TCPAddr
+	// Listener the connection was accepted on.
+	Listener *config.Listener
+	// ClientHello sent by the client, once parsed.
+	Hello *handshake.ClientHello
+
+	proxy *Proxy
+	span  Span
+	// Outcome of the connection (routed, denied, error...), and the
+	// counters of the route it matched.
+	outcome string
+	stats   *routeCounters
+	// Time at which the connection was accepted, and at which its
+	// handshake was replayed to the backend (when timing the phases).
+	accepted time.Time
+	replayed time.Time
+	// Addresses reported in the PROXY header, if one was received.
+	proxySrc *net.TCPAddr
+	proxyDst *net.TCPAddr
+	// PROXY header received, as sent, and whether one was sent to the
+	// backend.
+	proxyHeader []byte
+	sentProxy   bool
+	// Framing header skipped before the handshake, when forwarded.
+	framing []byte
+	// Route matched, and raw handshake read from the client.
+	route    *config.Route
+	rawHello []byte
+	// Whether TLS is terminated rather than passed through.
+	terminated bool
+	// Version of the record holding the client handshake, once read.
+	recordVersion uint16
+	// Bytes of the backend answer already forwarded to the client, once
+	// awaited for replay retries.
+	prefetched int64
+	// Backend used and address dialed, and bytes copied from the client
+	// (sent) and from the backend (received), once done.
+	backend     *config.Backend
+	backendAddr string
+	sent        int64
+	received    int64
+	// Time of the last data read from either side (unix nanoseconds),
+	// tracked when the listener has an idle timeout, and whether the
+	// connection was closed by the reaper.
+	lastActive atomic.Int64
+	reaped     atomic.Bool
+}
+
+// Listen and serve the connections.
+func (p *Proxy) ListenAndServe(bind string) error {
+	return p.ListenAndServeContext(context.Background(), bind)
+}
+
+// Checks a configuration can be used, beyond what its parsing checks.
+func validateConfig(c *config.Config) error {
+	// Check the TCP congestion control algorithms are available.
+	for _, route := range c.Routes {
+		if route.CongestionControl == "" {
+			continue
+		}
+		if err := validateCongestionControl(route.CongestionControl); err != nil {
+			return err
+		}
+	}
+	// Check DSCP marking is supported.
+	for _, route := range c.Routes {
+		if route.DSCP == 0 {
+			continue
+		}
+		if err := checkDSCP(); err != nil {
+			return err
+		}
+	}
+	// Check TCP user timeouts are supported.
+	for _, route := range c.Routes {
+		if route.UserTimeout == 0 {
+			continue
+		}
+		if err := checkUserTimeout(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the configuration currently used: Config, unless another one was
+// loaded since.
+func (p *Proxy) config() *config.Config {
+	if c := p.current.Load(); c != nil {
+		return c
+	}
+	return &p.Config
+}
+
+// Returns the configuration currently used, e.g. to check a reload was applied.
+func (p *Proxy) CurrentConfig() *config.Config {
+	return p.config()
+}
+
+// Replaces the configuration used by the new connections, if valid: the
+// current one is kept otherwise, and an error returned. Listeners are started
+// for the bind addresses added and stopped for the ones removed, the
+// connections they accepted being kept; the listening options and the metrics
+// and admin servers keep using the initial configuration. The replaced
+// configuration is closed (see config.Config.Close). This is what the command
+// line reloads use, and can be called by embedders from their own triggers.
+func (p *Proxy) Reload(c config.Config) error {
+	if err := validateConfig(&c); err != nil {
+		return err
+	}
+	start, err := p.reloadListeners(&c)
+	if err != nil {
+		return err
+	}
+	prev := p.config()
+	p.current.Store(&c)
+	start()
+	p.startTasks(&c)
+	p.stats.retain(c.Routes)
+	prev.Close()
+	return nil
+}
+
+// Background tasks of the configuration in use (health checks, certificate
+// probes), run while serving and canceled when the configuration is replaced.
+type configTasks struct {
+	mu     sync.Mutex
+	// Serving context, nil when not serving.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Runs the background tasks of the configuration in use, and of the ones
+// reloaded, until the context is canceled.
+func (p *Proxy) runTasks(ctx context.Context) {
+	p.tasks.mu.Lock()
+	p.tasks.ctx = ctx
+	p.tasks.mu.Unlock()
+	p.startTasks(p.config())
+
+	context.AfterFunc(ctx, func() {
+		p.tasks.mu.Lock()
+		defer p.tasks.mu.Unlock()
+		if p.tasks.ctx == ctx {
+			p.tasks.ctx, p.tasks.cancel = nil, nil
+		}
+	})
+}
+
+// Starts the background tasks of a configuration, stopping the ones of the
+// configuration it replaces. Nothing is started when not serving.
+func (p *Proxy) startTasks(c *config.Config) {
+	t := &p.tasks
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ctx == nil {
+		return
+	}
+	if t.cancel != nil {
+		t.cancel()
+	}
+
+	var ctx context.Context
+	ctx, t.cancel = context.WithCancel(t.ctx)
+	p.runHealthChecks(ctx, c.Routes)
+
+	// The results of the routes no longer used are dropped.
+	p.certs.retain(c.Routes)
+	for _, route := range c.Routes {
+		if route.CertProbe != "" {
+			go p.probeCerts(ctx, route)
+		}
+	}
+}
+
+// Listen and serve the connections until the context is canceled. Canceling
+// the context also closes all the connections being routed. The listeners of
+// the configuration are used if any, bind otherwise.
+func (p *Proxy) ListenAndServeContext(ctx context.Context, bind string) error {
+	if err := validateConfig(&p.Config); err != nil {
+		return err
+	}
+
+	// Export the connections traces, unless a tracer was already set.
+	if p.Tracer == nil && p.Config.Tracing != "" {
+		t := NewOTLPTracer(p.Config.Tracing)
+		p.Tracer = t
+		p.Closers = append(p.Closers, t)
+	}
+
+	// TCP Fast Open is an optimization, do not fail on hosts lacking it.
+	if p.Config.TCPFastOpen {
+		if err := checkTCPFastOpen(p.Config.TCPFastOpenOn); err != nil {
+			log.Printf("Warning: %s", err)
+		}
+	}
+
+	// Stop all listeners as soon as one fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := p.startListeners(ctx, &p.Config, bind); err != nil {
+		return err
+	}
+
+	errs := make(chan error, 2)
+	servers := 0
+	run := func(serve func() error) {
+		servers++
+		go func() {
+			errs <- serve()
+		}()
+	}
+
+	if p.Config.Metrics != "" {
+		run(func() error { return p.serveMetrics(ctx, p.Config.Metrics) })
+	}
+	if p.Config.Admin != "" {
+		run(func() error { return p.serveAdmin(ctx, p.Config.Admin) })
+	}
+
+	// Start probing the backends certificates and checking their health,
+	// following the reloads.
+	p.runTasks(ctx)
+
+	// Start closing the idle connections.
+	go p.runReaper(ctx)
+
+	var err error
+	select {
+	case err = <-p.listeners.failed:
+		break
+	case err = <-errs:
+		servers--
+		break
+	case <-p.stopping():
+	}
+
+	// On shutdown, the listeners stop on their own; wait for the
+	// connections being routed before closing them.
+	if p.stopped() {
+		p.waitListeners()
+		if !p.waitConns(p.Config.ShutdownTimeout) {
+			log.Printf("Shutdown timeout reached, closing the remaining connections")
+		}
+		err = nil
+	}
+
+	cancel()
+	p.waitListeners()
+	for ; servers > 0; servers-- {
+		<-errs
+	}
+	p.close()
+	return err
+}
+
+// Serves the connections of a single listener, until it is closed.
+func (p *Proxy) serve(ctx context.Context, rl *runningListener) error {
+	l := rl.l
+	defer l.Close()
+
+	// Stop accepting connections once the context is canceled, or on
+	// shutdown.
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	go func() {
+		select {
+		case <-p.stopping():
+			l.Close()
+		case <-ctx.Done():
+		}
+	}()
+
+	// Accept connections using one or more loops, all stopping as soon as
+	// one fails.
+	loops := rl.config.Load().AcceptLoops
+	if loops < 1 {
+		loops = 1
+	}
+	errs := make(chan error, loops)
+	for i := 0; i < loops; i++ {
+		go func() {
+			errs <- p.accept(ctx, rl)
+		}()
+	}
+
+	err := <-errs
+	l.Close()
+	for i := 1; i < loops; i++ {
+		<-errs
+	}
+	return err
+}
+
+// Accepts connections on a listener and handles them to a go routine, until
+// accepting fails.
+func (p *Proxy) accept(ctx context.Context, rl *runningListener) error {
+	for {
+		c, err := rl.l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if p.stopped() || rl.removed.Load() {
+				return nil
+			}
+			return err
+		}
+
+		conn := &Conn{
+			TCPConn: c.(*net.TCPConn),
+			Config: p.config(),
+			Listener: rl.config.Load(),
+			proxy: p,
+			accepted: time.Now(),
+		}
+
+		p.conns.Add(1)
+		go func() {
+			defer p.conns.Done()
+			conn.dispatch(ctx)
+		}()
+	}
+}
+
+// Dispatch a net.Conn. This cannot fail.
+func (conn *Conn) dispatch(ctx context.Context) {
+	defer conn.onClose()
+	defer conn.Close()
+
+	// Close the connection when the context is canceled, this interrupts
+	// any pending read or copy.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	tracer := conn.proxy.Tracer
+	if tracer == nil {
+		tracer = noopTracer{}
+	}
+	ctx, conn.span = tracer.Start(ctx, "sniproxy.conn")
+	defer conn.span.End()
+	conn.setOutcome("error")
+	defer conn.account()
+	defer conn.logRecord()
+
+	if err := conn.onAccept(); err != nil {
+		conn.reject(err)
+		return
+	}
+	if err := conn.handle(ctx); err != nil {
+		conn.reject(err)
+	}
+}
+
+// Routes a connection to its backend, until one side closes it. Returns a
+// DispatchError if the connection could not be routed.
+func (conn *Conn) handle(ctx context.Context) error {
+	// Bound the number of handshakes being buffered, up to the dial.
+	releaseHandshake, err := conn.enterHandshake()
+	if err != nil {
+		return err
+	}
+	defer releaseHandshake()
+
+	// Retrieve the original destination when transparent proxying is used.
+	switch conn.Config.Transparent {
+	case config.TransparentRedirect:
+		dst, err := originalDst(conn.TCPConn)
+		if err != nil {
+			return dispatchErrorf(ErrInternal, "%w", err)
+		}
+		conn.OriginalDst = dst
+		break
+	case config.TransparentTProxy:
+		conn.OriginalDst = conn.LocalAddr().(*net.TCPAddr)
+		break
+	}
+
+	sni, err := conn.readSNI()
+	if errors.Is(err, ErrNotTLS) && conn.Listener != nil && conn.Listener.NonTLS == config.NonTLSForward {
+		return conn.forwardNonTLS(ctx, conn.Listener.NonTLSBackend)
+	} else if err != nil {
+		return err
+	}
+	t := conn.phaseDone(phaseSNIRead, conn.accepted)
+
+	if err := conn.checkHello(); err != nil {
+		return err
+	}
+
+	route, backend, err := conn.selectRoute(ctx, sni)
+	if err != nil {
+		return err
+	}
+	conn.phaseDone(phaseRouteMatch, t)
+	conn.terminated = route.Terminates(conn.Config.RewriteSNI(sni))
+	conn.debugf("Matched %q to route %s and backend %s (%d bytes handshake, TLS %#x, read in %s)",
+		    sni, route.Label(), backend.Address, len(conn.rawHello), conn.Hello.MaxVersion(),
+		    time.Since(conn.accepted).Round(time.Microsecond))
+	conn.checkCipherSuites()
+
+	// Set the TCP congestion control algorithm of the client connection.
+	if route.CongestionControl != "" && route.CongestionControlOn != config.OnUpstream {
+		raw, err := conn.SyscallConn()
+		if err == nil {
+			err = setCongestionControl(raw, route.CongestionControl)
+		}
+		if err != nil {
+			return dispatchErrorf(ErrInternal, "%w", err)
+		}
+	}
+
+	// Mark the packets sent to the client.
+	if route.DSCP != 0 && route.DSCPOn != config.OnUpstream {
+		raw, err := conn.SyscallConn()
+		if err == nil {
+			err = setDSCP(raw, route.DSCP)
+		}
+		if err != nil {
+			return dispatchErrorf(ErrInternal, "%w", err)
+		}
+	}
+
+	// Enforce the route setup budget, covering the time spent since the
+	// connection was accepted up to the handshake replay.
+	setupCtx := ctx
+	if route.SetupTimeout > 0 {
+		var cancelSetup context.CancelFunc
+		setupCtx, cancelSetup = context.WithDeadline(ctx, conn.accepted.Add(route.SetupTimeout))
+		defer cancelSetup()
+	}
+	if err := conn.setupExpired(setupCtx, route, "handshake read"); err != nil {
+		return err
+	}
+
+	t = time.Now()
+	if err := conn.authorize(route, backend, conn.RemoteAddr().(*net.TCPAddr).IP); err != nil {
+		return err
+	}
+	conn.phaseDone(phaseACL, t)
+
+	release, err := conn.acquireSlot(setupCtx, route, backend)
+	if err != nil {
+		return err
+	}
+	defer func() { release() }()
+
+	releaseHandshake()
+	upstream, backend, err := conn.dialReplay(setupCtx, route, backend, &release)
+	if err != nil {
+		return err
+	}
+	conn.debugf("Connected to %s from %s, handshake replayed %s after accepting the connection",
+		    backend.Address, upstream.LocalAddr(), time.Since(conn.accepted).Round(time.Microsecond))
+	defer upstream.Close()
+	context.AfterFunc(ctx, func() { upstream.Close() })
+	defer conn.trackRouted(backend)()
+
+	if conn.terminated {
+		conn.terminate(ctx, route, backend, upstream)
+	} else {
+		conn.pump(ctx, route, backend, upstream)
+	}
+	return nil
+}
+
+// Reports whether a route overrides the handshake timeout.
+func (conn *Conn) extendsHandshake() bool {
+	for _, route := range conn.Config.Routes {
+		if route.HandshakeTimeout > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Reader of the handshake applying the handshake timeout of the route, if any,
+// as soon as the SNI is received: the deadline is set in two stages, the global
+// one applying until the SNI is known.
+type handshakeReader struct {
+	io.Reader
+	conn    *Conn
+	buf     *bytes.Buffer
+	timeout time.Duration
+	done    bool
+}
+
+func (r *handshakeReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if r.done || n == 0 {
+		return n, err
+	}
+
+	sni, ok := handshake.PeekServerName(r.buf.Bytes())
+	if !ok {
+		return n, err
+	}
+	r.done = true
+
+	// The route isn't selected yet (e.g. its JA3 fingerprints or TLS
+	// versions are unknown): use the first one whose domains match.
+	route := r.conn.Config.MatchDomain(r.conn.Config.RewriteSNI(sni))
+	if route == nil || route.HandshakeTimeout == 0 || route.HandshakeTimeout == r.timeout {
+		return n, err
+	}
+	if dlErr := r.conn.SetReadDeadline(r.conn.accepted.Add(route.HandshakeTimeout)); dlErr != nil {
+		r.conn.logf("Could not set the handshake deadline of route %s (%s)", route.Label(), dlErr)
+	} else {
+		r.conn.debugf("Handshake timeout set to %s for %q", route.HandshakeTimeout, sni)
+	}
+	return n, err
+}
+
+// Applies the abuse filter heuristics to the handshake: scanners often send
+// truncated or minimal ones.
+func (conn *Conn) checkHello() error {
+	if size := conn.Config.HelloMinSize; size > 0 && len(conn.rawHello) < size {
+		return dispatchErrorf(ErrSuspiciousHello, "Handshake of %d bytes for %q is below the minimum of %d bytes",
+				      len(conn.rawHello), conn.Hello.ServerName, size)
+	}
+	if conn.Config.HelloCheckVersions && conn.Hello.MissingSupportedVersions() {
+		return dispatchErrorf(ErrSuspiciousHello, "Handshake for %q offers TLS 1.3 cipher suites without the supported_versions extension",
+				      conn.Hello.ServerName)
+	}
+	return nil
+}
+
+// Reports the clients offering deprecated cipher suites (RC4, 3DES, export...),
+// which will fail once the backends stop supporting them. Only done at the
+// debug logging level.
+func (conn *Conn) checkCipherSuites() {
+	if conn.logLevel() != config.LogDebug {
+		return
+	}
+
+	if suites := conn.Hello.DeprecatedCipherSuites(); len(suites) > 0 {
+		conn.debugf("Client offered deprecated cipher suites for %q: %v", conn.Hello.ServerName, suites)
+		conn.stats.deprecatedCiphers.Add(1)
+	}
+}
+
+// Reads the TLS handshake sent by the client, and the PROXY header preceding
+// it if any, and returns the SNI it holds.
+func (conn *Conn) readSNI() (string, error) {
+	handshakeTimeout := conn.Config.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = 3*time.Second
+	}
+
+	// Wait for the first byte of the handshake, using a shorter deadline
+	// if one is set (not on trusted listeners). Connections not sending
+	// anything (e.g. port scanners) are closed right away, without an
+	// alert.
+	trusted := conn.Listener != nil && conn.Listener.Trusted
+	firstByteTimeout := conn.Config.FirstByteTimeout
+	if trusted || firstByteTimeout == 0 || firstByteTimeout > handshakeTimeout {
+		firstByteTimeout = handshakeTimeout
+	}
+	if err := conn.SetReadDeadline(conn.accepted.Add(firstByteTimeout)); err != nil {
+		return "", dispatchErrorf(ErrInternal, "Could not set a read deadline (%w)", err)
+	}
+
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		return "", dispatchErrorf(ErrNoData, "No data received (%w)", err)
+	}
+
+	// Set a deadline for reading the rest of the TLS handshake.
+	if err := conn.SetReadDeadline(conn.accepted.Add(handshakeTimeout)); err != nil {
+		return "", dispatchErrorf(ErrInternal, "Could not set a read deadline (%w)", err)
+	}
+
+	// Read the HAProxy PROXY header, if one is sent by a trusted source.
+	// As TLS records never start with the first byte of a PROXY header,
+	// there's no ambiguity.
+	if (first[0] == 'P' || first[0] == '\r') && conn.acceptProxy() {
+		if err := conn.readProxyHeader(first[0]); err != nil {
+			return "", dispatchErrorf(ErrProxyHeader, "%w", err)
+		}
+
+		if _, err := io.ReadFull(conn, first); err != nil {
+			return "", dispatchErrorf(ErrNoData, "No data received after the PROXY header (%w)", err)
+		}
+	}
+	conn.span.SetAttribute("client.ip", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+
+	if conn.Listener.Skips() {
+		if err := conn.skipFraming(first); err != nil {
+			return "", err
+		}
+	}
+
+	// Reject the clients not starting with a TLS handshake record right
+	// away, if the listener says so.
+	if first[0] != 0x16 && conn.Listener != nil && conn.Listener.NonTLS != config.NonTLSParse {
+		conn.rawHello = first
+		return "", dispatchErrorf(ErrNotTLS, "Client did not start with a TLS handshake record (first byte %#02x)", first[0])
+	}
+
+	// The handshake is read as small chunks, each being a read of the
+	// connection. Trusted listeners buffer the reads instead, the data read
+	// past the handshake being replayed along with it.
+	var buf bytes.Buffer
+	buf.Write(first)
+	var rest io.Reader = io.TeeReader(conn, &buf)
+	if conn.extendsHandshake() {
+		rest = &handshakeReader{ Reader: rest, conn: conn, buf: &buf, timeout: handshakeTimeout }
+	}
+	if trusted {
+		rest = bufio.NewReaderSize(rest, 4096)
+	}
+	hello, err := handshake.ParseClientHello(io.MultiReader(bytes.NewReader(first), rest))
+	if version, ok := handshake.RecordVersion(buf.Bytes()); ok {
+		conn.checkRecordVersion(version, hello)
+	}
+	if errors.Is(err, handshake.ErrNotHandshake) || errors.Is(err, handshake.ErrNotClientHello) {
+		return "", dispatchErrorf(ErrNotTLS, "Client did not start with a ClientHello message (%w)", err)
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		return "", dispatchErrorf(ErrHandshakeTimeout, "%w", err)
+	} else if err != nil {
+		return "", dispatchErrorf(ErrBadHandshake, "%w", err)
+	}
+	conn.Hello = hello
+	conn.rawHello = buf.Bytes()
+
+	conn.span.SetAttribute("sni", hello.ServerName)
+
+	// We found an SNI, reset the read deadline.
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return "", dispatchErrorf(ErrInternal, "Could not clear the read deadline (%w)", err)
+	}
+
+	return hello.ServerName, nil
+}
+
+// Skips the framing header of the listener preceding the handshake, its first
+// byte being already read in first. The first byte following it is read in
+// first. The header is kept to be forwarded if the listener says so.
+func (conn *Conn) skipFraming(first []byte) error {
+	l := conn.Listener
+	header := bytes.Clone(first)
+	if l.SkipBytes > 0 {
+		rest := make([]byte, l.SkipBytes - 1)
+		if _, err := io.ReadFull(conn, rest); err != nil {
+			return conn.framingError(err)
+		}
+		header = append(header, rest...)
+	} else {
+		// Read byte by byte not to consume the handshake.
+		b := make([]byte, 1)
+		for !bytes.HasSuffix(header, l.SkipUntil) {
+			if len(header) >= config.MaxSkip {
+				return dispatchErrorf(ErrBadHandshake, "Framing delimiter not found in the first %d bytes", config.MaxSkip)
+			}
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return conn.framingError(err)
+			}
+			header = append(header, b[0])
+		}
+	}
+
+	if _, err := io.ReadFull(conn, first); err != nil {
+		return conn.framingError(err)
+	}
+	if l.SkipForward {
+		conn.framing = header
+	}
+	return nil
+}
+
+// Returns the error of a failure to read the framing header.
+func (conn *Conn) framingError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return dispatchErrorf(ErrHandshakeTimeout, "Reading the framing header (%w)", err)
+	}
+	return dispatchErrorf(ErrNoData, "No data received after the framing header (%w)", err)
+}
+
+// Selects the route and backend a connection is sent to, given its SNI.
+func (conn *Conn) selectRoute(ctx context.Context, sni string) (*config.Route, *config.Backend, error) {
+	// Rewrite the SNI before matching. The original one is still used in
+	// the logs, and the handshake is replayed unmodified.
+	name := conn.Config.RewriteSNI(sni)
+	if name != sni {
+		conn.span.SetAttribute("sni.rewritten", name)
+	}
+
+	// The policy engine, if any, can select the route itself.
+	route, err := conn.evaluatePolicy(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if route == nil {
+		route, err = conn.Match(name)
+		if err != nil {
+			if sni == "" {
+				return nil, nil, dispatchErrorf(ErrNoSNI, "%w", err)
+			}
+			return nil, nil, dispatchErrorf(ErrNoRoute, "%w", err)
+		}
+	}
+	conn.route = route
+	conn.span.SetAttribute("route", route.Label())
+	conn.stats = conn.proxy.stats.get(route)
+	conn.stats.connections.Add(1)
+	conn.stats.active.Add(1)
+	for k, v := range route.Tags {
+		conn.span.SetAttribute("tag." + k, v)
+	}
+
+	// Routes in maintenance are rejected right away, without waiting for
+	// the backends to time out.
+	if route.Maintenance {
+		return nil, nil, dispatchErrorf(ErrMaintenance, "Route %s is in maintenance, rejected %s",
+						route.Label(), sni)
+	}
+
+	// Backends looked up take precedence, the route ones being used as a
+	// fallback.
+	var backend *config.Backend
+	if route.Lookup != "" {
+		backend, err = route.LookupBackend(ctx, name)
+		if err != nil {
+			conn.logf("Could not look up the backend of %s (%s)", name, err)
+		} else if backend == nil {
+			conn.debugf("No backend looked up for %s", name)
+		}
+	}
+	if backend == nil {
+		backend = route.PickBackend(name)
+	}
+	if backend == nil {
+		return nil, nil, dispatchErrorf(ErrNoBackend, "No backend available for %s", sni)
+	}
+	conn.span.SetAttribute("backend", backend.Address)
+
+	return route, backend, nil
+}
+
+// Checks a client is allowed to use a route: its address must be allowed by
+// the route ACLs, it must offer a recent enough TLS version and cipher suites
+// meeting the route policy, its SNI must be allowed to be forwarded to (sni
+// backends) and it must not exceed the route rate limit.
+func (conn *Conn) authorize(route *config.Route, backend *config.Backend, client net.IP) error {
+	if !clientAllowed(route, client) {
+		return dispatchErrorf(ErrDenied, "Denied %s / %s access to %s",
+				      client.String(), conn.Hello.ServerName, backend.Address)
+	}
+
+	// The record version is not checked, as clients set it to TLS 1.0 for
+	// compatibility whatever the versions they support.
+	if route.RequireTLS != 0 && conn.Hello.MaxVersion() < route.RequireTLS {
+		return dispatchErrorf(ErrTLSVersion, "Rejected %s / %s: highest TLS version offered %#x is below %#x",
+				      client.String(), conn.Hello.ServerName, conn.Hello.MaxVersion(), route.RequireTLS)
+	}
+	if route.RequireCiphers != nil && !route.RequireCiphers.Allows(conn.Hello.CipherSuites) {
+		return dispatchErrorf(ErrWeakCiphers, "Rejected %s / %s: none of the cipher suites offered meets the policy",
+				      client.String(), conn.Hello.ServerName)
+	}
+
+	if route.Forwards() && !route.ForwardAllowed(conn.Hello.ServerName) {
+		return dispatchErrorf(ErrDenied, "Denied %s forwarding to %s",
+				      client.String(), conn.Hello.ServerName)
+	}
+
+	if route.RateLimit != nil && !route.RateLimit.Allow(client.String()) {
+		return dispatchErrorf(ErrRateLimited, "Rate limited %s / %s access to %s",
+				      client.String(), conn.Hello.ServerName, backend.Address)
+	}
+
+	return nil
+}
+
+// Acquires a connection slot on the backend, waiting in the route queue if
+// the backend is at capacity. The setup budget bounds ctx.
+func (conn *Conn) acquireSlot(ctx context.Context, route *config.Route, backend *config.Backend) (func(), error) {
+	release, err := route.AcquireSlot(ctx, backend)
+	if err != nil {
+		err = dispatchErrorf(ErrBackendFull, "%w: %s for %s", err, backend.Address, conn.Hello.ServerName)
+		if e := conn.setupExpired(ctx, route, "queue"); e != nil {
+			err = e
+		}
+		return nil, err
+	}
+	return release, nil
+}
+
+// Returns an error if the route setup budget, bounding ctx, was exceeded
+// during a given phase of the connection setup.
+func (conn *Conn) setupExpired(ctx context.Context, route *config.Route, phase string) error {
+	// The write deadlines following the budget can expire right before
+	// the context does.
+	if ctx.Err() != context.DeadlineExceeded {
+		if deadline, ok := ctx.Deadline(); !ok || time.Now().Before(deadline) {
+			return nil
+		}
+	}
+	return dispatchErrorf(ErrSetupTimeout, "Setup budget of %s exceeded during %s for %s",
+			      route.SetupTimeout, phase, conn.Hello.ServerName)
+}
+
+// Connects to a backend, sends it the PROXY header if needed and replays the
+// client handshake. The setup budget bounds ctx. When the route races its
+// backends, the one connected first is used. Returns the connection and the
+// backend used.
+func (conn *Conn) dialBackend(ctx context.Context, route *config.Route, backend *config.Backend) (net.Conn, *config.Backend, error) {
+	t := time.Now()
+	var upstream net.Conn
+	if route.DialRace > 1 {
+		var err error
+		upstream, backend, err = conn.raceBackends(ctx, route, backend)
+		if err != nil {
+			if e := conn.setupExpired(ctx, route, "dial"); e != nil {
+				err = e
+			}
+			return nil, backend, err
+		}
+	} else {
+		address, err := conn.backendAddress(ctx, route, backend)
+		if err != nil {
+			return nil, backend, err
+		}
+		if backend.SNIPort != 0 {
+			t = conn.phaseDone(phaseResolve, t)
+		}
+
+		upstream, err = conn.dial(ctx, route, address)
+		if err != nil {
+			route.MarkDown(backend)
+			err = dispatchErrorf(ErrBackendDial, "%w", err)
+			if e := conn.setupExpired(ctx, route, "dial"); e != nil {
+				err = e
+			}
+			return nil, backend, err
+		}
+		route.MarkUp(backend)
+	}
+	t = conn.phaseDone(phaseDial, t)
+
+	// Batch the PROXY header and the handshake, if asked to.
+	tcp, isTCP := upstream.(*net.TCPConn)
+	if route.NoDelayAfterReplay && isTCP {
+		tcp.SetNoDelay(false)
+	}
+
+	// Bound the time spent replaying the handshake to the route replay
+	// timeout and to the setup budget, so that backends not reading are
+	// detected.
+	deadline, ok := ctx.Deadline()
+	if route.ReplayTimeout > 0 && (!ok || time.Until(deadline) > route.ReplayTimeout) {
+		deadline, ok = time.Now().Add(route.ReplayTimeout), true
+	}
+	if ok {
+		upstream.SetWriteDeadline(deadline)
+	}
+
+	fail := func(err error) (net.Conn, *config.Backend, error) {
+		upstream.Close()
+		if e := conn.setupExpired(ctx, route, "handshake replay"); e != nil {
+			err = e
+		}
+		return nil, backend, err
+	}
+
+	// Check if the HAProxy PROXY protocol header has to be sent.
+	if err := conn.sendProxyHeader(route, backend, upstream); err != nil {
+		return fail(dispatchErrorf(ErrReplay, "%w", err))
+	}
+
+	// Forward the framing header preceding the handshake, if kept.
+	if conn.framing != nil {
+		if _, err := upstream.Write(conn.framing); err != nil {
+			return fail(dispatchErrorf(ErrReplay, "Failed to forward the framing header to %s (%s)", backend.Address, err))
+		}
+	}
+
+	// Replay the handshake we read, unless TLS is terminated: the backend
+	// then only sees the plaintext.
+	if !conn.terminated {
+		if _, err := upstream.Write(conn.rawHello); err != nil {
+			return fail(dispatchErrorf(ErrReplay, "Failed to replay handshake to %s (%s)", backend.Address, err))
+		}
+	}
+	upstream.SetWriteDeadline(time.Time{})
+
+	// Disable Nagle's algorithm for the data phase, which also flushes
+	// the handshake.
+	if route.NoDelayAfterReplay && isTCP {
+		if err := tcp.SetNoDelay(true); err != nil {
+			return fail(dispatchErrorf(ErrReplay, "Could not enable TCP_NODELAY on %s (%s)", backend.Address, err))
+		}
+	}
+	conn.replayed = conn.phaseDone(phaseReplay, t)
+
+	return upstream, backend, nil
+}
+
+// Copies the traffic between the client and the backend, until one side
+// closes its connection.
+func (conn *Conn) pump(ctx context.Context, route *config.Route, backend *config.Backend, upstream net.Conn) {
+	sni := conn.Hello.ServerName
+
+	// Start mirroring the traffic, if the route has a mirror. The mirror
+	// gets its own copy of the handshake.
+	var m *mirror
+	if route.Mirror != "" {
+		m = newMirror(ctx, &net.Dialer{ Timeout: 3*time.Second }, route.Mirror,
+			      bytes.Clone(conn.rawHello))
+		defer m.Close()
+	}
+
+	// Each copy reports its direction once done.
+	const toBackend, toClient = 0, 1
+	var sent, received int64
+	var sentErr, receivedErr error
+	done := make(chan int, 2)
+	go func () {
+		if m != nil {
+			sent, sentErr = io.Copy(upstream, io.TeeReader(conn.tracked(conn.TCPConn), m))
+		} else {
+			sent, sentErr = io.Copy(upstream, conn.tracked(conn.TCPConn))
+		}
+		done<- toBackend
+	}()
+	go func () {
+		var err error
+		// Look for hints the backend does not speak the PROXY protocol.
+		// The first read also times the first backend byte. This was
+		// already done if the backend answer was awaited.
+		if conn.prefetched > 0 {
+			received = conn.prefetched
+		} else if conn.sentProxy {
+			received, err = conn.checkProxyResponse(upstream)
+		} else if conn.phaseTimings() {
+			received, err = copyFirstRead(conn.TCPConn, upstream)
+		}
+		if received > 0 && conn.prefetched == 0 {
+			conn.phaseDone(phaseFirstByte, conn.replayed)
+		}
+		if err == nil {
+			var n int64
+			n, err = io.Copy(conn.TCPConn, conn.tracked(upstream))
+			received += n
+		}
+
+		// Let the client know the connection failed if the backend
+		// reset it before sending anything, rather than closing it as
+		// if it was cleanly terminated.
+		if received == 0 && route.ResetAlert && errors.Is(err, syscall.ECONNRESET) {
+			conn.logf("Backend %s reset the connection before sending any data", backend.Address)
+			conn.alert(byte(config.Alerts["internal_error"]))
+		}
+		receivedErr = err
+		done<- toClient
+	}()
+
+	// Send keep alive messages to both the client and the backend, unless
+	// disabled for this route. Keep alive is enabled by default on both
+	// accepted and dialed connections, explicitly disable it in such case.
+	up, isTCP := upstream.(*net.TCPConn)
+	if route.KeepAlive > 0 {
+		if err := setKeepAlive(conn.TCPConn, route); err != nil {
+			conn.logf("Could not set the client keep alive parameters (%s)", err)
+		}
+		if isTCP {
+			if err := setKeepAlive(up, route); err != nil {
+				conn.logf("Could not set the backend keep alive parameters (%s)", err)
+			}
+		}
+	} else {
+		conn.SetKeepAlive(false)
+		if isTCP {
+			up.SetKeepAlive(false)
+		}
+	}
+	if route.UserTimeout > 0 {
+		if raw, err := conn.SyscallConn(); err == nil {
+			if err := setUserTimeout(raw, route.UserTimeout); err != nil {
+				conn.logf("Could not set the client user timeout (%s)", err)
+			}
+		}
+		if isTCP {
+			if raw, err := up.SyscallConn(); err == nil {
+				if err := setUserTimeout(raw, route.UserTimeout); err != nil {
+					conn.logf("Could not set the backend user timeout (%s)", err)
+				}
+			}
+		}
+	}
+
+	// Report the address actually dialed, as backends given as hostnames
+	// can resolve to multiple addresses of both families.
+	dest := backend.Address
+	conn.backend = backend
+	if addr, ok := upstream.RemoteAddr().(*net.TCPAddr); ok {
+		conn.backendAddr = addr.String()
+		conn.span.SetAttribute("backend.ip", addr.IP.String())
+		if addr.IP.To4() != nil {
+			conn.stats.dialedIPv4.Add(1)
+		} else {
+			conn.stats.dialedIPv6.Add(1)
+		}
+		if addr.String() != backend.Address {
+			dest += " (" + addr.String() + ")"
+		}
+	}
+
+	var label string
+	if route.Name != "" {
+		label = " [" + route.Name + "]"
+	}
+	if conn.OriginalDst != nil {
+		conn.accessf("Routing %s (%s) to %s%s", sni, conn.OriginalDst, dest, label)
+	} else {
+		conn.accessf("Routing %s to %s%s", sni, dest, label)
+	}
+	conn.setOutcome("routed")
+
+	// Close both sides once the route maximum lifetime is reached, whatever
+	// the activity of the connection.
+	var lifetimeExceeded atomic.Bool
+	if route.MaxLifetime > 0 {
+		timer := time.AfterFunc(time.Until(conn.accepted.Add(route.MaxLifetime)), func() {
+			lifetimeExceeded.Store(true)
+			conn.Close()
+			upstream.Close()
+		})
+		defer timer.Stop()
+	}
+
+	first := <-done
+
+	// A peer found unreachable (keep alive probes unanswered, or data
+	// unacknowledged for the user timeout) won't finish its side: both
+	// connections are closed right away.
+	var dead string
+	if first == toBackend {
+		dead = deadPeer(sentErr, true)
+	} else {
+		dead = deadPeer(receivedErr, false)
+	}
+
+	// One side closed. If the route has a grace period, propagate the
+	// half-close and let the other direction finish within it; the
+	// connections are then closed in all cases, so that the other copy is
+	// guaranteed to return even if its peer never closes its side. Reaped
+	// connections are closed right away as well.
+	pending := 1
+	if route.CloseGrace > 0 && dead == "" && !conn.reaped.Load() {
+		if first == toBackend {
+			closeWrite(upstream)
+		} else {
+			closeWrite(conn.TCPConn)
+		}
+
+		timer := time.NewTimer(route.CloseGrace)
+		select {
+		case <-done:
+			pending = 0
+			break
+		case <-timer.C:
+			conn.debugf("Other direction still open %s after the half-close, closing", route.CloseGrace)
+		}
+		timer.Stop()
+	}
+	conn.Close()
+	upstream.Close()
+	if pending > 0 {
+		<-done
+	}
+
+	conn.span.SetAttribute("bytes.sent", sent)
+	conn.span.SetAttribute("bytes.received", received)
+	conn.stats.bytesSent.Add(sent)
+	conn.stats.bytesReceived.Add(received)
+	conn.sent, conn.received = sent, received
+
+	if lifetimeExceeded.Load() {
+		conn.logf("Closed connection to %s: max lifetime exceeded (%s)", backend.Address, route.MaxLifetime)
+	} else if dead != "" {
+		conn.stats.deadPeers.Add(1)
+		conn.logf("Closed connection to %s: %s unreachable (timed out)", backend.Address, dead)
+	}
+
+	conn.accessf("Closed connection to %s after %s (%d bytes from the client, %d from the backend)",
+		     backend.Address, time.Since(conn.accepted).Round(time.Millisecond), sent, received)
+}
+
+// Returns the peer ("client" or "backend") found unreachable by the TCP stack
+// from the error of a copy, reading from the client or from the backend. An
+// empty string is returned for the other errors.
+func deadPeer(err error, fromClient bool) string {
+	var opErr *net.OpError
+	if !errors.Is(err, syscall.ETIMEDOUT) || !errors.As(err, &opErr) {
+		return ""
+	}
+	if (opErr.Op == "read") == fromClient {
+		return "client"
+	}
+	return "backend"
+}
+
+// Closes the write side of a connection, if supported.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// Rejects a connection which could not be routed: logs the error, sets the
+// outcome of the connection and sends the alert matching the failure kind.
+func (conn *Conn) reject(err error) {
+	conn.log(err)
+
+	cause := rejectCause(err)
+	action := conn.Config.RejectAction(cause)
+	switch cause {
+	case "not-tls":
+		if conn.Listener != nil && conn.Listener.NonTLS == config.NonTLSClose {
+			action = config.ActionClose
+		} else if conn.Listener != nil && conn.Listener.NonTLS == config.NonTLSReset {
+			action = config.ActionReset
+		}
+		conn.setOutcome("not_tls")
+		break
+	case "no-sni", "no-route":
+		conn.setOutcome("no_route")
+		break
+	case "denied":
+		if conn.route != nil {
+			action = routeAction(conn.route.DenyAction, action)
+		}
+		conn.setOutcome("denied")
+		break
+	case "rate-limited":
+		action = routeAction(conn.route.RateLimitAction, action)
+		conn.setOutcome("rate_limited")
+		break
+	case "tls-version":
+		conn.setOutcome("tls_version")
+		break
+	case "weak-ciphers":
+		conn.setOutcome("weak_ciphers")
+		break
+	case "suspicious-hello":
+		conn.setOutcome("suspicious_hello")
+		break
+	case "handshakes-full":
+		conn.setOutcome("shed")
+		break
+	case "backend-full":
+		conn.setOutcome("backend_full")
+		break
+	case "replay":
+		conn.stats.replayErrors.Add(1)
+		break
+	case "maintenance":
+		action = routeAction(conn.route.MaintenanceAction, action)
+		conn.setOutcome("maintenance")
+		// Serve the maintenance page if the route can terminate TLS.
+		if bg := conn.route.BadGateway; bg != nil {
+			if err := conn.serveBadGateway(bg, conn.rawHello, http.StatusServiceUnavailable,
+						       bg.MaintenancePage); err != nil {
+				conn.log(err)
+			}
+			return
+		}
+		break
+	case "no-backend", "backend-dial":
+		// Serve the route bad gateway page, if any, rather than
+		// sending an alert.
+		if conn.route != nil && conn.route.BadGateway != nil {
+			if err := conn.serveBadGateway(conn.route.BadGateway, conn.rawHello, http.StatusBadGateway,
+						       conn.route.BadGateway.Page); err != nil {
+				conn.log(err)
+			}
+			return
+		}
+		break
+	}
+
+	switch action {
+	case config.ActionClose:
+		break
+	case config.ActionReset:
+		// Closing the connection with a zero linger time discards its
+		// pending data and sends a TCP RST.
+		conn.SetLinger(0)
+		break
+	default:
+		conn.alert(byte(action))
+	}
+}
+
+// Returns the action a route takes, or the configuration one when not set.
+func routeAction(action, fallback int) int {
+	if action == config.ActionDefault {
+		return fallback
+	}
+	return action
+}
+
+// Sets the outcome of the connection.
+func (conn *Conn) setOutcome(outcome string) {
+	conn.outcome = outcome
+	conn.span.SetAttribute("outcome", outcome)
+}
+
+// Updates the route counters once a connection is done.
+func (conn *Conn) account() {
+	if conn.stats == nil {
+		return
+	}
+
+	conn.stats.active.Add(-1)
+	switch conn.outcome {
+	case "denied", "rate_limited", "tls_version", "weak_ciphers", "backend_full", "maintenance":
+		conn.stats.rejected.Add(1)
+		break
+	case "error":
+		conn.stats.errors.Add(1)
+		break
+	}
+}
+
+// Returns the address of the client, as reported by the PROXY header if one was
+// received.
+func (conn *Conn) RemoteAddr() net.Addr {
+	if conn.proxySrc != nil {
+		return conn.proxySrc
+	}
+	return conn.TCPConn.RemoteAddr()
+}
+
+// Returns the address the client connected to, as reported by the PROXY header
+// if one was received.
+func (conn *Conn) LocalAddr() net.Addr {
+	if conn.proxyDst != nil {
+		return conn.proxyDst
+	}
+	return conn.TCPConn.LocalAddr()
+}
+
+// Returns the dialer to use to connect to a route backend.
+func (conn *Conn) dialer(route *config.Route) *net.Dialer {
+	d := &net.Dialer{ Timeout: 3*time.Second }
+
+	var controls []func(network, address string, c syscall.RawConn) error
+
+	// Use the client address as the source address (transparent egress).
+	if route.TransparentEgress {
+		client := conn.RemoteAddr().(*net.TCPAddr)
+		d.LocalAddr = &net.TCPAddr{ IP: client.IP }
+		controls = append(controls, setTransparent)
+	}
+
+	// Set the TCP congestion control algorithm.
+	if route.CongestionControl != "" && route.CongestionControlOn != config.OnClient {
+		controls = append(controls, func(network, address string, c syscall.RawConn) error {
+			return setCongestionControl(c, route.CongestionControl)
+		})
+	}
+
+	// Mark the packets sent to the backend.
+	if route.DSCP != 0 && route.DSCPOn != config.OnClient {
+		controls = append(controls, func(network, address string, c syscall.RawConn) error {
+			return setDSCP(c, route.DSCP)
+		})
+	}
+
+	// Enable TCP Fast Open.
+	if conn.Config != nil && conn.Config.TCPFastOpen && conn.Config.TCPFastOpenOn != config.OnClient {
+		controls = append(controls, setDialFastOpen)
+	}
+
+	d.Control = chainControls(controls)
+	return d
+}
+
+// Returns a control function calling all the given ones in order, or nil if
+// there are none.
+func chainControls(controls []func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	if len(controls) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, control := range controls {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Dials a route backend, binding the connection to a port of the route source
+// port range if one is set. Ports already in use are skipped. The proxy dialer
+// is used instead, if set.
+func (conn *Conn) dial(ctx context.Context, route *config.Route, address string) (net.Conn, error) {
+	if conn.proxy != nil && conn.proxy.Dialer != nil {
+		return conn.proxy.Dialer.DialContext(ctx, route.DialNetwork(), address)
+	}
+
+	if route.SourcePorts == nil {
+		return conn.dialer(route).DialContext(ctx, route.DialNetwork(), address)
+	}
+
+	for i := 0; i < route.SourcePorts.Size(); i++ {
+		d := conn.dialer(route)
+		local := &net.TCPAddr{ Port: route.SourcePorts.Next() }
+		if d.LocalAddr != nil {
+			local.IP = d.LocalAddr.(*net.TCPAddr).IP
+		}
+		d.LocalAddr = local
+
+		up, err := d.DialContext(ctx, route.DialNetwork(), address)
+		if errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL) {
+			continue
+		}
+		return up, err
+	}
+
+	return nil, fmt.Errorf("No source port available in range %s to dial %s", route.SourcePorts, address)
+}
+
+// Sends an alert message with a fatal level to the remote.
+func (conn *Conn) alert(desc byte) {
+	// Craft an alert message (content type 21, record version of the
+	// client, level: 2).
+	major, minor := conn.alertVersion()
+	message := bytes.NewBuffer([]byte{21, major, minor, 0, 2, 2})
+
+	// Set the alert description.
+	message.WriteByte(desc)
+
+	// Set a write timeout before sending the alert.
+	if err := conn.SetWriteDeadline(time.Now().Add(3*time.Second)); err != nil {
+		conn.logf("Could not set a write deadline for the alert message (%s)", err)
+		return
+	}
+
+	if _, err := message.WriteTo(conn); err != nil {
+		conn.logf("Failed to send an alert message (%s)", err)
+		return
+	}
+	if conn.proxy != nil {
+		conn.proxy.alerts[desc].Add(1)
+	}
+}
+
+// Matches a connection to a backend.
+func (conn *Conn) Match(sni string) (*config.Route, error) {
+	// Routes matching the client fingerprint take precedence, unless
+	// configured otherwise.
+	if conn.Config.JA3Match == config.JA3BeforeSNI {
+		if route := conn.matchJA3(); route != nil {
+			return route, nil
+		}
+	}
+
+	// Connections without an SNI are first matched on the address the
+	// client connected to.
+	if sni == "" {
+		if route := conn.matchDestination(); route != nil {
+			return route, nil
+		}
+	}
+
+	// Loop over each route described in the configuration. The first
+	// route matching is used, unless routes restricted to client networks
+	// match: the one with the most specific network is used then.
+	var match *config.Route
+	matchBits := -1
+	for _, route := range conn.Config.Routes {
+		// Once a route is found, only the routes restricted to a more
+		// specific client network can take precedence.
+		bits := -1
+		if len(route.Clients) > 0 {
+			if bits = conn.clientBits(route); bits < 0 {
+				continue
+			}
+		}
+		if match != nil && bits <= matchBits {
+			continue
+		}
+
+		// Skip the routes disabled at runtime, and check the TLS
+		// versions offered by the client fit the route.
+		if !route.Enabled() || !conn.tlsVersionMatches(route) {
+			continue
+		}
+
+		if domainMatches(route, sni) {
+			match, matchBits = route, bits
+		}
+	}
+	if match != nil {
+		return match, nil
+	}
+
+	if conn.Config.JA3Match == config.JA3AfterSNI {
+		if route := conn.matchJA3(); route != nil {
+			return route, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No route matching the requested domain (%s)", sni)
+}
+
+// Reports whether a server name matches the domains or the domain lists of a
+// route.
+func domainMatches(route *config.Route, sni string) bool {
+	for _, domain := range route.Domains {
+		if domain.MatchString(sni) {
+			return true
+		}
+	}
+	for _, list := range route.DomainLists {
+		if list.Match(sni) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the prefix length of the most specific client network of a route the
+// client address belongs to, or -1 if none.
+func (conn *Conn) clientBits(route *config.Route) int {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return -1
+	}
+	bits := -1
+	for _, subnet := range route.Clients {
+		if ones, _ := subnet.Mask.Size(); ones > bits && subnet.Contains(addr.IP) {
+			bits = ones
+		}
+	}
+	return bits
+}
+
+// Returns the first route matching the JA3 fingerprint of the client.
+func (conn *Conn) matchJA3() *config.Route {
+	if conn.Hello == nil {
+		return nil
+	}
+
+	var ja3 string
+	for _, route := range conn.Config.Routes {
+		if len(route.JA3) == 0 || !route.Enabled() || !conn.tlsVersionMatches(route) {
+			continue
+		}
+
+		// Only compute the fingerprint when needed.
+		if ja3 == "" {
+			ja3 = conn.Hello.JA3()
+			conn.span.SetAttribute("ja3", ja3)
+		}
+		if route.JA3[ja3] {
+			return route
+		}
+	}
+	return nil
+}
+
+// Returns the first route matching the destination of the connection: its
+// original destination when transparent proxying is used, the local address
+// otherwise.
+func (conn *Conn) matchDestination() *config.Route {
+	var dst *net.TCPAddr
+	for _, route := range conn.Config.Routes {
+		if len(route.Destinations) == 0 || !route.Enabled() || !conn.tlsVersionMatches(route) {
+			continue
+		}
+
+		if dst == nil {
+			dst = conn.OriginalDst
+			if dst == nil {
+				dst, _ = conn.LocalAddr().(*net.TCPAddr)
+			}
+		}
+		for _, d := range route.Destinations {
+			if d.Matches(dst) {
+				return route
+			}
+		}
+	}
+	return nil
+}
+
+// Checks the highest TLS version offered by the client is within the route
+// bounds, if any.
+func (conn *Conn) tlsVersionMatches(route *config.Route) bool {
+	if route.TLSMinVersion == 0 && route.TLSMaxVersion == 0 {
+		return true
+	}
+	if conn.Hello == nil {
+		return false
+	}
+
+	v := conn.Hello.MaxVersion()
+	return (route.TLSMinVersion == 0 || v >= route.TLSMinVersion) &&
+	       (route.TLSMaxVersion == 0 || v <= route.TLSMaxVersion)
+}
+
+// Check an IP against a route deny/allow rules.
+// The more specific subnet takes precedence, and Deny wins over Allow in case
+// none is more specific (unless the route tie break favors Allow).
+func clientAllowed(route *config.Route, ip net.IP) bool {
+	// Check if filtering is enabled for the route.
+	if len(route.Allow) == 0 && len(route.Deny) == 0 &&
+	   len(route.AllowLists) == 0 && len(route.DenyLists) == 0 {
+		return true
+	}
+
+	// Returns the length of the most specific subnet matching the IP, -1
+	// if none matched.
+	longest := func(static []*net.IPNet, lists []*config.SubnetList) int {
+		var cidr int = -1
+		match := func(subnets []*net.IPNet) {
+			for _, subnet := range(subnets) {
+				if subnet.Contains(ip) {
+					sz, _ := subnet.Mask.Size()
+					if sz > cidr {
+						cidr = sz
+					}
+				}
+			}
+		}
+
+		match(static)
+		for _, list := range(lists) {
+			match(list.Subnets())
+		}
+		return cidr
+	}
+
+	allow := longest(route.Allow, route.AllowLists)
+	deny := longest(route.Deny, route.DenyLists)
+	if deny > allow || (deny >= 0 && deny == allow && route.ACLTieBreak == config.ACLTieBreakDeny) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,391 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// A connection without addresses, for which PROXY headers report none (e.g.
+// for connections initiated by the proxy itself).
+type noAddrConn struct {
+	net.Conn
+}
+
+func (noAddrConn) RemoteAddr() net.Addr { return nil }
+func (noAddrConn) LocalAddr() net.Addr { return nil }
+
+// Handles sending an HAProxy PROXY header of a given version to a backend.
+func proxyHeader(version uint, client, upstream net.Conn) error {
+	var header bytes.Buffer
+
+	// Retrieve the PROXY header to be sent.
+	switch (version) {
+	case config.ProxyV1:
+		header = proxyHeaderV1(client)
+		break
+	case config.ProxyV2:
+		header = proxyHeaderV2(client)
+		break
+	default:
+		return fmt.Errorf("PROXY protocol version not supported (%d)", version)
+	}
+
+	// Send the PROXY header to the backend.
+	if _, err := header.WriteTo(upstream); err != nil {
+		return fmt.Errorf("Could not send the PROXY header (%s)", err)
+	}
+
+	return nil
+}
+
+// Sends the PROXY header expected by a backend, if any, following the route
+// handling of the header received from the client.
+func (conn *Conn) sendProxyHeader(route *config.Route, backend *config.Backend, upstream net.Conn) error {
+	if route.ProxyInbound == config.ProxyInboundPass && conn.proxyHeader != nil {
+		if _, err := upstream.Write(conn.proxyHeader); err != nil {
+			return fmt.Errorf("Could not pass the PROXY header (%s)", err)
+		}
+		conn.sentProxy = true
+		return nil
+	}
+
+	version := route.ProxyVersion(backend)
+	if version == config.ProxyNone {
+		return nil
+	}
+	var client net.Conn = conn
+	if route.ProxyInbound == config.ProxyInboundStrip {
+		client = conn.TCPConn
+	}
+	if err := proxyHeader(version, client, upstream); err != nil {
+		return err
+	}
+	conn.sentProxy = true
+	return nil
+}
+
+// Reads the first bytes sent back by a backend after a PROXY header was sent,
+// forwards them to the client and logs a warning if the backend does not
+// seem to speak the PROXY protocol. Backends not expecting a PROXY header
+// usually close the connection right away, reply in plain text or send a TLS
+// alert as they fail to parse the handshake. Returns the number of bytes
+// forwarded, and the error which ended the connection if any.
+func (conn *Conn) checkProxyResponse(upstream net.Conn) (int64, error) {
+	b := make([]byte, 512)
+	n, err := upstream.Read(b)
+	if n > 0 {
+		if _, err := conn.Write(b[:n]); err != nil {
+			return 0, err
+		}
+	}
+
+	warn := func(reason string) {
+		conn.logf("Backend %s %s after the PROXY header was sent, check it supports the PROXY protocol (send-proxy)",
+			  upstream.RemoteAddr(), reason)
+	}
+
+	if n == 0 {
+		if err == io.EOF {
+			warn("closed the connection")
+		} else if errors.Is(err, syscall.ECONNRESET) {
+			warn("reset the connection")
+		}
+		return 0, err
+	}
+
+	switch b[0] {
+	// TLS alert.
+	case 21:
+		warn("sent a TLS alert")
+		break
+	// Other TLS content types (change cipher spec, handshake, data).
+	case 20, 22, 23:
+		break
+	default:
+		warn("replied with non-TLS data")
+	}
+	return int64(n), err
+}
+
+// PROXY protocol v2 signature.
+var proxyV2Signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+// Reports whether the client is allowed to send a PROXY header.
+func (conn *Conn) acceptProxy() bool {
+	if conn.Listener == nil {
+		return false
+	}
+
+	peer := conn.TCPConn.RemoteAddr().(*net.TCPAddr).IP
+	for _, subnet := range conn.Listener.AcceptProxy {
+		if subnet.Contains(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads an HAProxy PROXY header (v1 or v2) sent by the client, whose first
+// byte was already read. The addresses it reports are then used as the client
+// and local addresses of the connection.
+func (conn *Conn) readProxyHeader(first byte) error {
+	// Keep the header as sent, to be able to pass it to the backend.
+	raw := bytes.NewBuffer([]byte{ first })
+	r := io.TeeReader(conn.TCPConn, raw)
+
+	var src, dst *net.TCPAddr
+	var err error
+	if first == 'P' {
+		src, dst, err = readProxyHeaderV1(r)
+	} else {
+		src, dst, err = readProxyHeaderV2(r)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid PROXY header (%s)", err)
+	}
+	conn.proxyHeader = raw.Bytes()
+
+	// The header might not report any address (e.g. health checks).
+	if src != nil && dst != nil {
+		conn.proxySrc, conn.proxyDst = src, dst
+	}
+	return nil
+}
+
+// Reads an HAProxy PROXY header (protocol v1), without its first byte. The
+// header is read byte by byte so that no data following it is consumed.
+func readProxyHeaderV1(r io.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	// A v1 header is at most 107 bytes long.
+	line := []byte{'P'}
+	b := make([]byte, 1)
+	for len(line) < 107 && !bytes.HasSuffix(line, []byte("\r\n")) {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("header too long")
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, fmt.Errorf("wrong signature")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, fmt.Errorf("unsupported protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, nil, fmt.Errorf("wrong number of fields")
+	}
+
+	parse := func(ip, port string) (*net.TCPAddr, error) {
+		// IPv4-mapped IPv6 addresses are valid TCP6 addresses, check
+		// the textual form rather than the parsed address.
+		addr := net.ParseIP(ip)
+		if addr == nil || (fields[1] == "TCP4") == strings.Contains(ip, ":") {
+			return nil, fmt.Errorf("invalid address %q", ip)
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+		return &net.TCPAddr{ IP: addr, Port: int(p) }, nil
+	}
+
+	src, err := parse(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parse(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+// Reads an HAProxy PROXY header (protocol v2), without its first byte.
+func readProxyHeaderV2(r io.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	// Signature (without its first byte), version and command, family and
+	// protocol, length.
+	header := make([]byte, 15)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(header[:11], proxyV2Signature[1:]) {
+		return nil, nil, fmt.Errorf("wrong signature")
+	}
+	if header[11] >> 4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported version %d", header[11] >> 4)
+	}
+
+	// Read the addresses and TLVs, if any.
+	payload := make([]byte, binary.BigEndian.Uint16(header[13:15]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL command, the addresses are not reported.
+	if header[11] & 0xf == 0 {
+		return nil, nil, nil
+	}
+	if header[11] & 0xf != 1 {
+		return nil, nil, fmt.Errorf("unsupported command %d", header[11] & 0xf)
+	}
+
+	switch header[12] {
+	// TCP over IPv4.
+	case 0x11:
+		if len(payload) < 12 {
+			return nil, nil, fmt.Errorf("addresses too short")
+		}
+		return &net.TCPAddr{ IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10])) },
+		       &net.TCPAddr{ IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12])) },
+		       nil
+	// TCP over IPv6.
+	case 0x21:
+		if len(payload) < 36 {
+			return nil, nil, fmt.Errorf("addresses too short")
+		}
+		return &net.TCPAddr{ IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34])) },
+		       &net.TCPAddr{ IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36])) },
+		       nil
+	}
+
+	// Other families and protocols (UNIX, UDP, unspecified): the
+	// addresses are not used.
+	return nil, nil, nil
+}
+
+// Returns an HAProxy PROXY header (protocol v1).
+func proxyHeaderV1(conn net.Conn) bytes.Buffer {
+	var buf bytes.Buffer
+
+	client, local, ipv4, ok := proxyAddrs(conn)
+	if !ok {
+		buf.WriteString("PROXY UNKNOWN\r\n")
+		return buf
+	}
+
+	inetProto, clientIP, localIP := "TCP6", ipv6String(client.IP), ipv6String(local.IP)
+	if ipv4 {
+		inetProto, clientIP, localIP = "TCP4", client.IP.String(), local.IP.String()
+	}
+
+	buf.WriteString(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", inetProto,
+				    clientIP, localIP, client.Port, local.Port))
+	return buf
+}
+
+// Returns an HAProxy PROXY header (protocol v2).
+// See https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+func proxyHeaderV2(conn net.Conn) bytes.Buffer {
+	var buf bytes.Buffer
+
+	// Protocol signature.
+	buf.Write(proxyV2Signature)
+
+	client, local, ipv4, ok := proxyAddrs(conn)
+	if !ok {
+		// 'local' command, unspecified family and no address.
+		buf.Write([]byte{ 0x20, 0x00, 0x00, 0x00 })
+		return buf
+	}
+
+	// Command. Must be \x2 followed by \x0 for 'local' or \x1 for 'proxy'.
+	buf.WriteByte(0x21)
+
+	// Transport protocol and address family. The highest 4 bits represent
+	// the address family (0x1: AF_INET, 0x2: AF_INET6) and the lowest 4
+	// bits the protocol (0x1: SOCK_STREAM).
+	if ipv4 {
+		buf.WriteByte(0x11)
+	} else {
+		buf.WriteByte(0x21)
+	}
+
+	tmp := make([]byte, 2)
+
+	// Address length.
+	if ipv4 {
+		binary.BigEndian.PutUint16(tmp, 12)
+	} else {
+		binary.BigEndian.PutUint16(tmp, 36)
+	}
+	buf.Write(tmp)
+
+	// Addresses (client, local).
+	if ipv4 {
+		buf.Write(client.IP.To4())
+		buf.Write(local.IP.To4())
+	} else {
+		buf.Write(client.IP.To16())
+		buf.Write(local.IP.To16())
+	}
+
+	// TCP ports (client, local).
+	binary.BigEndian.PutUint16(tmp, uint16(client.Port))
+	buf.Write(tmp)
+	binary.BigEndian.PutUint16(tmp, uint16(local.Port))
+	buf.Write(tmp)
+
+	return buf
+}
+
+// Returns the client and local addresses to report in a PROXY header, and
+// whether both are IPv4 addresses. IPv4-mapped IPv6 addresses (as seen on
+// dual-stack sockets) count as IPv4, and an IPv4 address paired with an IPv6
+// one is reported in its mapped form, as a header holds a single family. The
+// family is always taken from the socket addresses, never from the backend
+// address. Reports false if they are not TCP addresses.
+func proxyAddrs(conn net.Conn) (*net.TCPAddr, *net.TCPAddr, bool, bool) {
+	client, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || client.IP == nil {
+		return nil, nil, false, false
+	}
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok || local.IP == nil {
+		return nil, nil, false, false
+	}
+
+	ipv4 := client.IP.To4() != nil && local.IP.To4() != nil
+	return client, local, ipv4, true
+}
+
+// Formats an IP address in its IPv6 form, as net.IP.String prints
+// IPv4-mapped addresses in the dotted IPv4 form.
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,417 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// A net.Conn reporting fixed addresses.
+type addrConn struct {
+	net.Conn
+	remote, local net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+func (c *addrConn) LocalAddr() net.Addr { return c.local }
+
+func tcpAddr(ip string, port int) *net.TCPAddr {
+	return &net.TCPAddr{ IP: net.ParseIP(ip), Port: port }
+}
+
+func TestProxyHeaderFamily(t *testing.T) {
+	tests := []struct {
+		desc   string
+		client string
+		local  string
+		v1     string
+		family byte
+		src    string
+		dst    string
+	}{
+		{
+			"IPv4 client, IPv4 local",
+			"192.0.2.1", "198.51.100.1",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 1234 443\r\n",
+			0x11, "192.0.2.1", "198.51.100.1",
+		},
+		{
+			"IPv6 client, IPv6 local",
+			"2001:db8::1", "2001:db8::2",
+			"PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n",
+			0x21, "2001:db8::1", "2001:db8::2",
+		},
+		{
+			"IPv4-mapped client, IPv4-mapped local (dual-stack socket)",
+			"::ffff:192.0.2.1", "::ffff:198.51.100.1",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 1234 443\r\n",
+			0x11, "192.0.2.1", "198.51.100.1",
+		},
+		{
+			"IPv4 client, IPv6 local",
+			"192.0.2.1", "2001:db8::2",
+			"PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 1234 443\r\n",
+			0x21, "::ffff:192.0.2.1", "2001:db8::2",
+		},
+		{
+			"IPv6 client, IPv4 local",
+			"2001:db8::1", "198.51.100.1",
+			"PROXY TCP6 2001:db8::1 ::ffff:198.51.100.1 1234 443\r\n",
+			0x21, "2001:db8::1", "::ffff:198.51.100.1",
+		},
+	}
+
+	for _, test := range(tests) {
+		conn := &addrConn{ remote: tcpAddr(test.client, 1234), local: tcpAddr(test.local, 443) }
+
+		v1 := proxyHeaderV1(conn)
+		if v1.String() != test.v1 {
+			t.Errorf("%s: wrong v1 header: got %q, wanted %q", test.desc, v1.String(), test.v1)
+		}
+		src, dst, err := readProxyHeaderV1(bytes.NewReader(v1.Bytes()[1:]))
+		if err != nil {
+			t.Errorf("%s: could not read back the v1 header: %s", test.desc, err)
+		} else if !src.IP.Equal(net.ParseIP(test.src)) || !dst.IP.Equal(net.ParseIP(test.dst)) {
+			t.Errorf("%s: v1 header read back as %s, %s", test.desc, src, dst)
+		}
+
+		v2 := proxyHeaderV2(conn)
+		if family := v2.Bytes()[13]; family != test.family {
+			t.Errorf("%s: wrong v2 family: got %#x, wanted %#x", test.desc, family, test.family)
+		}
+		src, dst, err = readProxyHeaderV2(bytes.NewReader(v2.Bytes()[1:]))
+		if err != nil {
+			t.Errorf("%s: could not read back the v2 header: %s", test.desc, err)
+			continue
+		}
+		if !src.IP.Equal(net.ParseIP(test.src)) || src.Port != 1234 ||
+		   !dst.IP.Equal(net.ParseIP(test.dst)) || dst.Port != 443 {
+			t.Errorf("%s: v2 header read back as %s, %s", test.desc, src, dst)
+		}
+		length := 16 + 36
+		if test.family == 0x11 {
+			length = 16 + 12
+		}
+		if v2.Len() != length {
+			t.Errorf("%s: wrong v2 header length: got %d, wanted %d", test.desc, v2.Len(), length)
+		}
+	}
+
+	// Non-TCP addresses are reported as unknown.
+	conn := &addrConn{ remote: &net.UnixAddr{ Name: "@client", Net: "unix" },
+			   local: &net.UnixAddr{ Name: "@local", Net: "unix" } }
+	if v1 := proxyHeaderV1(conn); v1.String() != "PROXY UNKNOWN\r\n" {
+		t.Errorf("wrong v1 header for unix addresses: %q", v1.String())
+	}
+	v2 := proxyHeaderV2(conn)
+	if !bytes.Equal(v2.Bytes()[12:], []byte{ 0x20, 0x00, 0x00, 0x00 }) {
+		t.Errorf("wrong v2 header for unix addresses: %x", v2.Bytes())
+	}
+}
+
+func TestBackendSendProxy(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Backends are used in turn, the first one using the route setting.
+	var conf config.Config
+	if err := conf.Parse([]byte("example.net {\n" +
+				    "\tbackend v1.invalid:443\n" +
+				    "\tbackend v2.invalid:443 send-proxy-v2\n" +
+				    "\tbackend none.invalid:443 weight 2 no-send-proxy\n" +
+				    "\tsend-proxy\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		backend string
+		prefix  []byte
+	}{
+		{ "tcp/v1.invalid:443", []byte("PROXY TCP4 ") },
+		{ "tcp/v2.invalid:443", []byte("\r\n\r\n\x00\r\nQUIT\n") },
+		{ "tcp/none.invalid:443", []byte{ 22, 3 } },
+	}
+	for _, test := range(tests) {
+		received := make(chan []byte, 1)
+		// The PROXY header and the handshake are written separately,
+		// read both before answering.
+		d := &fakeDialer{ backend: func(c net.Conn) {
+			defer c.Close()
+			var data []byte
+			b := make([]byte, 4096)
+			for !bytes.Contains(data, []byte("example.net")) {
+				n, err := c.Read(b)
+				if err != nil {
+					break
+				}
+				data = append(data, b[:n]...)
+			}
+			received <- data
+			c.Write([]byte{ 22, 3, 3, 0, 0 })
+		}}
+		send := func(c net.Conn) {
+			c.Write(rawClientHello(t, "example.net"))
+			io.ReadAll(c)
+		}
+		if err := handleProxyConn(t, &Proxy{ Dialer: d }, &conf, send); err != nil {
+			t.Fatal(err)
+		}
+		if len(d.dialed) != 1 || d.dialed[0] != test.backend {
+			t.Errorf("dialed %v, wanted %s", d.dialed, test.backend)
+			continue
+		}
+		if b := <-received; !bytes.HasPrefix(b, test.prefix) {
+			t.Errorf("%s: got %q, wanted the prefix %q", test.backend, b, test.prefix)
+		}
+	}
+}
+
+func TestCheckProxyResponse(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		desc  string
+		reply func(*net.TCPConn)
+		warn  string
+	}{
+		{ "Plain text", func(c *net.TCPConn) { c.Write([]byte("invalid request\n")) }, "replied with non-TLS data" },
+		{ "HTTP error", func(c *net.TCPConn) { c.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n")) },
+		  "replied with non-TLS data" },
+		{ "Reset", func(c *net.TCPConn) { c.SetLinger(0) }, "reset the connection" },
+		{ "Close", func(c *net.TCPConn) {}, "closed the connection" },
+		{ "TLS alert", func(c *net.TCPConn) { c.Write([]byte{ 21, 3, 3, 0, 2, 2, 40 }) }, "sent a TLS alert" },
+		{ "TLS handshake", func(c *net.TCPConn) { c.Write([]byte{ 22, 3, 3, 0, 0 }) }, "" },
+	}
+
+	for _, test := range(tests) {
+		backend, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The backend answers once both the PROXY header and the
+		// handshake are read.
+		go func() {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			var data []byte
+			b := make([]byte, 4096)
+			for !bytes.Contains(data, []byte("example.net")) {
+				n, err := c.Read(b)
+				if err != nil {
+					return
+				}
+				data = append(data, b[:n]...)
+			}
+			test.reply(c.(*net.TCPConn))
+		}()
+
+		var conf config.Config
+		if err := conf.Parse([]byte("example.net {\n\tbackend " + backend.Addr().String() +
+					    "\n\tsend-proxy\n}\n")); err != nil {
+			t.Fatal(err)
+		}
+		logs.Reset()
+		send := func(c net.Conn) {
+			c.Write(rawClientHello(t, "example.net"))
+			io.ReadAll(c)
+		}
+		handleConn(t, &conf, send)
+		backend.Close()
+
+		warned := bytes.Contains(logs.Bytes(), []byte("check it supports the PROXY protocol"))
+		if test.warn == "" {
+			if warned {
+				t.Errorf("%s: unexpected warning (%q)", test.desc, logs.String())
+			}
+			continue
+		}
+		if !warned || !bytes.Contains(logs.Bytes(), []byte(backend.Addr().String() + " " + test.warn)) {
+			t.Errorf("%s: no warning about %s %s (%q)", test.desc, backend.Addr(), test.warn, logs.String())
+		}
+	}
+}
+
+func TestProxyInbound(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	v1 := "PROXY TCP4 192.0.2.1 198.51.100.1 1234 443\r\n"
+	tests := []struct {
+		desc    string
+		inbound uint
+		send    uint
+		header  string
+		// Client address reported to the backend, the header passed
+		// verbatim, or nothing.
+		client  string
+		pass    string
+	}{
+		{ "receive-v1/send-v2", config.ProxyInboundRewrite, config.ProxyV2, v1, "192.0.2.1", "" },
+		{ "receive-none/send-v2", config.ProxyInboundRewrite, config.ProxyV2, "", "127.0.0.1", "" },
+		{ "receive-v1/strip/send-v2", config.ProxyInboundStrip, config.ProxyV2, v1, "127.0.0.1", "" },
+		{ "receive-v1/pass", config.ProxyInboundPass, config.ProxyNone, v1, "", v1 },
+		{ "receive-v1/pass/send-v2", config.ProxyInboundPass, config.ProxyV2, v1, "", v1 },
+		{ "receive-none/pass/send-v2", config.ProxyInboundPass, config.ProxyV2, "", "127.0.0.1", "" },
+		{ "receive-v1/send-none", config.ProxyInboundRewrite, config.ProxyNone, v1, "", "" },
+	}
+
+	listener := &config.Listener{ AcceptProxy: cidrs("127.0.0.0/8") }
+	for _, test := range(tests) {
+		conf := &config.Config{
+			Routes: []*config.Route{
+				{ Domains: domains(`example\.net`),
+				  Backends: []*config.Backend{{ Address: "backend.invalid:443", Weight: 1 }},
+				  SendProxy: test.send, ProxyInbound: test.inbound },
+			},
+		}
+		received := make(chan []byte, 1)
+		d := &fakeDialer{ backend: func(c net.Conn) {
+			defer c.Close()
+			var data []byte
+			b := make([]byte, 4096)
+			for !bytes.Contains(data, []byte("example.net")) {
+				n, err := c.Read(b)
+				if err != nil {
+					break
+				}
+				data = append(data, b[:n]...)
+			}
+			received <- data
+			c.Write([]byte{ 22, 3, 3, 0, 0 })
+		}}
+		send := func(c net.Conn) {
+			c.Write(append([]byte(test.header), rawClientHello(t, "example.net")...))
+			io.ReadAll(c)
+		}
+		if err := handleListenerConn(t, &Proxy{ Dialer: d }, listener, conf, send); err != nil {
+			t.Errorf("%s: %s", test.desc, err)
+			continue
+		}
+
+		data := <-received
+		switch {
+		case test.client != "":
+			if len(data) == 0 || data[0] != '\r' {
+				t.Errorf("%s: no v2 header sent (%q)", test.desc, data)
+				break
+			}
+			src, _, err := readProxyHeaderV2(bytes.NewReader(data[1:]))
+			if err != nil || src == nil || src.IP.String() != test.client {
+				t.Errorf("%s: got client %v (%v), wanted %s", test.desc, src, err, test.client)
+			}
+			break
+		case test.pass != "":
+			if !bytes.HasPrefix(data, []byte(test.pass + "\x16")) {
+				t.Errorf("%s: header not passed verbatim (%q)", test.desc, data)
+			}
+			break
+		default:
+			if len(data) == 0 || data[0] != 0x16 {
+				t.Errorf("%s: got %q, wanted the handshake only", test.desc, data)
+			}
+		}
+	}
+}
+
+func TestAcceptProxy(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	v1 := "PROXY TCP4 192.0.2.1 198.51.100.1 1234 443\r\n"
+	tests := []struct {
+		desc   string
+		accept string
+		header string
+		// Client address reported to the backend, if dialed, or the
+		// error of the connection.
+		client string
+		err    error
+	}{
+		{ "trusted peer", "127.0.0.0/8", v1, "192.0.2.1", nil },
+		{ "trusted peer, no header", "127.0.0.0/8", "", "127.0.0.1", nil },
+		{ "untrusted peer", "10.0.0.0/8", v1, "", ErrNotTLS },
+		{ "untrusted peer, no header", "10.0.0.0/8", "", "127.0.0.1", nil },
+		{ "trusted peer, malformed header", "127.0.0.0/8", "PROXY TCP4 192.0.2.1\r\n", "", ErrProxyHeader },
+		{ "trusted peer, bad v2 signature", "127.0.0.0/8", "\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x00", "", ErrProxyHeader },
+	}
+
+	for _, test := range(tests) {
+		conf := &config.Config{
+			Routes: []*config.Route{
+				{ Domains: domains(`example\.net`),
+				  Backends: []*config.Backend{{ Address: "backend.invalid:443", Weight: 1 }},
+				  SendProxy: config.ProxyV2 },
+			},
+		}
+		received := make(chan []byte, 1)
+		d := &fakeDialer{ backend: func(c net.Conn) {
+			defer c.Close()
+			var data []byte
+			b := make([]byte, 4096)
+			for !bytes.Contains(data, []byte("example.net")) {
+				n, err := c.Read(b)
+				if err != nil {
+					break
+				}
+				data = append(data, b[:n]...)
+			}
+			received <- data
+		}}
+		send := func(c net.Conn) {
+			c.Write(append([]byte(test.header), rawClientHello(t, "example.net")...))
+			io.ReadAll(c)
+		}
+		listener := &config.Listener{ AcceptProxy: cidrs(test.accept) }
+		err := handleListenerConn(t, &Proxy{ Dialer: d }, listener, conf, send)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error '%v', wanted '%v'", test.desc, err, test.err)
+			continue
+		}
+		if test.err != nil {
+			select {
+			case <-received:
+				t.Errorf("%s: backend dialed", test.desc)
+			default:
+			}
+			continue
+		}
+
+		// The header sent to the backend reports the client.
+		data := <-received
+		if len(data) == 0 || data[0] != '\r' {
+			t.Errorf("%s: no v2 header sent (%q)", test.desc, data)
+			continue
+		}
+		src, _, err := readProxyHeaderV2(bytes.NewReader(data[1:]))
+		if err != nil || src == nil || src.IP.String() != test.client {
+			t.Errorf("%s: got client %v (%v), wanted %s", test.desc, src, err, test.client)
+		}
+	}
+}
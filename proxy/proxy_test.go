@@ -0,0 +1,2352 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+	"github.com/atenart/sniproxy/handshake"
+)
+
+func cidrs(subnets ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, subnet := range(subnets) {
+		_, n, err := net.ParseCIDR(subnet)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func domains(regexps ...string) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, r := range regexps {
+		res = append(res, regexp.MustCompile("^" + r + "$"))
+	}
+	return res
+}
+
+func TestClientAllowed(t *testing.T) {
+	tests := []struct {
+		desc    string
+		route   *config.Route
+		ip      string
+		allowed bool
+	}{
+		{
+			"No filtering",
+			&config.Route{},
+			"10.0.0.1",
+			true,
+		},
+		{
+			"Denied address",
+			&config.Route{ Deny: cidrs("10.0.0.1/32") },
+			"10.0.0.1",
+			false,
+		},
+		{
+			"Address not denied",
+			&config.Route{ Deny: cidrs("10.0.0.1/32") },
+			"10.0.0.2",
+			true,
+		},
+		{
+			"Allowed address, implicit deny all",
+			&config.Route{ Allow: cidrs("10.0.0.1/32"), Deny: cidrs("0.0.0.0/0", "::/0") },
+			"10.0.0.1",
+			true,
+		},
+		{
+			"Address not allowed, implicit deny all",
+			&config.Route{ Allow: cidrs("10.0.0.1/32"), Deny: cidrs("0.0.0.0/0", "::/0") },
+			"10.0.0.2",
+			false,
+		},
+		{
+			"Address not allowed, implicit deny all, allow wins ties",
+			&config.Route{ Allow: cidrs("10.0.0.1/32"), Deny: cidrs("0.0.0.0/0", "::/0"),
+				      ACLTieBreak: config.ACLTieBreakAllow },
+			"10.0.0.2",
+			false,
+		},
+		{
+			"More specific allow",
+			&config.Route{ Allow: cidrs("10.0.0.0/29"), Deny: cidrs("10.0.0.0/24") },
+			"10.0.0.1",
+			true,
+		},
+		{
+			"More specific deny",
+			&config.Route{ Allow: cidrs("10.0.0.0/24"), Deny: cidrs("10.0.0.0/29") },
+			"10.0.0.1",
+			false,
+		},
+		{
+			"More specific deny, allow wins ties",
+			&config.Route{ Allow: cidrs("10.0.0.0/24"), Deny: cidrs("10.0.0.0/29"),
+				      ACLTieBreak: config.ACLTieBreakAllow },
+			"10.0.0.1",
+			false,
+		},
+		{
+			"Tie, deny wins ties",
+			&config.Route{ Allow: cidrs("10.0.0.0/24"), Deny: cidrs("10.0.0.0/24"),
+				      ACLTieBreak: config.ACLTieBreakDeny },
+			"10.0.0.1",
+			false,
+		},
+		{
+			"Tie, allow wins ties",
+			&config.Route{ Allow: cidrs("10.0.0.0/24"), Deny: cidrs("10.0.0.0/24"),
+				      ACLTieBreak: config.ACLTieBreakAllow },
+			"10.0.0.1",
+			true,
+		},
+		{
+			"Tie on single addresses, allow wins ties",
+			&config.Route{ Allow: cidrs("10.0.0.1/32"), Deny: cidrs("10.0.0.0/24", "10.0.0.1/32"),
+				      ACLTieBreak: config.ACLTieBreakAllow },
+			"10.0.0.1",
+			true,
+		},
+	}
+
+	for _, test := range(tests) {
+		if clientAllowed(test.route, net.ParseIP(test.ip)) != test.allowed {
+			t.Error(test.desc)
+		}
+	}
+}
+
+func TestMatchTLSVersion(t *testing.T) {
+	domains := []*regexp.Regexp{ regexp.MustCompile(`example\.net`) }
+	modern := &config.Route{ Name: "modern", Domains: domains,
+				 TLSMinVersion: handshake.VersionTLS13 }
+	legacy := &config.Route{ Name: "legacy", Domains: domains,
+				 TLSMaxVersion: handshake.VersionTLS12 }
+	conf := &config.Config{ Routes: []*config.Route{ modern, legacy } }
+
+	supportedVersions := func(versions ...byte) []handshake.Extension {
+		return []handshake.Extension{
+			{ Type: handshake.ExtSupportedVersions,
+			  Data: append([]byte{ byte(len(versions)) }, versions...) },
+		}
+	}
+
+	tests := []struct {
+		desc  string
+		hello *handshake.ClientHello
+		route *config.Route
+	}{
+		{
+			"TLS 1.2 and TLS 1.3 client",
+			&handshake.ClientHello{ Version: handshake.VersionTLS12,
+						Extensions: supportedVersions(3, 4, 3, 3) },
+			modern,
+		},
+		{
+			"TLS 1.3 only client",
+			&handshake.ClientHello{ Version: handshake.VersionTLS12,
+						Extensions: supportedVersions(3, 4) },
+			modern,
+		},
+		{
+			"TLS 1.2 client, no supported_versions extension",
+			&handshake.ClientHello{ Version: handshake.VersionTLS12 },
+			legacy,
+		},
+		{
+			"TLS 1.0 and TLS 1.1 client",
+			&handshake.ClientHello{ Version: handshake.VersionTLS12,
+						Extensions: supportedVersions(3, 2, 3, 1) },
+			legacy,
+		},
+	}
+
+	for _, test := range(tests) {
+		conn := &Conn{ Config: conf, Hello: test.hello }
+		route, err := conn.Match("example.net")
+		if err != nil {
+			t.Errorf("%s: %s", test.desc, err)
+			continue
+		}
+		if route != test.route {
+			t.Errorf("%s: wrong route: got %s, wanted %s", test.desc, route.Name, test.route.Name)
+		}
+	}
+
+	// No route matches when the client version is out of all bounds.
+	conn := &Conn{
+		Config: &config.Config{ Routes: []*config.Route{ modern } },
+		Hello: &handshake.ClientHello{ Version: handshake.VersionTLS12 },
+	}
+	if _, err := conn.Match("example.net"); err == nil {
+		t.Error("TLS 1.2 client matched a TLS 1.3 only route")
+	}
+}
+
+func TestDialSourcePorts(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// Find a free port, and keep another one in use.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := uint16(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+	inUse := uint16(used.Addr().(*net.TCPAddr).Port)
+
+	conn := &Conn{}
+	route := &config.Route{ SourcePorts: &config.PortRange{ Low: free, High: free } }
+	up, err := conn.dial(context.Background(), route, backend.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := up.LocalAddr().(*net.TCPAddr).Port; port != int(free) {
+		t.Errorf("wrong source port: got %d, wanted %d", port, free)
+	}
+	up.Close()
+
+	route = &config.Route{ SourcePorts: &config.PortRange{ Low: inUse, High: inUse } }
+	if _, err := conn.dial(context.Background(), route, backend.Addr().String()); err == nil {
+		t.Error("dialed using a source port already in use")
+	}
+}
+
+func TestDialNetwork(t *testing.T) {
+	backend, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	tests := []struct {
+		network string
+		ok      bool
+	}{
+		{ "", true },
+		{ "tcp4", true },
+		{ "tcp6", false },
+	}
+
+	conn := &Conn{}
+	for _, test := range(tests) {
+		route := &config.Route{ Network: test.network }
+		up, err := conn.dial(context.Background(), route, backend.Addr().String())
+		if (err == nil) != test.ok {
+			t.Errorf("network %q: got error '%v'", test.network, err)
+		}
+		if err == nil {
+			up.Close()
+		}
+	}
+}
+
+func TestDialFastOpen(t *testing.T) {
+	lc := net.ListenConfig{ Control: setListenFastOpen }
+	backend, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			received <- ""
+			return
+		}
+		defer c.Close()
+		b, _ := io.ReadAll(c)
+		received <- string(b)
+	}()
+
+	// The connection is only established when writing, with TFO.
+	conn := &Conn{ Config: &config.Config{ TCPFastOpen: true, TCPFastOpenOn: config.OnBoth } }
+	up, err := conn.dial(context.Background(), &config.Route{}, backend.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	up.Write([]byte("hello"))
+	up.(*net.TCPConn).CloseWrite()
+	defer up.Close()
+
+	if got := <-received; got != "hello" {
+		t.Errorf("backend received %q", got)
+	}
+}
+
+func TestPortRangeNext(t *testing.T) {
+	r := &config.PortRange{ Low: 1000, High: 1002 }
+	for i, want := range []int{ 1000, 1001, 1002, 1000, 1001 } {
+		if port := r.Next(); port != want {
+			t.Errorf("call %d: got port %d, wanted %d", i, port, want)
+		}
+	}
+}
+
+func TestSelectRoute(t *testing.T) {
+	backend := &config.Backend{ Address: "1.2.3.4:443", Weight: 1 }
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Name: "net", Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			  Backends: []*config.Backend{ backend } },
+			{ Name: "empty", Domains: []*regexp.Regexp{ regexp.MustCompile(`^empty\.example\.net$`) } },
+		},
+		Rewrites: []*config.Rewrite{
+			{ Pattern: regexp.MustCompile(`^www\.`), Replacement: "" },
+		},
+	}
+
+	tests := []struct {
+		sni   string
+		route string
+		err   error
+	}{
+		{ "example.net", "net", nil },
+		{ "www.example.net", "net", nil },
+		{ "example.org", "", ErrNoRoute },
+		{ "", "", ErrNoSNI },
+		{ "empty.example.net", "", ErrNoBackend },
+	}
+
+	for _, test := range(tests) {
+		conn := &Conn{ Config: conf, proxy: &Proxy{}, span: noopSpan{} }
+		route, b, err := conn.selectRoute(context.Background(), test.sni)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error '%v', wanted '%v'", test.sni, err, test.err)
+			continue
+		}
+		if err == nil && (route.Name != test.route || b != backend) {
+			t.Errorf("%s: wrong route %s / backend %s", test.sni, route.Name, b.Address)
+		}
+	}
+}
+
+func TestSelectRoutePolicy(t *testing.T) {
+	backend := &config.Backend{ Address: "1.2.3.4:443", Weight: 1 }
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Name: "net", Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			  Backends: []*config.Backend{ backend } },
+			{ Name: "internal", Domains: []*regexp.Regexp{ regexp.MustCompile(`^internal\.invalid$`) },
+			  Backends: []*config.Backend{ backend } },
+		},
+	}
+
+	// Internal clients go to the internal route, h2 clients are denied.
+	var inputs []PolicyInput
+	policy := PolicyFunc(func(ctx context.Context, input PolicyInput) (PolicyDecision, error) {
+		inputs = append(inputs, input)
+		switch {
+		case input.SNI == "error.example.net":
+			return PolicyDecision{}, errors.New("script error")
+		case input.SNI == "unknown.example.net":
+			return PolicyDecision{ Route: "unknown" }, nil
+		case len(input.ALPN) > 0 && input.ALPN[0] == "h2":
+			return PolicyDecision{ Deny: true }, nil
+		case input.ClientIP.IsPrivate():
+			return PolicyDecision{ Route: "internal" }, nil
+		}
+		return PolicyDecision{}, nil
+	})
+
+	tests := []struct {
+		sni    string
+		client string
+		alpn   []string
+		route  string
+		err    error
+	}{
+		{ "example.net", "192.0.2.1", nil, "net", nil },
+		{ "example.net", "10.0.0.1", nil, "internal", nil },
+		{ "example.net", "192.0.2.1", []string{ "h2" }, "", ErrDenied },
+		{ "error.example.net", "192.0.2.1", nil, "", ErrDenied },
+		{ "unknown.example.net", "192.0.2.1", nil, "", ErrNoRoute },
+	}
+
+	for _, test := range(tests) {
+		raw := rawClientHelloConfig(t, &tls.Config{ ServerName: test.sni, NextProtos: test.alpn,
+							    InsecureSkipVerify: true })
+		hello, err := handshake.ParseClientHello(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := &Conn{ Config: conf, proxy: &Proxy{ Policy: policy }, span: noopSpan{}, Hello: hello,
+			       proxySrc: &net.TCPAddr{ IP: net.ParseIP(test.client), Port: 1234 },
+			       proxyDst: &net.TCPAddr{ IP: net.ParseIP("192.0.2.100"), Port: 443 } }
+		route, _, err := conn.selectRoute(context.Background(), test.sni)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s from %s: got error '%v', wanted '%v'", test.sni, test.client, err, test.err)
+			continue
+		}
+		if err == nil && route.Name != test.route {
+			t.Errorf("%s from %s: got route %s, wanted %s", test.sni, test.client, route.Name, test.route)
+		}
+	}
+
+	input := inputs[0]
+	if input.SNI != "example.net" || input.LocalPort != 443 || len(input.JA3) != 32 {
+		t.Errorf("wrong policy input %+v", input)
+	}
+}
+
+func TestMatchClients(t *testing.T) {
+	tenant := domains(`app\.example\.net`)
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Name: "shared", Domains: domains(`.*\.example\.net`) },
+			{ Name: "tenant-a", Domains: tenant, Clients: cidrs("10.1.0.0/16") },
+			{ Name: "tenant-a-lab", Domains: tenant, Clients: cidrs("10.1.2.0/24") },
+			{ Name: "tenant-b", Domains: tenant, Clients: cidrs("10.2.0.0/16", "2001:db8::/32") },
+			{ Name: "only-tenant-c", Domains: domains(`c\.example\.org`), Clients: cidrs("10.3.0.0/16") },
+		},
+	}
+
+	tests := []struct {
+		sni    string
+		client string
+		route  string
+	}{
+		{ "app.example.net", "192.0.2.1", "shared" },
+		{ "app.example.net", "10.1.1.1", "tenant-a" },
+		{ "app.example.net", "10.1.2.1", "tenant-a-lab" },
+		{ "app.example.net", "10.2.0.1", "tenant-b" },
+		{ "app.example.net", "2001:db8::1", "tenant-b" },
+		{ "www.example.net", "10.1.1.1", "shared" },
+		{ "c.example.org", "10.3.0.1", "only-tenant-c" },
+		{ "c.example.org", "10.1.1.1", "" },
+	}
+
+	for _, test := range(tests) {
+		conn := &Conn{ Config: conf, proxySrc: &net.TCPAddr{ IP: net.ParseIP(test.client), Port: 1234 } }
+		route, err := conn.Match(test.sni)
+		if test.route == "" {
+			if err == nil {
+				t.Errorf("%s from %s: matched route %s", test.sni, test.client, route.Name)
+			}
+			continue
+		}
+		if err != nil || route.Name != test.route {
+			t.Errorf("%s from %s: got route %v (%v), wanted %s", test.sni, test.client, route, err, test.route)
+		}
+	}
+}
+
+func TestMatchDestination(t *testing.T) {
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Name: "sni", Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			  Destinations: []*config.Destination{ { Subnet: cidrs("192.0.2.10/32")[0], Port: 443 } } },
+			{ Name: "vip", Domains: []*regexp.Regexp{ regexp.MustCompile(`^vip\.invalid$`) },
+			  Destinations: []*config.Destination{ { Subnet: cidrs("192.0.2.20/32")[0], Port: 443 } } },
+			{ Name: "port", Domains: []*regexp.Regexp{ regexp.MustCompile(`^port\.invalid$`) },
+			  Destinations: []*config.Destination{ { Port: 8443 } } },
+			{ Name: "v6", Domains: []*regexp.Regexp{ regexp.MustCompile(`^v6\.invalid$`) },
+			  Destinations: []*config.Destination{ { Subnet: cidrs("2001:db8::/32")[0] } } },
+			{ Name: "default", Domains: []*regexp.Regexp{ regexp.MustCompile(`^.*$`) } },
+		},
+	}
+
+	tests := []struct {
+		sni   string
+		dst   string
+		route string
+	}{
+		// Destinations are only used without an SNI.
+		{ "example.net", "192.0.2.20:443", "sni" },
+		{ "", "192.0.2.10:443", "sni" },
+		{ "", "192.0.2.20:443", "vip" },
+		{ "", "192.0.2.20:80", "default" },
+		{ "", "192.0.2.30:8443", "port" },
+		{ "", "[2001:db8::1]:443", "v6" },
+		{ "", "198.51.100.1:443", "default" },
+	}
+
+	for _, test := range(tests) {
+		addr, _ := net.ResolveTCPAddr("tcp", test.dst)
+		conn := &Conn{ Config: conf, OriginalDst: addr }
+		route, err := conn.Match(test.sni)
+		if err != nil {
+			t.Errorf("%q to %s: %s", test.sni, test.dst, err)
+			continue
+		}
+		if route.Name != test.route {
+			t.Errorf("%q to %s: got route %s, wanted %s", test.sni, test.dst, route.Name, test.route)
+		}
+	}
+}
+
+func TestMatchJA3(t *testing.T) {
+	scanner := &handshake.ClientHello{ Version: handshake.VersionTLS12, CipherSuites: []uint16{ 47 } }
+	client := &handshake.ClientHello{ Version: handshake.VersionTLS12, CipherSuites: []uint16{ 4865 } }
+	routes := []*config.Route{
+		{ Name: "web", Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) } },
+		{ Name: "honeypot", Domains: []*regexp.Regexp{ regexp.MustCompile(`^honeypot\.invalid$`) },
+		  JA3: map[string]bool{ scanner.JA3(): true } },
+	}
+
+	tests := []struct {
+		desc  string
+		match uint
+		hello *handshake.ClientHello
+		sni   string
+		route string
+	}{
+		{ "Fingerprint before SNI", config.JA3BeforeSNI, scanner, "example.net", "honeypot" },
+		{ "Fingerprint after SNI", config.JA3AfterSNI, scanner, "example.net", "web" },
+		{ "Fingerprint after SNI, unknown SNI", config.JA3AfterSNI, scanner, "example.org", "honeypot" },
+		{ "Fingerprint after SNI, no SNI", config.JA3AfterSNI, scanner, "", "honeypot" },
+		{ "Other client", config.JA3BeforeSNI, client, "example.net", "web" },
+		{ "Other client, unknown SNI", config.JA3BeforeSNI, client, "example.org", "" },
+	}
+
+	for _, test := range(tests) {
+		conn := &Conn{
+			Config: &config.Config{ Routes: routes, JA3Match: test.match },
+			Hello: test.hello,
+			span: noopSpan{},
+		}
+		route, err := conn.Match(test.sni)
+		if err != nil {
+			if test.route != "" {
+				t.Errorf("%s: %s", test.desc, err)
+			}
+			continue
+		}
+		if route.Name != test.route {
+			t.Errorf("%s: got route %s, wanted %s", test.desc, route.Name, test.route)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	backend := &config.Backend{ Address: "1.2.3.4:443", Weight: 1 }
+	forward := []*config.Backend{{ Address: "sni:443", Weight: 1, SNIPort: 443 }}
+	tls13 := []handshake.Extension{
+		{ Type: handshake.ExtSupportedVersions, Data: []byte{ 4, 3, 4, 3, 3 } },
+	}
+
+	tests := []struct {
+		desc  string
+		route *config.Route
+		ip    string
+		// Extensions of a TLS 1.2 ClientHello.
+		exts  []handshake.Extension
+		err   error
+	}{
+		{ "No ACL", &config.Route{}, "192.0.2.1", nil, nil },
+		{ "Allowed client", &config.Route{ Allow: cidrs("192.0.2.0/24"), Deny: cidrs("0.0.0.0/0") },
+		  "192.0.2.1", nil, nil },
+		{ "Denied client", &config.Route{ Deny: cidrs("192.0.2.0/24") }, "192.0.2.1", nil, ErrDenied },
+		{ "Rate limited client", &config.Route{ RateLimit: &config.RateLimiter{ Rate: 1, Burst: 0 } },
+		  "192.0.2.1", nil, ErrRateLimited },
+		{ "Denied and rate limited client",
+		  &config.Route{ Deny: cidrs("192.0.2.1/32"), RateLimit: &config.RateLimiter{ Rate: 1 } },
+		  "192.0.2.1", nil, ErrDenied },
+		{ "TLS 1.2 client, TLS 1.2 required", &config.Route{ RequireTLS: handshake.VersionTLS12 },
+		  "192.0.2.1", nil, nil },
+		{ "TLS 1.2 client, TLS 1.3 required", &config.Route{ RequireTLS: handshake.VersionTLS13 },
+		  "192.0.2.1", nil, ErrTLSVersion },
+		{ "TLS 1.3 client, TLS 1.3 required", &config.Route{ RequireTLS: handshake.VersionTLS13 },
+		  "192.0.2.1", tls13, nil },
+		{ "Forwarded SNI allowed", &config.Route{ Backends: forward, ForwardAllow: domains(`example\.net`) },
+		  "192.0.2.1", nil, nil },
+		{ "Forwarded SNI not allowed", &config.Route{ Backends: forward, ForwardAllow: domains(`example\.org`) },
+		  "192.0.2.1", nil, ErrDenied },
+		{ "Forwarded SNI denied",
+		  &config.Route{ Backends: forward, ForwardAllow: domains(`.*`), ForwardDeny: domains(`example\.net`) },
+		  "192.0.2.1", nil, ErrDenied },
+	}
+
+	for _, test := range(tests) {
+		conn := &Conn{ Hello: &handshake.ClientHello{ ServerName: "example.net",
+							     Version: handshake.VersionTLS12,
+							     Extensions: test.exts } }
+		err := conn.authorize(test.route, backend, net.ParseIP(test.ip))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error '%v', wanted '%v'", test.desc, err, test.err)
+		}
+	}
+}
+
+func TestAuthorizeCiphers(t *testing.T) {
+	backend := &config.Backend{ Address: "1.2.3.4:443", Weight: 1 }
+	parse := func(c *tls.Config) *handshake.ClientHello {
+		c.ServerName, c.InsecureSkipVerify = "example.net", true
+		hello, err := handshake.ParseClientHello(bytes.NewReader(rawClientHelloConfig(t, c)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hello
+	}
+	weak := parse(&tls.Config{ MaxVersion: tls.VersionTLS12,
+				   CipherSuites: []uint16{ tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA } })
+	strong := parse(&tls.Config{})
+
+	tests := []struct {
+		desc   string
+		policy *config.CipherPolicy
+		hello  *handshake.ClientHello
+		err    error
+	}{
+		{ "No policy, weak client", nil, weak, nil },
+		{ "AEAD required, weak client", &config.CipherPolicy{ AEAD: true }, weak, ErrWeakCiphers },
+		{ "AEAD required, strong client", &config.CipherPolicy{ AEAD: true }, strong, nil },
+		{ "Weak suite allowed", &config.CipherPolicy{ AEAD: true,
+		  Suites: map[uint16]bool{ tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA: true } }, weak, nil },
+		{ "Suite not offered", &config.CipherPolicy{
+		  Suites: map[uint16]bool{ tls.TLS_CHACHA20_POLY1305_SHA256: true } }, weak, ErrWeakCiphers },
+	}
+
+	for _, test := range(tests) {
+		conn := &Conn{ Hello: test.hello }
+		err := conn.authorize(&config.Route{ RequireCiphers: test.policy }, backend, net.ParseIP("192.0.2.1"))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error '%v', wanted '%v'", test.desc, err, test.err)
+		}
+	}
+
+	// Rejected clients get an insufficient_security alert.
+	if action := (&config.Config{}).RejectAction("weak-ciphers"); action != config.Alerts["insufficient_security"] {
+		t.Errorf("got default action %d, wanted insufficient_security", action)
+	}
+}
+
+func TestBackendAddress(t *testing.T) {
+	tests := []struct {
+		sni     string
+		network string
+		address string
+		err     error
+	}{
+		{ "192.0.2.1", "", "192.0.2.1:8443", nil },
+		{ "2001:db8::1", "", "[2001:db8::1]:8443", nil },
+		{ "2001:db8::1", "tcp4", "", ErrBackendDial },
+		// Loops back to the proxy.
+		{ "127.0.0.1", "", "", ErrDenied },
+		{ "localhost", "", "", ErrDenied },
+		{ "", "", "", ErrNoBackend },
+	}
+
+	backend := &config.Backend{ Address: "sni:8443", Weight: 1, SNIPort: 8443 }
+	for _, test := range(tests) {
+		conn := &Conn{ Hello: &handshake.ClientHello{ ServerName: test.sni } }
+		route := &config.Route{ Backends: []*config.Backend{ backend }, Network: test.network }
+		address, err := conn.backendAddress(context.Background(), route, backend)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%q: got error '%v', wanted '%v'", test.sni, err, test.err)
+		}
+		if address != test.address {
+			t.Errorf("%q: got address %q, wanted %q", test.sni, address, test.address)
+		}
+	}
+}
+
+func TestRejectCauses(t *testing.T) {
+	for kind, cause := range rejectCauses {
+		if _, ok := config.RejectCauses[cause]; !ok {
+			t.Errorf("%s: unknown rejection cause %s", kind, cause)
+		}
+		if got := rejectCause(dispatchErrorf(kind, "test")); got != cause {
+			t.Errorf("%s: got cause %s, wanted %s", kind, got, cause)
+		}
+	}
+	if cause := rejectCause(errors.New("test")); cause != "internal" {
+		t.Errorf("unexpected cause for a non-dispatch error: %s", cause)
+	}
+}
+
+// Handles a connection accepted on the loopback, the client side being driven
+// by send, and returns the resulting error.
+func handleConn(t *testing.T, conf *config.Config, send func(net.Conn)) error {
+	return handleProxyConn(t, &Proxy{}, conf, send)
+}
+
+// Same as handleConn, the connection belonging to a given proxy.
+func handleProxyConn(t *testing.T, p *Proxy, conf *config.Config, send func(net.Conn)) error {
+	return handleListenerConn(t, p, nil, conf, send)
+}
+
+// Same as handleProxyConn, the connection being accepted on a given listener.
+func handleListenerConn(t *testing.T, p *Proxy, listener *config.Listener, conf *config.Config,
+			send func(net.Conn)) error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sent := make(chan struct{})
+	go func() {
+		send(client)
+		close(sent)
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &Conn{
+		TCPConn: c.(*net.TCPConn),
+		Config: conf,
+		Listener: listener,
+		proxy: p,
+		span: noopSpan{},
+		accepted: time.Now(),
+	}
+
+	// Let the client see the connection being closed before closing its
+	// side.
+	err = conn.handle(context.Background())
+	conn.Close()
+	<-sent
+	return err
+}
+
+func TestHandleErrors(t *testing.T) {
+	domains := []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) }
+	unreachable := []*config.Backend{{ Address: "127.0.0.1:1", Weight: 1 }}
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: domains, Backends: unreachable },
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^denied\.example\.net$`) },
+			  Backends: unreachable, Deny: cidrs("127.0.0.0/8") },
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^empty\.example\.net$`) } },
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^maintenance\.example\.net$`) },
+			  Backends: unreachable, Maintenance: true },
+		},
+		HandshakeTimeout: 500*time.Millisecond,
+	}
+
+	clientHello := func(sni string) func(net.Conn) {
+		return func(c net.Conn) {
+			tls.Client(c, &tls.Config{ ServerName: sni, InsecureSkipVerify: true }).Handshake()
+		}
+	}
+
+	tests := []struct {
+		desc string
+		send func(net.Conn)
+		err  error
+	}{
+		{ "No data", func(c net.Conn) { c.Close() }, ErrNoData },
+		{ "HTTP request", func(c net.Conn) { c.Write([]byte("GET / HTTP/1.1\r\n\r\n")) }, ErrNotTLS },
+		{ "Truncated handshake", func(c net.Conn) { c.Write([]byte{ 22, 3, 1 }) }, ErrHandshakeTimeout },
+		{ "Invalid handshake", func(c net.Conn) { c.Write([]byte{ 22, 4, 1, 0, 0 }) }, ErrBadHandshake },
+		{ "No SNI", clientHello(""), ErrNoSNI },
+		{ "Unknown SNI", clientHello("example.org"), ErrNoRoute },
+		{ "Denied client", clientHello("denied.example.net"), ErrDenied },
+		{ "No backend", clientHello("empty.example.net"), ErrNoBackend },
+		{ "Route in maintenance", clientHello("maintenance.example.net"), ErrMaintenance },
+		{ "Unreachable backend", clientHello("example.net"), ErrBackendDial },
+	}
+
+	for _, test := range(tests) {
+		err := handleConn(t, conf, test.send)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error '%v', wanted '%s'", test.desc, err, test.err)
+		}
+		var dispatchErr *DispatchError
+		if !errors.As(err, &dispatchErr) {
+			t.Errorf("%s: not a DispatchError (%T)", test.desc, err)
+		}
+	}
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	tests := []struct {
+		desc      string
+		firstByte time.Duration
+		handshake time.Duration
+		trusted   bool
+		want      time.Duration
+	}{
+		{ "First byte timeout", 200*time.Millisecond, 2*time.Second, false, 200*time.Millisecond },
+		{ "Capped to the handshake timeout", 2*time.Second, 300*time.Millisecond, false, 300*time.Millisecond },
+		{ "Trusted listener", 200*time.Millisecond, 600*time.Millisecond, true, 600*time.Millisecond },
+	}
+
+	for _, test := range(tests) {
+		conf := &config.Config{ FirstByteTimeout: test.firstByte, HandshakeTimeout: test.handshake }
+		listener := &config.Listener{ Trusted: test.trusted }
+
+		// The client sends nothing, and gets the connection closed
+		// without any alert once the timeout expires.
+		var n int64
+		var elapsed time.Duration
+		err := handleListenerConn(t, &Proxy{}, listener, conf, func(c net.Conn) {
+			start := time.Now()
+			n, _ = io.Copy(io.Discard, c)
+			elapsed = time.Since(start)
+		})
+		if !errors.Is(err, ErrNoData) {
+			t.Errorf("%s: got error '%v', wanted '%s'", test.desc, err, ErrNoData)
+		}
+		if n != 0 {
+			t.Errorf("%s: %d bytes written back", test.desc, n)
+		}
+		if elapsed < test.want - 50*time.Millisecond || elapsed > test.want + 500*time.Millisecond {
+			t.Errorf("%s: connection closed after %s, wanted %s", test.desc, elapsed, test.want)
+		}
+	}
+}
+
+func TestCheckHello(t *testing.T) {
+	modern := &handshake.ClientHello{
+		ServerName:   "example.net",
+		CipherSuites: []uint16{ 0x1301, 0xc02f },
+		Extensions:   []handshake.Extension{{ Type: handshake.ExtSupportedVersions }},
+	}
+	forged := &handshake.ClientHello{ ServerName: "example.net", CipherSuites: []uint16{ 0x1302 } }
+	legacy := &handshake.ClientHello{ ServerName: "example.net", CipherSuites: []uint16{ 0xc02f } }
+
+	tests := []struct {
+		desc    string
+		conf    *config.Config
+		hello   *handshake.ClientHello
+		size    int
+		err     error
+	}{
+		{ "No check", &config.Config{}, forged, 50, nil },
+		{ "Above minimum size", &config.Config{ HelloMinSize: 128 }, modern, 128, nil },
+		{ "Below minimum size", &config.Config{ HelloMinSize: 128 }, modern, 127, ErrSuspiciousHello },
+		{ "TLS 1.3 client", &config.Config{ HelloCheckVersions: true }, modern, 300, nil },
+		{ "Legacy client", &config.Config{ HelloCheckVersions: true }, legacy, 300, nil },
+		{ "Missing supported_versions", &config.Config{ HelloCheckVersions: true }, forged, 300, ErrSuspiciousHello },
+	}
+
+	for _, test := range(tests) {
+		conn := &Conn{ Config: test.conf, Hello: test.hello, rawHello: make([]byte, test.size) }
+		if err := conn.checkHello(); !errors.Is(err, test.err) {
+			t.Errorf("%s: got error '%v', wanted '%v'", test.desc, err, test.err)
+		}
+	}
+}
+
+func TestRejectReset(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, test := range []struct {
+		action int
+		err    string
+	}{
+		{ config.Alerts["access_denied"], "access denied" },
+		{ config.ActionReset, "connection reset" },
+	} {
+		conf := &config.Config{
+			Routes: []*config.Route{
+				{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+				  Backends: []*config.Backend{{ Address: "127.0.0.1:1", Weight: 1 }},
+				  Deny: cidrs("127.0.0.0/8"), DenyAction: test.action },
+			},
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make(chan error, 1)
+		go func() {
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				res <- err
+				return
+			}
+			defer c.Close()
+			res <- tls.Client(c, &tls.Config{ ServerName: "example.net", InsecureSkipVerify: true }).Handshake()
+		}()
+
+		c, err := l.Accept()
+		l.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := &Conn{ TCPConn: c.(*net.TCPConn), Config: conf, proxy: &Proxy{}, accepted: time.Now() }
+		conn.dispatch(context.Background())
+
+		if err := <-res; !strings.Contains(fmt.Sprint(err), test.err) {
+			t.Errorf("action %d: got client error '%v', wanted %q", test.action, err, test.err)
+		}
+	}
+}
+
+// Dispatches a TLS client connection, returning the error of its handshake.
+func dispatchTLSClient(t *testing.T, conf *config.Config) error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(chan error, 1)
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			res <- err
+			return
+		}
+		defer c.Close()
+		res <- tls.Client(c, &tls.Config{ ServerName: "example.net", InsecureSkipVerify: true }).Handshake()
+	}()
+
+	c, err := l.Accept()
+	l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &Conn{ TCPConn: c.(*net.TCPConn), Config: conf, proxy: &Proxy{}, span: noopSpan{}, accepted: time.Now() }
+	conn.dispatch(context.Background())
+	conn.Close()
+	return <-res
+}
+
+func TestRouteDefaultActions(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Routes built from Go, leaving their actions unset.
+	denied := func() *config.Route {
+		return &config.Route{ Deny: cidrs("127.0.0.0/8") }
+	}
+	maintenance := func() *config.Route {
+		return &config.Route{ Maintenance: true }
+	}
+	limited := func() *config.Route {
+		return &config.Route{ RateLimit: &config.RateLimiter{ Rate: 1, Burst: 0 } }
+	}
+	for _, test := range []struct {
+		desc    string
+		route   *config.Route
+		actions map[string]int
+		err     string
+	}{
+		{ "denied", denied(), nil, "access denied" },
+		{ "denied, global action", denied(), map[string]int{ "denied": config.Alerts["handshake_failure"] },
+		  "handshake failure" },
+		{ "denied, route action", &config.Route{ Deny: cidrs("127.0.0.0/8"), DenyAction: config.ActionReset },
+		  map[string]int{ "denied": config.Alerts["handshake_failure"] }, "connection reset" },
+		{ "maintenance", maintenance(), nil, "internal error" },
+		{ "maintenance, global action", maintenance(), map[string]int{ "maintenance": config.ActionClose }, "EOF" },
+		{ "rate-limited", limited(), nil, "internal error" },
+		{ "rate-limited, global action", limited(), map[string]int{ "rate-limited": config.Alerts["user_canceled"] },
+		  "user canceled" },
+	} {
+		test.route.Domains = []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) }
+		test.route.Backends = []*config.Backend{{ Address: "127.0.0.1:1", Weight: 1 }}
+		conf := &config.Config{ Routes: []*config.Route{ test.route }, RejectActions: test.actions }
+
+		if err := dispatchTLSClient(t, conf); !strings.Contains(fmt.Sprint(err), test.err) {
+			t.Errorf("%s: got client error '%v', wanted %q", test.desc, err, test.err)
+		}
+	}
+}
+
+// Dispatches a connection sending raw data, and returns the bytes written back
+// to the client until the connection is closed.
+func dispatchRaw(t *testing.T, conf *config.Config, data []byte) []byte {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(chan []byte, 1)
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			res <- nil
+			return
+		}
+		defer c.Close()
+		c.Write(data)
+		b, _ := io.ReadAll(c)
+		res <- b
+	}()
+
+	c, err := l.Accept()
+	l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &Conn{ TCPConn: c.(*net.TCPConn), Config: conf, proxy: &Proxy{}, span: noopSpan{}, accepted: time.Now() }
+	conn.dispatch(context.Background())
+	return <-res
+}
+
+func TestNoMatchAction(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		action string
+		sni    string
+		alert  int
+	}{
+		{ "", "example.org", config.Alerts["unrecognized_name"] },
+		{ "", "", config.Alerts["unrecognized_name"] },
+		{ "close", "example.org", -1 },
+		{ "close", "", -1 },
+		{ "internal_error", "example.org", 80 },
+		{ "internal_error", "", 80 },
+	}
+
+	for _, test := range(tests) {
+		directive := ""
+		if test.action != "" {
+			directive = "no-match-action " + test.action + "\n"
+		}
+		var conf config.Config
+		if err := conf.Parse([]byte(directive + "example.net {\n\tbackend 127.0.0.1:1\n}\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		// A closing connection gets no byte back, the others a single
+		// fatal alert record.
+		got := dispatchRaw(t, &conf, rawClientHello(t, test.sni))
+		if test.alert < 0 {
+			if len(got) != 0 {
+				t.Errorf("%q, SNI %q: got %v, wanted no alert", test.action, test.sni, got)
+			}
+			continue
+		}
+		if len(got) != 7 || got[0] != 21 || got[5] != 2 || int(got[6]) != test.alert {
+			t.Errorf("%q, SNI %q: got %v, wanted alert %d", test.action, test.sni, got, test.alert)
+		}
+	}
+}
+
+func TestMaxHandshakes(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			  Backends: []*config.Backend{{ Address: "127.0.0.1:1", Weight: 1 }} },
+		},
+		MaxHandshakes: 8,
+		HandshakeTimeout: 5*time.Second,
+	}
+	p := &Proxy{}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	defer wg.Wait()
+	defer l.Close()
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn := &Conn{ TCPConn: c.(*net.TCPConn), Config: conf, proxy: p, accepted: time.Now() }
+				conn.dispatch(context.Background())
+			}()
+		}
+	}()
+
+	// Slow clients, sending the start of their handshake and stalling.
+	// Half of them are reset right away, possibly before their dial
+	// returns.
+	var slow []net.Conn
+	defer func() {
+		for _, c := range slow {
+			c.Close()
+		}
+	}()
+	var reset int
+	for i := 0; i < 16; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if errors.Is(err, syscall.ECONNRESET) {
+			reset++
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte{ 22, 3, 1 })
+		slow = append(slow, c)
+	}
+	results := make(chan error, len(slow))
+	for _, c := range slow {
+		go func(c net.Conn) {
+			c.SetReadDeadline(time.Now().Add(500*time.Millisecond))
+			_, err := c.Read(make([]byte, 1))
+			results <- err
+		}(c)
+	}
+	for range slow {
+		if err := <-results; errors.Is(err, syscall.ECONNRESET) {
+			reset++
+		}
+	}
+	if reset != 8 || p.handshakes.shed.Load() != 8 || p.handshakes.inFlight.Load() != 8 {
+		t.Errorf("got %d connections reset, %d shed and %d in flight, wanted 8", reset,
+			 p.handshakes.shed.Load(), p.handshakes.inFlight.Load())
+	}
+
+	// Handshakes are accepted again once the slow clients are gone.
+	for _, c := range slow {
+		c.Close()
+	}
+	slow = nil
+	for i := 0; i < 50 && p.handshakes.inFlight.Load() > 0; i++ {
+		time.Sleep(10*time.Millisecond)
+	}
+	if n := p.handshakes.inFlight.Load(); n != 0 {
+		t.Errorf("%d handshakes still in flight", n)
+	}
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := tls.Client(c, &tls.Config{ ServerName: "example.net", InsecureSkipVerify: true }).Handshake();
+	   !strings.Contains(fmt.Sprint(err), "internal error") {
+		t.Errorf("got client error '%v', wanted the backend dial alert", err)
+	}
+	if n := p.handshakes.shed.Load(); n != 8 {
+		t.Errorf("got %d connections shed, wanted 8", n)
+	}
+}
+
+func TestNonTLSListener(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// HTTP server redirecting to HTTPS, recording the request it got.
+	web, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer web.Close()
+	requests := make(chan string, 1)
+	go func() {
+		c, err := web.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		req, _ := bufio.NewReader(c).ReadString('\n')
+		requests <- req
+		c.Write([]byte("HTTP/1.1 301 Moved Permanently\r\n\r\n"))
+	}()
+
+	for _, test := range []struct {
+		listener *config.Listener
+		reply    string
+		err      string
+	}{
+		{ &config.Listener{}, "\x15\x03\x00\x00\x02\x02\x50", "" },
+		{ &config.Listener{ NonTLS: config.NonTLSClose }, "", "" },
+		{ &config.Listener{ NonTLS: config.NonTLSReset }, "", "connection reset" },
+		{ &config.Listener{ NonTLS: config.NonTLSForward, NonTLSBackend: web.Addr().String() },
+		  "HTTP/1.1 301 Moved Permanently\r\n\r\n", "<nil>" },
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		type result struct {
+			reply string
+			err   error
+		}
+		res := make(chan result, 1)
+		go func() {
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				res <- result{ err: err }
+				return
+			}
+			defer c.Close()
+			c.Write([]byte("GET / HTTP/1.1\r\nHost: example.net\r\n\r\n"))
+			reply, err := io.ReadAll(c)
+			res <- result{ string(reply), err }
+		}()
+
+		c, err := l.Accept()
+		l.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := &Conn{ TCPConn: c.(*net.TCPConn), Config: &config.Config{}, Listener: test.listener,
+			       proxy: &Proxy{}, accepted: time.Now() }
+		start := time.Now()
+		conn.dispatch(context.Background())
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("mode %d: connection handled in %s", test.listener.NonTLS, elapsed)
+		}
+
+		r := <-res
+		if r.reply != test.reply {
+			t.Errorf("mode %d: got reply %q, wanted %q", test.listener.NonTLS, r.reply, test.reply)
+		}
+		// Closing with unread data can also reset the connection.
+		if !strings.Contains(fmt.Sprint(r.err), test.err) {
+			t.Errorf("mode %d: got error '%v', wanted %q", test.listener.NonTLS, r.err, test.err)
+		}
+	}
+
+	if req := <-requests; req != "GET / HTTP/1.1\r\n" {
+		t.Errorf("non-TLS backend got request %q", req)
+	}
+}
+
+func TestReplayRetries(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, test := range []struct {
+		retries  int
+		dials    int
+		answered bool
+	}{
+		{ 0, 1, false },
+		{ 1, 2, false },
+		{ 3, 3, true },
+	} {
+		conf := &config.Config{
+			Routes: []*config.Route{
+				{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+				  Backends: []*config.Backend{{ Address: "backend.invalid:443", Weight: 1 }},
+				  ReplayRetries: test.retries },
+			},
+		}
+
+		// The first two backend connections are closed right away.
+		var dials atomic.Int32
+		d := &fakeDialer{ backend: func(c net.Conn) {
+			defer c.Close()
+			if dials.Add(1) <= 2 {
+				return
+			}
+			c.Read(make([]byte, 4096))
+			c.Write([]byte("answer"))
+		}}
+		replies := make(chan string, 1)
+		send := func(c net.Conn) {
+			c.Write(rawClientHello(t, "example.net"))
+			reply, _ := io.ReadAll(c)
+			replies <- string(reply)
+		}
+		handleProxyConn(t, &Proxy{ Dialer: d }, conf, send)
+
+		if len(d.dialed) != test.dials {
+			t.Errorf("%d retries: got %d dials, wanted %d", test.retries, len(d.dialed), test.dials)
+		}
+		if reply := <-replies; (reply == "answer") != test.answered {
+			t.Errorf("%d retries: client got %q", test.retries, reply)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	p := &Proxy{}
+	if p.config() != &p.Config {
+		t.Error("initial configuration not used")
+	}
+
+	route := &config.Route{ Name: "new" }
+	if err := p.Reload(config.Config{ Routes: []*config.Route{ route } }); err != nil {
+		t.Fatal(err)
+	}
+	c := p.config()
+	if c == &p.Config || len(c.Routes) != 1 || c.Routes[0] != route {
+		t.Error("reloaded configuration not used")
+	}
+
+	// Invalid configurations are not used.
+	invalid := config.Config{ Routes: []*config.Route{{ CongestionControl: "unknown" }} }
+	if err := p.Reload(invalid); err == nil {
+		t.Error("invalid configuration reloaded")
+	}
+	if p.config() != c {
+		t.Error("invalid configuration used")
+	}
+}
+
+// Dialer returning one side of a pipe, or an error, and recording the
+// addresses dialed.
+type fakeDialer struct {
+	backend func(net.Conn)
+	err     error
+	dialed  []string
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dialed = append(d.dialed, network + "/" + address)
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	client, backend := net.Pipe()
+	go d.backend(backend)
+	return client, nil
+}
+
+func TestHandleDialer(t *testing.T) {
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			  Backends: []*config.Backend{{ Address: "backend.invalid:443", Weight: 1 }},
+			  Network: "tcp4" },
+		},
+		HandshakeTimeout: 500*time.Millisecond,
+	}
+	send := func(c net.Conn) {
+		tls.Client(c, &tls.Config{ ServerName: "example.net", InsecureSkipVerify: true }).Handshake()
+	}
+
+	// The handshake is replayed to the backend.
+	received := make(chan []byte, 1)
+	d := &fakeDialer{ backend: func(c net.Conn) {
+		defer c.Close()
+		b := make([]byte, 4096)
+		n, _ := c.Read(b)
+		received <- b[:n]
+	}}
+	if err := handleProxyConn(t, &Proxy{ Dialer: d }, conf, send); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.dialed) != 1 || d.dialed[0] != "tcp4/backend.invalid:443" {
+		t.Errorf("wrong dialed addresses %v", d.dialed)
+	}
+	if b := <-received; len(b) == 0 || b[0] != 22 || !bytes.Contains(b, []byte("example.net")) {
+		t.Errorf("backend did not receive the handshake (%q)", b)
+	}
+
+	// Dial failures are reported.
+	d = &fakeDialer{ err: errors.New("connection refused") }
+	if err := handleProxyConn(t, &Proxy{ Dialer: d }, conf, send); !errors.Is(err, ErrBackendDial) {
+		t.Errorf("got error '%v', wanted '%s'", err, ErrBackendDial)
+	}
+}
+
+// Dialer blocking until the dial context is done.
+type blockingDialer struct{}
+
+func (blockingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSetupBudget(t *testing.T) {
+	newRoute := func() *config.Route {
+		return &config.Route{
+			Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			Backends: []*config.Backend{{ Address: "backend.invalid:443", Weight: 1 }},
+			SetupTimeout: 200*time.Millisecond,
+		}
+	}
+	send := func(c net.Conn) {
+		c.Write(rawClientHello(t, "example.net"))
+		io.Copy(io.Discard, c)
+	}
+
+	// Backend at capacity, the connection waiting in the queue.
+	queued := newRoute()
+	queued.MaxConns, queued.QueueDepth, queued.QueueWait = 1, 1, 5*time.Second
+	if _, err := queued.AcquireSlot(context.Background(), queued.Backends[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		phase  string
+		route  *config.Route
+		dialer Dialer
+	}{
+		{ "queue", queued, &fakeDialer{ backend: func(c net.Conn) { c.Close() } } },
+		{ "dial", newRoute(), blockingDialer{} },
+		// The backend never reads the handshake replayed.
+		{ "handshake replay", newRoute(), &fakeDialer{ backend: func(c net.Conn) {} } },
+	}
+
+	for _, test := range tests {
+		conf := &config.Config{
+			Routes: []*config.Route{ test.route },
+			HandshakeTimeout: 5*time.Second,
+		}
+		start := time.Now()
+		err := handleProxyConn(t, &Proxy{ Dialer: test.dialer }, conf, send)
+		if !errors.Is(err, ErrSetupTimeout) || !strings.Contains(err.Error(), "during " + test.phase) {
+			t.Errorf("%s: got error '%v', wanted the setup budget exceeded", test.phase, err)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: connection aborted after %s", test.phase, d)
+		}
+	}
+}
+
+func TestHandleBackendLookup(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("sni") {
+		case "a.example.net":
+			w.Write([]byte("10.0.0.1:443"))
+			break
+		case "broken.example.net":
+			http.Error(w, "broken", http.StatusInternalServerError)
+			break
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^[^.]*\.example\.net$`) },
+			  Backends: []*config.Backend{{ Address: "fallback.invalid:443", Weight: 1 }},
+			  Lookup: srv.URL, LookupTTL: time.Minute },
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^[^.]*\.example\.org$`) },
+			  Lookup: srv.URL, LookupTTL: time.Minute },
+		},
+	}
+
+	tests := []struct {
+		sni    string
+		dialed string
+		err    error
+	}{
+		{ "a.example.net", "tcp/10.0.0.1:443", nil },
+		// Names without a backend, and lookup failures, use the route
+		// backends.
+		{ "b.example.net", "tcp/fallback.invalid:443", nil },
+		{ "broken.example.net", "tcp/fallback.invalid:443", nil },
+		{ "b.example.org", "", ErrNoBackend },
+	}
+	for _, test := range(tests) {
+		d := &fakeDialer{ backend: func(c net.Conn) {
+			defer c.Close()
+			c.Read(make([]byte, 4096))
+			c.Write([]byte("reply"))
+		}}
+		send := func(c net.Conn) {
+			c.Write(rawClientHello(t, test.sni))
+			io.ReadAll(c)
+		}
+		err := handleProxyConn(t, &Proxy{ Dialer: d }, conf, send)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error '%v', wanted '%v'", test.sni, err, test.err)
+		}
+		if test.dialed == "" {
+			if len(d.dialed) != 0 {
+				t.Errorf("%s: dialed %v", test.sni, d.dialed)
+			}
+		} else if len(d.dialed) != 1 || d.dialed[0] != test.dialed {
+			t.Errorf("%s: dialed %v, wanted %s", test.sni, d.dialed, test.dialed)
+		}
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	cert := srv.TLS.Certificates[0]
+	srv.Close()
+
+	// Only secure.example.net is terminated, example.net being passed
+	// through.
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^(secure\.)?example\.net$`) },
+			  Backends: []*config.Backend{{ Address: "backend.invalid:80", Weight: 1 }},
+			  Terminate: &config.Termination{
+				Certificate: cert,
+				Domains: []*regexp.Regexp{ regexp.MustCompile(`^secure\.example\.net$`) },
+			  } },
+		},
+		HandshakeTimeout: 500*time.Millisecond,
+	}
+
+	tests := []struct{
+		sni        string
+		terminated bool
+	}{
+		{ "secure.example.net", true },
+		{ "example.net", false },
+	}
+	for _, tt := range(tests) {
+		received := make(chan []byte, 1)
+		d := &fakeDialer{ backend: func(c net.Conn) {
+			defer c.Close()
+			b := make([]byte, 4096)
+			n, _ := c.Read(b)
+			received <- b[:n]
+			c.Write([]byte("pong"))
+		}}
+
+		var reply []byte
+		send := func(c net.Conn) {
+			tc := tls.Client(c, &tls.Config{ ServerName: tt.sni, InsecureSkipVerify: true })
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			tc.Write([]byte("ping"))
+			reply, _ = io.ReadAll(tc)
+		}
+		if err := handleProxyConn(t, &Proxy{ Dialer: d }, conf, send); err != nil {
+			t.Fatalf("%s: %s", tt.sni, err)
+		}
+
+		b := <-received
+		if tt.terminated {
+			if string(b) != "ping" || string(reply) != "pong" {
+				t.Errorf("%s: plaintext not forwarded (sent %q, received %q)", tt.sni, b, reply)
+			}
+		} else if len(b) == 0 || b[0] != 22 || !bytes.Contains(b, []byte(tt.sni)) {
+			t.Errorf("%s: backend did not receive the handshake (%q)", tt.sni, b)
+		}
+	}
+}
+
+func TestSkipFraming(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: domains(`example\.net`),
+			  Backends: []*config.Backend{{ Address: "backend.invalid:443", Weight: 1 }} },
+		},
+	}
+	hello := rawClientHello(t, "example.net")
+
+	// Fixtures: the framing sent before the handshake, and the data the
+	// backend receives before it.
+	tests := []struct {
+		desc      string
+		listener  *config.Listener
+		framing   string
+		forwarded string
+		err       error
+	}{
+		{ "Fixed length, dropped", &config.Listener{ SkipBytes: 4 }, "\x00\x00\x02\x05", "", nil },
+		{ "Fixed length, forwarded", &config.Listener{ SkipBytes: 4, SkipForward: true },
+		  "\x00\x00\x02\x05", "\x00\x00\x02\x05", nil },
+		{ "Delimiter, dropped", &config.Listener{ SkipUntil: []byte("\r\n") }, "tenant=42\r\n", "", nil },
+		{ "Delimiter, forwarded", &config.Listener{ SkipUntil: []byte("\r\n"), SkipForward: true },
+		  "tenant=42\r\n", "tenant=42\r\n", nil },
+		{ "Delimiter only", &config.Listener{ SkipUntil: []byte("\n") }, "\n", "", nil },
+		{ "Delimiter missing", &config.Listener{ SkipUntil: []byte("\r\n") },
+		  strings.Repeat("x", config.MaxSkip), "", ErrBadHandshake },
+		{ "Too short", &config.Listener{ SkipBytes: 4096 }, "\x00\x00", "", ErrNoData },
+	}
+	for _, test := range(tests) {
+		received := make(chan []byte, 1)
+		d := &fakeDialer{ backend: func(c net.Conn) {
+			defer c.Close()
+			var data []byte
+			b := make([]byte, 4096)
+			for !bytes.Contains(data, []byte("example.net")) {
+				n, err := c.Read(b)
+				if err != nil {
+					break
+				}
+				data = append(data, b[:n]...)
+			}
+			received <- data
+			c.Write([]byte{ 22, 3, 3, 0, 0 })
+		}}
+		send := func(c net.Conn) {
+			c.Write([]byte(test.framing))
+			if test.err != ErrNoData {
+				c.Write(hello)
+			} else {
+				c.(*net.TCPConn).CloseWrite()
+			}
+			io.ReadAll(c)
+		}
+		err := handleListenerConn(t, &Proxy{ Dialer: d }, test.listener, conf, send)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error '%v', wanted '%v'", test.desc, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if data := <-received; !bytes.Equal(data, append([]byte(test.forwarded), hello...)) {
+			t.Errorf("%s: backend received %q", test.desc, data)
+		}
+	}
+}
+
+func TestRouteHandshakeTimeout(t *testing.T) {
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^slow\.example\.net$`) },
+			  Backends: []*config.Backend{{ Address: "backend.invalid:443", Weight: 1 }},
+			  HandshakeTimeout: 3*time.Second },
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^fast\.example\.net$`) },
+			  Backends: []*config.Backend{{ Address: "backend.invalid:443", Weight: 1 }} },
+		},
+		HandshakeTimeout: 300*time.Millisecond,
+	}
+
+	// Slow-drip ClientHello: the first bytes, up to the SNI (and a given
+	// number of bytes more), are sent right away and the rest after the
+	// global handshake timeout.
+	drip := func(sni string, extra int) func(net.Conn) {
+		hello := rawClientHello(t, sni)
+		split := 0
+		for ; split < len(hello); split++ {
+			if _, ok := handshake.PeekServerName(hello[:split]); ok {
+				break
+			}
+		}
+		split += extra
+		return func(c net.Conn) {
+			c.Write(hello[:split])
+			time.Sleep(600*time.Millisecond)
+			c.Write(hello[split:])
+		}
+	}
+
+	tests := []struct {
+		desc string
+		send func(net.Conn)
+		err  error
+	}{
+		{ "Extended timeout", drip("slow.example.net", 0), ErrBackendDial },
+		{ "Extended timeout, later chunk", drip("slow.example.net", 1), ErrBackendDial },
+		{ "SNI not received in time", drip("slow.example.net", -1), ErrHandshakeTimeout },
+		{ "Global timeout", drip("fast.example.net", 0), ErrHandshakeTimeout },
+	}
+
+	for _, test := range(tests) {
+		d := &fakeDialer{ err: errors.New("connection refused") }
+		if err := handleProxyConn(t, &Proxy{ Dialer: d }, conf, test.send); !errors.Is(err, test.err) {
+			t.Errorf("%s: got error '%v', wanted '%s'", test.desc, err, test.err)
+		}
+	}
+}
+
+// Dialer connecting to in-memory backends after a given delay, ignoring the
+// dial cancellation.
+type raceDialer struct {
+	delays  map[string]time.Duration
+	mu      sync.Mutex
+	served  []string
+	closed  chan string
+}
+
+func (d *raceDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	delay, ok := d.delays[address]
+	if !ok {
+		return nil, errors.New("connection refused")
+	}
+	time.Sleep(delay)
+
+	client, backend := net.Pipe()
+	go func() {
+		defer backend.Close()
+		b := make([]byte, 4096)
+		if n, _ := backend.Read(b); n > 0 {
+			d.mu.Lock()
+			d.served = append(d.served, address)
+			d.mu.Unlock()
+			return
+		}
+		d.closed <- address
+	}()
+	return client, nil
+}
+
+func TestDialRace(t *testing.T) {
+	backends := []*config.Backend{
+		{ Address: "slow.invalid:443", Weight: 1 },
+		{ Address: "down.invalid:443", Weight: 1 },
+		{ Address: "fast.invalid:443", Weight: 1 },
+		{ Address: "unused.invalid:443", Weight: 1 },
+	}
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			  Backends: backends, DialRace: 3 },
+		},
+		HandshakeTimeout: 500*time.Millisecond,
+	}
+	send := func(c net.Conn) {
+		tls.Client(c, &tls.Config{ ServerName: "example.net", InsecureSkipVerify: true }).Handshake()
+	}
+
+	d := &raceDialer{
+		delays: map[string]time.Duration{
+			"slow.invalid:443": 200*time.Millisecond,
+			"fast.invalid:443": 0,
+			"unused.invalid:443": 0,
+		},
+		closed: make(chan string, 4),
+	}
+	if err := handleProxyConn(t, &Proxy{ Dialer: d }, conf, send); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fastest of the first three backends is used, the connection to
+	// the slow one being closed once established.
+	select {
+	case addr := <-d.closed:
+		if addr != "slow.invalid:443" {
+			t.Errorf("connection to %s closed, wanted slow.invalid:443", addr)
+		}
+	case <-time.After(2*time.Second):
+		t.Error("connection to the losing backend not closed")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.served) != 1 || d.served[0] != "fast.invalid:443" {
+		t.Errorf("handshake replayed to %v, wanted [fast.invalid:443]", d.served)
+	}
+}
+
+func TestReplayTimeout(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	route := &config.Route{
+		Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+		Backends: []*config.Backend{{ Address: "a.invalid:443", Weight: 1 },
+					    { Address: "b.invalid:443", Weight: 1 }},
+		ReplayTimeout: 100*time.Millisecond,
+	}
+	conf := &config.Config{ Routes: []*config.Route{ route }, HandshakeTimeout: 500*time.Millisecond }
+	send := func(c net.Conn) {
+		tls.Client(c, &tls.Config{ ServerName: "example.net", InsecureSkipVerify: true }).Handshake()
+	}
+
+	// Backends accepting the connections but never reading (as net.Pipe
+	// has no buffer, writes block until read), except the ones after the
+	// given number of dials which read the handshake and answer.
+	stalling := func(stalls int32) *fakeDialer {
+		var dials atomic.Int32
+		stop := make(chan struct{})
+		t.Cleanup(func() { close(stop) })
+		return &fakeDialer{ backend: func(c net.Conn) {
+			defer c.Close()
+			if dials.Add(1) <= stalls {
+				<-stop
+				return
+			}
+			c.Read(make([]byte, 4096))
+			c.Write([]byte{ 21, 3, 3, 0, 2, 2, 80 })
+		}}
+	}
+
+	start := time.Now()
+	if err := handleProxyConn(t, &Proxy{ Dialer: stalling(2) }, conf, send); !errors.Is(err, ErrReplay) {
+		t.Errorf("got error '%v', wanted '%s'", err, ErrReplay)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("stalled backend detected after %s", d)
+	}
+
+	// The handshake is replayed to another backend when retries are
+	// enabled.
+	route.ReplayRetries = 1
+	d := stalling(1)
+	if err := handleProxyConn(t, &Proxy{ Dialer: d }, conf, send); err != nil {
+		t.Errorf("got error '%v' with retries", err)
+	}
+	if len(d.dialed) != 2 {
+		t.Errorf("dialed %v, wanted two backends", d.dialed)
+	}
+}
+
+func TestResetAlert(t *testing.T) {
+	// Backend resetting the connections once the handshake is received.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			c.Read(make([]byte, 4096))
+			c.(*net.TCPConn).SetLinger(0)
+			c.Close()
+		}
+	}()
+
+	for _, alert := range []bool{ true, false } {
+		conf := &config.Config{
+			Routes: []*config.Route{
+				{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+				  Backends: []*config.Backend{{ Address: backend.Addr().String(), Weight: 1 }},
+				  ResetAlert: alert },
+			},
+		}
+
+		res := make(chan error, 1)
+		err := handleConn(t, conf, func(c net.Conn) {
+			res <- tls.Client(c, &tls.Config{ ServerName: "example.net", InsecureSkipVerify: true }).Handshake()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-res; strings.Contains(fmt.Sprint(err), "internal error") != alert {
+			t.Errorf("reset-alert %t: got client error '%v'", alert, err)
+		}
+	}
+}
+
+// Returns the ClientHello record sent by a Go TLS client for a given SNI.
+func rawClientHello(t *testing.T, sni string) []byte {
+	return rawClientHelloConfig(t, &tls.Config{ ServerName: sni, InsecureSkipVerify: true })
+}
+
+func rawClientHelloConfig(t *testing.T, config *tls.Config) []byte {
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		tls.Client(c, config).Handshake()
+		c.Close()
+	}()
+
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(s, hdr); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5 + (int(hdr[3]) << 8 | int(hdr[4])))
+	copy(record, hdr)
+	if _, err := io.ReadFull(s, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestHalfOpenBackend(t *testing.T) {
+	// Backend never closing its side of the connections.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := make(chan net.Conn, 1)
+	defer func() {
+		backend.Close()
+		if c := <-held; c != nil {
+			c.Close()
+		}
+	}()
+	go func() {
+		c, _ := backend.Accept()
+		held <- c
+	}()
+
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			  Backends: []*config.Backend{{ Address: backend.Addr().String(), Weight: 1 }},
+			  CloseGrace: 100*time.Millisecond },
+		},
+	}
+
+	hello := rawClientHello(t, "example.net")
+	baseline := runtime.NumGoroutine()
+	start := time.Now()
+	err = handleConn(t, conf, func(c net.Conn) {
+		c.Write(hello)
+		c.(*net.TCPConn).CloseWrite()
+		io.Copy(io.Discard, c)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("connection closed after %s, wanted the grace period", elapsed)
+	}
+
+	// Both copies returned.
+	for i := 0; runtime.NumGoroutine() > baseline; i++ {
+		if i == 100 {
+			t.Fatalf("got %d goroutines, wanted %d", runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			  Backends: []*config.Backend{{ Address: "backend.invalid:443", Weight: 1 }},
+			  MaxLifetime: 200*time.Millisecond },
+		},
+	}
+
+	// The client keeps the connection active, dripping data to the backend.
+	d := &fakeDialer{ backend: func(c net.Conn) {
+		defer c.Close()
+		io.Copy(io.Discard, c)
+	}}
+	send := func(c net.Conn) {
+		c.Write(rawClientHello(t, "example.net"))
+		for {
+			if _, err := c.Write([]byte("data")); err != nil {
+				return
+			}
+			time.Sleep(10*time.Millisecond)
+		}
+	}
+
+	start := time.Now()
+	if err := handleProxyConn(t, &Proxy{ Dialer: d }, conf, send); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("connection closed after %s, wanted the max lifetime", elapsed)
+	}
+	if !strings.Contains(logs.String(), "Closed connection to backend.invalid:443: max lifetime exceeded (200ms)") {
+		t.Errorf("forced close not logged: %s", logs.String())
+	}
+}
+
+func TestTrustedListener(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			b, _ := io.ReadAll(c)
+			c.Close()
+			received <- b
+		}
+	}()
+
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			  Backends: []*config.Backend{{ Address: backend.Addr().String(), Weight: 1 }} },
+		},
+	}
+
+	// Data sent right after the handshake reaches the backend in order,
+	// whether the handshake is read using a buffer or not.
+	hello := rawClientHello(t, "example.net")
+	want := append(bytes.Clone(hello), "early data"...)
+	for _, trusted := range []bool{ false, true } {
+		listener := &config.Listener{ Trusted: trusted }
+		err := handleListenerConn(t, &Proxy{}, listener, conf, func(c net.Conn) {
+			c.Write(want)
+			c.(*net.TCPConn).CloseWrite()
+			io.Copy(io.Discard, c)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := <-received; !bytes.Equal(got, want) {
+			t.Errorf("trusted %t: backend received %d bytes, wanted %d", trusted, len(got), len(want))
+		}
+	}
+}
+
+func TestRoutingLog(t *testing.T) {
+	backend, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			c.Read(make([]byte, 4096))
+			c.Close()
+		}
+	}()
+
+	var access bytes.Buffer
+	accessLog = log.New(&access, "", 0)
+	defer func() { accessLog = log.Default() }()
+
+	port := backend.Addr().(*net.TCPAddr).Port
+	p := &Proxy{}
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Name: "web", Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			  Backends: []*config.Backend{{ Address: fmt.Sprintf("localhost:%d", port), Weight: 1 }},
+			  Network: "tcp4" },
+		},
+	}
+	err = handleProxyConn(t, p, conf, func(c net.Conn) {
+		tls.Client(c, &tls.Config{ ServerName: "example.net", InsecureSkipVerify: true }).Handshake()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The address dialed is logged and counted.
+	want := fmt.Sprintf("Routing example.net to localhost:%d (127.0.0.1:%d) [web]", port, port)
+	if !strings.Contains(access.String(), want) {
+		t.Errorf("missing '%s' in access logs:\n%s", want, access.String())
+	}
+	if stat := p.RouteStats()["web"]; stat.DialedIPv4 != 1 || stat.DialedIPv6 != 0 {
+		t.Errorf("wrong backend families %d / %d", stat.DialedIPv4, stat.DialedIPv6)
+	}
+}
+
+// Builds a configuration holding n routes, mixing exact names, wildcards and
+// regexps, as the configuration parser would.
+func benchConfig(b *testing.B, n int) *config.Config {
+	var text strings.Builder
+	for i := 0; i < n; i++ {
+		switch i % 3 {
+		case 0:
+			fmt.Fprintf(&text, "host%d.example.net {\n", i)
+		case 1:
+			fmt.Fprintf(&text, "tenant%d.example.com, *.tenant%d.example.com {\n", i, i)
+		case 2:
+			fmt.Fprintf(&text, "api[0-9]+.svc%d.example.org {\n", i)
+		}
+		fmt.Fprintf(&text, "\tbackend 10.0.%d.%d:443\n}\n", i / 256, i % 256)
+	}
+
+	file := filepath.Join(b.TempDir(), "sniproxy.conf")
+	if err := os.WriteFile(file, []byte(text.String()), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	conf := &config.Config{}
+	if err := conf.ReadFile(file); err != nil {
+		b.Fatal(err)
+	}
+	return conf
+}
+
+func BenchmarkMatch(b *testing.B) {
+	conn := &Conn{ Config: benchConfig(b, 1000) }
+
+	tests := []struct {
+		desc string
+		sni  string
+		hit  bool
+	}{
+		{ "first", "host0.example.net", true },
+		{ "wildcard", "www.tenant499.example.com", true },
+		{ "last", "api42.svc998.example.org", true },
+		{ "miss", "unknown.example.io", false },
+	}
+
+	for _, test := range(tests) {
+		b.Run(test.desc, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Match(test.sni); (err == nil) != test.hit {
+					b.Fatalf("unexpected match result for %s: %v", test.sni, err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkClientAllowed(b *testing.B) {
+	var deny, allow []string
+	for i := 0; i < 1000; i++ {
+		deny = append(deny, fmt.Sprintf("10.%d.%d.0/24", i / 256, i % 256))
+	}
+	for i := 0; i < 100; i++ {
+		allow = append(allow, fmt.Sprintf("172.%d.0.0/16", 16 + i % 16),
+			      fmt.Sprintf("2001:db8:%x::/48", i))
+	}
+	route := &config.Route{ Deny: cidrs(deny...), Allow: cidrs(allow...) }
+
+	tests := []struct {
+		desc string
+		ip   string
+	}{
+		{ "denied", "10.3.231.7" },
+		{ "allowed", "172.20.1.1" },
+		{ "ipv6", "2001:db8:63::1" },
+		{ "unlisted", "192.0.2.1" },
+	}
+
+	for _, test := range(tests) {
+		ip := net.ParseIP(test.ip)
+		b.Run(test.desc, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				clientAllowed(route, ip)
+			}
+		})
+	}
+}
+
+// Starts a proxy listening on a random local port, using a given number of
+// accept loops. Returns its address and a function stopping it, which
+// returns the proxy error.
+func startAcceptLoops(tb testing.TB, loops int) (string, func() error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p := &Proxy{ Config: config.Config{
+		Listeners: []*config.Listener{{ Bind: addr, AcceptLoops: loops }},
+		HandshakeTimeout: time.Second,
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.ListenAndServeContext(ctx, "")
+	}()
+
+	// Wait for the listener to be up.
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			break
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+
+	return addr, func() error {
+		cancel()
+		return <-errs
+	}
+}
+
+func TestAcceptLoops(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	addr, stop := startAcceptLoops(t, 4)
+	for i := 0; i < 20; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Connections are accepted, and rejected as no data is sent.
+		c.(*net.TCPConn).CloseWrite()
+		c.SetReadDeadline(time.Now().Add(3*time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("connection %d: got '%v', wanted EOF", i, err)
+		}
+		c.Close()
+	}
+
+	// All the loops stop with the proxy.
+	done := make(chan error)
+	go func() { done <- stop() }()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("got error '%v'", err)
+		}
+	case <-time.After(3*time.Second):
+		t.Error("proxy did not stop")
+	}
+}
+
+func BenchmarkAccept(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, loops := range []int{ 1, 4 } {
+		b.Run(fmt.Sprintf("loops=%d", loops), func(b *testing.B) {
+			addr, stop := startAcceptLoops(b, loops)
+			defer stop()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					c.Close()
+				}
+			})
+		})
+	}
+}
+
+func TestDeadPeer(t *testing.T) {
+	timedOut := func(op string) error {
+		return &net.OpError{ Op: op, Net: "tcp", Err: os.NewSyscallError(op, syscall.ETIMEDOUT) }
+	}
+	tests := []struct {
+		err        error
+		fromClient bool
+		dead       string
+	}{
+		{ timedOut("read"), true, "client" },
+		{ timedOut("write"), true, "backend" },
+		{ timedOut("read"), false, "backend" },
+		{ timedOut("write"), false, "client" },
+		{ &net.OpError{ Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded }, true, "" },
+		{ &net.OpError{ Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET) }, true, "" },
+		{ nil, true, "" },
+	}
+	for _, test := range(tests) {
+		if dead := deadPeer(test.err, test.fromClient); dead != test.dead {
+			t.Errorf("%v (from the client: %t): got %q, wanted %q", test.err, test.fromClient, dead, test.dead)
+		}
+	}
+}
+
+func TestRecordVersions(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			  Backends: []*config.Backend{{ Address: "backend.invalid:443", Weight: 1 }} },
+		},
+		RecordVersionWarn: 0x301,
+	}
+	d := &fakeDialer{ backend: func(c net.Conn) {
+		c.Read(make([]byte, 4096))
+		c.Close()
+	}}
+	p := &Proxy{ Config: *conf, Dialer: d }
+
+	// A regular handshake, in a TLS 1.0 record, and one sent by an SSL 3.0
+	// client, which is rejected but still reported.
+	hello := rawClientHello(t, "example.net")
+	if hello[1] != 3 || hello[2] != 1 {
+		t.Fatalf("unexpected record version %d.%d", hello[1], hello[2])
+	}
+	if err := handleProxyConn(t, p, conf, func(c net.Conn) { c.Write(hello); io.ReadAll(c) }); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logs.String(), "Unusual") {
+		t.Errorf("TLS 1.0 record reported as unusual: %s", logs.String())
+	}
+
+	ssl3 := bytes.Clone(hello)
+	ssl3[2] = 0
+	err := handleProxyConn(t, p, conf, func(c net.Conn) { c.Write(ssl3); io.ReadAll(c) })
+	if !errors.Is(err, ErrBadHandshake) {
+		t.Errorf("got error '%v', wanted '%s'", err, ErrBadHandshake)
+	}
+	if !strings.Contains(logs.String(), "Unusual TLS record version 0x0300 (ssl3.0)") {
+		t.Errorf("SSL 3.0 record not reported: %s", logs.String())
+	}
+
+	var buf bytes.Buffer
+	p.writeMetrics(&buf)
+	for _, want := range []string{
+		`sniproxy_record_versions_total{version="ssl3.0"} 1`,
+		`sniproxy_record_versions_total{version="tls1.0"} 1`,
+		`sniproxy_record_versions_total{version="tls1.2"} 0`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing metric %s in:\n%s", want, buf.String())
+		}
+	}
+
+	// Alerts use the record version of the client.
+	for _, test := range []struct {
+		version      uint16
+		major, minor byte
+	}{
+		{ 0x300, 3, 0 }, { 0x303, 3, 3 }, { 0, 3, 0 }, { 0x0a0a, 3, 0 },
+	} {
+		if major, minor := (&Conn{ recordVersion: test.version }).alertVersion(); major != test.major || minor != test.minor {
+			t.Errorf("%#x: got alert version %d.%d, wanted %d.%d", test.version, major, minor, test.major, test.minor)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Dials the picked backend and up to DialRace - 1 others in parallel, using the
+// first connection established. The other dials are canceled, and the
+// connections they established before that are closed.
+func (conn *Conn) raceBackends(ctx context.Context, route *config.Route, first *config.Backend) (net.Conn, *config.Backend, error) {
+	candidates := raceCandidates(route, first)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		upstream net.Conn
+		backend  *config.Backend
+		err      error
+	}
+	results := make(chan result, len(candidates))
+	for _, backend := range candidates {
+		go func(backend *config.Backend) {
+			dialCtx := ctx
+			if route.DialRaceTimeout > 0 {
+				var cancelDial context.CancelFunc
+				dialCtx, cancelDial = context.WithTimeout(ctx, route.DialRaceTimeout)
+				defer cancelDial()
+			}
+			upstream, err := conn.dial(dialCtx, route, backend.Address)
+			results <- result{ upstream, backend, err }
+		}(backend)
+	}
+
+	var errs []error
+	for i := range(candidates) {
+		r := <-results
+		if r.err != nil {
+			route.MarkDown(r.backend)
+			errs = append(errs, r.err)
+			continue
+		}
+		route.MarkUp(r.backend)
+		if r.backend != first {
+			conn.debugf("Backend %s connected first, racing %d backends", r.backend.Address, len(candidates))
+		}
+
+		// Close the connections of the losers, once their dial is
+		// canceled or done.
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if r := <-results; r.upstream != nil {
+					r.upstream.Close()
+				}
+			}
+		}(len(candidates) - i - 1)
+		return r.upstream, r.backend, nil
+	}
+	return nil, first, dispatchErrorf(ErrBackendDial, "%w", errors.Join(errs...))
+}
+
+// Returns the backends raced: the picked one, then the following ones in the
+// route order, skipping those known to be down.
+func raceCandidates(route *config.Route, first *config.Backend) []*config.Backend {
+	backends := route.CurrentBackends()
+	candidates := []*config.Backend{ first }
+	start := 0
+	for i, b := range backends {
+		if b == first {
+			start = i + 1
+			break
+		}
+	}
+	for i := 0; i < len(backends) - 1 && len(candidates) < route.DialRace; i++ {
+		b := backends[(start + i) % len(backends)]
+		if b != first && route.BackendUp(b) {
+			candidates = append(candidates, b)
+		}
+	}
+	return candidates
+}
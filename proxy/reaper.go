@@ -0,0 +1,123 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Interval at which the connections are scanned for idle ones, when not set.
+const defaultReapInterval = 10*time.Second
+
+// Reader recording the time of the last data read, for the idle connections
+// reaper.
+type activityReader struct {
+	r    io.Reader
+	last *atomic.Int64
+}
+
+func (a *activityReader) Read(b []byte) (int, error) {
+	n, err := a.r.Read(b)
+	if n > 0 {
+		a.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Returns a reader recording the activity of the connection when its listener
+// has an idle timeout, the reader itself otherwise (so that splicing is kept).
+func (conn *Conn) tracked(r io.Reader) io.Reader {
+	if conn.Listener == nil || conn.Listener.IdleTimeout == 0 {
+		return r
+	}
+	return &activityReader{ r, &conn.lastActive }
+}
+
+// Scans the connections being routed at the configured interval, closing the
+// ones idle for longer than the idle timeout of their listener, until the
+// context is canceled. The scan is a safety net, the copies not looking at
+// the idle time themselves; connections are closed up to one interval after
+// their timeout.
+func (p *Proxy) runReaper(ctx context.Context) {
+	interval := p.reapInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.reapIdle(now)
+		}
+
+		// Follow the interval of the reloaded configurations.
+		if i := p.reapInterval(); i != interval {
+			interval = i
+			ticker.Reset(interval)
+		}
+	}
+}
+
+// Returns the interval at which the connections are scanned.
+func (p *Proxy) reapInterval() time.Duration {
+	if i := p.config().ReapInterval; i > 0 {
+		return i
+	}
+	return defaultReapInterval
+}
+
+// Closes the connections being routed which were idle for longer than the
+// idle timeout of their listener at a given time.
+func (p *Proxy) reapIdle(now time.Time) {
+	p.routed.Range(func(k, v any) bool {
+		conn := k.(*Conn)
+		if conn.Listener == nil || conn.Listener.IdleTimeout == 0 {
+			return true
+		}
+		idle := now.Sub(time.Unix(0, conn.lastActive.Load()))
+		if idle < conn.Listener.IdleTimeout || !conn.reaped.CompareAndSwap(false, true) {
+			return true
+		}
+
+		conn.logf("Closing connection to %s: idle for more than %s", v.(adminConn).Backend,
+			  conn.Listener.IdleTimeout)
+		n, _ := p.reaped.LoadOrStore(conn.Listener.Bind, new(atomic.Int64))
+		n.(*atomic.Int64).Add(1)
+		conn.Close()
+		return true
+	})
+}
+
+// Writes the number of connections reaped, by listener.
+func (p *Proxy) writeReaperMetrics(m *metricsWriter) {
+	var binds []string
+	p.reaped.Range(func(k, v any) bool {
+		binds = append(binds, k.(string))
+		return true
+	})
+	sort.Strings(binds)
+
+	m.header("sniproxy_reaped_connections_total", "counter", "Connections closed by the reaper as idle, by listener.")
+	for _, bind := range binds {
+		n, _ := p.reaped.Load(bind)
+		m.sample("sniproxy_reaped_connections_total", float64(n.(*atomic.Int64).Load()), "listener", bind)
+	}
+}
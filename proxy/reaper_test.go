@@ -0,0 +1,81 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+func TestReaper(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	conf := &config.Config{
+		Routes: []*config.Route{
+			{ Domains: []*regexp.Regexp{ regexp.MustCompile(`^example\.net$`) },
+			  Backends: []*config.Backend{{ Address: "backend.invalid:443", Weight: 1 }} },
+		},
+		ReapInterval: 10*time.Millisecond,
+	}
+	listener := &config.Listener{ Bind: ":443", IdleTimeout: 100*time.Millisecond }
+
+	// The backend answers after a while, postponing the reaping, then
+	// stays idle until the connection is closed.
+	d := &fakeDialer{ backend: func(c net.Conn) {
+		defer c.Close()
+		c.Read(make([]byte, 4096))
+		time.Sleep(60*time.Millisecond)
+		c.Write([]byte("data"))
+		io.Copy(io.Discard, c)
+	}}
+	p := &Proxy{ Config: *conf, Dialer: d }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.runReaper(ctx)
+
+	start := time.Now()
+	send := func(c net.Conn) {
+		c.Write(rawClientHello(t, "example.net"))
+		io.ReadAll(c)
+	}
+	if err := handleListenerConn(t, p, listener, conf, send); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 160*time.Millisecond {
+		t.Errorf("connection reaped after %s, despite the backend activity", elapsed)
+	}
+	if !strings.Contains(logs.String(), "Closing connection to backend.invalid:443: idle for more than 100ms") {
+		t.Errorf("reaping not logged: %s", logs.String())
+	}
+
+	var buf bytes.Buffer
+	p.writeMetrics(&buf)
+	if !strings.Contains(buf.String(), `sniproxy_reaped_connections_total{listener=":443"} 1`) {
+		t.Errorf("reaped connection not counted:\n%s", buf.String())
+	}
+}
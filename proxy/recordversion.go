@@ -0,0 +1,70 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"github.com/atenart/sniproxy/handshake"
+)
+
+// TLS record versions counted in the metrics, the others being counted
+// together.
+var recordVersionNames = []string{ "ssl3.0", "tls1.0", "tls1.1", "tls1.2", "tls1.3", "other" }
+
+// Returns the index in recordVersionNames of a TLS record version.
+func recordVersionIndex(version uint16) int {
+	if version < 0x300 || version > 0x304 {
+		return len(recordVersionNames) - 1
+	}
+	return int(version - 0x300)
+}
+
+// Counts the record version of the client handshake, and logs it if unusual:
+// below the configured version, or above TLS 1.2 which no conforming client
+// sends (legacy_record_version). This is done before the handshake is parsed,
+// so that the clients rejected as using an unsupported version (e.g. SSL 3.0)
+// are also reported. Forwarding is not changed.
+func (conn *Conn) checkRecordVersion(version uint16, hello *handshake.ClientHello) {
+	conn.recordVersion = version
+	if conn.proxy != nil {
+		conn.proxy.recordVersions[recordVersionIndex(version)].Add(1)
+	}
+
+	if min := conn.Config.RecordVersionWarn; min > 0 && (version < min || version > 0x303) {
+		sni := ""
+		if hello != nil {
+			sni = hello.ServerName
+		}
+		conn.logf("Unusual TLS record version 0x%04x (%s) in the handshake for %q",
+			  version, recordVersionNames[recordVersionIndex(version)], sni)
+	}
+}
+
+// Returns the record version of the alerts sent to the client: the one of its
+// handshake, when read and of TLS 1.x, SSL 3.0 otherwise.
+func (conn *Conn) alertVersion() (byte, byte) {
+	if conn.recordVersion >> 8 == 3 && conn.recordVersion <= 0x304 {
+		return 3, byte(conn.recordVersion)
+	}
+	return 3, 0
+}
+
+// Writes the distribution of the client handshakes record versions.
+func (p *Proxy) writeRecordVersionMetrics(m *metricsWriter) {
+	m.header("sniproxy_record_versions_total", "counter", "Client handshakes, by TLS record version.")
+	for i, name := range recordVersionNames {
+		m.sample("sniproxy_record_versions_total", float64(p.recordVersions[i].Load()), "version", name)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Connects to a backend and replays the handshake, as dialBackend does. When
+// the route allows replay retries, the backend answer is also awaited: if the
+// backend closes the connection before sending anything, as the client has not
+// seen any data yet, the handshake is replayed again to a newly picked backend,
+// up to the route retries count and retry period. The backend slot is released
+// and acquired again when the backend changes. Returns the connection and the
+// backend used.
+func (conn *Conn) dialReplay(ctx context.Context, route *config.Route, backend *config.Backend,
+			     release *func()) (net.Conn, *config.Backend, error) {
+	start := time.Now()
+	var b *backoff
+	for attempt := 0; ; attempt++ {
+		upstream, used, err := conn.dialBackend(ctx, route, backend)
+		if used != backend {
+			if err == nil {
+				err = conn.switchBackend(ctx, route, used, release)
+			}
+			if err != nil {
+				if upstream != nil {
+					upstream.Close()
+				}
+				return nil, used, err
+			}
+			backend = used
+		}
+		if err == nil && route.ReplayRetries > 0 && !conn.terminated {
+			if err = conn.awaitBackend(upstream, backend); err != nil {
+				upstream.Close()
+			}
+		}
+		if err == nil {
+			return upstream, backend, nil
+		}
+
+		if !errors.Is(err, ErrReplay) || attempt >= route.ReplayRetries || ctx.Err() != nil ||
+		   (route.ReplayRetryPeriod > 0 && time.Since(start) >= route.ReplayRetryPeriod) {
+			return nil, backend, err
+		}
+		conn.logf("%s, replaying the handshake again (retry %d/%d)", err, attempt + 1, route.ReplayRetries)
+
+		// Wait before retrying, if the route backs off.
+		if route.RetryBackoff > 0 {
+			if b == nil {
+				b = newBackoff(route.RetryBackoff, route.RetryBackoffMax, conn.Config.BackoffJitter)
+			}
+			timer := time.NewTimer(b.next())
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, backend, err
+			case <-timer.C:
+			}
+		}
+
+		next := route.PickBackend(conn.Config.RewriteSNI(conn.Hello.ServerName))
+		if next == nil {
+			return nil, backend, err
+		}
+		if next != backend {
+			if err := conn.switchBackend(ctx, route, next, release); err != nil {
+				return nil, next, err
+			}
+		}
+		backend = next
+	}
+}
+
+// Releases the slot of the backend used so far and acquires one of the backend
+// now used.
+func (conn *Conn) switchBackend(ctx context.Context, route *config.Route, backend *config.Backend,
+				release *func()) error {
+	(*release)()
+	*release = func() {}
+	r, err := conn.acquireSlot(ctx, route, backend)
+	if err != nil {
+		return err
+	}
+	*release = r
+	return nil
+}
+
+// Waits for the backend to answer the replayed handshake, forwarding its first
+// data to the client. Returns an ErrReplay DispatchError if the backend closed or
+// reset the connection without sending anything.
+func (conn *Conn) awaitBackend(upstream net.Conn, backend *config.Backend) error {
+	b := make([]byte, 16*1024)
+	n, err := upstream.Read(b)
+	if n == 0 {
+		if err == io.EOF || errors.Is(err, syscall.ECONNRESET) {
+			return dispatchErrorf(ErrReplay, "Backend %s closed the connection before answering the handshake", backend.Address)
+		}
+		return dispatchErrorf(ErrBackendDial, "Could not read the answer of backend %s (%s)", backend.Address, err)
+	}
+	conn.phaseDone(phaseFirstByte, conn.replayed)
+
+	if _, err := conn.Write(b[:n]); err != nil {
+		return dispatchErrorf(ErrInternal, "Could not forward the answer of backend %s (%s)", backend.Address, err)
+	}
+	conn.prefetched = int64(n)
+	return nil
+}
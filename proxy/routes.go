@@ -0,0 +1,144 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Names of the PROXY header versions, as the backend parameters setting them.
+var proxyVersionNames = map[uint]string{
+	config.ProxyNone: "no-send-proxy",
+	config.ProxyV1:   "send-proxy",
+	config.ProxyV2:   "send-proxy-v2",
+}
+
+// Writes the routing table: every route, in matching order, with its compiled
+// domain patterns, backends and access control summary. Meant for checking the
+// effective configuration, e.g. routes shadowed by earlier ones.
+func PrintRoutes(w io.Writer, c *config.Config) {
+	var ja3Routes bool
+	for _, route := range c.Routes {
+		ja3Routes = ja3Routes || len(route.JA3) > 0
+	}
+	switch {
+	case !ja3Routes:
+		break
+	case c.JA3Match == config.JA3BeforeSNI:
+		fmt.Fprintln(w, "Routes matching JA3 fingerprints take precedence over the SNI.")
+		break
+	case c.JA3Match == config.JA3AfterSNI:
+		fmt.Fprintln(w, "Routes matching JA3 fingerprints are used when no route matches the SNI.")
+		break
+	}
+
+	for i, route := range c.Routes {
+		fmt.Fprintf(w, "#%d %s", i + 1, route.Label())
+		if !route.Enabled() {
+			fmt.Fprint(w, " (disabled)")
+		} else if route.Maintenance {
+			fmt.Fprint(w, " (maintenance)")
+		}
+		fmt.Fprintln(w)
+
+		var domains []string
+		for _, domain := range route.Domains {
+			domains = append(domains, domain.String())
+		}
+		for _, list := range route.DomainLists {
+			domains = append(domains, "list " + list.File)
+		}
+		printRouteField(w, "domains", domains)
+
+		var dsts []string
+		for _, d := range route.Destinations {
+			dst := "*"
+			if d.Subnet != nil {
+				dst = d.Subnet.String()
+			}
+			if d.Port != 0 {
+				dst = net.JoinHostPort(dst, strconv.Itoa(d.Port))
+			}
+			dsts = append(dsts, dst)
+		}
+		printRouteField(w, "destinations", dsts)
+		printRouteField(w, "clients", subnetStrings(route.Clients))
+
+		var ja3 []string
+		for hash := range route.JA3 {
+			ja3 = append(ja3, hash)
+		}
+		sort.Strings(ja3)
+		printRouteField(w, "ja3", ja3)
+
+		var backends []string
+		if route.Lookup != "" {
+			backends = append(backends, fmt.Sprintf("lookup %s (ttl %s)", route.Lookup, route.LookupTTL))
+		}
+		if route.SRV != "" {
+			backends = append(backends, "srv " + route.SRV)
+		} else if route.Discovery != "" {
+			backends = append(backends, "discovery " + route.Discovery)
+		} else if route.Forwards() {
+			backends = append(backends, "sni:" + strconv.Itoa(route.Backends[0].SNIPort))
+		} else {
+			for _, b := range route.Backends {
+				backend := fmt.Sprintf("%s (weight %d", b.Address, b.Weight)
+				if b.OverrideProxy {
+					backend += ", " + proxyVersionNames[b.SendProxy]
+				}
+				backends = append(backends, backend + ")")
+			}
+		}
+		if len(backends) == 0 {
+			backends = append(backends, "none")
+		}
+		printRouteField(w, "backends", backends)
+
+		acl := subnetStrings(route.Allow)
+		for i := range acl {
+			acl[i] = "allow " + acl[i]
+		}
+		for _, s := range subnetStrings(route.Deny) {
+			acl = append(acl, "deny " + s)
+		}
+		for _, list := range route.AllowLists {
+			acl = append(acl, "allow list " + redactURL(list.Source))
+		}
+		for _, list := range route.DenyLists {
+			acl = append(acl, "deny list " + redactURL(list.Source))
+		}
+		if len(acl) == 0 {
+			acl = append(acl, "all allowed")
+		}
+		printRouteField(w, "acl", acl)
+	}
+}
+
+func printRouteField(w io.Writer, name string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "    %-13s %s\n", name, strings.Join(values, ", "))
+}
@@ -0,0 +1,56 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+func TestPrintRoutes(t *testing.T) {
+	c := &config.Config{}
+	if err := c.Parse([]byte(`
+example.net, *.example.net {
+	name web
+	backend 10.0.0.1:443,10.0.0.2:443
+	allow 10.0.0.0/8
+	deny 10.0.0.1
+}
+example.org {
+	backend 10.0.1.1:443
+}
+`)); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	PrintRoutes(&out, c)
+	want := `#1 web
+    domains       (?i)^(?:example\.net)$, (?i)^(?:[^.]*\.example\.net)$
+    backends      10.0.0.1:443 (weight 1), 10.0.0.2:443 (weight 1)
+    acl           allow 10.0.0.0/8, deny 10.0.0.1/32, deny 0.0.0.0/0, deny ::/0
+#2 10.0.1.1:443
+    domains       (?i)^(?:example\.org)$
+    backends      10.0.1.1:443 (weight 1)
+    acl           all allowed
+`
+	if out.String() != want {
+		t.Errorf("got routing table:\n%s\nwanted:\n%s", out.String(), want)
+	}
+}
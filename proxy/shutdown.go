@@ -0,0 +1,106 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Gracefully shuts the proxy down, once started: the proxy is reported as not
+// ready (draining) for the configured grace period, letting the load
+// balancers notice, then the listeners are closed. The connections being
+// routed are then given up to the shutdown timeout to finish before
+// ListenAndServeContext closes the remaining ones and returns.
+func (p *Proxy) Shutdown() {
+	if p.draining.Swap(true) {
+		return
+	}
+
+	grace := p.Config.ShutdownGrace
+	log.Printf("Draining, stopping accepting connections in %s", grace)
+	time.AfterFunc(grace, func() {
+		log.Printf("Shutting down, waiting up to %s for the connections to finish",
+			   p.Config.ShutdownTimeout)
+		close(p.stopping())
+	})
+}
+
+// Returns the channel closed once the listeners have to stop accepting
+// connections.
+func (p *Proxy) stopping() chan struct{} {
+	p.stopOnce.Do(func() { p.stop = make(chan struct{}) })
+	return p.stop
+}
+
+// Reports whether the listeners have stopped accepting connections.
+func (p *Proxy) stopped() bool {
+	select {
+	case <-p.stopping():
+		return true
+	default:
+		return false
+	}
+}
+
+// Waits for the connections being routed to finish, for at most a given time.
+// Reports whether they all did.
+func (p *Proxy) waitConns(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		p.conns.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Closes the subsystems of the proxy, in order, once it stopped. Connections
+// closed on the way out are waited for not to lose their records.
+func (p *Proxy) close() {
+	p.conns.Wait()
+	for _, c := range p.Closers {
+		if err := c.Close(); err != nil {
+			log.Printf("Could not close %T (%s)", c, err)
+		}
+	}
+}
+
+// Adapts a function to io.Closer.
+type CloserFunc func() error
+
+func (f CloserFunc) Close() error {
+	return f()
+}
+
+// Readiness endpoint: reports whether the proxy accepts new connections, i.e.
+// it is not draining.
+func (p *Proxy) serveReady(w http.ResponseWriter, r *http.Request) {
+	if p.draining.Load() {
+		http.Error(w, "Draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK\n"))
+}
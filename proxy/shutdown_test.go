@@ -0,0 +1,141 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+func TestShutdown(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p := &Proxy{ Config: config.Config{
+		Listeners: []*config.Listener{{ Bind: addr }},
+		HandshakeTimeout: 5*time.Second,
+		ShutdownGrace: 200*time.Millisecond,
+		ShutdownTimeout: 300*time.Millisecond,
+	}}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.ListenAndServeContext(context.Background(), "")
+	}()
+
+	// Connection still being handled on shutdown, as it sends nothing.
+	var idle net.Conn
+	for i := 0; i < 100; i++ {
+		if idle, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	ready := func() int {
+		w := httptest.NewRecorder()
+		p.serveReady(w, httptest.NewRequest("GET", "/ready", nil))
+		return w.Code
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("before shutdown: got status %d", code)
+	}
+
+	start := time.Now()
+	p.Shutdown()
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("draining: got status %d", code)
+	}
+
+	// Connections are still accepted during the grace period.
+	if c, err := net.Dial("tcp", addr); err != nil {
+		t.Errorf("draining: %s", err)
+	} else {
+		c.Close()
+	}
+
+	// The idle connection is closed once the shutdown timeout is reached.
+	idle.SetReadDeadline(time.Now().Add(3*time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle connection: got '%v', wanted EOF", err)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("got error '%v'", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("shut down after %s", elapsed)
+	}
+
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Error("connection accepted after shutdown")
+	}
+}
+
+func TestShutdownClosers(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var closed []string
+	closer := func(name string, err error) io.Closer {
+		return CloserFunc(func() error {
+			closed = append(closed, name)
+			return err
+		})
+	}
+
+	// Closers are all called in order, even when one fails.
+	p := &Proxy{
+		Config: config.Config{ Listeners: []*config.Listener{{ Bind: "127.0.0.1:0" }} },
+		Closers: []io.Closer{ closer("logs", errors.New("failed")), closer("metrics", nil) },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.ListenAndServeContext(ctx, "")
+	}()
+	time.Sleep(50*time.Millisecond)
+	if len(closed) != 0 {
+		t.Errorf("closed %v while serving", closed)
+	}
+
+	cancel()
+	<-errs
+	if len(closed) != 2 || closed[0] != "logs" || closed[1] != "metrics" {
+		t.Errorf("got closed %v", closed)
+	}
+}
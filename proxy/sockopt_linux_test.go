@@ -0,0 +1,184 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+func TestDialDSCP(t *testing.T) {
+	for _, test := range []struct {
+		bind  string
+		level int
+		opt   int
+	}{
+		{ "127.0.0.1:0", syscall.IPPROTO_IP, syscall.IP_TOS },
+		{ "[::1]:0", syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS },
+	} {
+		backend, err := net.Listen("tcp", test.bind)
+		if err != nil {
+			t.Logf("%s: %s, skipping", test.bind, err)
+			continue
+		}
+		defer backend.Close()
+
+		route := &config.Route{ DSCP: 46 }
+		up, err := (&Conn{}).dial(context.Background(), route, backend.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer up.Close()
+
+		raw, err := up.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tos int
+		raw.Control(func(fd uintptr) {
+			tos, err = syscall.GetsockoptInt(int(fd), test.level, test.opt)
+		})
+		if err != nil || tos != 46 << 2 {
+			t.Errorf("%s: got ToS %#x (%v), wanted %#x", test.bind, tos, err, 46 << 2)
+		}
+	}
+}
+
+func TestNoDelayAfterReplay(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer c.Close()
+		b := make([]byte, 1024)
+		n, _ := io.ReadAtLeast(c, b, len("PROXY TCP4 192.0.2.1 192.0.2.2 1234 443\r\nhello"))
+		received <- b[:n]
+	}()
+
+	route := &config.Route{ SendProxy: config.ProxyV1, NoDelayAfterReplay: true }
+	conn := &Conn{ rawHello: []byte("hello"),
+		       proxySrc: &net.TCPAddr{ IP: net.ParseIP("192.0.2.1"), Port: 1234 },
+		       proxyDst: &net.TCPAddr{ IP: net.ParseIP("192.0.2.2"), Port: 443 } }
+	up, _, err := conn.dialBackend(context.Background(), route,
+				    &config.Backend{ Address: backend.Addr().String() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+
+	raw, err := up.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nodelay int
+	raw.Control(func(fd uintptr) {
+		nodelay, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	})
+	if err != nil || nodelay == 0 {
+		t.Errorf("TCP_NODELAY not set after the replay (%v)", err)
+	}
+
+	if got := string(<-received); got != "PROXY TCP4 192.0.2.1 192.0.2.2 1234 443\r\nhello" {
+		t.Errorf("backend received %q", got)
+	}
+}
+
+func TestSetUserTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setUserTimeout(raw, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	var timeout int
+	raw.Control(func(fd uintptr) {
+		timeout, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout)
+	})
+	if err != nil || timeout != 20000 {
+		t.Errorf("got user timeout %dms (%v), wanted 20000ms", timeout, err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, test := range []struct {
+		route    *config.Route
+		idle     int
+		interval int
+		count    int
+	}{
+		// The system probes count is kept.
+		{ &config.Route{ KeepAlive: 30*time.Second }, 30, 30, 0 },
+		{ &config.Route{ KeepAlive: 30*time.Second, KeepAliveInterval: 1500*time.Millisecond,
+				 KeepAliveCount: 3 }, 30, 2, 3 },
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err := setKeepAlive(c.(*net.TCPConn), test.route); err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := c.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var idle, interval, count int
+		raw.Control(func(fd uintptr) {
+			idle, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+			interval, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+			count, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT)
+		})
+		if idle != test.idle || interval != test.interval || (test.count > 0 && count != test.count) {
+			t.Errorf("got idle %ds, interval %ds and count %d, wanted %ds, %ds and %d",
+				 idle, interval, count, test.idle, test.interval, test.count)
+		}
+	}
+}
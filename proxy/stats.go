@@ -0,0 +1,126 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// RouteStat is a snapshot of the counters of a route.
+type RouteStat struct {
+	// Number of connections matching the route.
+	Connections   int64
+	// Number of connections currently being handled.
+	Active        int64
+	// Number of connections rejected (ACLs, rate limits, capacity, maintenance).
+	Rejected      int64
+	// Number of connections which failed to be routed, and among them
+	// those for which the handshake could not be replayed to the backend.
+	Errors        int64
+	ReplayErrors  int64
+	// Number of connections closed as their client or backend was found
+	// unreachable (keep alive or user timeout).
+	DeadPeers     int64
+	// Bytes sent to and received from the backends.
+	BytesSent     int64
+	BytesReceived int64
+	// Number of connections routed to an IPv4 or an IPv6 backend address.
+	DialedIPv4    int64
+	DialedIPv6    int64
+	// Number of connections whose client offered deprecated cipher suites,
+	// only counted when the route logging level is debug.
+	DeprecatedCiphers int64
+}
+
+// Live counters of a route.
+type routeCounters struct {
+	connections   atomic.Int64
+	active        atomic.Int64
+	rejected      atomic.Int64
+	errors        atomic.Int64
+	replayErrors  atomic.Int64
+	deadPeers     atomic.Int64
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+	dialedIPv4    atomic.Int64
+	dialedIPv6    atomic.Int64
+	deprecatedCiphers atomic.Int64
+}
+
+// Per route counters, indexed by route label so that they are kept across
+// reloads.
+type routeStats struct {
+	routes sync.Map
+}
+
+// Returns the counters of a route, creating them if needed.
+func (s *routeStats) get(route *config.Route) *routeCounters {
+	label := route.Label()
+	if c, ok := s.routes.Load(label); ok {
+		return c.(*routeCounters)
+	}
+
+	c, _ := s.routes.LoadOrStore(label, &routeCounters{})
+	return c.(*routeCounters)
+}
+
+// Drops the counters of the routes no longer configured, unless connections
+// are still being handled on them.
+func (s *routeStats) retain(routes []*config.Route) {
+	labels := make(map[string]bool)
+	for _, route := range routes {
+		labels[route.Label()] = true
+	}
+
+	s.routes.Range(func(k, v interface{}) bool {
+		if !labels[k.(string)] && v.(*routeCounters).active.Load() == 0 {
+			s.routes.Delete(k)
+		}
+		return true
+	})
+}
+
+// Returns a snapshot of the per route counters, indexed by route label (its
+// name, or its backends when the route is not named). Routes sharing the same
+// label are aggregated.
+func (p *Proxy) RouteStats() map[string]RouteStat {
+	stats := make(map[string]RouteStat)
+
+	p.stats.routes.Range(func(k, v interface{}) bool {
+		label, c := k.(string), v.(*routeCounters)
+
+		stat := stats[label]
+		stat.Connections += c.connections.Load()
+		stat.Active += c.active.Load()
+		stat.Rejected += c.rejected.Load()
+		stat.Errors += c.errors.Load()
+		stat.ReplayErrors += c.replayErrors.Load()
+		stat.DeadPeers += c.deadPeers.Load()
+		stat.BytesSent += c.bytesSent.Load()
+		stat.BytesReceived += c.bytesReceived.Load()
+		stat.DialedIPv4 += c.dialedIPv4.Load()
+		stat.DialedIPv6 += c.dialedIPv6.Load()
+		stat.DeprecatedCiphers += c.deprecatedCiphers.Load()
+		stats[label] = stat
+
+		return true
+	})
+
+	return stats
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Time given to clients to complete the handshake of terminated connections.
+const terminateHandshakeTimeout = 10*time.Second
+
+// Terminates TLS on the client connection using the route certificate,
+// replaying the handshake already read, and copies the plaintext between the
+// client and the backend.
+func (conn *Conn) terminate(ctx context.Context, route *config.Route, backend *config.Backend, upstream net.Conn) {
+	c := tls.Server(&replayConn{ conn.TCPConn, io.MultiReader(bytes.NewReader(conn.rawHello), conn.TCPConn) },
+			&tls.Config{ Certificates: []tls.Certificate{ route.Terminate.Certificate } })
+	defer c.Close()
+
+	hsCtx, cancel := context.WithTimeout(ctx, terminateHandshakeTimeout)
+	err := c.HandshakeContext(hsCtx)
+	cancel()
+	if err != nil {
+		conn.logf("Could not complete the TLS handshake (%s)", err)
+		return
+	}
+	conn.setOutcome("routed")
+
+	var sent, received int64
+	done := make(chan struct{}, 2)
+	go func() {
+		sent, _ = io.Copy(upstream, conn.tracked(c))
+		done<- struct{}{}
+	}()
+	go func() {
+		received, _ = io.Copy(c, conn.tracked(upstream))
+		done<- struct{}{}
+	}()
+
+	// Both sides are closed once one is, the plaintext protocol having no
+	// half-close over TLS.
+	<-done
+	c.Close()
+	upstream.Close()
+	<-done
+
+	conn.span.SetAttribute("bytes.sent", sent)
+	conn.span.SetAttribute("bytes.received", received)
+	conn.stats.bytesSent.Add(sent)
+	conn.stats.bytesReceived.Add(received)
+	conn.sent, conn.received = sent, received
+
+	conn.accessf("Closed terminated connection to %s after %s (%d bytes from the client, %d from the backend)",
+		     backend.Address, time.Since(conn.accepted).Round(time.Millisecond), sent, received)
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Netfilter socket option to retrieve the original destination of a
+// connection redirected using REDIRECT (linux/netfilter_ipv4.h). The IPv6
+// variant (IP6T_SO_ORIGINAL_DST) shares the same value.
+const soOriginalDst = 80
+
+// Not exported by the syscall package (linux/in6.h).
+const ipv6Transparent = 75
+
+// Sets IP_TRANSPARENT on a socket, allowing to accept connections to non-local
+// addresses (TPROXY) and to bind to non-local addresses (transparent egress).
+func setTransparent(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		if serr == nil && network == "tcp6" {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("Could not set IP_TRANSPARENT (%s)", serr)
+	}
+	return nil
+}
+
+// Retrieves the original destination of a connection redirected by netfilter
+// (REDIRECT target).
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	ipv4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+
+	// Large enough to hold a struct sockaddr_in6.
+	var addr [syscall.SizeofSockaddrInet6]byte
+	size := uint32(len(addr))
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		level := syscall.SOL_IP
+		if !ipv4 {
+			level = syscall.SOL_IPV6
+		}
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+						uintptr(level), soOriginalDst,
+						uintptr(unsafe.Pointer(&addr[0])),
+						uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			serr = errno
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, fmt.Errorf("Could not retrieve the original destination (%s)", serr)
+	}
+
+	// The port is stored in network byte order in both sockaddr_in and
+	// sockaddr_in6, right after the address family.
+	port := int(binary.BigEndian.Uint16(addr[2:4]))
+	if ipv4 {
+		return &net.TCPAddr{ IP: net.IP(addr[4:8]), Port: port }, nil
+	}
+	return &net.TCPAddr{ IP: net.IP(addr[8:24]), Port: port }, nil
+}
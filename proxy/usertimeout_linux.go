@@ -0,0 +1,46 @@
+// Copyright (C) 2019 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// Not exported by the syscall package (linux/tcp.h).
+const tcpUserTimeout = 18
+
+// TCP user timeouts are supported.
+func checkUserTimeout() error {
+	return nil
+}
+
+// Sets the maximum time transmitted data can remain unacknowledged (including
+// the keep alive probes) before the connection is closed.
+func setUserTimeout(raw syscall.RawConn, timeout time.Duration) error {
+	var serr error
+	err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(timeout.Milliseconds()))
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("Could not set the TCP user timeout to %s (%s)", timeout, serr)
+	}
+	return nil
+}
@@ -13,17 +13,14 @@
 // You should have received a copy of the GNU General Public License
 // along with this program. If not, see <https://www.gnu.org/licenses/>.
 
+//go:build !unix
+
 package main
 
 import (
-	"fmt"
-	"log"
+	"os"
+	"syscall"
 )
 
-func (conn *Conn) logf(format string, v ...interface{}) {
-	log.Printf("%s %s", conn.RemoteAddr(), fmt.Sprintf(format, v...))
-}
-
-func (conn *Conn) log(v ...interface{}) {
-	log.Printf("%s %s", conn.RemoteAddr(), fmt.Sprint(v...))
-}
+// Signals triggering reopening the log files.
+var reopenSignals = []os.Signal{ syscall.SIGHUP }